@@ -0,0 +1,112 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	initlib "github.com/dvonthenen/go-utilities/diff-directory"
+	diffdirectory "github.com/dvonthenen/go-utilities/diff-directory/pkg/diff-directory"
+)
+
+func printChecksumHelp() {
+	fmt.Println("Usage: diff-directory checksum -src <src> (-write | -check) [-format <format>] [-per-dir] [-dryrun]")
+	fmt.Println("Options:")
+	fmt.Println("  -src string")
+	fmt.Println("    	The directory to write or check checksum files in")
+	fmt.Println("  -write")
+	fmt.Println("    	Write checksum files")
+	fmt.Println("  -check")
+	fmt.Println("    	Check the files listed in existing checksum files")
+	fmt.Println("  -format string")
+	fmt.Println("    	sha256 (SHA256SUMS), md5 (.md5) or sfv (.sfv). Check defaults to all formats")
+	fmt.Println("  -per-dir")
+	fmt.Println("    	Write one checksum file per directory instead of one at the root")
+	fmt.Println("  -dryrun")
+	fmt.Println("    	Do a run run only... don't write any files")
+	fmt.Println("  -logging int")
+	fmt.Println("    	Set logging level: 2 - standard (default), 7 - very verbose")
+}
+
+func checksumMain(args []string) int {
+	// flags
+	flags := flag.NewFlagSet("checksum", flag.ExitOnError)
+
+	var srcDir string
+	flags.StringVar(&srcDir, "src", "", "The directory to write or check checksum files in")
+
+	var write bool
+	flags.BoolVar(&write, "write", false, "Write checksum files")
+
+	var check bool
+	flags.BoolVar(&check, "check", false, "Check the files listed in existing checksum files")
+
+	var format string
+	flags.StringVar(&format, "format", "", "sha256 (SHA256SUMS), md5 (.md5) or sfv (.sfv)")
+
+	var perDir bool
+	flags.BoolVar(&perDir, "per-dir", false, "Write one checksum file per directory instead of one at the root")
+
+	var dryrun bool
+	flags.BoolVar(&dryrun, "dryrun", false, "Do a run run only... don't write any files")
+
+	var logging int
+	flags.IntVar(&logging, "logging", 2, "Set logging level: 2 - standard (default), 7 - very verbose")
+
+	flags.Parse(args)
+	// flags
+
+	initlib.Init(initlib.DiffDirectoryInit{
+		LogLevel: initlib.LogLevel(logging),
+	})
+
+	absSrcPath, err := validateDir("src", srcDir)
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println()
+		printChecksumHelp()
+		return 1
+	}
+	if write == check {
+		fmt.Println("Must provide exactly one of -write or -check.")
+		fmt.Println()
+		printChecksumHelp()
+		return 1
+	}
+
+	diff := diffdirectory.New(diffdirectory.DiffOpts{
+		RootSrcPath: absSrcPath,
+		DryRun:      dryrun,
+	})
+
+	if write {
+		if len(format) == 0 {
+			format = diffdirectory.ChecksumSHA256
+		}
+		written, err := diff.WriteChecksums(format, perDir)
+		if err != nil {
+			fmt.Printf("Checksum failed. Err: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Wrote %d checksum files\n", written)
+		fmt.Printf("Checksum Completed!\n")
+		return 0
+	}
+
+	report, err := diff.CheckChecksums(format)
+	if report != nil {
+		fmt.Printf("Checked: %d\n", report.Checked)
+		fmt.Printf("Missing: %d\n", len(report.Missing))
+		fmt.Printf("Modified: %d\n", len(report.Modified))
+		fmt.Printf("Corrupt: %d\n", len(report.Corrupt))
+	}
+	if err != nil {
+		fmt.Printf("Checksum failed. Err: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Checksum Completed!\n")
+	return 0
+}
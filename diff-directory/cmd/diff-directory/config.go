@@ -0,0 +1,224 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	initlib "github.com/dvonthenen/go-utilities/diff-directory"
+	diffdirectory "github.com/dvonthenen/go-utilities/diff-directory/pkg/diff-directory"
+)
+
+const (
+	// ConfigEnv environment variable holding the config file path
+	ConfigEnv string = "DIFF_DIRECTORY_CONFIG"
+)
+
+func printRunHelp() {
+	fmt.Println("Usage: diff-directory run [-config <file>] (<profile> [<profile>...] | --all)")
+	fmt.Println("       diff-directory config validate [-config <file>]")
+	fmt.Println("Runs the named sync profiles of a config file.")
+	fmt.Println("Options:")
+	fmt.Println("  -config string")
+	fmt.Printf("    	The config file (defaults to %s or %s)\n", ConfigEnv, defaultConfigPath())
+	fmt.Println("  -all")
+	fmt.Println("    	Run every profile in the config file")
+	fmt.Println("Environment:")
+	fmt.Println("  DIFF_DIRECTORY_<PROFILE>__<KEY>, DIFF_DIRECTORY_<KEY>")
+	fmt.Println("    	Override a key of one profile or of all of them, e.g. DIFF_DIRECTORY_MUSIC__DRY_RUN=true")
+}
+
+// defaultConfigPath is the config file in the user config directory
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "config.yaml"
+	}
+	return filepath.Join(dir, "diff-directory", "config.yaml")
+}
+
+func loadConfig(path string) (*diffdirectory.Config, error) {
+	if len(path) == 0 {
+		path = os.Getenv(ConfigEnv)
+	}
+	if len(path) == 0 {
+		path = defaultConfigPath()
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("config filepath.Abs failed. Err: %v", err)
+	}
+	return diffdirectory.LoadConfig(absPath)
+}
+
+func runMain(args []string) int {
+	// flags
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+
+	var configPath string
+	flags.StringVar(&configPath, "config", "", "The config file")
+
+	var all bool
+	flags.BoolVar(&all, "all", false, "Run every profile in the config file")
+
+	flags.Parse(args)
+	// flags
+
+	initlib.Init(initlib.DiffDirectoryInit{
+		LogLevel: initlib.LogLevelStandard,
+	})
+
+	if all == (flags.NArg() > 0) {
+		fmt.Println("Must provide profile names or --all.")
+		fmt.Println()
+		printRunHelp()
+		return 1
+	}
+
+	config, err := loadConfig(configPath)
+	if err != nil {
+		fmt.Printf("Loading config failed. Err: %v\n", err)
+		return 1
+	}
+
+	names := flags.Args()
+	if all {
+		names = config.ProfileNames()
+	}
+	for _, name := range names {
+		if config.Profiles[name] == nil {
+			fmt.Printf("Unknown profile: %s\n", name)
+			return 1
+		}
+	}
+	// a broken profile that isn't run doesn't stop the others
+	err = config.Validate(names...)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+
+	// the worst exit code wins, a failed profile over one with failed files
+	failed := make([]string, 0)
+	code := 0
+	for _, name := range names {
+		fmt.Printf("Profile: %s\n", name)
+		if rc := runProfile(config.Profiles[name]); rc != 0 {
+			failed = append(failed, name)
+			if code != 1 {
+				code = rc
+			}
+		}
+		fmt.Printf("\n\n")
+	}
+
+	if len(failed) > 0 {
+		fmt.Printf("Failed profiles: %s\n", strings.Join(failed, ", "))
+	}
+	return code
+}
+
+func runProfile(profile *diffdirectory.Profile) int {
+	logging := profile.Logging
+	if logging == 0 {
+		logging = initlib.LogLevelStandard
+	}
+	flag.Set("v", strconv.Itoa(logging))
+
+	// store
+	if strings.HasPrefix(profile.Dst, diffdirectory.StorePrefix) {
+		absStorePath := strings.TrimPrefix(profile.Dst, diffdirectory.StorePrefix)
+
+		fmt.Printf("logging: %d\n", logging)
+		fmt.Printf("Src Path: %s\n", profile.Src)
+		fmt.Printf("Store Path: %s\n", absStorePath)
+		fmt.Printf("Dry Run: %t\n", profile.DryRun)
+		fmt.Printf("\n\n")
+
+		store := diffdirectory.NewStore(diffdirectory.StoreOpts{
+			RootPath: absStorePath,
+			DryRun:   profile.DryRun,
+		})
+		return storeBackup(store, profile.Src, "")
+	}
+
+	// encryption
+	opts := profile.Options()
+	opts.Passphrase = os.Getenv(PassphraseEnv)
+	if opts.EncryptDst && len(opts.Passphrase) == 0 && len(opts.KeyFile) == 0 {
+		fmt.Printf("Encryption requires %s or keyfile.\n", PassphraseEnv)
+		return 1
+	}
+
+	// output
+	fmt.Printf("logging: %d\n", logging)
+	fmt.Printf("Src Path: %s\n", opts.RootSrcPath)
+	fmt.Printf("Dst Path: %s\n", opts.RootDstPath)
+	fmt.Printf("Skip Src: %t\n", opts.SkipSrcUpdate)
+	fmt.Printf("Dry Run: %t\n", opts.DryRun)
+	fmt.Printf("Verify: %t\n", opts.Verify)
+	fmt.Printf("Stream: %t\n", opts.Stream)
+	fmt.Printf("Extract: %t\n", opts.Extract)
+	fmt.Printf("Audio: %t\n", opts.Audio || opts.SyncTags)
+	fmt.Printf("Sync Tags: %t\n", opts.SyncTags)
+	fmt.Printf("Direction: %s\n", opts.Direction)
+	fmt.Printf("Conflict: %s\n", opts.Conflict)
+	fmt.Printf("Ignore: %s\n", strings.Join(opts.Ignore, ", "))
+	fmt.Printf("Hash: %s\n", opts.Hash)
+	fmt.Printf("Workers: %d\n", opts.Workers)
+	fmt.Printf("Copy Strategy: %s\n", opts.CopyStrategy)
+	fmt.Printf("Throttle: %s\n", opts.Throttle)
+	fmt.Printf("Filter: %s\n", filterSummary(opts.Filter))
+	fmt.Printf("On Error: %s\n", opts.ErrorPolicy)
+	fmt.Printf("Rules: %s\n", opts.RulesFile)
+	fmt.Printf("Encrypt Dst: %t\n", opts.EncryptDst)
+	fmt.Printf("\n\n")
+
+	return exitCode("Process", "Diff", diffdirectory.New(opts).Process())
+}
+
+func configMain(args []string) int {
+	if len(args) == 0 || args[0] != "validate" {
+		printRunHelp()
+		return 1
+	}
+
+	// flags
+	flags := flag.NewFlagSet("config validate", flag.ExitOnError)
+
+	var configPath string
+	flags.StringVar(&configPath, "config", "", "The config file")
+
+	flags.Parse(args[1:])
+	// flags
+
+	initlib.Init(initlib.DiffDirectoryInit{
+		LogLevel: initlib.LogLevelErrorOnly,
+	})
+
+	config, err := loadConfig(configPath)
+	if err != nil {
+		fmt.Printf("Loading config failed. Err: %v\n", err)
+		return 1
+	}
+	err = config.Validate()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+
+	for _, name := range config.ProfileNames() {
+		profile := config.Profiles[name]
+		fmt.Printf("%s: %s -> %s\n", name, profile.Src, profile.Dst)
+	}
+	fmt.Printf("Config is valid (%d profiles)\n", len(config.Profiles))
+	return 0
+}
@@ -0,0 +1,88 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	diffdirectory "github.com/dvonthenen/go-utilities/diff-directory/pkg/diff-directory"
+)
+
+func printFilterHelp() {
+	fmt.Println("  -newer-than string")
+	fmt.Println("    	Only compare files modified within this long, e.g. 7d, 2w or 36h")
+	fmt.Println("  -older-than string")
+	fmt.Println("    	Only compare files modified more than this long ago")
+	fmt.Println("  -min-size string")
+	fmt.Println("    	Only compare files of at least this size, e.g. 100K")
+	fmt.Println("  -max-size string")
+	fmt.Println("    	Only compare files of at most this size, e.g. 2G")
+	fmt.Println("  -exclude-class string")
+	fmt.Println("    	Leave out these extension classes, comma separated: audio, video, images")
+}
+
+// filterFlags registers the filter flags, the returned func builds the options after Parse
+func filterFlags(flags *flag.FlagSet) func() (diffdirectory.FilterOpts, error) {
+	newerThan := flags.String("newer-than", "", "Only compare files modified within this long, e.g. 7d, 2w or 36h")
+	olderThan := flags.String("older-than", "", "Only compare files modified more than this long ago")
+	minSize := flags.String("min-size", "", "Only compare files of at least this size, e.g. 100K")
+	maxSize := flags.String("max-size", "", "Only compare files of at most this size, e.g. 2G")
+	excludeClass := flags.String("exclude-class", "", "Leave out these extension classes, comma separated: audio, video, images")
+
+	return func() (diffdirectory.FilterOpts, error) {
+		opts := diffdirectory.FilterOpts{}
+
+		var err error
+		opts.NewerThan, err = diffdirectory.ParseAge(*newerThan)
+		if err != nil {
+			return opts, fmt.Errorf("invalid newer-than: %v", err)
+		}
+		opts.OlderThan, err = diffdirectory.ParseAge(*olderThan)
+		if err != nil {
+			return opts, fmt.Errorf("invalid older-than: %v", err)
+		}
+		opts.MinSize, err = diffdirectory.ParseBytes(*minSize)
+		if err != nil {
+			return opts, fmt.Errorf("invalid min-size: %v", err)
+		}
+		opts.MaxSize, err = diffdirectory.ParseBytes(*maxSize)
+		if err != nil {
+			return opts, fmt.Errorf("invalid max-size: %v", err)
+		}
+
+		for _, class := range strings.Split(*excludeClass, ",") {
+			if class = strings.TrimSpace(class); class != "" {
+				opts.ExcludeClasses = append(opts.ExcludeClasses, class)
+			}
+		}
+		return opts, nil
+	}
+}
+
+// filterSummary describes the filters for the settings output
+func filterSummary(opts diffdirectory.FilterOpts) string {
+	parts := make([]string, 0)
+	if opts.NewerThan > 0 {
+		parts = append(parts, fmt.Sprintf("newer than %v", opts.NewerThan))
+	}
+	if opts.OlderThan > 0 {
+		parts = append(parts, fmt.Sprintf("older than %v", opts.OlderThan))
+	}
+	if opts.MinSize > 0 {
+		parts = append(parts, fmt.Sprintf("min size %d", opts.MinSize))
+	}
+	if opts.MaxSize > 0 {
+		parts = append(parts, fmt.Sprintf("max size %d", opts.MaxSize))
+	}
+	if len(opts.ExcludeClasses) > 0 {
+		parts = append(parts, "excluding "+strings.Join(opts.ExcludeClasses, ", "))
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
@@ -5,32 +5,188 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	initlib "github.com/dvonthenen/go-utilities/diff-directory"
 	diffdirectory "github.com/dvonthenen/go-utilities/diff-directory/pkg/diff-directory"
 )
 
+const (
+	// PassphraseEnv environment variable holding the dst encryption passphrase
+	PassphraseEnv string = "DIFF_DIRECTORY_PASSPHRASE"
+)
+
 func printHelp() {
-	fmt.Println("Usage: diff-directory -src <src> -dst <dst> [-skipsrc] [-dryrun] [-logging <level>]")
+	fmt.Println("Usage: diff-directory -src <src> -dst <dst> [-skipsrc] [-dryrun [-show-diff]] [-verify] [-stream] [-interactive] [-max-files <n>] [-force] [-encrypt [-keyfile <file>]] [-snapshot <name>] [-logging <level>]")
+	fmt.Println("       diff-directory store <action> -store <path> [options]")
+	fmt.Println("       diff-directory verify -src <src> (-dst <dst> | -manifest <file> | -write-manifest <file>)")
+	fmt.Println("       diff-directory checksum -src <src> (-write | -check) [-format <format>] [-per-dir]")
+	fmt.Println("       diff-directory multi [options] <root> <root> [<root>...]")
+	fmt.Println("       diff-directory stats -src <src> [-dst <dst>] [-duplicates [-hardlink [-cross-tree]]]")
+	fmt.Println("       diff-directory run [-config <file>] (<profile> [<profile>...] | --all)")
+	fmt.Println("       diff-directory config validate [-config <file>]")
 	fmt.Println("Options:")
 	fmt.Println("  -src string")
 	fmt.Println("    	The source directory for all music files")
+	fmt.Println("    	Use git:<repo>@<rev> to sync a git revision without checking it out")
+	fmt.Println("    	Files .gitattributes rewrites on checkout (LFS, ident, eol=crlf) are skipped")
+	fmt.Println("    	Either -src or -dst can be a .tar, .tar.gz, .tar.zst or .zip archive")
 	fmt.Println("  -dst string")
 	fmt.Println("    	The destination directory for all music files")
+	fmt.Println("    	Use store:<path> to backup into a content-addressable store")
 	fmt.Println("  -skipsrc")
 	fmt.Println("    	Skip updating the source of the diff")
 	fmt.Println("  -dryrun")
 	fmt.Println("    	Do a run run only... don't update/copy any files")
+	fmt.Println("  -verify")
+	fmt.Println("    	Read back every copied file and compare it against the original")
+	fmt.Println("  -stream")
+	fmt.Println("    	Copy each difference as soon as it is found instead of after the comparison")
+	fmt.Println("  -extract")
+	fmt.Println("    	With an archive, write its new and changed members to the directory")
+	fmt.Println("  -audio")
+	fmt.Println("    	Compare MP3, FLAC and M4A files by their audio, telling tags-only changes apart")
+	fmt.Println("  -sync-tags")
+	fmt.Println("    	Sync tags-only changes by writing just the tags, implies -audio")
+	fmt.Println("  -rules string")
+	fmt.Println("    	Rules file assigning a direction and conflict policy per subtree")
+	fmt.Println("  -hash string")
+	fmt.Println("    	Content hash used to compare files: sha256 (default), md5 or sfv")
+	fmt.Println("  -workers int")
+	fmt.Println("    	Hash this many files in parallel")
+	fmt.Println("  -copy-strategy string")
+	fmt.Println("    	First copy strategy to try: auto (default), reflink, copy_file_range, sendfile or buffered")
+	fmt.Println("  -show-diff")
+	fmt.Println("    	With -dryrun show a unified diff for every changed text file")
+	fmt.Println("  -color string")
+	fmt.Println("    	Colorize diffs: auto (default), always or never")
+	fmt.Println("  -interactive")
+	fmt.Println("    	Review every action before it is carried out")
+	fmt.Println("  -max-files int")
+	fmt.Println("    	Refuse runs that change more than this many files, 0 means no limit")
+	fmt.Println("  -max-bytes int")
+	fmt.Println("    	Refuse runs that copy more than this many bytes, 0 means no limit")
+	fmt.Println("  -max-overwrite-pct float")
+	fmt.Println("    	Refuse runs that overwrite more than this percentage of either tree, 0 means no limit")
+	fmt.Println("  -force")
+	fmt.Println("    	Run even when a safety limit is exceeded or free space looks short")
+	fmt.Println("  -on-error string")
+	fmt.Println("    	What to do when a file fails: fail-fast (default) or continue, exit code 2 when files failed")
+	fmt.Println("  -wait duration")
+	fmt.Println("    	Wait this long for another run holding the lock on src or dst (default fail right away)")
+	printThrottleHelp()
+	printFilterHelp()
+	fmt.Println("  -target-fs string")
+	fmt.Println("    	dst filesystem profile: auto (default), posix or fat (FAT32/exFAT)")
+	fmt.Println("  -mtime-tolerance duration")
+	fmt.Println("    	Treat mod times this close as equal (fat defaults to 2s)")
+	fmt.Println("  -ignore-tz-shift")
+	fmt.Println("    	Treat mod times that differ by whole hours as equal")
+	fmt.Println("  -normalize string")
+	fmt.Println("    	Match paths by unicode normalized form: none (default), nfc or nfd")
+	fmt.Println("  -src-hashes string")
+	fmt.Println("    	Trusted checksum file (SHA256SUMS, .md5, .sfv) for src")
+	fmt.Println("  -dst-hashes string")
+	fmt.Println("    	Trusted checksum file (SHA256SUMS, .md5, .sfv) for dst")
+	fmt.Println("  -encrypt")
+	fmt.Println("    	Keep dst encrypted (passphrase from DIFF_DIRECTORY_PASSPHRASE or -keyfile)")
+	fmt.Println("  -keyfile string")
+	fmt.Println("    	Key file used to derive the dst encryption key")
+	fmt.Println("  -snapshot string")
+	fmt.Println("    	The snapshot name when dst is a store (defaults to the current time)")
 	fmt.Println("  -logging int")
 	fmt.Println("    	Set logging level: 2 - standard (default), 7 - very verbose")
 
 }
 
+func validateDir(name, dir string) (string, error) {
+	if len(dir) == 0 {
+		return "", fmt.Errorf("Provided %s path is empty. Must provide a valid directory.", name)
+	}
+
+	absPath, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("%s filepath.Abs failed. Err: %v", name, err)
+	}
+
+	stat, err := os.Stat(absPath)
+	if err != nil || !stat.IsDir() {
+		return "", fmt.Errorf("Invalid %s=%s directory. Must provide a valid directory.", name, absPath)
+	}
+
+	return absPath, nil
+}
+
+// validateTree is validateDir also accepting an archive, and git:<repo>@<rev> for src
+func validateTree(name, dir string) (string, error) {
+	if diffdirectory.IsArchive(dir) {
+		return filepath.Abs(dir)
+	}
+	repo, rev, ok := diffdirectory.ParseGitSource(dir)
+	if !ok || name != "src" {
+		return validateDir(name, dir)
+	}
+	absRepo, err := validateDir("src git repository", repo)
+	if err != nil {
+		return "", err
+	}
+	return diffdirectory.GitPrefix + absRepo + "@" + rev, nil
+}
+
+/*
+exitCode prints how a run ended and returns the exit code: 0 when everything synced, 1
+when the run failed and 2 when it continued past files that failed.
+*/
+func exitCode(label, done string, err error) int {
+	if err == nil {
+		fmt.Printf("%s Completed!\n", done)
+		return 0
+	}
+
+	var fileErrs diffdirectory.FileErrors
+	if errors.As(err, &fileErrs) {
+		fmt.Printf("%s Completed, %d files failed:\n", done, len(fileErrs))
+		for _, fileErr := range fileErrs {
+			fmt.Printf("\t%v\n", fileErr)
+		}
+		return 2
+	}
+	fmt.Printf("%s failed. Err: %v\n", label, err)
+	return 1
+}
+
+// isTerminal reports whether f is a terminal rather than a file or pipe
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "store":
+			os.Exit(storeMain(os.Args[2:]))
+		case "verify":
+			os.Exit(verifyMain(os.Args[2:]))
+		case "checksum":
+			os.Exit(checksumMain(os.Args[2:]))
+		case "multi":
+			os.Exit(multiMain(os.Args[2:]))
+		case "stats":
+			os.Exit(statsMain(os.Args[2:]))
+		case "run":
+			os.Exit(runMain(os.Args[2:]))
+		case "config":
+			os.Exit(configMain(os.Args[2:]))
+		}
+	}
+
 	// flags
 	var skipSrc bool
 	flag.BoolVar(&skipSrc, "skipsrc", false, "Skip updating the source of the diff")
@@ -44,6 +200,90 @@ func main() {
 	var dstDir string
 	flag.StringVar(&dstDir, "dst", "", "The destination directory for all music files")
 
+	var verify bool
+	flag.BoolVar(&verify, "verify", false, "Read back every copied file and compare it against the original")
+
+	var stream bool
+	flag.BoolVar(&stream, "stream", false, "Copy each difference as soon as it is found instead of after the comparison")
+
+	var extract bool
+	flag.BoolVar(&extract, "extract", false, "With an archive, write its new and changed members to the directory")
+
+	var audio bool
+	flag.BoolVar(&audio, "audio", false, "Compare MP3, FLAC and M4A files by their audio, telling tags-only changes apart")
+
+	var syncTags bool
+	flag.BoolVar(&syncTags, "sync-tags", false, "Sync tags-only changes by writing just the tags, implies -audio")
+
+	var rules string
+	flag.StringVar(&rules, "rules", "", "Rules file assigning a direction and conflict policy per subtree")
+
+	var hash string
+	flag.StringVar(&hash, "hash", diffdirectory.ChecksumSHA256, "Content hash used to compare files: sha256, md5 or sfv")
+
+	var workers int
+	flag.IntVar(&workers, "workers", 1, "Hash this many files in parallel")
+
+	var copyStrategy string
+	flag.StringVar(&copyStrategy, "copy-strategy", diffdirectory.CopyAuto, "First copy strategy to try: auto, reflink, copy_file_range, sendfile or buffered")
+
+	var showDiff bool
+	flag.BoolVar(&showDiff, "show-diff", false, "With -dryrun show a unified diff for every changed text file")
+
+	var color string
+	flag.StringVar(&color, "color", "auto", "Colorize diffs: auto, always or never")
+
+	var interactive bool
+	flag.BoolVar(&interactive, "interactive", false, "Review every action before it is carried out")
+
+	var maxFiles int
+	flag.IntVar(&maxFiles, "max-files", 0, "Refuse runs that change more than this many files, 0 means no limit")
+
+	var maxBytes int64
+	flag.Int64Var(&maxBytes, "max-bytes", 0, "Refuse runs that copy more than this many bytes, 0 means no limit")
+
+	var maxOverwritePct float64
+	flag.Float64Var(&maxOverwritePct, "max-overwrite-pct", 0, "Refuse runs that overwrite more than this percentage of either tree, 0 means no limit")
+
+	var force bool
+	flag.BoolVar(&force, "force", false, "Run even when a safety limit is exceeded or free space looks short")
+
+	var onError string
+	flag.StringVar(&onError, "on-error", diffdirectory.ErrorPolicyFailFast, "What to do when a file fails: fail-fast or continue")
+
+	var wait time.Duration
+	flag.DurationVar(&wait, "wait", 0, "Wait this long for another run holding the lock on src or dst")
+
+	throttleOpts := throttleFlags(flag.CommandLine)
+	filterOpts := filterFlags(flag.CommandLine)
+
+	var targetFS string
+	flag.StringVar(&targetFS, "target-fs", diffdirectory.TargetFSAuto, "dst filesystem profile: auto, posix or fat (FAT32/exFAT)")
+
+	var mtimeTolerance time.Duration
+	flag.DurationVar(&mtimeTolerance, "mtime-tolerance", 0, "Treat mod times this close as equal (fat defaults to 2s)")
+
+	var ignoreTZShift bool
+	flag.BoolVar(&ignoreTZShift, "ignore-tz-shift", false, "Treat mod times that differ by whole hours as equal")
+
+	var normalize string
+	flag.StringVar(&normalize, "normalize", diffdirectory.NormalizeNone, "Match paths by unicode normalized form: none, nfc or nfd")
+
+	var srcHashes string
+	flag.StringVar(&srcHashes, "src-hashes", "", "Trusted checksum file (SHA256SUMS, .md5, .sfv) for src")
+
+	var dstHashes string
+	flag.StringVar(&dstHashes, "dst-hashes", "", "Trusted checksum file (SHA256SUMS, .md5, .sfv) for dst")
+
+	var encrypt bool
+	flag.BoolVar(&encrypt, "encrypt", false, "Keep dst encrypted (passphrase from DIFF_DIRECTORY_PASSPHRASE or -keyfile)")
+
+	var keyFile string
+	flag.StringVar(&keyFile, "keyfile", "", "Key file used to derive the dst encryption key")
+
+	var snapshot string
+	flag.StringVar(&snapshot, "snapshot", "", "The snapshot name when dst is a store (defaults to the current time)")
+
 	var logging int
 	flag.IntVar(&logging, "logging", 2, "Set logging level: 2 - standard (default), 7 - very verbose")
 
@@ -55,60 +295,96 @@ func main() {
 	})
 
 	// src
-	if len(srcDir) == 0 {
-		fmt.Println("Provided src path is empty. Must provide a valid directory.")
+	absSrcPath, err := validateTree("src", srcDir)
+	if err != nil {
+		fmt.Println(err)
 		fmt.Println()
 		printHelp()
 		os.Exit(1)
 	}
 
-	absSrcPath, err := filepath.Abs(srcDir)
+	// store
+	if strings.HasPrefix(dstDir, diffdirectory.StorePrefix) {
+		if strings.HasPrefix(absSrcPath, diffdirectory.GitPrefix) || diffdirectory.IsArchive(absSrcPath) {
+			fmt.Println("A git or archive src can't be backed up into a store.")
+			os.Exit(1)
+		}
+		absStorePath, err := filepath.Abs(strings.TrimPrefix(dstDir, diffdirectory.StorePrefix))
+		if err != nil {
+			fmt.Printf("Store filepath.Abs failed. Err: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("logging: %d\n", logging)
+		fmt.Printf("Src Path: %s\n", absSrcPath)
+		fmt.Printf("Store Path: %s\n", absStorePath)
+		fmt.Printf("Dry Run: %t\n", dryrun)
+		fmt.Printf("\n\n")
+
+		store := diffdirectory.NewStore(diffdirectory.StoreOpts{
+			RootPath: absStorePath,
+			DryRun:   dryrun,
+		})
+		os.Exit(storeBackup(store, absSrcPath, snapshot))
+	}
+
+	//dst
+	absDstPath, err := validateTree("dst", dstDir)
 	if err != nil {
-		fmt.Printf("Source filepath.Abs failed. Err: %v\n", err)
+		fmt.Println(err)
 		fmt.Println()
 		printHelp()
 		os.Exit(1)
 	}
 
-	stat, err := os.Stat(absSrcPath)
+	// throttle and filters
+	throttle, err := throttleOpts()
 	if err != nil {
-		fmt.Printf("Invalid src=%s directory. Must provide a valid directory.\n", absSrcPath)
+		fmt.Println(err)
 		fmt.Println()
 		printHelp()
 		os.Exit(1)
 	}
-	if !stat.IsDir() {
-		fmt.Printf("Invalid src=%s directory. Must provide a valid directory.\n", absSrcPath)
+	filter, err := filterOpts()
+	if err != nil {
+		fmt.Println(err)
 		fmt.Println()
 		printHelp()
 		os.Exit(1)
 	}
 
-	//dst
-	if len(dstDir) == 0 {
-		fmt.Println("Provided dst path is empty. Must provide a valid directory.")
-		fmt.Println()
-		printHelp()
-		os.Exit(1)
+	// trusted checksums and rules
+	for _, hashes := range []*string{&srcHashes, &dstHashes, &rules} {
+		if len(*hashes) == 0 {
+			continue
+		}
+		absHashes, err := filepath.Abs(*hashes)
+		if err != nil {
+			fmt.Printf("%s filepath.Abs failed. Err: %v\n", *hashes, err)
+			os.Exit(1)
+		}
+		*hashes = absHashes
 	}
 
-	absDstPath, err := filepath.Abs(dstDir)
-	if err != nil {
-		fmt.Printf("Destination filepath.Abs failed. Err: %v\n", err)
+	// encryption
+	passphrase := os.Getenv(PassphraseEnv)
+	if encrypt && len(passphrase) == 0 && len(keyFile) == 0 {
+		fmt.Printf("Encryption requires %s or -keyfile.\n", PassphraseEnv)
 		fmt.Println()
 		printHelp()
 		os.Exit(1)
 	}
 
-	stat, err = os.Stat(absDstPath)
-	if err != nil {
-		fmt.Printf("Invalid dst=%s directory. Must provide a valid directory.\n", absDstPath)
-		fmt.Println()
-		printHelp()
-		os.Exit(1)
-	}
-	if !stat.IsDir() {
-		fmt.Printf("Invalid dst=%s directory. Must provide a valid directory.\n", absDstPath)
+	// color
+	diffColor := false
+	switch color {
+	case "auto":
+		diffColor = isTerminal(os.Stderr) && len(os.Getenv("NO_COLOR")) == 0
+	case "always":
+		diffColor = true
+	case "never":
+	default:
+		fmt.Printf("Invalid color=%s. Must be auto, always or never.\n", color)
 		fmt.Println()
 		printHelp()
 		os.Exit(1)
@@ -120,6 +396,23 @@ func main() {
 	fmt.Printf("Dst Path: %s\n", absDstPath)
 	fmt.Printf("Skip Src: %t\n", skipSrc)
 	fmt.Printf("Dry Run: %t\n", dryrun)
+	fmt.Printf("Verify: %t\n", verify)
+	fmt.Printf("Stream: %t\n", stream)
+	fmt.Printf("Extract: %t\n", extract)
+	fmt.Printf("Audio: %t\n", audio || syncTags)
+	fmt.Printf("Sync Tags: %t\n", syncTags)
+	fmt.Printf("Interactive: %t\n", interactive)
+	fmt.Printf("Force: %t\n", force)
+	fmt.Printf("On Error: %s\n", onError)
+	fmt.Printf("Target FS: %s\n", targetFS)
+	fmt.Printf("Normalize: %s\n", normalize)
+	fmt.Printf("Rules: %s\n", rules)
+	fmt.Printf("Hash: %s\n", hash)
+	fmt.Printf("Workers: %d\n", workers)
+	fmt.Printf("Copy Strategy: %s\n", copyStrategy)
+	fmt.Printf("Throttle: %s\n", throttle)
+	fmt.Printf("Filter: %s\n", filterSummary(filter))
+	fmt.Printf("Encrypt Dst: %t\n", encrypt)
 	fmt.Printf("\n\n")
 
 	dist := diffdirectory.New(diffdirectory.DiffOpts{
@@ -127,12 +420,40 @@ func main() {
 		RootDstPath:   absDstPath,
 		SkipSrcUpdate: skipSrc,
 		DryRun:        dryrun,
+		Verify:        verify,
+		Stream:        stream,
+		Extract:       extract,
+		Audio:         audio,
+		SyncTags:      syncTags,
+		Interactive:   interactive,
+		ShowDiff:      showDiff,
+		DiffColor:     diffColor,
+
+		MaxFiles:        maxFiles,
+		MaxBytes:        maxBytes,
+		MaxOverwritePct: maxOverwritePct,
+		Force:           force,
+		ErrorPolicy:     onError,
+		LockWait:        wait,
+		Throttle:        throttle,
+		Filter:          filter,
+
+		TargetFS:       targetFS,
+		MTimeTolerance: mtimeTolerance,
+		IgnoreTZShift:  ignoreTZShift,
+		Normalize:      normalize,
+		RulesFile:      rules,
+		Hash:           hash,
+		Workers:        workers,
+		CopyStrategy:   copyStrategy,
+
+		SrcChecksumFile: srcHashes,
+		DstChecksumFile: dstHashes,
+
+		EncryptDst: encrypt,
+		Passphrase: passphrase,
+		KeyFile:    keyFile,
 	})
 
-	err = dist.Process()
-	if err == nil {
-		fmt.Printf("Diff Completed!\n")
-	} else {
-		fmt.Printf("Process failed. Err: %v\n", err)
-	}
+	os.Exit(exitCode("Process", "Diff", dist.Process()))
 }
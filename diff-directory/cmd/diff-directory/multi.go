@@ -0,0 +1,170 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	initlib "github.com/dvonthenen/go-utilities/diff-directory"
+	diffdirectory "github.com/dvonthenen/go-utilities/diff-directory/pkg/diff-directory"
+)
+
+func printMultiHelp() {
+	fmt.Println("Usage: diff-directory multi [options] <root> <root> [<root>...]")
+	fmt.Println("Brings every root up to date with the newest version of each file across all roots.")
+	fmt.Println("Deletions aren't synced: a file deleted from some roots is copied back from the others.")
+	fmt.Println("Every root must be on a POSIX filesystem, FAT and exFAT roots are refused.")
+	fmt.Println("Options:")
+	fmt.Println("  -dryrun")
+	fmt.Println("    	Do a run run only... don't update/copy any files")
+	fmt.Println("  -verify")
+	fmt.Println("    	Read back every copied file and compare it against the original")
+	fmt.Println("  -max-files int")
+	fmt.Println("    	Refuse runs that change more than this many files, 0 means no limit")
+	fmt.Println("  -max-bytes int")
+	fmt.Println("    	Refuse runs that copy more than this many bytes, 0 means no limit")
+	fmt.Println("  -max-overwrite-pct float")
+	fmt.Println("    	Refuse runs that overwrite more than this percentage of any root, 0 means no limit")
+	fmt.Println("  -force")
+	fmt.Println("    	Run even when a safety limit is exceeded or free space looks short")
+	fmt.Println("  -copy-strategy string")
+	fmt.Println("    	First copy strategy to try: auto (default), reflink, copy_file_range, sendfile or buffered")
+	fmt.Println("  -on-error string")
+	fmt.Println("    	What to do when a file fails: fail-fast (default) or continue, exit code 2 when files failed")
+	fmt.Println("  -wait duration")
+	fmt.Println("    	Wait this long for another run holding the lock on a root (default fail right away)")
+	printThrottleHelp()
+	printFilterHelp()
+	fmt.Println("  -mtime-tolerance duration")
+	fmt.Println("    	Treat mod times this close as equal")
+	fmt.Println("  -ignore-tz-shift")
+	fmt.Println("    	Treat mod times that differ by whole hours as equal")
+	fmt.Println("  -normalize string")
+	fmt.Println("    	Match paths by unicode normalized form: none (default), nfc or nfd")
+	fmt.Println("  -logging int")
+	fmt.Println("    	Set logging level: 2 - standard (default), 7 - very verbose")
+}
+
+func multiMain(args []string) int {
+	// flags
+	flags := flag.NewFlagSet("multi", flag.ExitOnError)
+
+	var dryrun bool
+	flags.BoolVar(&dryrun, "dryrun", false, "Do a run run only... don't update/copy any files")
+
+	var verify bool
+	flags.BoolVar(&verify, "verify", false, "Read back every copied file and compare it against the original")
+
+	var maxFiles int
+	flags.IntVar(&maxFiles, "max-files", 0, "Refuse runs that change more than this many files, 0 means no limit")
+
+	var maxBytes int64
+	flags.Int64Var(&maxBytes, "max-bytes", 0, "Refuse runs that copy more than this many bytes, 0 means no limit")
+
+	var maxOverwritePct float64
+	flags.Float64Var(&maxOverwritePct, "max-overwrite-pct", 0, "Refuse runs that overwrite more than this percentage of any root, 0 means no limit")
+
+	var force bool
+	flags.BoolVar(&force, "force", false, "Run even when a safety limit is exceeded or free space looks short")
+
+	var copyStrategy string
+	flags.StringVar(&copyStrategy, "copy-strategy", diffdirectory.CopyAuto, "First copy strategy to try: auto, reflink, copy_file_range, sendfile or buffered")
+
+	var onError string
+	flags.StringVar(&onError, "on-error", diffdirectory.ErrorPolicyFailFast, "What to do when a file fails: fail-fast or continue")
+
+	var wait time.Duration
+	flags.DurationVar(&wait, "wait", 0, "Wait this long for another run holding the lock on a root")
+
+	throttleOpts := throttleFlags(flags)
+	filterOpts := filterFlags(flags)
+
+	var mtimeTolerance time.Duration
+	flags.DurationVar(&mtimeTolerance, "mtime-tolerance", 0, "Treat mod times this close as equal")
+
+	var ignoreTZShift bool
+	flags.BoolVar(&ignoreTZShift, "ignore-tz-shift", false, "Treat mod times that differ by whole hours as equal")
+
+	var normalize string
+	flags.StringVar(&normalize, "normalize", diffdirectory.NormalizeNone, "Match paths by unicode normalized form: none, nfc or nfd")
+
+	var logging int
+	flags.IntVar(&logging, "logging", 2, "Set logging level: 2 - standard (default), 7 - very verbose")
+
+	flags.Parse(args)
+	// flags
+
+	initlib.Init(initlib.DiffDirectoryInit{
+		LogLevel: initlib.LogLevel(logging),
+	})
+
+	if flags.NArg() < 2 {
+		fmt.Println("Must provide at least two roots.")
+		fmt.Println()
+		printMultiHelp()
+		return 1
+	}
+
+	roots := make([]string, 0, flags.NArg())
+	for i, dir := range flags.Args() {
+		absPath, err := validateDir(fmt.Sprintf("root%d", i+1), dir)
+		if err != nil {
+			fmt.Println(err)
+			fmt.Println()
+			printMultiHelp()
+			return 1
+		}
+		roots = append(roots, absPath)
+	}
+
+	throttle, err := throttleOpts()
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println()
+		printMultiHelp()
+		return 1
+	}
+	filter, err := filterOpts()
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println()
+		printMultiHelp()
+		return 1
+	}
+
+	// output
+	fmt.Printf("logging: %d\n", logging)
+	for i, root := range roots {
+		fmt.Printf("Root %d: %s\n", i+1, root)
+	}
+	fmt.Printf("Dry Run: %t\n", dryrun)
+	fmt.Printf("Verify: %t\n", verify)
+	fmt.Printf("Copy Strategy: %s\n", copyStrategy)
+	fmt.Printf("Throttle: %s\n", throttle)
+	fmt.Printf("Filter: %s\n", filterSummary(filter))
+	fmt.Printf("\n\n")
+
+	err = diffdirectory.NewMulti(diffdirectory.MultiOpts{
+		Roots:          roots,
+		DryRun:         dryrun,
+		Verify:         verify,
+		MTimeTolerance: mtimeTolerance,
+		IgnoreTZShift:  ignoreTZShift,
+		Normalize:      normalize,
+		LockWait:       wait,
+		ErrorPolicy:    onError,
+		CopyStrategy:   copyStrategy,
+		Throttle:       throttle,
+		Filter:         filter,
+
+		MaxFiles:        maxFiles,
+		MaxBytes:        maxBytes,
+		MaxOverwritePct: maxOverwritePct,
+		Force:           force,
+	}).Process()
+	return exitCode("Multi", "Multi", err)
+}
@@ -0,0 +1,134 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	initlib "github.com/dvonthenen/go-utilities/diff-directory"
+	diffdirectory "github.com/dvonthenen/go-utilities/diff-directory/pkg/diff-directory"
+)
+
+func printStatsHelp() {
+	fmt.Println("Usage: diff-directory stats -src <src> [-dst <dst>] [options]")
+	fmt.Println("Reports file counts and sizes by extension and top level directory, the largest,")
+	fmt.Println("oldest and newest files and optionally the duplicate files.")
+	fmt.Println("Options:")
+	fmt.Println("  -src string")
+	fmt.Println("    	The directory to report on")
+	fmt.Println("  -dst string")
+	fmt.Println("    	A second directory to report on, duplicates are also found across both")
+	fmt.Println("  -top int")
+	fmt.Println("    	How many of the largest, oldest and newest files to list (default 10)")
+	fmt.Println("  -duplicates")
+	fmt.Println("    	Group identical files by size and then hash")
+	fmt.Println("  -hardlink")
+	fmt.Println("    	Replace duplicates with hardlinks to the first file of their group (implies -duplicates)")
+	fmt.Println("    	Each tree is linked on its own, src and dst are locked while linking")
+	fmt.Println("  -cross-tree")
+	fmt.Println("    	With -hardlink also link dst files to src files, the backup then shares them")
+	fmt.Println("  -dryrun")
+	fmt.Println("    	With -hardlink only show the links that would be made")
+	printFilterHelp()
+	fmt.Println("  -ignore string")
+	fmt.Println("    	Comma separated patterns to leave out (.gitignore style)")
+	fmt.Println("  -on-error string")
+	fmt.Println("    	What to do when a file fails: fail-fast (default) or continue, exit code 2 when files failed")
+	fmt.Println("  -logging int")
+	fmt.Println("    	Set logging level: 2 - standard (default), 7 - very verbose")
+}
+
+func statsMain(args []string) int {
+	// flags
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+
+	var srcDir string
+	flags.StringVar(&srcDir, "src", "", "The directory to report on")
+
+	var dstDir string
+	flags.StringVar(&dstDir, "dst", "", "A second directory to report on")
+
+	var top int
+	flags.IntVar(&top, "top", 10, "How many of the largest, oldest and newest files to list")
+
+	var duplicates bool
+	flags.BoolVar(&duplicates, "duplicates", false, "Group identical files by size and then hash")
+
+	var hardlink bool
+	flags.BoolVar(&hardlink, "hardlink", false, "Replace duplicates with hardlinks to the first file of their group")
+
+	var crossTree bool
+	flags.BoolVar(&crossTree, "cross-tree", false, "With -hardlink also link dst files to src files")
+
+	var dryrun bool
+	flags.BoolVar(&dryrun, "dryrun", false, "With -hardlink only show the links that would be made")
+
+	filterOpts := filterFlags(flags)
+
+	var ignore string
+	flags.StringVar(&ignore, "ignore", "", "Comma separated patterns to leave out")
+
+	var onError string
+	flags.StringVar(&onError, "on-error", diffdirectory.ErrorPolicyFailFast, "What to do when a file fails: fail-fast or continue")
+
+	var logging int
+	flags.IntVar(&logging, "logging", 2, "Set logging level: 2 - standard (default), 7 - very verbose")
+
+	flags.Parse(args)
+	// flags
+
+	initlib.Init(initlib.DiffDirectoryInit{
+		LogLevel: initlib.LogLevel(logging),
+	})
+
+	absSrcPath, err := validateDir("src", srcDir)
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println()
+		printStatsHelp()
+		return 1
+	}
+
+	opts := diffdirectory.DiffOpts{
+		RootSrcPath: absSrcPath,
+		DryRun:      dryrun,
+		ErrorPolicy: onError,
+	}
+	if len(dstDir) > 0 {
+		opts.RootDstPath, err = validateDir("dst", dstDir)
+		if err != nil {
+			fmt.Println(err)
+			fmt.Println()
+			printStatsHelp()
+			return 1
+		}
+	}
+	opts.Filter, err = filterOpts()
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println()
+		printStatsHelp()
+		return 1
+	}
+	for _, pattern := range strings.Split(ignore, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			opts.Ignore = append(opts.Ignore, pattern)
+		}
+	}
+
+	report, err := diffdirectory.New(opts).Stats(diffdirectory.StatsOpts{
+		Top:        top,
+		Duplicates: duplicates || hardlink,
+		Hardlink:   hardlink,
+		CrossTree:  crossTree,
+	})
+	if report != nil {
+		report.Print(os.Stdout)
+	}
+	return exitCode("Stats", "Stats", err)
+}
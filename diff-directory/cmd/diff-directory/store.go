@@ -0,0 +1,188 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	initlib "github.com/dvonthenen/go-utilities/diff-directory"
+	diffdirectory "github.com/dvonthenen/go-utilities/diff-directory/pkg/diff-directory"
+)
+
+func printStoreHelp() {
+	fmt.Println("Usage: diff-directory store <action> -store <path> [options]")
+	fmt.Println("Actions:")
+	fmt.Println("  init      Create a new store (-compression none|gzip)")
+	fmt.Println("  backup    Record -src as a new snapshot (-snapshot <name>)")
+	fmt.Println("  restore   Write -snapshot <name> to -dst")
+	fmt.Println("  list      List all snapshots")
+	fmt.Println("  prune     Remove unreferenced chunks, keeping the newest -keep snapshots")
+	fmt.Println("  check     Verify the integrity of all chunks and snapshots")
+	fmt.Println("Options:")
+	fmt.Println("  -store string")
+	fmt.Println("    	The path of the content-addressable store")
+	fmt.Println("  -src string")
+	fmt.Println("    	The source directory to backup")
+	fmt.Println("  -dst string")
+	fmt.Println("    	The destination directory to restore into")
+	fmt.Println("  -snapshot string")
+	fmt.Println("    	The snapshot name (backup defaults to the current time)")
+	fmt.Println("  -compression string")
+	fmt.Println("    	Chunk compression for new stores: none or gzip (default)")
+	fmt.Println("  -keep int")
+	fmt.Println("    	Number of snapshots to keep when pruning, 0 keeps all")
+	fmt.Println("  -dryrun")
+	fmt.Println("    	Do a run run only... don't update/copy any files")
+	fmt.Println("  -logging int")
+	fmt.Println("    	Set logging level: 2 - standard (default), 7 - very verbose")
+}
+
+func storeMain(args []string) int {
+	if len(args) == 0 {
+		printStoreHelp()
+		return 1
+	}
+	action := args[0]
+
+	// flags
+	flags := flag.NewFlagSet("store", flag.ExitOnError)
+
+	var storeDir string
+	flags.StringVar(&storeDir, "store", "", "The path of the content-addressable store")
+
+	var srcDir string
+	flags.StringVar(&srcDir, "src", "", "The source directory to backup")
+
+	var dstDir string
+	flags.StringVar(&dstDir, "dst", "", "The destination directory to restore into")
+
+	var snapshot string
+	flags.StringVar(&snapshot, "snapshot", "", "The snapshot name")
+
+	var compression string
+	flags.StringVar(&compression, "compression", diffdirectory.StoreCompressionGzip, "Chunk compression for new stores: none or gzip")
+
+	var keep int
+	flags.IntVar(&keep, "keep", 0, "Number of snapshots to keep when pruning, 0 keeps all")
+
+	var dryrun bool
+	flags.BoolVar(&dryrun, "dryrun", false, "Do a run run only... don't update/copy any files")
+
+	var logging int
+	flags.IntVar(&logging, "logging", 2, "Set logging level: 2 - standard (default), 7 - very verbose")
+
+	flags.Parse(args[1:])
+	// flags
+
+	initlib.Init(initlib.DiffDirectoryInit{
+		LogLevel: initlib.LogLevel(logging),
+	})
+
+	if len(storeDir) == 0 {
+		fmt.Println("Provided store path is empty. Must provide a valid path.")
+		fmt.Println()
+		printStoreHelp()
+		return 1
+	}
+	absStorePath, err := filepath.Abs(storeDir)
+	if err != nil {
+		fmt.Printf("Store filepath.Abs failed. Err: %v\n", err)
+		return 1
+	}
+
+	store := diffdirectory.NewStore(diffdirectory.StoreOpts{
+		RootPath:    absStorePath,
+		Compression: compression,
+		DryRun:      dryrun,
+	})
+
+	switch action {
+	case "init":
+		err = store.Init()
+	case "backup":
+		absSrcPath, err := validateDir("src", srcDir)
+		if err != nil {
+			fmt.Println(err)
+			fmt.Println()
+			printStoreHelp()
+			return 1
+		}
+		return storeBackup(store, absSrcPath, snapshot)
+	case "restore":
+		if len(snapshot) == 0 || len(dstDir) == 0 {
+			fmt.Println("Restore requires -snapshot and -dst.")
+			fmt.Println()
+			printStoreHelp()
+			return 1
+		}
+		absDstPath, err := filepath.Abs(dstDir)
+		if err != nil {
+			fmt.Printf("Destination filepath.Abs failed. Err: %v\n", err)
+			return 1
+		}
+		err = store.Restore(snapshot, absDstPath)
+		if err != nil {
+			fmt.Printf("Restore failed. Err: %v\n", err)
+			return 1
+		}
+	case "list":
+		snapshots, err := store.Snapshots()
+		if err != nil {
+			fmt.Printf("List failed. Err: %v\n", err)
+			return 1
+		}
+		for _, s := range snapshots {
+			fmt.Printf("%s\t%s\t%d files\t%s\n", s.Name, s.Created.Format(time.RFC3339), len(s.Files), s.Source)
+		}
+	case "prune":
+		removed, freed, err := store.Prune(keep)
+		if err != nil {
+			fmt.Printf("Prune failed. Err: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Removed %d chunks (%d bytes)\n", removed, freed)
+	case "check":
+		err = store.Check()
+	default:
+		fmt.Printf("Unknown store action: %s\n", action)
+		fmt.Println()
+		printStoreHelp()
+		return 1
+	}
+
+	if err != nil {
+		fmt.Printf("Store %s failed. Err: %v\n", action, err)
+		return 1
+	}
+	fmt.Printf("Store %s Completed!\n", action)
+	return 0
+}
+
+func storeBackup(store *diffdirectory.Store, absSrcPath, snapshot string) int {
+	if len(snapshot) == 0 {
+		snapshot = time.Now().Format("20060102-150405")
+	}
+
+	err := store.Init()
+	if err != nil {
+		fmt.Printf("Store init failed. Err: %v\n", err)
+		return 1
+	}
+
+	stats, err := store.Backup(absSrcPath, snapshot)
+	if err != nil {
+		fmt.Printf("Backup failed. Err: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Snapshot: %s\n", snapshot)
+	fmt.Printf("Files: %d (%d bytes), unchanged: %d\n", stats.Files, stats.Bytes, stats.ReusedFiles)
+	fmt.Printf("New chunks: %d (%d bytes)\n", stats.NewChunks, stats.NewBytes)
+	fmt.Printf("Backup Completed!\n")
+	return 0
+}
@@ -0,0 +1,64 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+
+	diffdirectory "github.com/dvonthenen/go-utilities/diff-directory/pkg/diff-directory"
+)
+
+func printThrottleHelp() {
+	fmt.Println("  -read-bps string")
+	fmt.Println("    	Limit hashing to this many bytes per second, e.g. 20M (default unlimited)")
+	fmt.Println("  -read-fps float")
+	fmt.Println("    	Limit hashing to this many files per second (default unlimited)")
+	fmt.Println("  -write-bps string")
+	fmt.Println("    	Limit copying to this many bytes per second, e.g. 5M (default unlimited)")
+	fmt.Println("  -write-fps float")
+	fmt.Println("    	Limit copying to this many files per second (default unlimited)")
+	fmt.Println("  -throttle-schedule string")
+	fmt.Println("    	Only throttle inside these HH:MM-HH:MM windows, e.g. 08:00-18:00 (default always)")
+	fmt.Println("  -throttle-file string")
+	fmt.Println("    	Control file overriding the limits while running, re-read when it changes or on SIGHUP")
+}
+
+// throttleFlags registers the throttle flags, the returned func builds the options after Parse
+func throttleFlags(flags *flag.FlagSet) func() (diffdirectory.ThrottleOpts, error) {
+	readBPS := flags.String("read-bps", "", "Limit hashing to this many bytes per second, e.g. 20M")
+	readFPS := flags.Float64("read-fps", 0, "Limit hashing to this many files per second")
+	writeBPS := flags.String("write-bps", "", "Limit copying to this many bytes per second, e.g. 5M")
+	writeFPS := flags.Float64("write-fps", 0, "Limit copying to this many files per second")
+	schedule := flags.String("throttle-schedule", "", "Only throttle inside these HH:MM-HH:MM windows, e.g. 08:00-18:00")
+	controlFile := flags.String("throttle-file", "", "Control file overriding the limits while running")
+
+	return func() (diffdirectory.ThrottleOpts, error) {
+		opts := diffdirectory.ThrottleOpts{
+			ReadFilesPerSec:  *readFPS,
+			WriteFilesPerSec: *writeFPS,
+			Schedule:         *schedule,
+		}
+
+		var err error
+		opts.ReadBytesPerSec, err = diffdirectory.ParseBytes(*readBPS)
+		if err != nil {
+			return opts, fmt.Errorf("invalid read-bps: %v", err)
+		}
+		opts.WriteBytesPerSec, err = diffdirectory.ParseBytes(*writeBPS)
+		if err != nil {
+			return opts, fmt.Errorf("invalid write-bps: %v", err)
+		}
+
+		if len(*controlFile) > 0 {
+			opts.ControlFile, err = filepath.Abs(*controlFile)
+			if err != nil {
+				return opts, fmt.Errorf("throttle-file filepath.Abs failed. Err: %v", err)
+			}
+		}
+		return opts, nil
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	initlib "github.com/dvonthenen/go-utilities/diff-directory"
+	diffdirectory "github.com/dvonthenen/go-utilities/diff-directory/pkg/diff-directory"
+)
+
+func printVerifyHelp() {
+	fmt.Println("Usage: diff-directory verify -src <src> (-dst <dst> | -manifest <file> | -write-manifest <file>) [options]")
+	fmt.Println("Options:")
+	fmt.Println("  -src string")
+	fmt.Println("    	The directory to verify")
+	fmt.Println("  -dst string")
+	fmt.Println("    	Re-hash both trees and compare them")
+	fmt.Println("  -manifest string")
+	fmt.Println("    	Re-hash src and compare it against a manifest")
+	fmt.Println("  -write-manifest string")
+	fmt.Println("    	Hash src and write a manifest for later verification")
+	fmt.Println("  -encrypt")
+	fmt.Println("    	dst is encrypted (passphrase from DIFF_DIRECTORY_PASSPHRASE or -keyfile)")
+	fmt.Println("  -keyfile string")
+	fmt.Println("    	Key file used to derive the dst encryption key")
+	fmt.Println("  -logging int")
+	fmt.Println("    	Set logging level: 2 - standard (default), 7 - very verbose")
+}
+
+func verifyMain(args []string) int {
+	// flags
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+
+	var srcDir string
+	flags.StringVar(&srcDir, "src", "", "The directory to verify")
+
+	var dstDir string
+	flags.StringVar(&dstDir, "dst", "", "Re-hash both trees and compare them")
+
+	var manifest string
+	flags.StringVar(&manifest, "manifest", "", "Re-hash src and compare it against a manifest")
+
+	var writeManifest string
+	flags.StringVar(&writeManifest, "write-manifest", "", "Hash src and write a manifest for later verification")
+
+	var encrypt bool
+	flags.BoolVar(&encrypt, "encrypt", false, "dst is encrypted")
+
+	var keyFile string
+	flags.StringVar(&keyFile, "keyfile", "", "Key file used to derive the dst encryption key")
+
+	var logging int
+	flags.IntVar(&logging, "logging", 2, "Set logging level: 2 - standard (default), 7 - very verbose")
+
+	flags.Parse(args)
+	// flags
+
+	initlib.Init(initlib.DiffDirectoryInit{
+		LogLevel: initlib.LogLevel(logging),
+	})
+
+	absSrcPath, err := validateDir("src", srcDir)
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println()
+		printVerifyHelp()
+		return 1
+	}
+
+	opts := diffdirectory.DiffOpts{
+		RootSrcPath: absSrcPath,
+		EncryptDst:  encrypt,
+		Passphrase:  os.Getenv(PassphraseEnv),
+		KeyFile:     keyFile,
+	}
+
+	var report *diffdirectory.VerifyReport
+	switch {
+	case len(dstDir) > 0:
+		opts.RootDstPath, err = validateDir("dst", dstDir)
+		if err != nil {
+			fmt.Println(err)
+			fmt.Println()
+			printVerifyHelp()
+			return 1
+		}
+		report, err = diffdirectory.New(opts).VerifyTrees()
+	case len(manifest) > 0:
+		report, err = diffdirectory.New(opts).VerifyManifest(manifest)
+	case len(writeManifest) > 0:
+		absManifest, err := filepath.Abs(writeManifest)
+		if err != nil {
+			fmt.Printf("Manifest filepath.Abs failed. Err: %v\n", err)
+			return 1
+		}
+		err = diffdirectory.New(opts).WriteManifest(absManifest)
+		if err != nil {
+			fmt.Printf("Write manifest failed. Err: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Manifest written to %s\n", absManifest)
+		return 0
+	default:
+		fmt.Println("Must provide one of -dst, -manifest or -write-manifest.")
+		fmt.Println()
+		printVerifyHelp()
+		return 1
+	}
+
+	if report != nil {
+		fmt.Printf("Checked: %d\n", report.Checked)
+		fmt.Printf("Missing: %d\n", len(report.Missing))
+		fmt.Printf("Modified: %d\n", len(report.Modified))
+		fmt.Printf("Corrupt: %d\n", len(report.Corrupt))
+	}
+	if err != nil {
+		fmt.Printf("Verify failed. Err: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Verify Completed!\n")
+	return 0
+}
@@ -1,7 +1,19 @@
 module github.com/dvonthenen/go-utilities/diff-directory
 
-go 1.18
+// go 1.22 is the floor of github.com/klauspost/compress v1.18.0, needed for the
+// zstd reader of .tar.zst archives. It was go 1.18 before archives were supported.
+go 1.22
 
-require k8s.io/klog/v2 v2.100.1
+require (
+	github.com/dvonthenen/go-utilities/filecopy v0.0.0
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/crypto v0.24.0
+	golang.org/x/sys v0.21.0
+	golang.org/x/text v0.16.0
+	gopkg.in/yaml.v3 v3.0.1
+	k8s.io/klog/v2 v2.100.1
+)
 
 require github.com/go-logr/logr v1.2.0 // indirect
+
+replace github.com/dvonthenen/go-utilities/filecopy => ../filecopy
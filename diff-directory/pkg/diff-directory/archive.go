@@ -0,0 +1,589 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	klog "k8s.io/klog/v2"
+)
+
+/*
+Archives
+
+Either root can be a .tar, .tar.gz, .tar.zst or .zip archive, the other has to be a
+directory. The archive is a read-only tree listed from its headers. Members are only
+read when their size matches the directory file but their mod time doesn't, and then
+streamed through the hash, nothing is unpacked to compare. With Extract the members that
+are new or newer than the directory are written to it, the rest of the archive is left
+alone.
+*/
+
+// archive mod times are stored in whole seconds, or two for zip without extended times
+var archiveTolerance = map[string]time.Duration{
+	ArchiveTar:     time.Second,
+	ArchiveTarGzip: time.Second,
+	ArchiveTarZstd: time.Second,
+	ArchiveZip:     2 * time.Second,
+}
+
+// archiveFormat returns the format of an archive file, empty for anything else
+func archiveFormat(path string) string {
+	lower := strings.ToLower(path)
+	format := ""
+	switch {
+	case strings.HasSuffix(lower, ".tar"):
+		format = ArchiveTar
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		format = ArchiveTarGzip
+	case strings.HasSuffix(lower, ".tar.zst"), strings.HasSuffix(lower, ".tzst"):
+		format = ArchiveTarZstd
+	case strings.HasSuffix(lower, ".zip"):
+		format = ArchiveZip
+	default:
+		return ""
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil || !stat.Mode().IsRegular() {
+		return ""
+	}
+	return format
+}
+
+// IsArchive reports whether path is an archive file diff-directory can read
+func IsArchive(path string) bool {
+	return archiveFormat(path) != ""
+}
+
+/*
+walkArchive calls fn for every regular file of the archive in the order they are
+stored. open reads the member and is only valid until fn returns.
+*/
+func (d *Diff) walkArchive(archivePath, format string, fn func(file *DiffFile, open func() (io.ReadCloser, error)) error) error {
+	if format == ArchiveZip {
+		zr, err := zip.OpenReader(archivePath)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+
+		for _, member := range zr.File {
+			file := d.archiveFile(archivePath, member.Name, member.FileInfo())
+			if file == nil {
+				continue
+			}
+			err = fn(file, func() (io.ReadCloser, error) {
+				rc, err := member.Open()
+				if err != nil {
+					return nil, err
+				}
+				return struct {
+					io.Reader
+					io.Closer
+				}{d.throttle.reader(rc), rc}, nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// a tar is read front to back whatever is needed from it
+	var r io.Reader = d.throttle.reader(f)
+	switch format {
+	case ArchiveTarGzip:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	case ArchiveTarZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			if header.Typeflag != tar.TypeDir {
+				klog.V(3).Infof("[ARCHIVE] skip %s, not a regular file\n", header.Name)
+			}
+			continue
+		}
+
+		file := d.archiveFile(archivePath, header.Name, header.FileInfo())
+		if file == nil {
+			continue
+		}
+		err = fn(file, func() (io.ReadCloser, error) {
+			return io.NopCloser(tr), nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// archiveFile describes a member, nil for anything but regular files, internal files and unsafe names
+func (d *Diff) archiveFile(archivePath, name string, info os.FileInfo) *DiffFile {
+	if info.IsDir() {
+		return nil
+	}
+	if !info.Mode().IsRegular() {
+		// symlinks, devices and the like would be extracted as regular files
+		klog.V(3).Infof("[ARCHIVE] skip %s, not a regular file\n", name)
+		return nil
+	}
+	// leading slashes are dropped the way tar does, parent references are refused
+	clean := path.Clean(strings.TrimLeft(strings.ReplaceAll(name, `\`, "/"), "/"))
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		klog.Infof("[ARCHIVE] Skipping %s because it points outside the archive\n", name)
+		return nil
+	}
+	if isInternalFile(path.Base(clean)) {
+		return nil
+	}
+
+	relPath := filepath.FromSlash(clean)
+	var attr os.FileInfo = &treeFileInfo{
+		name:    path.Base(clean),
+		size:    info.Size(),
+		mode:    info.Mode(),
+		modTime: info.ModTime(),
+	}
+	return &DiffFile{
+		Path:    filepath.Join(archivePath, relPath),
+		RelPath: relPath,
+		Attr:    &attr,
+	}
+}
+
+func (d *Diff) processArchive() error {
+	srcFormat := archiveFormat(d.options.RootSrcPath)
+	dstFormat := archiveFormat(d.options.RootDstPath)
+	if srcFormat != "" && dstFormat != "" {
+		klog.Errorf("src and dst are both archives, one has to be a directory\n")
+		return ErrArchiveBoth
+	}
+	if d.options.EncryptDst || d.options.Interactive || d.options.SrcChecksumFile != "" || d.options.DstChecksumFile != "" {
+		klog.Errorf("An archive doesn't work with encryption, -interactive or checksum files\n")
+		return fmt.Errorf("%w: encryption, interactive review or checksum files", ErrArchiveUnsupported)
+	}
+
+	// the archive side and the directory side
+	archivePath, format, dirPath := d.options.RootSrcPath, srcFormat, d.options.RootDstPath
+	archiveLabel, dirLabel := "SRC", "DST"
+	toDir, toArchive := DIRECTION_SRC_TO_DST, DIRECTION_DST_TO_SRC
+	if dstFormat != "" {
+		archivePath, format, dirPath = d.options.RootDstPath, dstFormat, d.options.RootSrcPath
+		archiveLabel, dirLabel = "DST", "SRC"
+		toDir, toArchive = DIRECTION_DST_TO_SRC, DIRECTION_SRC_TO_DST
+	}
+	label := fmt.Sprintf("[%s -> %s]", archiveLabel, dirLabel)
+
+	err := d.checkErrorPolicy()
+	if err != nil {
+		return err
+	}
+	err = d.startThrottle()
+	if err != nil {
+		return err
+	}
+	defer d.stopThrottle()
+
+	if d.options.Extract && !d.options.DryRun {
+		var locks []*runLock
+		locks, err = lockRoots([]string{dirPath}, d.options.LockWait)
+		if err != nil {
+			klog.Errorf("lockRoots failed. Err: %v\n", err)
+			return err
+		}
+		defer unlockRoots(locks)
+	}
+
+	err = d.checkNormalize()
+	if err != nil {
+		klog.Errorf("checkNormalize failed. Err: %v\n", err)
+		return err
+	}
+	err = d.loadRules()
+	if err != nil {
+		klog.Errorf("loadRules failed. Err: %v\n", err)
+		return err
+	}
+	err = d.checkFilter()
+	if err != nil {
+		klog.Errorf("checkFilter failed. Err: %v\n", err)
+		return err
+	}
+	if d.options.MTimeTolerance < archiveTolerance[format] {
+		d.options.MTimeTolerance = archiveTolerance[format]
+	}
+
+	// list both trees
+	archiveFiles := make(map[string]*DiffFile)
+	err = d.walkArchive(archivePath, format, func(file *DiffFile, open func() (io.ReadCloser, error)) error {
+		key := d.pathKey(file.RelPath, false)
+		if existing := archiveFiles[key]; existing != nil {
+			// a later member replaces an earlier one when unpacked
+			klog.V(3).Infof("[%s] %s is stored more than once, the last one counts\n", archiveLabel, file.RelPath)
+		}
+		archiveFiles[key] = file
+		return nil
+	})
+	if err != nil {
+		klog.Errorf("walkArchive(%s) failed. Err: %v\n", archivePath, err)
+		return err
+	}
+	dirFiles, err := d.walkTree(dirLabel, dirPath)
+	if err != nil {
+		klog.Errorf("walkTree(%s) failed. Err: %v\n", dirPath, err)
+		return err
+	}
+
+	keys := make([]string, 0, len(archiveFiles)+len(dirFiles))
+	for key := range archiveFiles {
+		keys = append(keys, key)
+	}
+	for key := range dirFiles {
+		if archiveFiles[key] == nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	// pair them up, members of the same size but another mod time need their hash
+	diffs := make([]*DiffCompare, 0)
+	onlyDir := make([]string, 0)
+	hashes := make(map[string]*DiffCompare)
+	for _, key := range keys {
+		archiveFile, dirFile := archiveFiles[key], dirFiles[key]
+		relPath := key
+		if archiveFile != nil {
+			relPath = archiveFile.RelPath
+		} else {
+			relPath = dirFile.RelPath
+		}
+		if rule := d.matchRule(relPath); rule != nil && rule.Direction == RuleIgnore {
+			continue
+		}
+		if d.filterOut([]*DiffFile{archiveFile, dirFile}, []string{archiveLabel, dirLabel}) {
+			continue
+		}
+
+		diff := &DiffCompare{Direction: toDir}
+		if archiveLabel == "SRC" {
+			diff.SrcFile, diff.DstFile = archiveFile, dirFile
+		} else {
+			diff.SrcFile, diff.DstFile = dirFile, archiveFile
+		}
+		switch {
+		case dirFile == nil:
+			diffs = append(diffs, diff)
+		case archiveFile == nil:
+			onlyDir = append(onlyDir, relPath)
+		case (*archiveFile.Attr).Size() != (*dirFile.Attr).Size():
+			if d.compareModTime((*archiveFile.Attr).ModTime(), (*dirFile.Attr).ModTime()) < 0 {
+				diff.Direction = toArchive
+			}
+			diffs = append(diffs, diff)
+		case d.compareModTime((*archiveFile.Attr).ModTime(), (*dirFile.Attr).ModTime()) != 0:
+			hashes[archiveFile.RelPath] = diff
+		}
+	}
+
+	if len(hashes) > 0 {
+		err = d.walkArchive(archivePath, format, func(file *DiffFile, open func() (io.ReadCloser, error)) error {
+			diff := hashes[file.RelPath]
+			if diff == nil {
+				return nil
+			}
+			archiveFile, dirFile := diff.SrcFile, diff.DstFile
+			if archiveLabel == "DST" {
+				archiveFile, dirFile = diff.DstFile, diff.SrcFile
+			}
+			if !sameMember(archiveFile, file) {
+				// an earlier copy of a member stored more than once
+				return nil
+			}
+			delete(hashes, file.RelPath)
+
+			archiveHash, err := d.hashMember(open)
+			if err == nil {
+				archiveFile.Hash = archiveHash
+				_, err = d.fileHash(dirFile)
+			}
+			if err != nil {
+				klog.Errorf("Error calculating hash(%s, %s)\n", archiveFile.Path, dirFile.Path)
+				return d.fileError("hash", file.RelPath, err)
+			}
+			if archiveFile.Hash == dirFile.Hash {
+				return nil
+			}
+			if d.compareModTime((*archiveFile.Attr).ModTime(), (*dirFile.Attr).ModTime()) < 0 {
+				diff.Direction = toArchive
+			}
+			diffs = append(diffs, diff)
+			return nil
+		})
+		if err != nil {
+			klog.Errorf("walkArchive(%s) failed. Err: %v\n", archivePath, err)
+			return err
+		}
+		sort.Slice(diffs, func(a, b int) bool {
+			return diffRelPath(diffs[a]) < diffRelPath(diffs[b])
+		})
+	}
+
+	// the limits and the free space are checked against what would be extracted
+	if d.options.Extract {
+		d.srcCount, d.dstCount = len(archiveFiles), len(dirFiles)
+		if archiveLabel == "DST" {
+			d.srcCount, d.dstCount = d.dstCount, d.srcCount
+		}
+		planned := make([]*DiffCompare, 0, len(diffs))
+		for _, diff := range diffs {
+			if diff.Direction == toDir {
+				planned = append(planned, diff)
+			}
+		}
+		err = d.checkSafety(planned)
+		if err != nil {
+			klog.Errorf("checkSafety failed. Err: %v\n", err)
+			return err
+		}
+		err = d.checkSpace(planned)
+		if err != nil {
+			klog.Errorf("checkSpace failed. Err: %v\n", err)
+			return err
+		}
+	}
+
+	// report, and extract what the archive has newer
+	extract := make(map[string]*DiffCompare)
+	added, changed, newer := make([]string, 0), make([]string, 0), make([]string, 0)
+	for _, diff := range diffs {
+		relPath := diffRelPath(diff)
+		archiveFile, dirFile := diff.SrcFile, diff.DstFile
+		if archiveLabel == "DST" {
+			archiveFile, dirFile = diff.DstFile, diff.SrcFile
+		}
+
+		reason := "Destination file does not exist"
+		switch {
+		case diff.Direction == toArchive:
+			klog.Infof("[%s] Newer: %s\n", dirLabel, relPath)
+			klog.Infof("\tThe %s file is newer than the archive member, kept\n", strings.ToLower(dirLabel))
+			klog.Infof("\n")
+			newer = append(newer, relPath)
+			continue
+		case dirFile == nil:
+			added = append(added, relPath)
+		case archiveFile.Hash != "":
+			reason = fmt.Sprintf("Hash mismatch: %s -> %s", archiveFile.Hash, dirFile.Hash)
+			changed = append(changed, relPath)
+		default:
+			reason = fmt.Sprintf("Size mismatch: %d -> %d", (*archiveFile.Attr).Size(), (*dirFile.Attr).Size())
+			changed = append(changed, relPath)
+		}
+
+		if d.options.Extract && !d.options.DryRun {
+			klog.Infof("%s Extracting... %s\n", label, relPath)
+		} else {
+			klog.Infof("%s Diff: %s\n", label, relPath)
+		}
+		klog.Infof("\t%s\n", reason)
+		klog.Infof("\n")
+		extract[archiveFile.RelPath] = diff
+	}
+
+	extracted := make([]string, 0)
+	if d.options.Extract && len(extract) > 0 {
+		err = d.walkArchive(archivePath, format, func(file *DiffFile, open func() (io.ReadCloser, error)) error {
+			diff := extract[file.RelPath]
+			if diff == nil {
+				return nil
+			}
+			archiveFile, dirFile := diff.SrcFile, diff.DstFile
+			if archiveLabel == "DST" {
+				archiveFile, dirFile = diff.DstFile, diff.SrcFile
+			}
+			if !sameMember(archiveFile, file) {
+				return nil
+			}
+			delete(extract, file.RelPath)
+
+			target := filepath.Join(dirPath, file.RelPath)
+			if dirFile != nil {
+				target = dirFile.Path
+			}
+			err := d.extractMember(file, open, target)
+			if err != nil {
+				klog.Errorf("extractMember(%s, %s) failed. Err: %v\n", file.Path, target, err)
+				return d.fileError("extract", file.RelPath, err)
+			}
+			extracted = append(extracted, fmt.Sprintf("%s Extracted %s", label, file.RelPath))
+			return nil
+		})
+		if err != nil {
+			klog.Errorf("walkArchive(%s) failed. Err: %v\n", archivePath, err)
+			return err
+		}
+	}
+
+	d.reportArchive(dirLabel, added, changed, newer, onlyDir)
+	if !d.options.DryRun && len(extracted) > 0 {
+		klog.Infof("\n\n")
+		klog.Infof("Extracted files:\n")
+		for _, line := range extracted {
+			klog.Infof("%s\n", line)
+		}
+	}
+	if len(d.collisions) > 0 {
+		klog.Infof("\n\n")
+		klog.Infof("Name collisions (skipped):\n")
+		for _, relPath := range d.collisions {
+			klog.Infof("%s\n", relPath)
+		}
+	}
+	d.reportFiltered()
+
+	return d.partialFailure()
+}
+
+// sameMember tells the listed member apart from earlier copies stored under its name
+func sameMember(listed, file *DiffFile) bool {
+	return (*listed.Attr).Size() == (*file.Attr).Size() && (*listed.Attr).ModTime().Equal((*file.Attr).ModTime())
+}
+
+func (d *Diff) reportArchive(dirLabel string, added, changed, newer, onlyDir []string) {
+	sections := []struct {
+		title string
+		paths []string
+	}{
+		{"New in the archive:", added},
+		{"Changed in the archive:", changed},
+		{fmt.Sprintf("Newer in %s (kept):", strings.ToLower(dirLabel)), newer},
+		{fmt.Sprintf("Only in %s:", strings.ToLower(dirLabel)), onlyDir},
+	}
+	for _, section := range sections {
+		if len(section.paths) == 0 {
+			continue
+		}
+		klog.Infof("\n\n")
+		klog.Infof("%s\n", section.title)
+		for _, relPath := range section.paths {
+			klog.Infof("%s\n", relPath)
+		}
+	}
+}
+
+// hashMember streams a member through the same hash as getHash
+func (d *Diff) hashMember(open func() (io.ReadCloser, error)) (string, error) {
+	d.throttle.readFile()
+	rc, err := open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	sum, err := hashReader(rc)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(sum), nil
+}
+
+// extractMember writes a member to target with its mode and mod time
+func (d *Diff) extractMember(file *DiffFile, open func() (io.ReadCloser, error), target string) error {
+	if d.options.DryRun {
+		klog.V(3).Infof("DryRun: extract(%s, %s)\n", file.Path, target)
+		return nil
+	}
+
+	err := d.buildDir(target)
+	if err != nil {
+		return err
+	}
+	d.throttle.writeFile()
+	rc, err := open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	destination, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	nBytes, err := io.Copy(d.throttle.writer(destination), io.TeeReader(rc, hash))
+	if errClose := destination.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return err
+	}
+	info := *file.Attr
+	if nBytes != info.Size() {
+		return fmt.Errorf("extract byte size mismatch. member: %d != file: %d", info.Size(), nBytes)
+	}
+
+	if runtime.GOOS != "windows" {
+		err = os.Chmod(target, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Chtimes(target, info.ModTime(), info.ModTime())
+	if err != nil {
+		return err
+	}
+
+	if d.options.Verify {
+		written, err := d.getHash(target)
+		if err != nil {
+			return err
+		}
+		if written != base64.URLEncoding.EncodeToString(hash.Sum(nil)) {
+			return fmt.Errorf("%w: %s", ErrVerifyMismatch, target)
+		}
+	}
+	return nil
+}
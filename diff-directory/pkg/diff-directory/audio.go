@@ -0,0 +1,386 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	klog "k8s.io/klog/v2"
+)
+
+/*
+Audio aware comparison
+
+Retagging a song changes the hash of the whole file. With Audio, music files whose
+hashes differ are hashed again over their audio payload only: MP3 without its ID3v2,
+ID3v1 and APE tags, FLAC without its metadata blocks and M4A by its mdat atoms. A
+difference is then tags-only when the payloads match and audio-changed when they don't.
+With SyncTags a tags-only difference is synced by writing the tags, the audio already on
+the target is kept: in place when the tags take the same room, otherwise by rebuilding the
+file around the audio the target already has.
+*/
+
+var audioLayouts = map[string]func(f io.ReaderAt, size int64) ([]audioRange, bool){
+	".mp3":  mp3Layout,
+	".flac": flacLayout,
+	".m4a":  m4aLayout,
+	".m4b":  m4aLayout,
+}
+
+func (d *Diff) audioAware() bool {
+	return (d.options.Audio || d.options.SyncTags) && d.crypt == nil
+}
+
+/*
+classifyAudio tells a tags-only change from an audio change for two music files whose
+hashes differ, empty when they aren't music or their layout isn't recognized.
+*/
+func (d *Diff) classifyAudio(src, dst *DiffFile) string {
+	if !d.audioAware() || audioLayouts[strings.ToLower(filepath.Ext(src.RelPath))] == nil {
+		return ""
+	}
+
+	srcHash, err := d.audioHash(src)
+	if err != nil {
+		klog.V(3).Infof("[AUDIO] %s: %v\n", src.Path, err)
+		return ""
+	}
+	dstHash, err := d.audioHash(dst)
+	if err != nil {
+		klog.V(3).Infof("[AUDIO] %s: %v\n", dst.Path, err)
+		return ""
+	}
+
+	change := AudioChanged
+	if srcHash == dstHash {
+		change = AudioTagsOnly
+	}
+	klog.V(3).Infof("[AUDIO] %s is %s\n", src.RelPath, change)
+	d.audioChanges[change]++
+	return change
+}
+
+// audioHash hashes the audio payload of a music file
+func (d *Diff) audioHash(file *DiffFile) (string, error) {
+	if file.AudioHash != "" {
+		return file.AudioHash, nil
+	}
+
+	d.throttle.readFile()
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	ranges, err := audioRanges(f, file.Path)
+	if err != nil {
+		return "", err
+	}
+	readers := make([]io.Reader, 0, len(ranges))
+	for _, r := range ranges {
+		readers = append(readers, io.NewSectionReader(f, r.start, r.end-r.start))
+	}
+	sum, err := hashReaderWith(d.throttle.reader(io.MultiReader(readers...)), sha256.New())
+	if err != nil {
+		return "", err
+	}
+
+	file.AudioHash = base64.URLEncoding.EncodeToString(sum)
+	return file.AudioHash, nil
+}
+
+// audioRanges returns where the audio payload of an open music file is
+func audioRanges(f *os.File, path string) ([]audioRange, error) {
+	layout := audioLayouts[strings.ToLower(filepath.Ext(path))]
+	if layout == nil {
+		return nil, ErrAudioUnknownLayout
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	ranges, ok := layout(f, info.Size())
+	if !ok || len(ranges) == 0 {
+		return nil, ErrAudioUnknownLayout
+	}
+	return ranges, nil
+}
+
+// readAt reads n bytes at offset, nil when the file is too short
+func readAt(f io.ReaderAt, offset int64, n int) []byte {
+	if offset < 0 {
+		return nil
+	}
+	buf := make([]byte, n)
+	if _, err := f.ReadAt(buf, offset); err != nil {
+		return nil
+	}
+	return buf
+}
+
+// id3v2Size returns the size of the ID3v2 tag at offset, 0 when there is none
+func id3v2Size(f io.ReaderAt, offset int64) int64 {
+	header := readAt(f, offset, 10)
+	if header == nil || !bytes.Equal(header[:3], []byte("ID3")) {
+		return 0
+	}
+	// a syncsafe integer, 7 bits per byte
+	size := int64(header[6]&0x7f)<<21 | int64(header[7]&0x7f)<<14 | int64(header[8]&0x7f)<<7 | int64(header[9]&0x7f)
+	size += 10
+	if header[5]&0x10 != 0 {
+		size += 10 // footer
+	}
+	return size
+}
+
+// skipID3v2 skips the ID3v2 tags at the start of a file, there can be more than one
+func skipID3v2(f io.ReaderAt, size int64) int64 {
+	start := int64(0)
+	for start < size {
+		n := id3v2Size(f, start)
+		if n == 0 {
+			break
+		}
+		start += n
+	}
+	return start
+}
+
+// trimTrailingTags strips the ID3v1, enhanced ID3v1 and APEv2 tags from the end
+func trimTrailingTags(f io.ReaderAt, start, end int64) int64 {
+	for {
+		switch {
+		case end-start >= 128 && bytes.Equal(readAt(f, end-128, 3), []byte("TAG")):
+			end -= 128
+			if end-start >= 227 && bytes.Equal(readAt(f, end-227, 4), []byte("TAG+")) {
+				end -= 227
+			}
+		case end-start >= 32 && bytes.Equal(readAt(f, end-32, 8), []byte("APETAGEX")):
+			footer := readAt(f, end-32, 32)
+			// the tag size counts the items and the footer, the header is extra
+			size := int64(binary.LittleEndian.Uint32(footer[12:16]))
+			if binary.LittleEndian.Uint32(footer[20:24])&(1<<31) != 0 {
+				size += 32
+			}
+			if size < 32 || size > end-start {
+				return end
+			}
+			end -= size
+		default:
+			return end
+		}
+	}
+}
+
+func mp3Layout(f io.ReaderAt, size int64) ([]audioRange, bool) {
+	start := skipID3v2(f, size)
+	end := trimTrailingTags(f, start, size)
+	if end <= start {
+		return nil, false
+	}
+	// every MPEG audio frame starts with 11 set sync bits
+	sync := readAt(f, start, 2)
+	if sync == nil || sync[0] != 0xff || sync[1]&0xe0 != 0xe0 {
+		return nil, false
+	}
+	return []audioRange{{start: start, end: end}}, true
+}
+
+func flacLayout(f io.ReaderAt, size int64) ([]audioRange, bool) {
+	start := skipID3v2(f, size)
+	if !bytes.Equal(readAt(f, start, 4), []byte("fLaC")) {
+		return nil, false
+	}
+	offset := start + 4
+	for {
+		header := readAt(f, offset, 4)
+		if header == nil {
+			return nil, false
+		}
+		offset += 4 + (int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3]))
+		if header[0]&0x80 != 0 {
+			break // the last metadata block
+		}
+	}
+
+	end := trimTrailingTags(f, offset, size)
+	if end <= offset {
+		return nil, false
+	}
+	return []audioRange{{start: offset, end: end}}, true
+}
+
+func m4aLayout(f io.ReaderAt, size int64) ([]audioRange, bool) {
+	ranges := make([]audioRange, 0, 1)
+	offset := int64(0)
+	for offset+8 <= size {
+		header := readAt(f, offset, 8)
+		if header == nil {
+			return nil, false
+		}
+		atomSize := int64(binary.BigEndian.Uint32(header[:4]))
+		headerSize := int64(8)
+		switch atomSize {
+		case 0:
+			atomSize = size - offset // runs to the end of the file
+		case 1:
+			large := readAt(f, offset+8, 8)
+			if large == nil {
+				return nil, false
+			}
+			atomSize = int64(binary.BigEndian.Uint64(large))
+			headerSize = 16
+		}
+		if atomSize < headerSize || atomSize > size-offset {
+			return nil, false
+		}
+		if string(header[4:8]) == "mdat" {
+			ranges = append(ranges, audioRange{start: offset + headerSize, end: offset + atomSize})
+		}
+		offset += atomSize
+	}
+	return ranges, len(ranges) > 0
+}
+
+/*
+syncTags brings the tags of to in line with from when their audio is the same, falling
+back to a full copy when the layouts don't match up.
+*/
+func (d *Diff) syncTags(from, to string) error {
+	if d.options.DryRun {
+		klog.V(3).Infof("DryRun: syncTags(%s, %s)\n", from, to)
+		return nil
+	}
+
+	source, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	target, err := os.OpenFile(to, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	sourceInfo, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	targetInfo, err := target.Stat()
+	if err != nil {
+		return err
+	}
+	sourceRanges, errSource := audioRanges(source, from)
+	targetRanges, errTarget := audioRanges(target, to)
+	if errSource != nil || errTarget != nil || len(sourceRanges) != len(targetRanges) {
+		klog.V(3).Infof("[AUDIO] %s layouts differ, copying all of it\n", to)
+		target.Close()
+		_, err = d.copy(from, to)
+		return err
+	}
+	inPlace := sourceInfo.Size() == targetInfo.Size()
+	for i := range sourceRanges {
+		if sourceRanges[i].end-sourceRanges[i].start != targetRanges[i].end-targetRanges[i].start {
+			klog.V(3).Infof("[AUDIO] %s layouts differ, copying all of it\n", to)
+			target.Close()
+			_, err = d.copy(from, to)
+			return err
+		}
+		inPlace = inPlace && sourceRanges[i] == targetRanges[i]
+	}
+	d.throttle.writeFile()
+
+	// the tags are what lies around the audio
+	tags := make([]audioRange, 0, len(sourceRanges)+1)
+	offset := int64(0)
+	for _, r := range sourceRanges {
+		tags = append(tags, audioRange{start: offset, end: r.start})
+		offset = r.end
+	}
+	tags = append(tags, audioRange{start: offset, end: sourceInfo.Size()})
+
+	if inPlace {
+		for _, tag := range tags {
+			_, err = io.Copy(d.throttle.writer(io.NewOffsetWriter(target, tag.start)), io.NewSectionReader(source, tag.start, tag.end-tag.start))
+			if err != nil {
+				return err
+			}
+		}
+		klog.V(4).Infof("[AUDIO] %s tags written in place\n", to)
+		d.audioChanges[audioTagsSynced]++
+		return target.Close()
+	}
+
+	// rebuild next to the target and swap it in
+	temp := filepath.Join(filepath.Dir(to), ".diff-directory-tags-"+filepath.Base(to))
+	rebuilt, err := os.OpenFile(temp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, targetInfo.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	// the umask may have taken bits away, the rebuilt file keeps the mode of the target
+	err = rebuilt.Chmod(targetInfo.Mode().Perm())
+	if err != nil {
+		rebuilt.Close()
+		return err
+	}
+	defer os.Remove(temp)
+	w := d.throttle.writer(rebuilt)
+	for i, tag := range tags {
+		_, err = io.Copy(w, io.NewSectionReader(source, tag.start, tag.end-tag.start))
+		if err == nil && i < len(targetRanges) {
+			r := targetRanges[i]
+			_, err = io.Copy(w, io.NewSectionReader(target, r.start, r.end-r.start))
+		}
+		if err != nil {
+			rebuilt.Close()
+			return err
+		}
+	}
+	err = rebuilt.Close()
+	if err != nil {
+		return err
+	}
+	target.Close()
+	err = os.Rename(temp, to)
+	if err != nil {
+		return err
+	}
+	klog.V(4).Infof("[AUDIO] %s rebuilt around its audio\n", to)
+	d.audioChanges[audioTagsSynced]++
+	return nil
+}
+
+// tagsOnly reports a difference synced by writing just the tags
+func (d *Diff) tagsOnly(diff *DiffCompare) bool {
+	return d.options.SyncTags && diff.Audio == AudioTagsOnly
+}
+
+func (d *Diff) audioSummary() string {
+	if len(d.audioChanges) == 0 {
+		return ""
+	}
+	summary := fmt.Sprintf("%s %d, %s %d", AudioTagsOnly, d.audioChanges[AudioTagsOnly], AudioChanged, d.audioChanges[AudioChanged])
+	if synced := d.audioChanges[audioTagsSynced]; synced > 0 {
+		summary += fmt.Sprintf(", tags synced %d", synced)
+	}
+	return summary
+}
+
+func (d *Diff) reportAudio() {
+	if summary := d.audioSummary(); summary != "" {
+		klog.Infof("\n\n")
+		klog.Infof("Audio changes: %s\n", summary)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// join concatenates the parts of a test file
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// id3v2Tag is an ID3v2 tag with size bytes after its header
+func id3v2Tag(size int) []byte {
+	header := []byte{'I', 'D', '3', 4, 0, 0, byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+	return append(header, make([]byte, size)...)
+}
+
+// apeTag is an APEv2 tag with items bytes of items and a footer
+func apeTag(items int) []byte {
+	footer := make([]byte, 32)
+	copy(footer, "APETAGEX")
+	binary.LittleEndian.PutUint32(footer[8:], 2000)
+	binary.LittleEndian.PutUint32(footer[12:], uint32(items+32))
+	return append(make([]byte, items), footer...)
+}
+
+// flacBlock is a metadata block with size bytes of data
+func flacBlock(last bool, size int) []byte {
+	header := []byte{0, byte(size >> 16), byte(size >> 8), byte(size)}
+	if last {
+		header[0] |= 0x80
+	}
+	return append(header, make([]byte, size)...)
+}
+
+// atom is an M4A atom around data, with a 64-bit size when large is set
+func atom(kind string, data []byte, large bool) []byte {
+	if large {
+		header := make([]byte, 16)
+		binary.BigEndian.PutUint32(header, 1)
+		copy(header[4:], kind)
+		binary.BigEndian.PutUint64(header[8:], uint64(16+len(data)))
+		return append(header, data...)
+	}
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(8+len(data)))
+	copy(header[4:], kind)
+	return append(header, data...)
+}
+
+// atomHeader is an M4A atom header claiming size bytes
+func atomHeader(kind string, size uint32) []byte {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, size)
+	copy(header[4:], kind)
+	return header
+}
+
+func TestMp3Layout(t *testing.T) {
+	frames := join([]byte{0xff, 0xfb, 0x90, 0x64}, make([]byte, 96))
+	id3v1 := append([]byte("TAG"), make([]byte, 125)...)
+
+	tests := []struct {
+		name   string
+		data   []byte
+		want   []audioRange
+		wantOK bool
+	}{
+		{name: "frames only", data: frames, want: []audioRange{{0, 100}}, wantOK: true},
+		{name: "id3v2", data: join(id3v2Tag(20), frames), want: []audioRange{{30, 130}}, wantOK: true},
+		{name: "two id3v2 tags", data: join(id3v2Tag(20), id3v2Tag(5), frames), want: []audioRange{{45, 145}}, wantOK: true},
+		{name: "id3v1", data: join(frames, id3v1), want: []audioRange{{0, 100}}, wantOK: true},
+		{name: "ape and id3v1", data: join(id3v2Tag(0), frames, apeTag(16), id3v1), want: []audioRange{{10, 110}}, wantOK: true},
+		{name: "empty", data: []byte{}},
+		{name: "id3v2 only", data: id3v2Tag(20)},
+		{name: "id3v2 past the end", data: join(id3v2Tag(1000)[:10], frames)},
+		{name: "truncated id3v2 header", data: []byte("ID3\x04\x00")},
+		{name: "no frame sync", data: join(id3v2Tag(4), make([]byte, 100))},
+		{name: "id3v1 only", data: id3v1},
+		{name: "ape size past the start", data: join(frames[:4], apeTag(0)[:12], []byte{0xff, 0xff, 0xff, 0x7f}, apeTag(0)[16:]), want: []audioRange{{0, 36}}, wantOK: true},
+		{name: "ape size too small", data: join(frames, apeTag(0)[:12], []byte{4, 0, 0, 0}, apeTag(0)[16:]), want: []audioRange{{0, 132}}, wantOK: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := mp3Layout(bytes.NewReader(tt.data), int64(len(tt.data)))
+			if ok != tt.wantOK || (ok && !reflect.DeepEqual(got, tt.want)) {
+				t.Errorf("mp3Layout() = %v, %t, want %v, %t", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestFlacLayout(t *testing.T) {
+	audio := make([]byte, 50)
+	id3v1 := append([]byte("TAG"), make([]byte, 125)...)
+
+	tests := []struct {
+		name   string
+		data   []byte
+		want   []audioRange
+		wantOK bool
+	}{
+		{name: "one block", data: join([]byte("fLaC"), flacBlock(true, 34), audio), want: []audioRange{{42, 92}}, wantOK: true},
+		{name: "two blocks", data: join([]byte("fLaC"), flacBlock(false, 34), flacBlock(true, 10), audio), want: []audioRange{{56, 106}}, wantOK: true},
+		{name: "id3v2 and id3v1", data: join(id3v2Tag(6), []byte("fLaC"), flacBlock(true, 34), audio, id3v1), want: []audioRange{{58, 108}}, wantOK: true},
+		{name: "empty", data: []byte{}},
+		{name: "no marker", data: join([]byte("fLaX"), flacBlock(true, 34), audio)},
+		{name: "no last block", data: join([]byte("fLaC"), flacBlock(false, 34), audio[:2])},
+		{name: "block past the end", data: join([]byte("fLaC"), flacBlock(true, 34)[:4], audio[:10])},
+		{name: "no audio", data: join([]byte("fLaC"), flacBlock(true, 34))},
+		{name: "truncated block header", data: join([]byte("fLaC"), []byte{0x80, 0})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := flacLayout(bytes.NewReader(tt.data), int64(len(tt.data)))
+			if ok != tt.wantOK || (ok && !reflect.DeepEqual(got, tt.want)) {
+				t.Errorf("flacLayout() = %v, %t, want %v, %t", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestM4aLayout(t *testing.T) {
+	ftyp := atom("ftyp", []byte("M4A \x00\x00\x00\x00"), false)
+	moov := atom("moov", make([]byte, 20), false)
+	audio := make([]byte, 40)
+
+	tests := []struct {
+		name   string
+		data   []byte
+		want   []audioRange
+		wantOK bool
+	}{
+		{name: "mdat", data: join(ftyp, moov, atom("mdat", audio, false)), want: []audioRange{{52, 92}}, wantOK: true},
+		{name: "large mdat", data: join(ftyp, atom("mdat", audio, true), moov), want: []audioRange{{32, 72}}, wantOK: true},
+		{name: "two mdat", data: join(ftyp, atom("mdat", audio[:10], false), atom("mdat", audio[:5], false)), want: []audioRange{{24, 34}, {42, 47}}, wantOK: true},
+		{name: "mdat to the end", data: join(ftyp, atomHeader("mdat", 0), audio), want: []audioRange{{24, 64}}, wantOK: true},
+		{name: "trailing bytes", data: join(ftyp, atom("mdat", audio, false), []byte{1, 2, 3}), want: []audioRange{{24, 64}}, wantOK: true},
+		{name: "empty", data: []byte{}},
+		{name: "no mdat", data: join(ftyp, moov)},
+		{name: "atom past the end", data: join(ftyp, atomHeader("mdat", 100), audio)},
+		{name: "atom smaller than its header", data: join(ftyp, atomHeader("mdat", 4), audio)},
+		{name: "truncated large size", data: join(ftyp, atomHeader("mdat", 1), []byte{0, 0})},
+		{name: "large size smaller than its header", data: join(ftyp, atomHeader("mdat", 1), make([]byte, 7), []byte{8}, audio)},
+		{name: "large size past the end", data: join(ftyp, atomHeader("mdat", 1), []byte{0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, audio)},
+		{name: "negative large size", data: join(ftyp, atomHeader("mdat", 1), bytes.Repeat([]byte{0xff}, 8), audio)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := m4aLayout(bytes.NewReader(tt.data), int64(len(tt.data)))
+			if ok != tt.wantOK || (ok && !reflect.DeepEqual(got, tt.want)) {
+				t.Errorf("m4aLayout() = %v, %t, want %v, %t", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
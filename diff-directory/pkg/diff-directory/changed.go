@@ -0,0 +1,188 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	klog "k8s.io/klog/v2"
+)
+
+/*
+Files changing during the sync
+
+A file can be written to between the comparison and its copy, or while it is being
+copied. The source is stat'ed before and after every copy: a file that changed after
+the comparison is hashed again, and copied as it is now, and one that changed while it
+was being copied is copied again. A file that keeps changing is deferred to the next run
+and its torn copy removed, so the next run copies it fresh instead of mistaking the torn
+copy for the newer version. A target that changed since the comparison is deferred as
+well, it is left alone so the next run compares the new version instead of overwriting it.
+*/
+
+/*
+copyChecked runs copyFn to copy from to the path to, verifying the result when Verify
+is set. planned is the target as it was compared, nil when it didn't exist. Only a plain
+source (watch) and a plain target can be stat'ed, encrypted ones are only written by runs
+holding the lock. Returns ErrFileChanged when the target changed since the comparison or
+the source kept changing.
+*/
+func (d *Diff) copyChecked(from, planned *DiffFile, to string, watch, encrypted bool, copyFn func() error) error {
+	if d.options.DryRun {
+		return copyFn()
+	}
+	if !encrypted {
+		if change := targetChange(planned, to); change != "" {
+			klog.Infof("[CHANGED] %s changed on the target since the comparison (%s), deferring it to the next run\n", from.RelPath, change)
+			return fmt.Errorf("%w: %s", ErrFileChanged, from.RelPath)
+		}
+	}
+	if !watch {
+		err := copyFn()
+		if err == nil && d.options.Verify {
+			err = d.verifyCopy(from, to, encrypted)
+		}
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		before, err := os.Stat(from.Path)
+		if err != nil {
+			klog.Errorf("os.Stat(%s) failed. Err: %v\n", from.Path, err)
+			return err
+		}
+		if change := statChange(*from.Attr, before); change != "" {
+			from.Attr = &before
+			same, err := d.samePlannedContent(from)
+			if err != nil {
+				klog.Errorf("getHash(%s) failed. Err: %v\n", from.Path, err)
+				return err
+			}
+			if same {
+				klog.Infof("[CHANGED] %s was touched since the comparison (%s), its content is the same\n", from.RelPath, change)
+			} else {
+				klog.Infof("[CHANGED] %s changed since the comparison (%s), copying it as it is now\n", from.RelPath, change)
+			}
+		}
+
+		errCopy := copyFn()
+		after, err := os.Stat(from.Path)
+		if err != nil {
+			klog.Errorf("os.Stat(%s) failed. Err: %v\n", from.Path, err)
+			return err
+		}
+		change := statChange(before, after)
+		if change == "" && errCopy != nil {
+			return errCopy
+		}
+		if change == "" && d.options.Verify {
+			errCopy = d.verifyCopy(from, to, encrypted)
+			if errCopy != nil {
+				// the content changed without touching size or mod time
+				after, err = os.Stat(from.Path)
+				if err != nil || statChange(before, after) == "" {
+					return errCopy
+				}
+				change = statChange(before, after)
+			}
+		}
+		if change == "" {
+			return nil
+		}
+
+		if attempt >= copyRetries {
+			klog.Infof("[CHANGED] %s kept changing while it was copied (%s), deferring it to the next run\n", from.RelPath, change)
+			d.removeTorn(to, encrypted)
+			return fmt.Errorf("%w: %s", ErrFileChanged, from.RelPath)
+		}
+		klog.Infof("[CHANGED] %s changed while it was copied (%s), copying it again\n", from.RelPath, change)
+		from.Attr = &after
+		from.Hash, from.SumFormat, from.Sum = "", "", ""
+		time.Sleep(copyRetryDelay)
+	}
+}
+
+/*
+samePlannedContent hashes a source that changed since the comparison again, telling a
+file that was only touched from one that was rewritten. Without a planned hash there is
+nothing to compare and it counts as rewritten.
+*/
+func (d *Diff) samePlannedContent(from *DiffFile) (bool, error) {
+	if from.Hash == "" {
+		from.SumFormat, from.Sum = "", ""
+		return false, nil
+	}
+	hash, err := d.getHash(from.Path)
+	if err != nil {
+		return false, err
+	}
+	if hash == from.Hash {
+		return true, nil
+	}
+	from.Hash, from.SumFormat, from.Sum = hash, "", ""
+	return false, nil
+}
+
+// targetChange describes how the target changed since the comparison, empty when it didn't
+func targetChange(planned *DiffFile, to string) string {
+	current, err := os.Lstat(to)
+	switch {
+	case planned == nil && err == nil:
+		return "created"
+	case planned == nil:
+		return ""
+	case err != nil:
+		return "removed"
+	}
+	return statChange(*planned.Attr, current)
+}
+
+// statChange describes how a file changed between two stats, empty when it didn't
+func statChange(planned, current os.FileInfo) string {
+	switch {
+	case planned.Size() != current.Size():
+		return fmt.Sprintf("size %d -> %d", planned.Size(), current.Size())
+	case !planned.ModTime().Equal(current.ModTime()):
+		return fmt.Sprintf("mod time %s -> %s", planned.ModTime().Format("2006-01-02T15:04:05.000"), current.ModTime().Format("2006-01-02T15:04:05.000"))
+	}
+	return ""
+}
+
+// removeTorn removes a copy that doesn't match any version of its source
+func (d *Diff) removeTorn(path string, encrypted bool) {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		klog.Errorf("Remove(%s) failed. Err: %v\n", path, err)
+	}
+	if !encrypted {
+		return
+	}
+
+	name, err := filepath.Rel(d.options.RootDstPath, path)
+	if err != nil {
+		return
+	}
+	for relPath, entry := range d.crypt.manifest.Files {
+		if entry.Name == name {
+			delete(d.crypt.manifest.Files, relPath)
+			d.crypt.dirty = true
+		}
+	}
+}
+
+// reportChanged lists the files deferred because they kept changing
+func (d *Diff) reportChanged() {
+	if len(d.changed) == 0 {
+		return
+	}
+	klog.Infof("\n\n")
+	klog.Infof("Changed during the sync (deferred to the next run):\n")
+	for _, relPath := range d.changed {
+		klog.Infof("%s\n", relPath)
+	}
+}
@@ -0,0 +1,432 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"bufio"
+	"crypto/md5"
+	sha256 "crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	klog "k8s.io/klog/v2"
+)
+
+/*
+Checksum sidecar files
+
+These are the files sha256sum, md5sum and the SFV tools read and write. Paths in a
+checksum file are relative to the directory the checksum file lives in so the same
+files work whether they are written once at the root or once per directory.
+*/
+
+type checksumFormat struct {
+	name     string
+	fileName string
+	newHash  func() hash.Hash
+	sfv      bool
+}
+
+var checksumFormats = map[string]*checksumFormat{
+	ChecksumSHA256: {name: ChecksumSHA256, fileName: "SHA256SUMS", newHash: sha256.New},
+	ChecksumMD5:    {name: ChecksumMD5, fileName: "checksums.md5", newHash: md5.New},
+	ChecksumSFV:    {name: ChecksumSFV, fileName: "checksums.sfv", newHash: func() hash.Hash { return crc32.NewIEEE() }, sfv: true},
+}
+
+var (
+	checksumGNURegex = regexp.MustCompile(`^\\?([0-9a-fA-F]+) [ *](.+)$`)
+	checksumBSDRegex = regexp.MustCompile(`^\\?(SHA256|MD5) \((.+)\) = ([0-9a-fA-F]+)$`)
+	checksumSFVRegex = regexp.MustCompile(`^(.+?)\s+([0-9a-fA-F]{8})$`)
+)
+
+type checksumEntry struct {
+	relPath string // relative to the tree root
+	sum     string
+}
+
+/*
+WriteChecksums hashes src and writes checksum files in the given format, either one at
+the root or one in every directory that contains files. Returns the number of files
+written.
+*/
+func (d *Diff) WriteChecksums(format string, perDir bool) (int, error) {
+	cf := checksumFormats[format]
+	if cf == nil {
+		klog.Errorf("Unknown checksum format: %s\n", format)
+		return 0, ErrChecksumUnknownFormat
+	}
+
+	srcMap, err := d.walkTree("SRC", d.options.RootSrcPath)
+	if err != nil {
+		klog.Errorf("walkTree(%s) Err: %v\n", d.options.RootSrcPath, err)
+		return 0, err
+	}
+
+	// group by the directory the checksum file is written to
+	groups := make(map[string][]string, 0)
+	for key := range srcMap {
+		if isChecksumFile(filepath.Base(key)) {
+			continue
+		}
+		dir := "."
+		if perDir {
+			dir = filepath.Dir(key)
+		}
+		groups[dir] = append(groups[dir], key)
+	}
+
+	written := 0
+	for dir, keys := range groups {
+		sort.Strings(keys)
+
+		var sb strings.Builder
+		if cf.sfv {
+			sb.WriteString("; Generated by diff-directory\n")
+		}
+		for _, key := range keys {
+			sum, err := d.getHashFormat(srcMap[key].Path, cf)
+			if err != nil {
+				klog.Errorf("getHashFormat(%s) failed. Err: %v\n", srcMap[key].Path, err)
+				return written, err
+			}
+
+			name := key
+			if dir != "." {
+				name, _ = filepath.Rel(dir, key)
+			}
+			name = filepath.ToSlash(name)
+			if cf.sfv {
+				sb.WriteString(fmt.Sprintf("%s %s\n", name, sum))
+			} else {
+				sb.WriteString(fmt.Sprintf("%s  %s\n", sum, name))
+			}
+		}
+
+		path := filepath.Join(d.options.RootSrcPath, dir, cf.fileName)
+		if d.options.DryRun {
+			klog.Infof("[CHECKSUM] Diff: %s (%d files)\n", path, len(keys))
+			continue
+		}
+		klog.Infof("[CHECKSUM] Writing... %s (%d files)\n", path, len(keys))
+		err = writeFileAtomic(path, []byte(sb.String()))
+		if err != nil {
+			klog.Errorf("writeFileAtomic(%s) failed. Err: %v\n", path, err)
+			return written, err
+		}
+		written++
+	}
+
+	return written, nil
+}
+
+/*
+CheckChecksums finds every checksum file in src (only the given format when not empty)
+and verifies the files they list.
+*/
+func (d *Diff) CheckChecksums(format string) (*VerifyReport, error) {
+	if format != "" && checksumFormats[format] == nil {
+		klog.Errorf("Unknown checksum format: %s\n", format)
+		return nil, ErrChecksumUnknownFormat
+	}
+
+	srcMap, err := d.walkTree("SRC", d.options.RootSrcPath)
+	if err != nil {
+		klog.Errorf("walkTree(%s) Err: %v\n", d.options.RootSrcPath, err)
+		return nil, err
+	}
+
+	report := &VerifyReport{}
+	found := 0
+	for _, key := range sortedKeys(srcMap) {
+		cf := checksumFormatOf(filepath.Base(key))
+		if cf == nil || (format != "" && cf.name != format) {
+			continue
+		}
+		found++
+
+		checksumFile := srcMap[key]
+		entries, err := d.readChecksums(checksumFile.Path, d.options.RootSrcPath, cf)
+		if err != nil {
+			klog.Errorf("readChecksums(%s) failed. Err: %v\n", checksumFile.Path, err)
+			return report, err
+		}
+		klog.V(3).Infof("[CHECKSUM] %s lists %d files\n", key, len(entries))
+
+		for _, entry := range entries {
+			file := srcMap[entry.relPath]
+			if file == nil {
+				klog.Infof("[CHECKSUM] Missing: %s\n", entry.relPath)
+				report.Missing = append(report.Missing, entry.relPath)
+				continue
+			}
+
+			report.Checked++
+			sum, err := d.getHashFormat(file.Path, cf)
+			if err != nil {
+				klog.Infof("[CHECKSUM] Unreadable: %s. Err: %v\n", entry.relPath, err)
+				report.Corrupt = append(report.Corrupt, entry.relPath)
+				continue
+			}
+			if strings.EqualFold(sum, entry.sum) {
+				klog.V(4).Infof("[CHECKSUM] OK %s\n", entry.relPath)
+				continue
+			}
+
+			// the file was not touched after the checksum was recorded so the content rotted
+			if (*file.Attr).ModTime().Before((*checksumFile.Attr).ModTime()) {
+				klog.Infof("[CHECKSUM] Corrupt: %s\n", entry.relPath)
+				report.Corrupt = append(report.Corrupt, entry.relPath)
+			} else {
+				klog.Infof("[CHECKSUM] Modified: %s\n", entry.relPath)
+				report.Modified = append(report.Modified, entry.relPath)
+			}
+			klog.Infof("\tChecksum mismatch: %s -> %s\n", entry.sum, sum)
+		}
+	}
+
+	if found == 0 {
+		klog.Infof("[CHECKSUM] No checksum files found in %s\n", d.options.RootSrcPath)
+	}
+	return report, report.err()
+}
+
+// trustedSums are the sums of a trusted checksum file by path key
+type trustedSums struct {
+	format *checksumFormat
+	sums   map[string]string
+}
+
+/*
+loadTrustedSums loads a trusted checksum file so the sums it lists can be attached to
+the files of a tree and they don't need to be hashed during the comparison.
+*/
+func (d *Diff) loadTrustedSums(checksumPath, rootPath string, dst bool) (*trustedSums, error) {
+	cf := checksumFormatOf(filepath.Base(checksumPath))
+	if cf == nil {
+		klog.Errorf("Unknown checksum file: %s\n", checksumPath)
+		return nil, ErrChecksumUnknownFormat
+	}
+
+	entries, err := d.readChecksums(checksumPath, rootPath, cf)
+	if err != nil {
+		klog.Errorf("readChecksums(%s) failed. Err: %v\n", checksumPath, err)
+		return nil, err
+	}
+
+	trusted := &trustedSums{
+		format: cf,
+		sums:   make(map[string]string, len(entries)),
+	}
+	for _, entry := range entries {
+		trusted.sums[d.pathKey(entry.relPath, dst)] = entry.sum
+	}
+
+	klog.V(3).Infof("[CHECKSUM] Trusting %d sums from %s\n", len(trusted.sums), checksumPath)
+	return trusted, nil
+}
+
+// apply attaches the trusted sum for key to file, if there is one
+func (t *trustedSums) apply(file *DiffFile, key string) error {
+	if t == nil {
+		return nil
+	}
+	sum, ok := t.sums[key]
+	if !ok {
+		return nil
+	}
+
+	if t.format.name == ChecksumSHA256 {
+		raw, err := hex.DecodeString(sum)
+		if err != nil {
+			return ErrChecksumInvalid
+		}
+		file.Hash = base64.URLEncoding.EncodeToString(raw)
+	} else {
+		file.SumFormat = t.format.name
+		file.Sum = strings.ToLower(sum)
+	}
+	return nil
+}
+
+/*
+contentHashes returns comparable hashes for two files. When either side has a trusted
+sum from a checksum file that format is used, otherwise crypto/sha256. An encrypted dst
+only knows the crypto/sha256 of its plaintext, from the manifest, so other formats are
+ignored there: hashing the ciphertext on disk would never match.
+*/
+func (d *Diff) contentHashes(a, b *DiffFile) (string, string, error) {
+	format := ""
+	if d.crypt == nil {
+		format = a.SumFormat
+		if format == "" {
+			format = b.SumFormat
+		}
+		if format == "" && d.options.Hash != ChecksumSHA256 {
+			format = d.options.Hash
+		}
+	}
+	if format == "" {
+		hashA, err := d.fileHash(a)
+		if err != nil {
+			return "", "", err
+		}
+		hashB, err := d.fileHash(b)
+		if err != nil {
+			return "", "", err
+		}
+		return hashA, hashB, nil
+	}
+
+	sumA, err := d.fileSum(a, format)
+	if err != nil {
+		return "", "", err
+	}
+	sumB, err := d.fileSum(b, format)
+	if err != nil {
+		return "", "", err
+	}
+	return sumA, sumB, nil
+}
+
+// checkHash makes sure the content hash is one of the checksum formats
+func (d *Diff) checkHash() error {
+	if d.options.Hash == "" {
+		return nil
+	}
+	if checksumFormats[d.options.Hash] == nil {
+		klog.Errorf("Unknown hash: %s\n", d.options.Hash)
+		return ErrChecksumUnknownFormat
+	}
+	if d.crypt != nil && d.options.Hash != ChecksumSHA256 {
+		klog.Infof("Encrypted dst files are compared by their crypto/sha256 hash, ignoring hash %s\n", d.options.Hash)
+	}
+	return nil
+}
+
+func (d *Diff) fileSum(file *DiffFile, format string) (string, error) {
+	if file.SumFormat == format && file.Sum != "" {
+		return file.Sum, nil
+	}
+
+	sum, err := d.getHashFormat(file.Path, checksumFormats[format])
+	if err != nil {
+		return "", err
+	}
+	file.SumFormat = format
+	file.Sum = strings.ToLower(sum)
+	return file.Sum, nil
+}
+
+func (d *Diff) getHashFormat(path string, cf *checksumFormat) (string, error) {
+	d.throttle.readFile()
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	sum, err := hashReaderWith(d.throttle.reader(f), cf.newHash())
+	if err != nil {
+		return "", err
+	}
+
+	if cf.sfv {
+		return strings.ToUpper(hex.EncodeToString(sum)), nil
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+// readChecksums parses a checksum file returning paths relative to rootPath
+func (d *Diff) readChecksums(path, rootPath string, cf *checksumFormat) ([]*checksumEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// paths are relative to the checksum file, unless it lives outside the tree
+	baseRel := ""
+	if rel, err := filepath.Rel(rootPath, filepath.Dir(path)); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		baseRel = rel
+	}
+
+	entries := make([]*checksumEntry, 0)
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(strings.TrimSpace(line)) == 0 || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var name, sum string
+		if cf.sfv {
+			matches := checksumSFVRegex.FindStringSubmatch(line)
+			if matches == nil {
+				klog.Errorf("%s:%d is not a valid SFV line\n", path, lineNum)
+				return nil, ErrChecksumInvalid
+			}
+			name, sum = matches[1], matches[2]
+		} else if matches := checksumBSDRegex.FindStringSubmatch(line); matches != nil {
+			name, sum = matches[2], matches[3]
+			if strings.HasPrefix(line, "\\") {
+				name = unescapeChecksumName(name)
+			}
+		} else if matches := checksumGNURegex.FindStringSubmatch(line); matches != nil {
+			sum, name = matches[1], matches[2]
+			if strings.HasPrefix(line, "\\") {
+				name = unescapeChecksumName(name)
+			}
+		} else {
+			klog.Errorf("%s:%d is not a valid checksum line\n", path, lineNum)
+			return nil, ErrChecksumInvalid
+		}
+		if len(sum) != cf.newHash().Size()*2 {
+			klog.Errorf("%s:%d has a checksum of the wrong length\n", path, lineNum)
+			return nil, ErrChecksumInvalid
+		}
+
+		relPath := filepath.Clean(filepath.Join(baseRel, filepath.FromSlash(strings.TrimPrefix(name, "./"))))
+		entries = append(entries, &checksumEntry{
+			relPath: relPath,
+			sum:     sum,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func unescapeChecksumName(name string) string {
+	return strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\r`, "\r").Replace(name)
+}
+
+func checksumFormatOf(filename string) *checksumFormat {
+	lower := strings.ToLower(filename)
+	switch {
+	case lower == "sha256sums" || strings.HasSuffix(lower, ".sha256"):
+		return checksumFormats[ChecksumSHA256]
+	case lower == "md5sums" || strings.HasSuffix(lower, ".md5"):
+		return checksumFormats[ChecksumMD5]
+	case strings.HasSuffix(lower, ".sfv"):
+		return checksumFormats[ChecksumSFV]
+	}
+	return nil
+}
+
+func isChecksumFile(filename string) bool {
+	return checksumFormatOf(filename) != nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"bytes"
+	"crypto/md5"
+	sha256 "crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestContentHashesEncryptedDst(t *testing.T) {
+	dir := t.TempDir()
+	c := testCryptor(1)
+
+	plain := []byte("the same content on both sides")
+	src := filepath.Join(dir, "src.txt")
+	if err := os.WriteFile(src, plain, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var encrypted bytes.Buffer
+	if _, err := c.encryptStream(&encrypted, bytes.NewReader(plain)); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "dst")
+	if err := os.WriteFile(dst, encrypted.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	md5Sum := md5.Sum(plain)
+	shaSum := sha256.Sum256(plain)
+	manifestHash := base64.URLEncoding.EncodeToString(shaSum[:])
+
+	tests := []struct {
+		name    string
+		srcSum  string // a trusted md5 of the src, empty for none
+		dstHash string // the plaintext hash from the manifest
+		hash    string
+		want    bool
+	}{
+		{name: "trusted md5", srcSum: hex.EncodeToString(md5Sum[:]), dstHash: manifestHash, want: true},
+		{name: "trusted md5 is ignored", srcSum: hex.EncodeToString(make([]byte, md5.Size)), dstHash: manifestHash, want: true},
+		{name: "no trusted sum", dstHash: manifestHash, want: true},
+		{name: "hash option", dstHash: manifestHash, hash: ChecksumMD5, want: true},
+		{name: "changed dst", srcSum: hex.EncodeToString(md5Sum[:]), dstHash: base64.URLEncoding.EncodeToString(make([]byte, sha256.Size))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := New(DiffOpts{Hash: tt.hash})
+			d.crypt = c
+
+			srcFile := &DiffFile{Path: src}
+			if tt.srcSum != "" {
+				srcFile.SumFormat = ChecksumMD5
+				srcFile.Sum = tt.srcSum
+			}
+			dstFile := &DiffFile{Path: dst, Hash: tt.dstHash}
+
+			hashA, hashB, err := d.contentHashes(srcFile, dstFile)
+			if err != nil {
+				t.Fatalf("contentHashes() failed. Err: %v", err)
+			}
+			if (hashA == hashB) != tt.want {
+				t.Errorf("contentHashes() = %s, %s, want equal %t", hashA, hashB, tt.want)
+			}
+		})
+	}
+}
+
+func TestContentHashesTrustedSum(t *testing.T) {
+	dir := t.TempDir()
+	plain := []byte("plain content")
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+	for _, path := range []string{a, b} {
+		if err := os.WriteFile(path, plain, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	md5Sum := md5.Sum(plain)
+
+	// without encryption the trusted format is used on both sides
+	d := New(DiffOpts{})
+	hashA, hashB, err := d.contentHashes(&DiffFile{Path: a, SumFormat: ChecksumMD5, Sum: hex.EncodeToString(md5Sum[:])}, &DiffFile{Path: b})
+	if err != nil {
+		t.Fatalf("contentHashes() failed. Err: %v", err)
+	}
+	if hashA != hashB || hashA != hex.EncodeToString(md5Sum[:]) {
+		t.Errorf("contentHashes() = %s, %s, want the md5 %x", hashA, hashB, md5Sum)
+	}
+}
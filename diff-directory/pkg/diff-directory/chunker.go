@@ -0,0 +1,111 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	sha256 "crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math/bits"
+)
+
+// gearTable is the per byte value of the rolling gear hash. It is derived from
+// crypto/sha256 so that chunk boundaries are stable across builds and stores.
+var gearTable [256]uint64
+
+func init() {
+	for i := range gearTable {
+		sum := sha256.Sum256([]byte{byte(i)})
+		gearTable[i] = binary.LittleEndian.Uint64(sum[:8])
+	}
+}
+
+// chunker splits a stream into content-defined chunks using a gear hash. A cut
+// is made when the top bits of the hash are zero so identical content produces
+// identical chunks regardless of where it sits in the file.
+type chunker struct {
+	r     io.Reader
+	buf   []byte
+	start int
+	end   int
+	eof   bool
+
+	min  int
+	max  int
+	mask uint64
+}
+
+func newChunker(r io.Reader, min, avg, max int) *chunker {
+	avgBits := bits.Len64(uint64(avg)) - 1
+	return &chunker{
+		r:    r,
+		buf:  make([]byte, max),
+		min:  min,
+		max:  max,
+		mask: ((uint64(1) << avgBits) - 1) << (64 - avgBits),
+	}
+}
+
+// Next returns the next chunk or io.EOF. The returned slice is only valid
+// until the next call.
+func (c *chunker) Next() ([]byte, error) {
+	err := c.fill()
+	if err != nil {
+		return nil, err
+	}
+	if c.end == c.start {
+		return nil, io.EOF
+	}
+
+	cut := c.cutPoint(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+cut]
+	c.start += cut
+	return chunk, nil
+}
+
+func (c *chunker) fill() error {
+	if c.eof || c.end-c.start >= c.max {
+		return nil
+	}
+
+	if c.start > 0 {
+		copy(c.buf, c.buf[c.start:c.end])
+		c.end -= c.start
+		c.start = 0
+	}
+
+	for c.end < len(c.buf) {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *chunker) cutPoint(data []byte) int {
+	if len(data) <= c.min {
+		return len(data)
+	}
+
+	limit := len(data)
+	if limit > c.max {
+		limit = c.max
+	}
+
+	var hash uint64
+	for i := c.min; i < limit; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&c.mask == 0 {
+			return i + 1
+		}
+	}
+	return limit
+}
@@ -0,0 +1,150 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+)
+
+const (
+	testChunkMin = 64
+	testChunkAvg = 256
+	testChunkMax = 1024
+)
+
+// testRandom returns size bytes of deterministic pseudo random data
+func testRandom(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// testChunks splits data with the test chunk sizes and returns copies of the chunks
+func testChunks(t *testing.T, r io.Reader) [][]byte {
+	t.Helper()
+	chunks := make([][]byte, 0)
+	c := newChunker(r, testChunkMin, testChunkAvg, testChunkMax)
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatalf("Next() failed. Err: %v", err)
+		}
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+}
+
+func TestChunkerSizes(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", []byte{}},
+		{"one byte", []byte{1}},
+		{"below min", testRandom(1, testChunkMin-1)},
+		{"exactly min", testRandom(2, testChunkMin)},
+		{"random", testRandom(3, 64*1024)},
+		// a run of zeros never hits the mask so every chunk is cut at max
+		{"zeros", make([]byte, 10*testChunkMax+17)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := testChunks(t, bytes.NewReader(tt.data))
+
+			if len(tt.data) == 0 && len(chunks) != 0 {
+				t.Fatalf("len(chunks) = %d, want 0", len(chunks))
+			}
+			for i, chunk := range chunks {
+				if len(chunk) > testChunkMax {
+					t.Errorf("len(chunk[%d]) = %d, want <= %d", i, len(chunk), testChunkMax)
+				}
+				if i < len(chunks)-1 && len(chunk) <= testChunkMin {
+					t.Errorf("len(chunk[%d]) = %d, want > %d", i, len(chunk), testChunkMin)
+				}
+			}
+			if got := bytes.Join(chunks, nil); !bytes.Equal(got, tt.data) {
+				t.Errorf("joined chunks differ from the input")
+			}
+		})
+	}
+}
+
+func TestChunkerZerosCutAtMax(t *testing.T) {
+	chunks := testChunks(t, bytes.NewReader(make([]byte, 3*testChunkMax+5)))
+
+	want := []int{testChunkMax, testChunkMax, testChunkMax, 5}
+	if len(chunks) != len(want) {
+		t.Fatalf("len(chunks) = %d, want %d", len(chunks), len(want))
+	}
+	for i, chunk := range chunks {
+		if len(chunk) != want[i] {
+			t.Errorf("len(chunk[%d]) = %d, want %d", i, len(chunk), want[i])
+		}
+	}
+}
+
+func TestChunkerShortReads(t *testing.T) {
+	data := testRandom(4, 32*1024)
+
+	want := testChunks(t, bytes.NewReader(data))
+	got := testChunks(t, iotest.OneByteReader(bytes.NewReader(data)))
+	if len(got) != len(want) {
+		t.Fatalf("len(chunks) = %d, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("chunk[%d] differs with one byte reads", i)
+		}
+	}
+}
+
+func TestChunkerStableAfterInsertion(t *testing.T) {
+	data := testRandom(5, 128*1024)
+
+	tests := []struct {
+		name   string
+		offset int
+		insert []byte
+	}{
+		{"prepend", 0, []byte("x")},
+		{"middle", len(data) / 2, []byte("inserted in the middle")},
+		{"near end", len(data) - 100, testRandom(6, 3*testChunkMax)},
+	}
+
+	before := testChunks(t, bytes.NewReader(data))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			edited := make([]byte, 0, len(data)+len(tt.insert))
+			edited = append(edited, data[:tt.offset]...)
+			edited = append(edited, tt.insert...)
+			edited = append(edited, data[tt.offset:]...)
+			after := testChunks(t, bytes.NewReader(edited))
+
+			prefix := 0
+			for prefix < len(before) && prefix < len(after) && bytes.Equal(before[prefix], after[prefix]) {
+				prefix++
+			}
+			suffix := 0
+			for suffix < len(before)-prefix && suffix < len(after)-prefix &&
+				bytes.Equal(before[len(before)-1-suffix], after[len(after)-1-suffix]) {
+				suffix++
+			}
+
+			// the boundaries resynchronize within a few chunks of the edit, a
+			// fixed size split would replace every chunk after it
+			if lost := len(before) - prefix - suffix; lost > 3 {
+				t.Errorf("%d of %d chunks replaced, want <= 3", lost, len(before))
+			}
+		})
+	}
+}
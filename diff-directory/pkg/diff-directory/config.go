@@ -0,0 +1,425 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+	klog "k8s.io/klog/v2"
+)
+
+/*
+Sync profiles
+
+A config file names the runs that are done over and over so they don't need all the
+flags retyped:
+
+	profiles:
+	  music:
+	    src: ~/Music
+	    dst: /media/player/Music
+	    skip-src: true
+	    direction: src-to-dst
+	    ignore: ["*.tmp", ".DS_Store"]
+	    hash: md5
+	    workers: 4
+	    logging: 3
+
+Relative paths are relative to the directory of the config file and ~ is the home
+directory. Any key can be overridden from the environment with
+DIFF_DIRECTORY_<PROFILE>__<KEY> for one profile or DIFF_DIRECTORY_<KEY> for all of them,
+names upper cased with dashes as underscores, e.g. DIFF_DIRECTORY_MUSIC__DRY_RUN=true.
+The double underscore keeps a profile variable from reading as a key of all profiles.
+Lists in the environment are comma separated.
+*/
+
+// LoadConfig reads a config file, resolves its paths and applies the environment overrides
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		klog.Errorf("ReadFile(%s) failed. Err: %v\n", path, err)
+		return nil, err
+	}
+
+	config := &Config{}
+	err = yaml.Unmarshal(data, config)
+	if err != nil {
+		klog.Errorf("yaml.Unmarshal(%s) failed. Err: %v\n", path, err)
+		return nil, fmt.Errorf("%w: %v", ErrConfigInvalid, err)
+	}
+	if len(config.Profiles) == 0 {
+		return nil, fmt.Errorf("%w: %s has no profiles", ErrConfigInvalid, path)
+	}
+
+	envNames := make(map[string]string)
+	for _, name := range config.ProfileNames() {
+		if other, ok := envNames[envKey(name)]; ok {
+			return nil, fmt.Errorf("%w: profiles %s and %s have the same environment name %s", ErrConfigInvalid, other, name, envKey(name))
+		}
+		envNames[envKey(name)] = name
+	}
+
+	baseDir := filepath.Dir(path)
+	for name, profile := range config.Profiles {
+		if profile == nil {
+			profile = &Profile{}
+			config.Profiles[name] = profile
+		}
+		profile.Name = name
+
+		err = profile.applyEnv()
+		if err != nil {
+			return nil, err
+		}
+		profile.resolvePaths(baseDir)
+	}
+
+	return config, nil
+}
+
+// ProfileNames returns the names of all profiles sorted
+func (c *Config) ProfileNames() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validate checks the named profiles, every profile without names, returning all problems found at once
+func (c *Config) Validate(names ...string) error {
+	if len(names) == 0 {
+		names = c.ProfileNames()
+	}
+	problems := make([]string, 0)
+	for _, name := range names {
+		if c.Profiles[name] == nil {
+			problems = append(problems, fmt.Sprintf("%s: unknown profile", name))
+			continue
+		}
+		for _, problem := range c.Profiles[name].problems() {
+			problems = append(problems, fmt.Sprintf("%s: %s", name, problem))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w:\n\t%s", ErrConfigInvalid, strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+// Options returns the sync options of a profile, the encryption passphrase is left to the caller
+func (p *Profile) Options() DiffOpts {
+	return DiffOpts{
+		RootSrcPath:   p.Src,
+		RootDstPath:   p.Dst,
+		SkipSrcUpdate: p.SkipSrc,
+		DryRun:        p.DryRun,
+		Verify:        p.Verify,
+		Stream:        p.Stream,
+		Extract:       p.Extract,
+		Audio:         p.Audio,
+		SyncTags:      p.SyncTags,
+
+		RulesFile: p.Rules,
+		Direction: p.Direction,
+		Conflict:  p.Conflict,
+		Ignore:    p.Ignore,
+
+		Hash:         p.Hash,
+		Workers:      p.Workers,
+		CopyStrategy: p.CopyStrategy,
+
+		SrcChecksumFile: p.SrcHashes,
+		DstChecksumFile: p.DstHashes,
+
+		TargetFS:       p.TargetFS,
+		MTimeTolerance: p.MTimeTolerance,
+		IgnoreTZShift:  p.IgnoreTZShift,
+		Normalize:      p.Normalize,
+
+		MaxFiles:        p.MaxFiles,
+		MaxBytes:        p.MaxBytes,
+		MaxOverwritePct: p.MaxOverwritePct,
+
+		ErrorPolicy: p.OnError,
+		LockWait:    p.LockWait,
+		Throttle:    p.throttle(),
+		Filter:      p.filter(),
+
+		EncryptDst: p.Encrypt,
+		KeyFile:    p.KeyFile,
+	}
+}
+
+// filter returns the filter options of a profile, invalid ages and sizes are left to problems
+func (p *Profile) filter() FilterOpts {
+	newerThan, _ := ParseAge(p.NewerThan)
+	olderThan, _ := ParseAge(p.OlderThan)
+	minSize, _ := ParseBytes(p.MinSize)
+	maxSize, _ := ParseBytes(p.MaxSize)
+	return FilterOpts{
+		NewerThan:      newerThan,
+		OlderThan:      olderThan,
+		MinSize:        minSize,
+		MaxSize:        maxSize,
+		ExcludeClasses: p.ExcludeClasses,
+	}
+}
+
+// throttle returns the throttle options of a profile, invalid byte counts are left to problems
+func (p *Profile) throttle() ThrottleOpts {
+	readBPS, _ := ParseBytes(p.ReadBPS)
+	writeBPS, _ := ParseBytes(p.WriteBPS)
+	return ThrottleOpts{
+		ReadBytesPerSec:  readBPS,
+		ReadFilesPerSec:  p.ReadFPS,
+		WriteBytesPerSec: writeBPS,
+		WriteFilesPerSec: p.WriteFPS,
+		Schedule:         p.ThrottleSchedule,
+		ControlFile:      p.ThrottleFile,
+	}
+}
+
+func (p *Profile) problems() []string {
+	problems := make([]string, 0)
+
+	if repo, _, ok := ParseGitSource(p.Src); ok {
+		if stat, err := os.Stat(repo); err != nil || !stat.IsDir() {
+			problems = append(problems, fmt.Sprintf("src git repository %s is not a directory", repo))
+		}
+		if strings.HasPrefix(p.Dst, StorePrefix) {
+			problems = append(problems, "a git src can't be backed up into a store")
+		}
+	} else if IsArchive(p.Src) {
+		if strings.HasPrefix(p.Dst, StorePrefix) {
+			problems = append(problems, "an archive src can't be backed up into a store")
+		}
+	} else if p.Src == "" {
+		problems = append(problems, "src is not set")
+	} else if stat, err := os.Stat(p.Src); err != nil || !stat.IsDir() {
+		problems = append(problems, fmt.Sprintf("src %s is not a directory", p.Src))
+	}
+	switch {
+	case p.Dst == "":
+		problems = append(problems, "dst is not set")
+	case strings.HasPrefix(p.Dst, StorePrefix), IsArchive(p.Dst):
+	default:
+		if stat, err := os.Stat(p.Dst); err != nil || !stat.IsDir() {
+			problems = append(problems, fmt.Sprintf("dst %s is not a directory", p.Dst))
+		}
+	}
+
+	direction, conflict := p.Direction, p.Conflict
+	if direction == "" {
+		direction = RuleTwoWay
+	}
+	if conflict == "" {
+		conflict = ConflictNewer
+	}
+	if _, err := newSyncRule("default", direction, conflict); err != nil {
+		problems = append(problems, strings.TrimPrefix(err.Error(), ErrRulesInvalid.Error()+": "))
+	}
+	for _, pattern := range p.Ignore {
+		if _, err := globRegexp(pattern); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid ignore pattern %s", pattern))
+		}
+	}
+
+	for _, file := range []string{p.Rules, p.SrcHashes, p.DstHashes, p.KeyFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			problems = append(problems, fmt.Sprintf("%s does not exist", file))
+		}
+	}
+
+	if p.Hash != "" && checksumFormats[p.Hash] == nil {
+		problems = append(problems, fmt.Sprintf("unknown hash %s, must be sha256, md5 or sfv", p.Hash))
+	}
+	switch p.TargetFS {
+	case "", TargetFSAuto, TargetFSPosix, TargetFSFat:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown target-fs %s, must be auto, posix or fat", p.TargetFS))
+	}
+	switch p.CopyStrategy {
+	case "", CopyAuto, CopyReflink, CopyFileRange, CopySendfile, CopyBuffered:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown copy-strategy %s, must be auto, reflink, copy_file_range, sendfile or buffered", p.CopyStrategy))
+	}
+	switch p.OnError {
+	case "", ErrorPolicyFailFast, ErrorPolicyContinue:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown on-error %s, must be fail-fast or continue", p.OnError))
+	}
+	switch p.Normalize {
+	case "", NormalizeNone, NormalizeNFC, NormalizeNFD:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown normalize %s, must be none, nfc or nfd", p.Normalize))
+	}
+
+	if _, err := ParseBytes(p.ReadBPS); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid read-bps %s", p.ReadBPS))
+	}
+	if _, err := ParseBytes(p.WriteBPS); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid write-bps %s", p.WriteBPS))
+	}
+	for _, age := range []string{p.NewerThan, p.OlderThan} {
+		if _, err := ParseAge(age); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid age %s, must be days (7d), weeks (2w) or a duration", age))
+		}
+	}
+	for _, size := range []string{p.MinSize, p.MaxSize} {
+		if _, err := ParseBytes(size); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid size %s", size))
+		}
+	}
+	for _, class := range p.ExcludeClasses {
+		if extensionClasses[class] == nil {
+			problems = append(problems, fmt.Sprintf("unknown exclude-classes %s, must be audio, video or images", class))
+		}
+	}
+	if _, err := parseSchedule(p.ThrottleSchedule); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid throttle-schedule %s, must be HH:MM-HH:MM windows", p.ThrottleSchedule))
+	}
+
+	if p.Workers < 0 || p.MaxFiles < 0 || p.MaxBytes < 0 || p.MaxOverwritePct < 0 || p.LockWait < 0 || p.ReadFPS < 0 || p.WriteFPS < 0 {
+		problems = append(problems, "workers, lock-wait, max-* and *-fps can't be negative")
+	}
+	if p.Logging < 0 || p.Logging > 7 {
+		problems = append(problems, fmt.Sprintf("logging %d must be between 0 and 7", p.Logging))
+	}
+
+	return problems
+}
+
+// resolvePaths makes the paths of a profile absolute
+func (p *Profile) resolvePaths(baseDir string) {
+	resolve := func(path string) string {
+		if path == "" {
+			return ""
+		}
+		if path == "~" || strings.HasPrefix(path, "~/") {
+			if home, err := os.UserHomeDir(); err == nil {
+				path = filepath.Join(home, path[1:])
+			}
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(baseDir, path)
+		}
+		return filepath.Clean(path)
+	}
+
+	if repo, rev, ok := ParseGitSource(p.Src); ok {
+		p.Src = GitPrefix + resolve(repo) + "@" + rev
+	} else {
+		p.Src = resolve(p.Src)
+	}
+	if strings.HasPrefix(p.Dst, StorePrefix) {
+		p.Dst = StorePrefix + resolve(strings.TrimPrefix(p.Dst, StorePrefix))
+	} else {
+		p.Dst = resolve(p.Dst)
+	}
+	p.Rules = resolve(p.Rules)
+	p.SrcHashes = resolve(p.SrcHashes)
+	p.DstHashes = resolve(p.DstHashes)
+	p.KeyFile = resolve(p.KeyFile)
+	p.ThrottleFile = resolve(p.ThrottleFile)
+}
+
+// applyEnv overrides the profile with the environment, the profile specific variable wins
+func (p *Profile) applyEnv() error {
+	profileKey := envKey(p.Name)
+	value := reflect.ValueOf(p).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		tag := strings.Split(value.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+
+		key := envKey(tag)
+		env, ok := os.LookupEnv(ConfigEnvPrefix + profileKey + "__" + key)
+		if !ok {
+			env, ok = os.LookupEnv(ConfigEnvPrefix + key)
+		}
+		if !ok {
+			continue
+		}
+
+		klog.V(3).Infof("[CONFIG] %s: %s from the environment\n", p.Name, tag)
+		err := setField(value.Field(i), env)
+		if err != nil {
+			return fmt.Errorf("%w: %s %s=%q: %v", ErrConfigInvalid, p.Name, tag, env, err)
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, env string) error {
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(env)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(env)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(env)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(env, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(env, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		list := make([]string, 0)
+		for _, item := range strings.Split(env, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// envKey upper cases a name with everything but letters and digits as underscores
+func envKey(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9'):
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -6,6 +6,193 @@ package diff
 
 import (
 	"errors"
+	"time"
+
+	filecopy "github.com/dvonthenen/go-utilities/filecopy"
+)
+
+const (
+	// StorePrefix marks a destination as a content-addressable store instead of a directory
+	StorePrefix string = "store:"
+
+	// GitPrefix marks a source as a git revision read from the object database, git:<repo>@<rev>
+	GitPrefix string = "git:"
+
+	// ArchiveTar an uncompressed tar archive
+	ArchiveTar string = "tar"
+
+	// ArchiveTarGzip a gzip compressed tar archive (.tar.gz, .tgz)
+	ArchiveTarGzip string = "tar.gz"
+
+	// ArchiveTarZstd a zstd compressed tar archive (.tar.zst, .tzst)
+	ArchiveTarZstd string = "tar.zst"
+
+	// ArchiveZip a zip archive
+	ArchiveZip string = "zip"
+
+	// StoreCompressionNone chunks are stored as-is
+	StoreCompressionNone string = "none"
+
+	// StoreCompressionGzip chunks are stored gzip compressed
+	StoreCompressionGzip string = "gzip"
+
+	// ChecksumSHA256 sha256sum compatible SHA256SUMS files
+	ChecksumSHA256 string = "sha256"
+
+	// ChecksumMD5 md5sum compatible .md5 files
+	ChecksumMD5 string = "md5"
+
+	// ChecksumSFV CRC32 based .sfv files
+	ChecksumSFV string = "sfv"
+
+	// TargetFSAuto detect the dst filesystem profile
+	TargetFSAuto string = "auto"
+
+	// TargetFSPosix case sensitive with exact mod times
+	TargetFSPosix string = "posix"
+
+	// TargetFSFat FAT32/exFAT: case insensitive, 2 second mod times, restricted names
+	TargetFSFat string = "fat"
+
+	// NormalizeNone match paths byte for byte
+	NormalizeNone string = "none"
+
+	// NormalizeNFC match paths by their composed form
+	NormalizeNFC string = "nfc"
+
+	// NormalizeNFD match paths by their decomposed form
+	NormalizeNFD string = "nfd"
+
+	// CopyAuto use the fastest copy strategy the filesystems support
+	CopyAuto string = filecopy.Auto
+
+	// CopyReflink share the blocks of the source on copy-on-write filesystems (FICLONE)
+	CopyReflink string = filecopy.Reflink
+
+	// CopyFileRange copy inside the kernel with copy_file_range
+	CopyFileRange string = filecopy.FileRange
+
+	// CopySendfile copy inside the kernel with sendfile
+	CopySendfile string = filecopy.Sendfile
+
+	// CopyBuffered copy through a buffer in user space
+	CopyBuffered string = filecopy.Buffered
+
+	// CopySparse copy only the data extents of a sparse file, reported but not a choice
+	CopySparse string = filecopy.Sparse
+
+	// FilterClassAudio audio files (mp3, flac, m4a, ...)
+	FilterClassAudio string = "audio"
+
+	// FilterClassVideo video files (mp4, mkv, avi, ...)
+	FilterClassVideo string = "video"
+
+	// FilterClassImages image files (jpg, png, raw, ...)
+	FilterClassImages string = "images"
+
+	// AudioTagsOnly two music files with the same audio and different tags
+	AudioTagsOnly string = "tags-only"
+
+	// AudioChanged two music files whose audio differs
+	AudioChanged string = "audio-changed"
+
+	// audioTagsSynced counts the tags-only differences synced by writing the tags
+	audioTagsSynced string = "tags-synced"
+
+	// RuleTwoWay sync in whichever direction the conflict policy picks
+	RuleTwoWay string = "two-way"
+
+	// RuleSrcToDst only ever write to dst
+	RuleSrcToDst string = "src-to-dst"
+
+	// RuleDstToSrc only ever write to src
+	RuleDstToSrc string = "dst-to-src"
+
+	// RuleIgnore leave the paths alone
+	RuleIgnore string = "ignore"
+
+	// ConflictNewer the newer file wins
+	ConflictNewer string = "newer"
+
+	// ConflictKeepBoth the newer file wins and the older one is kept under a conflict name
+	ConflictKeepBoth string = "keep-both"
+
+	// ConflictSrcWins src always wins
+	ConflictSrcWins string = "src-wins"
+
+	// ConflictDstWins dst always wins
+	ConflictDstWins string = "dst-wins"
+
+	// ConflictSkip conflicts are reported and left alone
+	ConflictSkip string = "skip"
+
+	// ConfigEnvPrefix prefixes the environment variables overriding config profiles
+	ConfigEnvPrefix string = "DIFF_DIRECTORY_"
+
+	// run locking
+	lockFile         string        = ".diff-directory-lock"
+	lockPollInterval time.Duration = 500 * time.Millisecond
+
+	// ErrorPolicyFailFast stop at the first file that fails
+	ErrorPolicyFailFast string = "fail-fast"
+
+	// ErrorPolicyContinue record failed files and carry on with the rest
+	ErrorPolicyContinue string = "continue"
+
+	// files changing during the sync
+	copyRetries    int           = 3
+	copyRetryDelay time.Duration = time.Second
+
+	// stats
+	statsTop int = 10
+
+	// throttling
+	throttleReloadInterval time.Duration = 2 * time.Second
+
+	// target filesystems
+	fatMTimeTolerance time.Duration = 2 * time.Second
+	maxTZShift        time.Duration = 14 * time.Hour
+
+	// unified diffs
+	diffContext     int   = 3
+	maxDiffEdits    int   = 2000
+	maxDiffSize     int64 = 1024 * 1024
+	binarySniffSize int   = 8000
+
+	// terminal colors
+	colorReset string = "\033[0m"
+	colorBold  string = "\033[1m"
+	colorRed   string = "\033[31m"
+	colorGreen string = "\033[32m"
+	colorCyan  string = "\033[36m"
+
+	// store layout
+	storeConfigFile   string = "store.json"
+	storeChunksDir    string = "chunks"
+	storeSnapshotsDir string = "snapshots"
+	storeVersion      int    = 1
+
+	// content-defined chunking sizes
+	storeChunkMin int = 256 * 1024
+	storeChunkAvg int = 1024 * 1024
+	storeChunkMax int = 4 * 1024 * 1024
+
+	// encrypted dst
+	cryptHeaderFile      string = ".diff-directory-crypt.json"
+	cryptManifestFile    string = ".diff-directory-manifest"
+	cryptMagic           string = "DDCRYPT1"
+	cryptVersion         int    = 1
+	cryptKDFScrypt       string = "scrypt"
+	cryptKDFKeyFile      string = "keyfile"
+	cryptScryptN         int    = 1 << 15
+	cryptScryptR         int    = 8
+	cryptScryptP         int    = 1
+	cryptSegmentSize            = 64 * 1024
+	cryptNoncePrefixSize        = 7
+	cryptMaxNameLength          = 255
+
+	// verify
+	verifyManifestVersion int = 1
 )
 
 var (
@@ -14,4 +201,151 @@ var (
 
 	// ErrUnknownDirection unknown direction to copy file (src -> dst OR dst -> src)
 	ErrUnknownDirection = errors.New("unknown direction to copy file (src -> dst OR dst -> src)")
+
+	// ErrUnknownTargetFS unknown target filesystem profile (auto, posix OR fat)
+	ErrUnknownTargetFS = errors.New("unknown target filesystem profile (auto, posix OR fat)")
+
+	// ErrUnknownNormalization unknown unicode normalization (none, nfc OR nfd)
+	ErrUnknownNormalization = errors.New("unknown unicode normalization (none, nfc OR nfd)")
+
+	// ErrStoreNotInitialized the store path does not contain an initialized store
+	ErrStoreNotInitialized = errors.New("the store path does not contain an initialized store")
+
+	// ErrStoreUnknownVersion the store was created by an unsupported version
+	ErrStoreUnknownVersion = errors.New("the store was created by an unsupported version")
+
+	// ErrStoreUnknownCompression the store uses an unsupported compression
+	ErrStoreUnknownCompression = errors.New("the store uses an unsupported compression")
+
+	// ErrStoreSnapshotNotFound the requested snapshot does not exist in the store
+	ErrStoreSnapshotNotFound = errors.New("the requested snapshot does not exist in the store")
+
+	// ErrStoreSnapshotExists a snapshot with the same name already exists in the store
+	ErrStoreSnapshotExists = errors.New("a snapshot with the same name already exists in the store")
+
+	// ErrStoreInvalidName the snapshot name contains invalid characters
+	ErrStoreInvalidName = errors.New("the snapshot name contains invalid characters")
+
+	// ErrStoreCorrupt the store failed the integrity check
+	ErrStoreCorrupt = errors.New("the store failed the integrity check")
+
+	// ErrCryptNoKey the encrypted dst requires a passphrase or key file
+	ErrCryptNoKey = errors.New("the encrypted dst requires a passphrase or key file")
+
+	// ErrCryptWrongKey the passphrase or key file does not match the encrypted dst
+	ErrCryptWrongKey = errors.New("the passphrase or key file does not match the encrypted dst")
+
+	// ErrCryptRequired the dst is encrypted but encryption was not enabled
+	ErrCryptRequired = errors.New("the dst is encrypted but encryption was not enabled")
+
+	// ErrCryptCorrupt encrypted data failed authentication
+	ErrCryptCorrupt = errors.New("encrypted data failed authentication")
+
+	// ErrCryptNameTooLong the encrypted file name exceeds the filesystem limit
+	ErrCryptNameTooLong = errors.New("the encrypted file name exceeds the filesystem limit")
+
+	// ErrVerifyMismatch the copied file does not match its source
+	ErrVerifyMismatch = errors.New("the copied file does not match its source")
+
+	// ErrVerifyFailed the trees did not pass verification
+	ErrVerifyFailed = errors.New("the trees did not pass verification")
+
+	// ErrChecksumUnknownFormat the checksum format is not sha256, md5 or sfv
+	ErrChecksumUnknownFormat = errors.New("the checksum format is not sha256, md5 or sfv")
+
+	// ErrChecksumInvalid the checksum file could not be parsed
+	ErrChecksumInvalid = errors.New("the checksum file could not be parsed")
+
+	// ErrSafetyLimit the run would change more than the safety limits allow
+	ErrSafetyLimit = errors.New("the run exceeds the safety limits")
+
+	// ErrReviewQuit the interactive review was quit
+	ErrReviewQuit = errors.New("the interactive review was quit")
+
+	// ErrReviewIrreversible the action can't be reversed
+	ErrReviewIrreversible = errors.New("the action can't be reversed")
+
+	// ErrDiffTooLarge the file is too large to diff
+	ErrDiffTooLarge = errors.New("the file is too large to diff")
+
+	// ErrDiffBinary the file is binary
+	ErrDiffBinary = errors.New("the file is binary")
+
+	// ErrRulesInvalid the rules file could not be parsed
+	ErrRulesInvalid = errors.New("the rules file could not be parsed")
+
+	// ErrMultiTooFewRoots a multi-root sync needs at least two roots
+	ErrMultiTooFewRoots = errors.New("a multi-root sync needs at least two roots")
+
+	// ErrMultiTargetFS a multi-root sync needs POSIX roots, FAT and exFAT aren't supported
+	ErrMultiTargetFS = errors.New("a multi-root sync needs POSIX roots, FAT and exFAT aren't supported")
+
+	// ErrConfigInvalid the config file is not valid
+	ErrConfigInvalid = errors.New("the config file is not valid")
+
+	// ErrInsufficientSpace a filesystem does not have room for the planned changes
+	ErrInsufficientSpace = errors.New("a filesystem does not have room for the planned changes")
+
+	// ErrSpaceUnknown the free space of the filesystem can't be determined
+	ErrSpaceUnknown = errors.New("the free space of the filesystem can't be determined")
+
+	// ErrLockHeld another run holds the lock on the tree
+	ErrLockHeld = errors.New("another run holds the lock on the tree")
+
+	// ErrUnknownErrorPolicy unknown error policy (fail-fast OR continue)
+	ErrUnknownErrorPolicy = errors.New("unknown error policy (fail-fast OR continue)")
+
+	// ErrPartialFailure some files failed while the rest were synced
+	ErrPartialFailure = errors.New("some files failed while the rest were synced")
+
+	// ErrFileChanged the file changed during the sync, it is deferred to the next run
+	ErrFileChanged = errors.New("the file changed during the sync")
+
+	// ErrUnknownCopyStrategy unknown copy strategy (auto, reflink, copy_file_range, sendfile OR buffered)
+	ErrUnknownCopyStrategy = filecopy.ErrUnknownStrategy
+
+	// ErrInvalidByteCount invalid byte count, a number with an optional K, M, G or T suffix
+	ErrInvalidByteCount = errors.New("invalid byte count, a number with an optional K, M, G or T suffix")
+
+	// ErrInvalidSchedule invalid schedule window, must be HH:MM-HH:MM
+	ErrInvalidSchedule = errors.New("invalid schedule window, must be HH:MM-HH:MM")
+
+	// ErrInvalidThrottle invalid throttle settings
+	ErrInvalidThrottle = errors.New("invalid throttle settings")
+
+	// ErrInvalidAge invalid age, a number of days (7d), weeks (2w) or a duration (36h)
+	ErrInvalidAge = errors.New("invalid age, a number of days (7d), weeks (2w) or a duration (36h)")
+
+	// ErrInvalidFilter invalid filter, negative or leaving no files
+	ErrInvalidFilter = errors.New("invalid filter, negative or leaving no files")
+
+	// ErrUnknownExtensionClass unknown extension class (audio, video OR images)
+	ErrUnknownExtensionClass = errors.New("unknown extension class (audio, video OR images)")
+
+	// ErrGitNotRepo not a git repository
+	ErrGitNotRepo = errors.New("not a git repository")
+
+	// ErrGitRevision unknown git revision
+	ErrGitRevision = errors.New("unknown git revision")
+
+	// ErrGitObjectMissing git object not found
+	ErrGitObjectMissing = errors.New("git object not found")
+
+	// ErrGitCorrupt corrupt git object
+	ErrGitCorrupt = errors.New("corrupt git object")
+
+	// ErrGitUnsupported unsupported by a git source
+	ErrGitUnsupported = errors.New("unsupported by a git source")
+
+	// ErrGitUnsafePath the dst path leads through a symlink
+	ErrGitUnsafePath = errors.New("the dst path leads through a symlink")
+
+	// ErrArchiveBoth src and dst can't both be archives
+	ErrArchiveBoth = errors.New("src and dst can't both be archives")
+
+	// ErrArchiveUnsupported unsupported with an archive
+	ErrArchiveUnsupported = errors.New("unsupported with an archive")
+
+	// ErrAudioUnknownLayout not a music file layout the audio comparison knows
+	ErrAudioUnknownLayout = errors.New("not a music file layout the audio comparison knows")
 )
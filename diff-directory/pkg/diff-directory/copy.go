@@ -0,0 +1,54 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	filecopy "github.com/dvonthenen/go-utilities/filecopy"
+	klog "k8s.io/klog/v2"
+)
+
+/*
+Copy strategies
+
+Copies go through the filecopy package, shared with file-distribute: a reflink first,
+then copy_file_range, sendfile and a buffered copy, CopyStrategy picks where to start.
+*/
+
+// checkCopyStrategy makes sure the copy strategy is auto or one of the strategies
+func (d *Diff) checkCopyStrategy() error {
+	err := filecopy.CheckStrategy(d.options.CopyStrategy)
+	if err != nil {
+		klog.Errorf("Unknown copy strategy: %s\n", d.options.CopyStrategy)
+		return err
+	}
+	return nil
+}
+
+// countStrategy records the strategy of a copy for the summary
+func (d *Diff) countStrategy(strategy string) {
+	if d.strategies == nil {
+		d.strategies = make(map[string]int)
+	}
+	d.strategies[strategy]++
+}
+
+// strategySummary lists how many files each strategy copied, empty when nothing was copied
+func (d *Diff) strategySummary() string {
+	names := make([]string, 0, len(d.strategies))
+	for name := range d.strategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s %d", name, d.strategies[name]))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,682 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	sha256 "crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	scrypt "golang.org/x/crypto/scrypt"
+	klog "k8s.io/klog/v2"
+)
+
+/*
+Encrypted destination trees
+
+File contents are encrypted with AES-256-GCM in fixed size segments. Each segment
+nonce is a random per file prefix, the segment counter and a final segment flag so
+that reordered, truncated or extended files fail authentication.
+
+Each path component is encrypted deterministically (HMAC-SHA256 synthetic IV +
+AES-CTR) so the same plaintext name always maps to the same encrypted name and
+comparisons still work. Names are base32 encoded in lower case so they survive
+case insensitive filesystems.
+
+The manifest of plaintext sizes, mod times and hashes is itself encrypted and lets
+a run detect changes without decrypting every file in dst.
+*/
+
+var cryptNameEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+type cryptor struct {
+	contentKey []byte
+	nameEncKey []byte
+	nameMacKey []byte
+	manifest   *cryptManifest
+	dirty      bool
+}
+
+type cryptHeader struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"`
+	Salt    []byte `json:"salt"`
+	N       int    `json:"n,omitempty"`
+	R       int    `json:"r,omitempty"`
+	P       int    `json:"p,omitempty"`
+	Check   []byte `json:"check"`
+}
+
+type cryptManifest struct {
+	Version int                            `json:"version"`
+	Files   map[string]*cryptManifestEntry `json:"files"`
+}
+
+type cryptManifestEntry struct {
+	Name    string    `json:"name"` // encrypted relative path
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Hash    string    `json:"hash"`
+}
+
+// cryptFileInfo presents a manifest entry as the plaintext file
+type cryptFileInfo struct {
+	name  string
+	entry *cryptManifestEntry
+}
+
+func (f *cryptFileInfo) Name() string       { return f.name }
+func (f *cryptFileInfo) Size() int64        { return f.entry.Size }
+func (f *cryptFileInfo) Mode() fs.FileMode  { return 0644 }
+func (f *cryptFileInfo) ModTime() time.Time { return f.entry.ModTime }
+func (f *cryptFileInfo) IsDir() bool        { return false }
+func (f *cryptFileInfo) Sys() interface{}   { return nil }
+
+/*
+openCrypt derives the keys for the encrypted dst, creating the header on first use,
+and loads the manifest.
+*/
+func (d *Diff) openCrypt() error {
+	headerPath := filepath.Join(d.options.RootDstPath, cryptHeaderFile)
+
+	header := &cryptHeader{}
+	data, err := os.ReadFile(headerPath)
+	switch {
+	case err == nil:
+		err = json.Unmarshal(data, header)
+		if err != nil {
+			klog.Errorf("json.Unmarshal(%s) failed. Err: %v\n", headerPath, err)
+			return err
+		}
+		if header.Version != cryptVersion {
+			klog.Errorf("Unknown encryption version: %d\n", header.Version)
+			return ErrCryptCorrupt
+		}
+	case os.IsNotExist(err):
+		header.Version = cryptVersion
+		header.Salt = make([]byte, 32)
+		_, err = rand.Read(header.Salt)
+		if err != nil {
+			return err
+		}
+		if d.options.KeyFile != "" {
+			header.KDF = cryptKDFKeyFile
+		} else {
+			header.KDF = cryptKDFScrypt
+			header.N = cryptScryptN
+			header.R = cryptScryptR
+			header.P = cryptScryptP
+		}
+	default:
+		klog.Errorf("ReadFile(%s) failed. Err: %v\n", headerPath, err)
+		return err
+	}
+
+	master, err := d.deriveMasterKey(header)
+	if err != nil {
+		return err
+	}
+	check := cryptSubKey(master, "diff-directory check")
+
+	if header.Check == nil {
+		header.Check = check
+
+		if d.options.DryRun {
+			klog.V(3).Infof("DryRun: create %s\n", headerPath)
+		} else {
+			data, err := json.MarshalIndent(header, "", "  ")
+			if err != nil {
+				return err
+			}
+			err = writeFileAtomic(headerPath, data)
+			if err != nil {
+				klog.Errorf("writeFileAtomic(%s) failed. Err: %v\n", headerPath, err)
+				return err
+			}
+		}
+	} else if !hmac.Equal(header.Check, check) {
+		klog.Errorf("Passphrase or key file does not match %s\n", d.options.RootDstPath)
+		return ErrCryptWrongKey
+	}
+
+	d.crypt = &cryptor{
+		contentKey: cryptSubKey(master, "diff-directory content"),
+		nameEncKey: cryptSubKey(master, "diff-directory name encryption"),
+		nameMacKey: cryptSubKey(master, "diff-directory name authentication"),
+	}
+
+	return d.loadManifest()
+}
+
+func (d *Diff) deriveMasterKey(header *cryptHeader) ([]byte, error) {
+	switch header.KDF {
+	case cryptKDFScrypt:
+		if d.options.Passphrase == "" {
+			klog.Errorf("%s is encrypted with a passphrase\n", d.options.RootDstPath)
+			return nil, ErrCryptNoKey
+		}
+		return scrypt.Key([]byte(d.options.Passphrase), header.Salt, header.N, header.R, header.P, 32)
+	case cryptKDFKeyFile:
+		if d.options.KeyFile == "" {
+			klog.Errorf("%s is encrypted with a key file\n", d.options.RootDstPath)
+			return nil, ErrCryptNoKey
+		}
+		key, err := os.ReadFile(d.options.KeyFile)
+		if err != nil {
+			klog.Errorf("ReadFile(%s) failed. Err: %v\n", d.options.KeyFile, err)
+			return nil, err
+		}
+		mac := hmac.New(sha256.New, header.Salt)
+		mac.Write(key)
+		return mac.Sum(nil), nil
+	default:
+		klog.Errorf("Unknown key derivation: %s\n", header.KDF)
+		return nil, ErrCryptCorrupt
+	}
+}
+
+func cryptSubKey(master []byte, label string) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+func (d *Diff) loadManifest() error {
+	d.crypt.manifest = &cryptManifest{
+		Version: cryptVersion,
+		Files:   make(map[string]*cryptManifestEntry, 0),
+	}
+
+	f, err := os.Open(filepath.Join(d.options.RootDstPath, cryptManifestFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	_, err = d.crypt.decryptStream(&buf, f)
+	if err != nil {
+		klog.Errorf("decrypt manifest failed. Err: %v\n", err)
+		return err
+	}
+
+	err = json.Unmarshal(buf.Bytes(), d.crypt.manifest)
+	if err != nil {
+		klog.Errorf("json.Unmarshal manifest failed. Err: %v\n", err)
+		return err
+	}
+	if d.crypt.manifest.Files == nil {
+		d.crypt.manifest.Files = make(map[string]*cryptManifestEntry, 0)
+	}
+	return nil
+}
+
+func (d *Diff) saveManifest() error {
+	if d.crypt == nil || !d.crypt.dirty {
+		return nil
+	}
+	if d.options.DryRun {
+		klog.V(3).Infof("DryRun: save manifest\n")
+		return nil
+	}
+
+	data, err := json.Marshal(d.crypt.manifest)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	_, err = d.crypt.encryptStream(&buf, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(filepath.Join(d.options.RootDstPath, cryptManifestFile), buf.Bytes())
+	if err != nil {
+		klog.Errorf("writeFileAtomic manifest failed. Err: %v\n", err)
+		return err
+	}
+
+	d.crypt.dirty = false
+	return nil
+}
+
+/*
+walkEncryptedTree builds the dst side of the comparison from the manifest. Only files
+that are missing from the manifest or whose encrypted size does not match get
+decrypted to recalculate their hash.
+*/
+func (d *Diff) walkEncryptedTree() (map[string]*DiffFile, error) {
+	dstPath := d.options.RootDstPath
+	lenDst := len(dstPath)
+	files := make(map[string]*DiffFile, 0)
+	seen := make(map[string]bool, 0)
+	manifest := d.crypt.manifest
+
+	err := filepath.Walk(dstPath, func(path string, info os.FileInfo, err error) error {
+		klog.V(6).Infof("[DST] path: %s\n", path)
+		if err != nil {
+			klog.Errorf("filepath.Walk Init. Err: %v\n", err)
+			return err
+		}
+		if path == dstPath || info.IsDir() || isInternalFile(info.Name()) {
+			return nil
+		}
+
+		encRel := path[lenDst+1:]
+		newRel, err := d.crypt.decryptPath(encRel)
+		if err != nil {
+			klog.V(2).Infof("[DST] Skipping %s because it is not part of the encrypted tree\n", encRel)
+			return nil
+		}
+
+		entry := manifest.Files[newRel]
+		if entry == nil || entry.Name != encRel || cryptSize(entry.Size) != info.Size() {
+			klog.V(3).Infof("[DST] %s is not in the manifest, decrypting to hash\n", newRel)
+			size, hash, err := d.crypt.hashEncrypted(path)
+			if err != nil {
+				klog.Errorf("hashEncrypted(%s) failed. Err: %v\n", path, err)
+				return err
+			}
+			entry = &cryptManifestEntry{
+				Name:    encRel,
+				Size:    size,
+				ModTime: info.ModTime(),
+				Hash:    hash,
+			}
+			manifest.Files[newRel] = entry
+			d.crypt.dirty = true
+		}
+
+		var attr fs.FileInfo = &cryptFileInfo{
+			name:  filepath.Base(newRel),
+			entry: entry,
+		}
+		seen[newRel] = true
+		key := d.pathKey(newRel, true)
+		if existing := files[key]; existing != nil {
+			klog.Infof("[DST] Skipping %s because it collides with %s\n", newRel, existing.RelPath)
+			d.collisions = append(d.collisions, newRel)
+			return nil
+		}
+		files[key] = &DiffFile{
+			Path:    path,
+			RelPath: newRel,
+			Attr:    &attr,
+			Hash:    entry.Hash,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for relPath := range manifest.Files {
+		if !seen[relPath] {
+			klog.V(3).Infof("[DST] %s is in the manifest but missing on disk\n", relPath)
+			delete(manifest.Files, relPath)
+			d.crypt.dirty = true
+		}
+	}
+
+	return files, nil
+}
+
+// encryptedDstPath returns where the plaintext relative path lives in dst
+func (d *Diff) encryptedDstPath(relPath string) (string, error) {
+	encRel, err := d.crypt.encryptPath(relPath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(d.options.RootDstPath, encRel), nil
+}
+
+func (d *Diff) encryptCopy(src *DiffFile, dst, dstRel string) (int64, error) {
+	if d.options.DryRun {
+		klog.V(3).Infof("DryRun: encryptCopy(%s, %s)\n", src.Path, dst)
+		return 0, nil
+	}
+	d.throttle.writeFile()
+
+	source, err := os.Open(src.Path)
+	if err != nil {
+		klog.Errorf("os.Open(%s) failed. Err: %v\n", src.Path, err)
+		return 0, err
+	}
+	defer source.Close()
+
+	stat, err := source.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".diff-directory-*")
+	if err != nil {
+		klog.Errorf("CreateTemp failed. Err: %v\n", err)
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	nBytes, err := d.crypt.encryptStream(d.throttle.writer(tmp), io.TeeReader(source, hash))
+	if err != nil {
+		klog.Errorf("encryptStream(%s) failed. Err: %v\n", src.Path, err)
+		return nBytes, err
+	}
+	if stat.Size() != nBytes {
+		klog.Errorf("copy byte size mismatch. src: %d != dst: %d\n", stat.Size(), nBytes)
+		return nBytes, fmt.Errorf("copy byte size mismatch. src: %d != dst: %d", stat.Size(), nBytes)
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return nBytes, err
+	}
+	err = os.Rename(tmp.Name(), dst)
+	if err != nil {
+		return nBytes, err
+	}
+	err = os.Chtimes(dst, stat.ModTime(), stat.ModTime())
+	if err != nil {
+		return nBytes, err
+	}
+
+	d.crypt.manifest.Files[dstRel] = &cryptManifestEntry{
+		Name:    dst[len(d.options.RootDstPath)+1:],
+		Size:    nBytes,
+		ModTime: stat.ModTime(),
+		Hash:    base64.URLEncoding.EncodeToString(hash.Sum(nil)),
+	}
+	d.crypt.dirty = true
+	return nBytes, nil
+}
+
+func (d *Diff) decryptCopy(dst *DiffFile, src string) (int64, error) {
+	if d.options.DryRun {
+		klog.V(3).Infof("DryRun: decryptCopy(%s, %s)\n", dst.Path, src)
+		return 0, nil
+	}
+	d.throttle.writeFile()
+
+	source, err := os.Open(dst.Path)
+	if err != nil {
+		klog.Errorf("os.Open(%s) failed. Err: %v\n", dst.Path, err)
+		return 0, err
+	}
+	defer source.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(src), ".diff-directory-*")
+	if err != nil {
+		klog.Errorf("CreateTemp failed. Err: %v\n", err)
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	nBytes, err := d.crypt.decryptStream(io.MultiWriter(d.throttle.writer(tmp), hash), source)
+	if err != nil {
+		klog.Errorf("decryptStream(%s) failed. Err: %v\n", dst.Path, err)
+		return nBytes, err
+	}
+	if dst.Hash != "" && base64.URLEncoding.EncodeToString(hash.Sum(nil)) != dst.Hash {
+		klog.Errorf("Decrypted %s does not match the manifest hash\n", dst.RelPath)
+		return nBytes, ErrCryptCorrupt
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return nBytes, err
+	}
+	err = os.Rename(tmp.Name(), src)
+	if err != nil {
+		return nBytes, err
+	}
+
+	modTime := (*dst.Attr).ModTime()
+	return nBytes, os.Chtimes(src, modTime, modTime)
+}
+
+func (c *cryptor) encryptPath(relPath string) (string, error) {
+	parts := strings.Split(relPath, string(filepath.Separator))
+	for i, part := range parts {
+		name, err := c.encryptName(part)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = name
+	}
+	return strings.Join(parts, string(filepath.Separator)), nil
+}
+
+func (c *cryptor) decryptPath(encRel string) (string, error) {
+	parts := strings.Split(encRel, string(filepath.Separator))
+	for i, part := range parts {
+		name, err := c.decryptName(part)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = name
+	}
+	return strings.Join(parts, string(filepath.Separator)), nil
+}
+
+func (c *cryptor) encryptName(name string) (string, error) {
+	mac := hmac.New(sha256.New, c.nameMacKey)
+	mac.Write([]byte(name))
+	iv := mac.Sum(nil)[:aes.BlockSize]
+
+	block, err := aes.NewCipher(c.nameEncKey)
+	if err != nil {
+		return "", err
+	}
+	out := make([]byte, aes.BlockSize+len(name))
+	copy(out, iv)
+	cipher.NewCTR(block, iv).XORKeyStream(out[aes.BlockSize:], []byte(name))
+
+	encoded := cryptNameEncoding.EncodeToString(out)
+	if len(encoded) > cryptMaxNameLength {
+		klog.Errorf("Encrypted name for %s is %d bytes\n", name, len(encoded))
+		return "", ErrCryptNameTooLong
+	}
+	return encoded, nil
+}
+
+func (c *cryptor) decryptName(encoded string) (string, error) {
+	data, err := cryptNameEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	if len(data) <= aes.BlockSize {
+		return "", ErrCryptCorrupt
+	}
+
+	block, err := aes.NewCipher(c.nameEncKey)
+	if err != nil {
+		return "", err
+	}
+	iv := data[:aes.BlockSize]
+	name := make([]byte, len(data)-aes.BlockSize)
+	cipher.NewCTR(block, iv).XORKeyStream(name, data[aes.BlockSize:])
+
+	mac := hmac.New(sha256.New, c.nameMacKey)
+	mac.Write(name)
+	if !hmac.Equal(mac.Sum(nil)[:aes.BlockSize], iv) {
+		return "", ErrCryptCorrupt
+	}
+	return string(name), nil
+}
+
+func (c *cryptor) hashEncrypted(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	return c.hashEncryptedReader(f)
+}
+
+func (c *cryptor) hashEncryptedReader(r io.Reader) (int64, string, error) {
+	hash := sha256.New()
+	size, err := c.decryptStream(hash, r)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, base64.URLEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (c *cryptor) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(c.contentKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptStream writes the encrypted form of r to w and returns the plaintext size
+func (c *cryptor) encryptStream(w io.Writer, r io.Reader) (int64, error) {
+	aead, err := c.aead()
+	if err != nil {
+		return 0, err
+	}
+
+	prefix := make([]byte, cryptNoncePrefixSize)
+	_, err = rand.Read(prefix)
+	if err != nil {
+		return 0, err
+	}
+	_, err = w.Write(append([]byte(cryptMagic), prefix...))
+	if err != nil {
+		return 0, err
+	}
+
+	cur := make([]byte, cryptSegmentSize)
+	next := make([]byte, cryptSegmentSize)
+	curN, err := io.ReadFull(r, cur)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+
+	var total int64
+	out := make([]byte, 0, cryptSegmentSize+aead.Overhead())
+	for counter := uint32(0); ; counter++ {
+		nextN := 0
+		if curN == cryptSegmentSize {
+			nextN, err = io.ReadFull(r, next)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return total, err
+			}
+		}
+		final := nextN == 0
+
+		out = aead.Seal(out[:0], cryptNonce(prefix, counter, final), cur[:curN], nil)
+		_, err = w.Write(out)
+		if err != nil {
+			return total, err
+		}
+		total += int64(curN)
+
+		if final {
+			return total, nil
+		}
+		cur, next = next, cur
+		curN = nextN
+	}
+}
+
+// decryptStream writes the plaintext of r to w and returns its size
+func (c *cryptor) decryptStream(w io.Writer, r io.Reader) (int64, error) {
+	aead, err := c.aead()
+	if err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, len(cryptMagic)+cryptNoncePrefixSize)
+	_, err = io.ReadFull(r, header)
+	if err != nil || string(header[:len(cryptMagic)]) != cryptMagic {
+		return 0, ErrCryptCorrupt
+	}
+	prefix := header[len(cryptMagic):]
+
+	segment := cryptSegmentSize + aead.Overhead()
+	cur := make([]byte, segment)
+	next := make([]byte, segment)
+	curN, err := io.ReadFull(r, cur)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+
+	var total int64
+	out := make([]byte, 0, cryptSegmentSize)
+	for counter := uint32(0); ; counter++ {
+		nextN := 0
+		if curN == segment {
+			nextN, err = io.ReadFull(r, next)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return total, err
+			}
+		}
+		final := nextN == 0
+
+		out, err = aead.Open(out[:0], cryptNonce(prefix, counter, final), cur[:curN], nil)
+		if err != nil {
+			return total, ErrCryptCorrupt
+		}
+		_, err = w.Write(out)
+		if err != nil {
+			return total, err
+		}
+		total += int64(len(out))
+
+		if final {
+			return total, nil
+		}
+		cur, next = next, cur
+		curN = nextN
+	}
+}
+
+func cryptNonce(prefix []byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[cryptNoncePrefixSize:], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// cryptSize returns the on disk size of an encrypted file for a plaintext size
+func cryptSize(size int64) int64 {
+	segments := (size + cryptSegmentSize - 1) / cryptSegmentSize
+	if segments == 0 {
+		segments = 1
+	}
+	return int64(len(cryptMagic)+cryptNoncePrefixSize) + size + segments*16
+}
+
+// isInternalFile reports files diff-directory keeps for itself in a tree
+func isInternalFile(name string) bool {
+	return name == cryptHeaderFile || name == cryptManifestFile || strings.HasPrefix(name, ".diff-directory-")
+}
@@ -0,0 +1,277 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCryptor is a cryptor with fixed keys
+func testCryptor(seed byte) *cryptor {
+	master := bytes.Repeat([]byte{seed}, 32)
+	return &cryptor{
+		contentKey: cryptSubKey(master, "diff-directory content"),
+		nameEncKey: cryptSubKey(master, "diff-directory name encryption"),
+		nameMacKey: cryptSubKey(master, "diff-directory name authentication"),
+	}
+}
+
+// testPlaintext is size bytes that differ from segment to segment
+func testPlaintext(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i/cryptSegmentSize + i*7)
+	}
+	return data
+}
+
+func TestCryptStreamRoundTrip(t *testing.T) {
+	c := testCryptor(1)
+	sizes := []int{0, 1, cryptSegmentSize - 1, cryptSegmentSize, cryptSegmentSize + 1, 3 * cryptSegmentSize, 3*cryptSegmentSize + 100}
+
+	for _, size := range sizes {
+		plain := testPlaintext(size)
+
+		var encrypted bytes.Buffer
+		n, err := c.encryptStream(&encrypted, bytes.NewReader(plain))
+		if err != nil {
+			t.Fatalf("encryptStream(%d bytes) failed. Err: %v", size, err)
+		}
+		if n != int64(size) {
+			t.Errorf("encryptStream(%d bytes) = %d", size, n)
+		}
+		if int64(encrypted.Len()) != cryptSize(int64(size)) {
+			t.Errorf("encryptStream(%d bytes) wrote %d bytes, cryptSize = %d", size, encrypted.Len(), cryptSize(int64(size)))
+		}
+
+		var decrypted bytes.Buffer
+		n, err = c.decryptStream(&decrypted, bytes.NewReader(encrypted.Bytes()))
+		if err != nil {
+			t.Fatalf("decryptStream(%d bytes) failed. Err: %v", size, err)
+		}
+		if n != int64(size) || !bytes.Equal(decrypted.Bytes(), plain) {
+			t.Errorf("decryptStream(%d bytes) = %d bytes that don't match the plaintext", size, n)
+		}
+	}
+}
+
+func TestCryptStreamNonceIsRandom(t *testing.T) {
+	c := testCryptor(1)
+	plain := testPlaintext(100)
+
+	var a, b bytes.Buffer
+	if _, err := c.encryptStream(&a, bytes.NewReader(plain)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.encryptStream(&b, bytes.NewReader(plain)); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Errorf("encryptStream() gave the same output twice")
+	}
+}
+
+func TestCryptStreamTampered(t *testing.T) {
+	c := testCryptor(1)
+	plain := testPlaintext(3 * cryptSegmentSize)
+
+	var buf bytes.Buffer
+	if _, err := c.encryptStream(&buf, bytes.NewReader(plain)); err != nil {
+		t.Fatal(err)
+	}
+	encrypted := buf.Bytes()
+
+	header := len(cryptMagic) + cryptNoncePrefixSize
+	segment := cryptSegmentSize + 16
+	segmentAt := func(i int) []byte {
+		return encrypted[header+i*segment : header+(i+1)*segment]
+	}
+	flip := func(at int) []byte {
+		data := append([]byte{}, encrypted...)
+		data[at] ^= 0x01
+		return data
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: []byte{}},
+		{name: "header only", data: encrypted[:header]},
+		{name: "wrong magic", data: flip(0)},
+		{name: "flipped nonce prefix", data: flip(len(cryptMagic))},
+		{name: "flipped first segment", data: flip(header + 10)},
+		{name: "flipped tag", data: flip(len(encrypted) - 1)},
+		{name: "last segment dropped", data: encrypted[:header+2*segment]},
+		{name: "truncated inside a segment", data: encrypted[:header+segment+100]},
+		{name: "segment repeated", data: append(append([]byte{}, encrypted...), segmentAt(2)...)},
+		{name: "segments swapped", data: bytes.Join([][]byte{encrypted[:header], segmentAt(1), segmentAt(0), segmentAt(2)}, nil)},
+		{name: "bytes appended", data: append(append([]byte{}, encrypted...), 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := c.decryptStream(&bytes.Buffer{}, bytes.NewReader(tt.data))
+			if !errors.Is(err, ErrCryptCorrupt) {
+				t.Errorf("decryptStream() err = %v, want %v", err, ErrCryptCorrupt)
+			}
+		})
+	}
+
+	t.Run("wrong key", func(t *testing.T) {
+		_, err := testCryptor(2).decryptStream(&bytes.Buffer{}, bytes.NewReader(encrypted))
+		if !errors.Is(err, ErrCryptCorrupt) {
+			t.Errorf("decryptStream() err = %v, want %v", err, ErrCryptCorrupt)
+		}
+	})
+}
+
+func TestCryptNameRoundTrip(t *testing.T) {
+	c := testCryptor(1)
+	names := []string{"a", "song.mp3", "Ünïcödé name.flac", ".hidden", strings.Repeat("x", 100)}
+
+	for _, name := range names {
+		encoded, err := c.encryptName(name)
+		if err != nil {
+			t.Fatalf("encryptName(%q) failed. Err: %v", name, err)
+		}
+		if encoded != strings.ToLower(encoded) || strings.ContainsAny(encoded, "/\\.") {
+			t.Errorf("encryptName(%q) = %q, not a lower case base32 name", name, encoded)
+		}
+		again, _ := c.encryptName(name)
+		if again != encoded {
+			t.Errorf("encryptName(%q) is not deterministic: %q != %q", name, encoded, again)
+		}
+		decoded, err := c.decryptName(encoded)
+		if err != nil || decoded != name {
+			t.Errorf("decryptName(encryptName(%q)) = %q, %v", name, decoded, err)
+		}
+	}
+
+	if _, err := c.encryptName(strings.Repeat("x", 200)); !errors.Is(err, ErrCryptNameTooLong) {
+		t.Errorf("encryptName(200 bytes) err = %v, want %v", err, ErrCryptNameTooLong)
+	}
+
+	encoded, _ := c.encryptName("song.mp3")
+	// another valid base32 letter, only the authentication fails
+	tampered := []byte(encoded)
+	if tampered[10] == 'a' {
+		tampered[10] = 'b'
+	} else {
+		tampered[10] = 'a'
+	}
+	for _, bad := range []string{string(tampered), encoded[:20], "abc", "not base32!"} {
+		if name, err := c.decryptName(bad); err == nil {
+			t.Errorf("decryptName(%q) = %q, want an error", bad, name)
+		}
+	}
+	if name, err := testCryptor(2).decryptName(encoded); err == nil {
+		t.Errorf("decryptName() with the wrong key = %q, want an error", name)
+	}
+
+	relPath := filepath.Join("artist", "album", "song.mp3")
+	encPath, err := c.encryptPath(relPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decPath, err := c.decryptPath(encPath); err != nil || decPath != relPath {
+		t.Errorf("decryptPath(encryptPath(%q)) = %q, %v", relPath, decPath, err)
+	}
+}
+
+func TestOpenCrypt(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, []byte("a key file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first open creates the header, a manifest saved then loads in the next open
+	d := New(DiffOpts{RootDstPath: dir, KeyFile: keyFile})
+	if err := d.openCrypt(); err != nil {
+		t.Fatalf("openCrypt() failed. Err: %v", err)
+	}
+	modTime := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	d.crypt.manifest.Files["song.mp3"] = &cryptManifestEntry{Name: "enc", Size: 42, ModTime: modTime, Hash: "hash"}
+	d.crypt.dirty = true
+	if err := d.saveManifest(); err != nil {
+		t.Fatalf("saveManifest() failed. Err: %v", err)
+	}
+
+	d = New(DiffOpts{RootDstPath: dir, KeyFile: keyFile})
+	if err := d.openCrypt(); err != nil {
+		t.Fatalf("openCrypt() again failed. Err: %v", err)
+	}
+	entry := d.crypt.manifest.Files["song.mp3"]
+	if entry == nil || entry.Size != 42 || !entry.ModTime.Equal(modTime) || entry.Hash != "hash" {
+		t.Errorf("manifest entry = %+v after reopening", entry)
+	}
+
+	// a different key file doesn't match the header
+	if err := os.WriteFile(keyFile, []byte("another key file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := New(DiffOpts{RootDstPath: dir, KeyFile: keyFile}).openCrypt(); !errors.Is(err, ErrCryptWrongKey) {
+		t.Errorf("openCrypt() with the wrong key file err = %v, want %v", err, ErrCryptWrongKey)
+	}
+	// the tree was set up with a key file, a passphrase can't open it
+	if err := New(DiffOpts{RootDstPath: dir, Passphrase: "secret"}).openCrypt(); !errors.Is(err, ErrCryptNoKey) {
+		t.Errorf("openCrypt() with a passphrase err = %v, want %v", err, ErrCryptNoKey)
+	}
+
+	// a corrupt manifest is refused
+	manifest := filepath.Join(dir, cryptManifestFile)
+	data, err := os.ReadFile(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0x01
+	if err := os.WriteFile(manifest, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, []byte("a key file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := New(DiffOpts{RootDstPath: dir, KeyFile: keyFile}).openCrypt(); !errors.Is(err, ErrCryptCorrupt) {
+		t.Errorf("openCrypt() with a corrupt manifest err = %v, want %v", err, ErrCryptCorrupt)
+	}
+}
+
+func TestOpenCryptPassphrase(t *testing.T) {
+	dir := t.TempDir()
+	if err := New(DiffOpts{RootDstPath: dir, Passphrase: "secret"}).openCrypt(); err != nil {
+		t.Fatalf("openCrypt() failed. Err: %v", err)
+	}
+
+	d := New(DiffOpts{RootDstPath: dir, Passphrase: "secret"})
+	if err := d.openCrypt(); err != nil {
+		t.Fatalf("openCrypt() again failed. Err: %v", err)
+	}
+	if err := New(DiffOpts{RootDstPath: dir, Passphrase: "wrong"}).openCrypt(); !errors.Is(err, ErrCryptWrongKey) {
+		t.Errorf("openCrypt() with the wrong passphrase err = %v, want %v", err, ErrCryptWrongKey)
+	}
+	if err := New(DiffOpts{RootDstPath: dir}).openCrypt(); !errors.Is(err, ErrCryptNoKey) {
+		t.Errorf("openCrypt() without a passphrase err = %v, want %v", err, ErrCryptNoKey)
+	}
+
+	// content encrypted by one open decrypts after another
+	var encrypted, decrypted bytes.Buffer
+	if _, err := d.crypt.encryptStream(&encrypted, strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	d = New(DiffOpts{RootDstPath: dir, Passphrase: "secret"})
+	if err := d.openCrypt(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.crypt.decryptStream(&decrypted, &encrypted); err != nil || decrypted.String() != "hello" {
+		t.Errorf("decryptStream() = %q, %v, want %q", decrypted.String(), err, "hello")
+	}
+}
@@ -7,92 +7,387 @@ package diff
 import (
 	sha256 "crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
 
+	filecopy "github.com/dvonthenen/go-utilities/filecopy"
 	klog "k8s.io/klog/v2"
 )
 
 func New(opts DiffOpts) *Diff {
 	dist := &Diff{
-		options: opts,
+		options:  opts,
+		failed:   make(map[*DiffCompare]bool),
+		filtered: make(map[string]int),
+
+		audioChanges: make(map[string]int),
 	}
 	return dist
 }
 
 func (d *Diff) Process() error {
+	if strings.HasPrefix(d.options.RootSrcPath, GitPrefix) {
+		return d.processGit()
+	}
+	if archiveFormat(d.options.RootSrcPath) != "" || archiveFormat(d.options.RootDstPath) != "" {
+		return d.processArchive()
+	}
 	diff := make([]*DiffCompare, 0)
 
-	err := d.fileComparison(&diff)
+	err := d.checkErrorPolicy()
 	if err != nil {
-		klog.Errorf("fileComparison failed. Err: %v\n", err)
+		return err
+	}
+	err = d.checkCopyStrategy()
+	if err != nil {
+		return err
+	}
+	err = d.startThrottle()
+	if err != nil {
+		return err
+	}
+	defer d.stopThrottle()
+
+	// dry runs don't change anything so they don't need to keep others out, and with
+	// SkipSrcUpdate src may be read-only so only dst is locked
+	if !d.options.DryRun {
+		roots := []string{d.options.RootDstPath}
+		if !d.options.SkipSrcUpdate {
+			roots = append(roots, d.options.RootSrcPath)
+		}
+		var locks []*runLock
+		locks, err = lockRoots(roots, d.options.LockWait)
+		if err != nil {
+			klog.Errorf("lockRoots failed. Err: %v\n", err)
+			return err
+		}
+		defer unlockRoots(locks)
+	}
+
+	err = d.openDst()
+	if err != nil {
+		klog.Errorf("openDst failed. Err: %v\n", err)
 		return err
 	}
 
-	err = d.resolveDifferences(&diff)
+	err = d.resolveTargetFS()
 	if err != nil {
-		klog.Errorf("resolveDifferences failed. Err: %v\n", err)
+		klog.Errorf("resolveTargetFS failed. Err: %v\n", err)
 		return err
 	}
 
+	err = d.checkNormalize()
+	if err != nil {
+		klog.Errorf("checkNormalize failed. Err: %v\n", err)
+		return err
+	}
+
+	err = d.checkHash()
+	if err != nil {
+		klog.Errorf("checkHash failed. Err: %v\n", err)
+		return err
+	}
+
+	err = d.loadRules()
+	if err != nil {
+		klog.Errorf("loadRules failed. Err: %v\n", err)
+		return err
+	}
+
+	err = d.checkFilter()
+	if err != nil {
+		klog.Errorf("checkFilter failed. Err: %v\n", err)
+		return err
+	}
+
+	// reviews and safety limits need every change known before the first copy
+	stream := d.options.Stream && !d.options.Interactive && !d.hasSafetyLimits()
+	if d.options.Stream && !stream {
+		klog.Infof("Differences are copied after the comparison because of -interactive or safety limits\n")
+	}
+	if stream {
+		klog.V(3).Infof("Free space can't be checked ahead of a streamed run\n")
+	}
+
+	// case renames move dst directories so they wait until the walk is done
+	deferred := make([]*DiffCompare, 0)
+	err = d.fileComparison(func(dc *DiffCompare) error {
+		diff = append(diff, dc)
+		if !stream {
+			return nil
+		}
+		if dc.DstFile != nil && dc.SrcFile != nil && d.needsCaseRename(dc.SrcFile, dc.DstFile) {
+			deferred = append(deferred, dc)
+			return nil
+		}
+		return d.resolveDifferences([]*DiffCompare{dc})
+	})
+	if err != nil {
+		klog.Errorf("fileComparison failed. Err: %v\n", err)
+	} else if d.options.Interactive {
+		diff, err = d.review(diff)
+	}
+	if err == nil {
+		err = d.checkSafety(diff)
+	}
+	if err == nil && !stream {
+		err = d.checkSpace(diff)
+	}
+	if err == nil {
+		if !stream {
+			deferred = diff
+		}
+		err = d.resolveDifferences(deferred)
+		if err != nil {
+			klog.Errorf("resolveDifferences failed. Err: %v\n", err)
+		} else {
+			err = d.reportCopied(diff)
+		}
+	}
+
+	// with Stream files may have been copied even when the walk failed
+	if errManifest := d.saveManifest(); errManifest != nil {
+		klog.Errorf("saveManifest failed. Err: %v\n", errManifest)
+		if err == nil {
+			err = errManifest
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(d.collisions) > 0 {
+		klog.Infof("\n\n")
+		klog.Infof("Name collisions (skipped):\n")
+		for _, relPath := range d.collisions {
+			klog.Infof("%s\n", relPath)
+		}
+	}
+	d.reportFiltered()
+	d.reportAudio()
+	d.reportChanged()
+
+	return d.partialFailure()
+}
+
+// openDst prepares an encrypted dst and refuses to treat one as plain files
+func (d *Diff) openDst() error {
+	if d.options.EncryptDst {
+		err := d.openCrypt()
+		if err != nil {
+			klog.Errorf("openCrypt failed. Err: %v\n", err)
+			return err
+		}
+	} else if _, err := os.Stat(filepath.Join(d.options.RootDstPath, cryptHeaderFile)); err == nil {
+		klog.Errorf("%s is an encrypted tree\n", d.options.RootDstPath)
+		return ErrCryptRequired
+	}
 	return nil
 }
 
-func (d *Diff) fileComparison(diff *[]*DiffCompare) error {
+/*
+fileComparison compares src and dst calling emit for every difference as it is found.
+Plain trees are merge-walked in sorted order, an encrypted dst is matched through its
+manifest.
+*/
+func (d *Diff) fileComparison(emit func(*DiffCompare) error) error {
 	srcPath := d.options.RootSrcPath
-	lenSrc := len(srcPath)
 	dstPath := d.options.RootDstPath
-	lenDst := len(dstPath)
 	klog.V(4).Infof("srcPath: %s\n", srcPath)
 	klog.V(4).Infof("dstPath: %s\n", dstPath)
 
-	srcMap := make(map[string]*DiffFile, 0)
-	dstMap := make(map[string]*DiffFile, 0)
-
-	err := filepath.Walk(srcPath, func(path string, info os.FileInfo, err error) error {
-		filename := filepath.Base(path)
-		klog.V(6).Infof("[SRC] path: %s\n", path)
-		klog.V(6).Infof("[SRC] filename: %s\n", filename)
+	var err error
+	if d.options.SrcChecksumFile != "" {
+		d.srcSums, err = d.loadTrustedSums(d.options.SrcChecksumFile, srcPath, false)
 		if err != nil {
-			klog.Errorf("filepath.Walk Init. Err: %v\n", err)
+			klog.Errorf("loadTrustedSums(%s) Err: %v\n", d.options.SrcChecksumFile, err)
 			return err
 		}
-		if strings.EqualFold(srcPath, path) || strings.EqualFold(filename, ".") || strings.EqualFold(filename, "..") {
-			klog.V(6).Infof("[SRC] filepath.Walk(%s) skip . and ..\n", path)
-			return nil
+	}
+	if d.options.DstChecksumFile != "" {
+		d.dstSums, err = d.loadTrustedSums(d.options.DstChecksumFile, dstPath, true)
+		if err != nil {
+			klog.Errorf("loadTrustedSums(%s) Err: %v\n", d.options.DstChecksumFile, err)
+			return err
 		}
+	}
 
-		if info.IsDir() {
-			klog.V(4).Infof("IsDir\n")
-			return nil
-		}
-		newRel := path[lenSrc+1:]
-		klog.V(6).Infof("newRel: %s\n", newRel)
-		srcMap[newRel] = &DiffFile{
-			Path:    path,
-			RelPath: newRel,
-			Attr:    &info,
+	klog.V(6).Infof("File comparison...\n")
+
+	if d.crypt != nil {
+		for _, sums := range []*trustedSums{d.srcSums, d.dstSums} {
+			if sums != nil && sums.format.name != ChecksumSHA256 {
+				klog.Infof("Encrypted dst files are compared by their crypto/sha256 hash, ignoring %s sums\n", sums.format.name)
+			}
 		}
-		return nil
-	})
+	}
+
+	if d.crypt == nil {
+		return d.mergeTrees(emit)
+	}
+
+	srcMap, err := d.walkTree("SRC", srcPath)
+	if err != nil {
+		klog.Errorf("walkTree(%s) Err: %v\n", srcPath, err)
+		return err
+	}
+	dstMap, err := d.walkEncryptedTree()
 	if err != nil {
-		klog.Errorf("filepath.Walk(%s) Err: %v\n", srcPath, err)
+		klog.Errorf("walkTree(%s) Err: %v\n", dstPath, err)
 		return err
 	}
+	d.srcCount, d.dstCount = len(srcMap), len(dstMap)
+
+	for _, key := range sortedKeys(srcMap) {
+		if d.filterOut([]*DiffFile{srcMap[key], dstMap[key]}, []string{"src", "dst"}) {
+			continue
+		}
+		err = d.srcSums.apply(srcMap[key], key)
+		if err != nil {
+			return err
+		}
+		if dst := dstMap[key]; dst != nil {
+			err = d.dstSums.apply(dst, key)
+			if err != nil {
+				return err
+			}
+		}
+		diff, err := d.compareFiles(srcMap[key], dstMap[key])
+		if err != nil {
+			return err
+		}
+		if diff != nil {
+			err = emit(diff)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, key := range sortedKeys(dstMap) {
+		if srcMap[key] != nil || d.filterOut([]*DiffFile{dstMap[key]}, []string{"dst"}) {
+			continue
+		}
+		err = d.dstSums.apply(dstMap[key], key)
+		if err != nil {
+			return err
+		}
+		diff, err := d.compareFiles(nil, dstMap[key])
+		if err != nil {
+			return err
+		}
+		if diff != nil {
+			err = emit(diff)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
 
-	err = filepath.Walk(dstPath, func(path string, info os.FileInfo, err error) error {
+// compareFiles returns the difference between a src and dst file allowed by the sync rules
+func (d *Diff) compareFiles(src, dst *DiffFile) (*DiffCompare, error) {
+	relPath := ""
+	if src != nil {
+		relPath = src.RelPath
+	} else {
+		relPath = d.srcRelPath(dst.RelPath)
+	}
+	rule := d.matchRule(relPath)
+	if rule != nil && rule.Direction == RuleIgnore {
+		klog.V(4).Infof("[RULE] Ignoring %s (rule: %s)\n", relPath, rule)
+		return nil, nil
+	}
+
+	diff, err := d.compareContent(src, dst)
+	if diff == nil || rule == nil {
+		return diff, err
+	}
+	diff.Rule = rule
+	return d.applyRule(diff), nil
+}
+
+// compareContent returns the difference between a src and dst file, or nil when they match
+func (d *Diff) compareContent(src, dst *DiffFile) (*DiffCompare, error) {
+	if dst == nil {
+		klog.V(3).Infof("[ADDING] %s because dst is missing file.", src.Path)
+		return &DiffCompare{
+			SrcFile:   src,
+			DstFile:   nil,
+			Direction: DIRECTION_SRC_TO_DST,
+		}, nil
+	}
+	if src == nil {
+		klog.V(3).Infof("[ADDING] %s because src is missing file.\n", dst.Path)
+		return &DiffCompare{
+			SrcFile:   nil,
+			DstFile:   dst,
+			Direction: DIRECTION_DST_TO_SRC,
+		}, nil
+	}
+
+	cmp := d.compareModTime((*src.Attr).ModTime(), (*dst.Attr).ModTime())
+	if cmp != 0 {
+		srcHash, dstHash, err := d.contentHashes(src, dst)
+		if err != nil {
+			klog.Errorf("Error calculating hash(%s, %s)\n", src.Path, dst.Path)
+			return nil, d.fileError("hash", src.RelPath, err)
+		}
+
+		if srcHash != dstHash {
+			if cmp > 0 {
+				klog.V(3).Infof("[ADDING] %s hash: %s -> %s hash: %s\n", src.Path, srcHash, dst.Path, dstHash)
+				return &DiffCompare{
+					SrcFile:   src,
+					DstFile:   dst,
+					Direction: DIRECTION_SRC_TO_DST,
+					Audio:     d.classifyAudio(src, dst),
+				}, nil
+			}
+			klog.V(3).Infof("[ADDING] %s hash: %s <- %s hash: %s\n", src.Path, srcHash, dst.Path, dstHash)
+			return &DiffCompare{
+				SrcFile:   src,
+				DstFile:   dst,
+				Direction: DIRECTION_DST_TO_SRC,
+				Audio:     d.classifyAudio(src, dst),
+			}, nil
+		}
+	}
+
+	if d.needsCaseRename(src, dst) {
+		klog.V(3).Infof("[ADDING] %s because dst is spelled %s\n", src.Path, dst.RelPath)
+		return &DiffCompare{
+			SrcFile:    src,
+			DstFile:    dst,
+			Direction:  DIRECTION_SRC_TO_DST,
+			RenameOnly: true,
+		}, nil
+	}
+
+	return nil, nil
+}
+
+func (d *Diff) walkTree(label, rootPath string) (map[string]*DiffFile, error) {
+	lenRoot := len(rootPath)
+	isDst := rootPath == d.options.RootDstPath
+	files := make(map[string]*DiffFile, 0)
+
+	err := filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
 		filename := filepath.Base(path)
-		klog.V(6).Infof("[DST] path: %s\n", path)
-		klog.V(6).Infof("[DST] filename: %s\n", filename)
+		klog.V(6).Infof("[%s] path: %s\n", label, path)
+		klog.V(6).Infof("[%s] filename: %s\n", label, filename)
 		if err != nil {
 			klog.Errorf("filepath.Walk Init. Err: %v\n", err)
 			return err
 		}
-		if strings.EqualFold(dstPath, path) || strings.EqualFold(filename, ".") || strings.EqualFold(filename, "..") {
-			klog.V(6).Infof("filepath.Walk(%s) skip . and ..\n", path)
+		if strings.EqualFold(rootPath, path) || strings.EqualFold(filename, ".") || strings.EqualFold(filename, "..") {
+			klog.V(6).Infof("[%s] filepath.Walk(%s) skip . and ..\n", label, path)
 			return nil
 		}
 
@@ -100,9 +395,19 @@ func (d *Diff) fileComparison(diff *[]*DiffCompare) error {
 			klog.V(4).Infof("IsDir\n")
 			return nil
 		}
-		newRel := path[lenDst+1:]
+		if isInternalFile(filename) {
+			klog.V(4).Infof("[%s] skip internal file %s\n", label, path)
+			return nil
+		}
+		newRel := path[lenRoot+1:]
 		klog.V(6).Infof("newRel: %s\n", newRel)
-		dstMap[newRel] = &DiffFile{
+		key := d.pathKey(newRel, isDst)
+		if existing := files[key]; existing != nil {
+			klog.Infof("[%s] Skipping %s because it collides with %s\n", label, newRel, existing.RelPath)
+			d.collisions = append(d.collisions, newRel)
+			return nil
+		}
+		files[key] = &DiffFile{
 			Path:    path,
 			RelPath: newRel,
 			Attr:    &info,
@@ -110,213 +415,310 @@ func (d *Diff) fileComparison(diff *[]*DiffCompare) error {
 		return nil
 	})
 	if err != nil {
-		klog.Errorf("filepath.Walk(%s) Err: %v\n", dstPath, err)
-		return err
+		return nil, err
 	}
 
-	klog.V(6).Infof("File comparison...\n")
+	return files, nil
+}
 
-	for key, val := range srcMap {
-		dst := dstMap[key]
-		if dst == nil {
-			klog.V(3).Infof("[ADDING] %s because dst is missing file.", val.Path)
-			*diff = append(*diff, &DiffCompare{
-				SrcFile:   val,
-				DstFile:   nil,
-				Direction: DIRECTION_SRC_TO_DST,
-			})
+// resolveDifferences copies every difference, going past failed ones when the error policy allows
+func (d *Diff) resolveDifferences(diffs []*DiffCompare) error {
+	for _, diff := range diffs {
+		err := d.resolveDifference(diff)
+		if err == nil {
 			continue
 		}
-		if (*dst.Attr).ModTime().Before((*val.Attr).ModTime()) {
-			srcHash, err := d.getHash(val.Path)
-			if err != nil {
-				klog.Errorf("Error calculating sha256(%s)\n", val.Path)
-				continue
-			}
-			dstHash, err := d.getHash(dst.Path)
-			if err != nil {
-				klog.Errorf("Error calculating sha256(%s)\n", dst.Path)
-				continue
-			}
-
-			if srcHash != dstHash {
-				klog.V(3).Infof("[ADDING] %s hash: %s -> %s hash: %s\n", val.Path, srcHash, dst.Path, dstHash)
-				*diff = append(*diff, &DiffCompare{
-					SrcFile:   val,
-					DstFile:   dst,
-					Direction: DIRECTION_SRC_TO_DST,
-				})
-			}
-		} else if (*dst.Attr).ModTime().After((*val.Attr).ModTime()) {
-			srcHash, err := d.getHash(val.Path)
-			if err != nil {
-				klog.Errorf("Error calculating sha256(%s)\n", val.Path)
-				continue
-			}
-			dstHash, err := d.getHash(dst.Path)
-			if err != nil {
-				klog.Errorf("Error calculating sha256(%s)\n", dst.Path)
-				continue
-			}
-
-			if srcHash != dstHash {
-				klog.V(3).Infof("[ADDING] %s hash: %s <- %s hash: %s\n", val.Path, srcHash, dst.Path, dstHash)
-				*diff = append(*diff, &DiffCompare{
-					SrcFile:   val,
-					DstFile:   dst,
-					Direction: DIRECTION_DST_TO_SRC,
-				})
-			}
+		d.failed[diff] = true
+		if errors.Is(err, ErrFileChanged) {
+			d.changed = append(d.changed, diffRelPath(diff))
+			continue
 		}
-	}
-
-	for key, val := range dstMap {
-		src := srcMap[key]
-		if src == nil {
-			klog.V(3).Infof("[ADDING] %s because src is missing file.\n", val.Path)
-			*diff = append(*diff, &DiffCompare{
-				SrcFile:   nil,
-				DstFile:   val,
-				Direction: DIRECTION_DST_TO_SRC,
-			})
+		err = d.fileError("sync", diffRelPath(diff), err)
+		if err != nil {
+			return err
 		}
 	}
-
 	return nil
 }
 
-func (d *Diff) resolveDifferences(diffs *[]*DiffCompare) error {
-	for _, diff := range *diffs {
-		switch diff.Direction {
-		case DIRECTION_SRC_TO_DST:
-			newDst := filepath.Join(d.options.RootDstPath, diff.SrcFile.RelPath)
-			err := d.buildDir(newDst)
+// resolveDifference copies a single difference in the direction it points
+func (d *Diff) resolveDifference(diff *DiffCompare) error {
+	switch diff.Direction {
+	case DIRECTION_SRC_TO_DST:
+		var newDst string
+		dstRel := diff.SrcFile.RelPath
+		switch {
+		case diff.DstFile != nil && !d.needsCaseRename(diff.SrcFile, diff.DstFile):
+			// keep the spelling dst already uses
+			newDst = d.renamedPath(diff.DstFile.Path)
+			dstRel = diff.DstFile.RelPath
+		case d.crypt != nil:
+			var err error
+			newDst, err = d.encryptedDstPath(diff.SrcFile.RelPath)
 			if err != nil {
-				klog.Errorf("buildDir(%s) failed. Err: %v\n", newDst, err)
+				klog.Errorf("encryptedDstPath(%s) failed. Err: %v\n", diff.SrcFile.RelPath, err)
 				return err
 			}
-			_, err = d.copy(diff.SrcFile.Path, newDst)
+		default:
+			newDst = filepath.Join(d.options.RootDstPath, d.dstRelPath(diff.SrcFile.RelPath))
+		}
+		if diff.DstFile != nil && d.needsCaseRename(diff.SrcFile, diff.DstFile) {
+			err := d.renameCase(diff.DstFile.Path, newDst)
 			if err != nil {
-				klog.Errorf("copy(%s, %s) failed. Err: %v\n", diff.SrcFile.Path, newDst, err)
+				klog.Errorf("renameCase(%s, %s) failed. Err: %v\n", diff.DstFile.Path, newDst, err)
 				return err
 			}
-
-			klog.V(4).Infof("[SRC -> DST] Paths: %s to %s\n", diff.SrcFile.Path, newDst)
-			if d.options.DryRun {
-				klog.Infof("[SRC -> DST] Diff: %s\n", diff.SrcFile.RelPath)
-			} else {
-				klog.Infof("[SRC -> DST] Copying... %s\n", diff.SrcFile.RelPath)
+			if diff.RenameOnly {
+				if d.options.DryRun {
+					klog.Infof("[SRC -> DST] Diff: %s\n", diff.SrcFile.RelPath)
+				} else {
+					klog.Infof("[SRC -> DST] Renaming... %s\n", diff.SrcFile.RelPath)
+				}
+				klog.Infof("\tDestination file is spelled %s\n", diff.DstFile.RelPath)
+				klog.Infof("\n")
+				return nil
 			}
-			if diff.DstFile == nil {
-				klog.Infof("\tDestination file does not exist\n")
-			} else if diff.SrcFile.Hash != "" && diff.SrcFile.Hash != diff.DstFile.Hash {
-				klog.Infof("\tHash mismatch: %s -> %s\n", diff.SrcFile.Hash, diff.DstFile.Hash)
-			} else {
-				srcTime := (*diff.SrcFile.Attr).ModTime()
-				dstTime := (*diff.DstFile.Attr).ModTime()
-				klog.Infof("\tSrc Mod Time: %d-%02d-%02dT%02d:%02d:%02d != Dst Mod Time: %d-%02d-%02dT%02d:%02d:%02d\n",
-					srcTime.Year(), srcTime.Month(), srcTime.Day(),
-					srcTime.Hour(), srcTime.Minute(), srcTime.Second(),
-					dstTime.Year(), dstTime.Month(), dstTime.Day(),
-					dstTime.Hour(), dstTime.Minute(), dstTime.Second(),
-				)
+		}
+		err := d.buildDir(newDst)
+		if err != nil {
+			klog.Errorf("buildDir(%s) failed. Err: %v\n", newDst, err)
+			return err
+		}
+		conflictRel := ""
+		if diff.DstFile != nil && diff.Rule != nil && diff.Rule.Conflict == ConflictKeepBoth {
+			conflictRel, err = d.keepConflictCopy(diff.DstFile, true)
+			if err != nil {
+				klog.Errorf("keepConflictCopy(%s) failed. Err: %v\n", diff.DstFile.Path, err)
+				return err
 			}
-			klog.Infof("\n")
-		case DIRECTION_DST_TO_SRC:
-			if d.options.SkipSrcUpdate {
-				klog.V(3).Infof("Skipping src update because SkipSrcUpdate is true\n")
-				continue
+		}
+		planned := diff.DstFile
+		if conflictRel != "" {
+			// the compared target was moved aside
+			planned = nil
+		}
+		err = d.copyChecked(diff.SrcFile, planned, newDst, true, d.crypt != nil, func() error {
+			if d.crypt != nil {
+				_, err := d.encryptCopy(diff.SrcFile, newDst, dstRel)
+				return err
+			}
+			if d.tagsOnly(diff) {
+				return d.syncTags(diff.SrcFile.Path, newDst)
 			}
+			_, err := d.copy(diff.SrcFile.Path, newDst)
+			return err
+		})
+		if err != nil && !errors.Is(err, ErrFileChanged) {
+			klog.Errorf("copy(%s, %s) failed. Err: %v\n", diff.SrcFile.Path, newDst, err)
+		}
+		if err != nil {
+			return err
+		}
 
-			newSrc := filepath.Join(d.options.RootSrcPath, diff.DstFile.RelPath)
-			err := d.buildDir(newSrc)
+		klog.V(4).Infof("[SRC -> DST] Paths: %s to %s\n", diff.SrcFile.Path, newDst)
+		if d.options.DryRun {
+			klog.Infof("[SRC -> DST] Diff: %s%s\n", diff.SrcFile.RelPath, d.ruleSuffix(diff))
+		} else {
+			klog.Infof("[SRC -> DST] Copying... %s%s\n", diff.SrcFile.RelPath, d.ruleSuffix(diff))
+		}
+		if diff.DstFile == nil {
+			klog.Infof("\tDestination file does not exist\n")
+		} else if diff.SrcFile.Hash != "" && diff.SrcFile.Hash != diff.DstFile.Hash {
+			klog.Infof("\tHash mismatch: %s -> %s\n", diff.SrcFile.Hash, diff.DstFile.Hash)
+		} else {
+			srcTime := (*diff.SrcFile.Attr).ModTime()
+			dstTime := (*diff.DstFile.Attr).ModTime()
+			klog.Infof("\tSrc Mod Time: %d-%02d-%02dT%02d:%02d:%02d != Dst Mod Time: %d-%02d-%02dT%02d:%02d:%02d\n",
+				srcTime.Year(), srcTime.Month(), srcTime.Day(),
+				srcTime.Hour(), srcTime.Minute(), srcTime.Second(),
+				dstTime.Year(), dstTime.Month(), dstTime.Day(),
+				dstTime.Hour(), dstTime.Minute(), dstTime.Second(),
+			)
+		}
+		if diff.Audio != "" {
+			klog.Infof("\tAudio: %s\n", diff.Audio)
+		}
+		if conflictRel != "" {
+			klog.Infof("\tKeeping the older version as %s\n", conflictRel)
+		}
+		d.printContentDiff(diff)
+		klog.Infof("\n")
+	case DIRECTION_DST_TO_SRC:
+		if d.options.SkipSrcUpdate {
+			klog.V(3).Infof("Skipping src update because SkipSrcUpdate is true\n")
+			return nil
+		}
+
+		newSrc := filepath.Join(d.options.RootSrcPath, d.srcRelPath(diff.DstFile.RelPath))
+		if diff.SrcFile != nil {
+			newSrc = diff.SrcFile.Path
+		}
+		err := d.buildDir(newSrc)
+		if err != nil {
+			klog.Errorf("buildDir(%s) failed. Err: %v\n", newSrc, err)
+			return err
+		}
+		conflictRel := ""
+		if diff.SrcFile != nil && diff.Rule != nil && diff.Rule.Conflict == ConflictKeepBoth {
+			conflictRel, err = d.keepConflictCopy(diff.SrcFile, false)
 			if err != nil {
-				klog.Errorf("buildDir(%s) failed. Err: %v\n", newSrc, err)
+				klog.Errorf("keepConflictCopy(%s) failed. Err: %v\n", diff.SrcFile.Path, err)
 				return err
 			}
-			_, err = d.copy(diff.DstFile.Path, newSrc)
-			if err != nil {
-				klog.Errorf("copy(%s, %s) failed. Err: %v\n", diff.DstFile.Path, newSrc, err)
+		}
+		diff.DstFile.Path = d.renamedPath(diff.DstFile.Path)
+		planned := diff.SrcFile
+		if conflictRel != "" {
+			// the compared target was moved aside
+			planned = nil
+		}
+		err = d.copyChecked(diff.DstFile, planned, newSrc, d.crypt == nil, false, func() error {
+			if d.crypt != nil {
+				_, err := d.decryptCopy(diff.DstFile, newSrc)
 				return err
 			}
-
-			klog.V(4).Infof("[DST -> SRC] Paths: %s to %s\n", diff.DstFile.Path, newSrc)
-			if d.options.DryRun {
-				klog.Infof("[DST -> SRC] Diff: %s\n", diff.DstFile.RelPath)
-			} else {
-				klog.Infof("[DST -> SRC] Copying... %s\n", diff.DstFile.RelPath)
-			}
-			if diff.SrcFile == nil {
-				klog.Infof("\tSource file does not exist\n")
-			} else if diff.SrcFile.Hash != "" && diff.SrcFile.Hash != diff.DstFile.Hash {
-				klog.Infof("\tHash mismatch: %s -> %s\n", diff.SrcFile.Hash, diff.DstFile.Hash)
-			} else {
-				srcTime := (*diff.SrcFile.Attr).ModTime()
-				dstTime := (*diff.DstFile.Attr).ModTime()
-				klog.Infof("\tSrc Mod Time: %d-%02d-%02dT%02d:%02d:%02d != Dst Mod Time: %d-%02d-%02dT%02d:%02d:%02d\n",
-					srcTime.Year(), srcTime.Month(), srcTime.Day(),
-					srcTime.Hour(), srcTime.Minute(), srcTime.Second(),
-					dstTime.Year(), dstTime.Month(), dstTime.Day(),
-					dstTime.Hour(), dstTime.Minute(), dstTime.Second(),
-				)
+			if d.tagsOnly(diff) {
+				return d.syncTags(diff.DstFile.Path, newSrc)
 			}
-			klog.Infof("\n")
-		default:
-			klog.Errorf("Unknown direction: %d\n", diff.Direction)
-			return ErrUnknownDirection
+			_, err := d.copy(diff.DstFile.Path, newSrc)
+			return err
+		})
+		if err != nil && !errors.Is(err, ErrFileChanged) {
+			klog.Errorf("copy(%s, %s) failed. Err: %v\n", diff.DstFile.Path, newSrc, err)
+		}
+		if err != nil {
+			return err
+		}
+
+		klog.V(4).Infof("[DST -> SRC] Paths: %s to %s\n", diff.DstFile.Path, newSrc)
+		if d.options.DryRun {
+			klog.Infof("[DST -> SRC] Diff: %s%s\n", diff.DstFile.RelPath, d.ruleSuffix(diff))
+		} else {
+			klog.Infof("[DST -> SRC] Copying... %s%s\n", diff.DstFile.RelPath, d.ruleSuffix(diff))
+		}
+		if diff.SrcFile == nil {
+			klog.Infof("\tSource file does not exist\n")
+		} else if diff.SrcFile.Hash != "" && diff.SrcFile.Hash != diff.DstFile.Hash {
+			klog.Infof("\tHash mismatch: %s -> %s\n", diff.SrcFile.Hash, diff.DstFile.Hash)
+		} else {
+			srcTime := (*diff.SrcFile.Attr).ModTime()
+			dstTime := (*diff.DstFile.Attr).ModTime()
+			klog.Infof("\tSrc Mod Time: %d-%02d-%02dT%02d:%02d:%02d != Dst Mod Time: %d-%02d-%02dT%02d:%02d:%02d\n",
+				srcTime.Year(), srcTime.Month(), srcTime.Day(),
+				srcTime.Hour(), srcTime.Minute(), srcTime.Second(),
+				dstTime.Year(), dstTime.Month(), dstTime.Day(),
+				dstTime.Hour(), dstTime.Minute(), dstTime.Second(),
+			)
+		}
+		if diff.Audio != "" {
+			klog.Infof("\tAudio: %s\n", diff.Audio)
 		}
+		if conflictRel != "" {
+			klog.Infof("\tKeeping the older version as %s\n", conflictRel)
+		}
+		d.printContentDiff(diff)
+		klog.Infof("\n")
+	default:
+		klog.Errorf("Unknown direction: %d\n", diff.Direction)
+		return ErrUnknownDirection
 	}
+	return nil
+}
 
+// reportCopied prints the summary of everything that was copied
+func (d *Diff) reportCopied(diffs []*DiffCompare) error {
 	if d.options.DryRun {
 		return nil
 	}
 
-	if len(*diffs) > 0 {
+	if len(diffs) > 0 {
 		klog.Infof("\n\n")
 		klog.Infof("Copied files:\n")
-		for _, diff := range *diffs {
+		for _, diff := range diffs {
+			if d.failed[diff] {
+				continue
+			}
 			switch diff.Direction {
 			case DIRECTION_SRC_TO_DST:
-				klog.Infof("[SRC -> DST] Copied %s\n", diff.SrcFile.RelPath)
+				if diff.RenameOnly {
+					klog.Infof("[SRC -> DST] Renamed %s%s\n", diff.SrcFile.RelPath, d.ruleSuffix(diff))
+					continue
+				}
+				klog.Infof("[SRC -> DST] Copied %s%s\n", diff.SrcFile.RelPath, d.ruleSuffix(diff))
 			case DIRECTION_DST_TO_SRC:
-				klog.Infof("[DST -> SRC] Copied %s\n", diff.DstFile.RelPath)
+				klog.Infof("[DST -> SRC] Copied %s%s\n", diff.DstFile.RelPath, d.ruleSuffix(diff))
 			default:
 				klog.Errorf("Unknown direction: %d\n", diff.Direction)
 				return ErrUnknownDirection
 			}
 		}
 	}
+	if summary := d.strategySummary(); summary != "" {
+		klog.Infof("Copied with: %s\n", summary)
+	}
+	if summary := d.sparseSummary(); summary != "" {
+		klog.Infof("Sparse files: %s\n", summary)
+	}
 	return nil
 }
 
+// fileHash returns the hash of the file calculating it only when not already known
+func (d *Diff) fileHash(file *DiffFile) (string, error) {
+	if file.Hash != "" {
+		return file.Hash, nil
+	}
+
+	hash, err := d.getHash(file.Path)
+	if err != nil {
+		return "", err
+	}
+	file.Hash = hash
+	return hash, nil
+}
+
 func (d *Diff) getHash(path string) (string, error) {
+	d.throttle.readFile()
 	f, err := os.Open(path)
 	if err != nil {
 		return "", err
 	}
 	defer f.Close()
 
+	sum, err := hashReader(d.throttle.reader(f))
+	if err != nil {
+		return "", err
+	}
+
+	return base64.URLEncoding.EncodeToString(sum), nil
+}
+
+func hashReader(r io.Reader) ([]byte, error) {
+	return hashReaderWith(r, sha256.New())
+}
+
+func hashReaderWith(r io.Reader, hash hash.Hash) ([]byte, error) {
 	buf := make([]byte, 8194)
-	hash := sha256.New()
 	for {
-		srcN, err := f.Read(buf)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return "", err
-		}
+		// a reader may return the last bytes together with io.EOF
+		srcN, errRead := r.Read(buf)
 
 		dstN, err := hash.Write(buf[:srcN])
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 		if srcN != dstN {
-			return "", ErrDiffSizeCopied
+			return nil, ErrDiffSizeCopied
+		}
+
+		if errRead == io.EOF {
+			break
+		}
+		if errRead != nil {
+			return nil, errRead
 		}
 	}
 
-	return base64.URLEncoding.EncodeToString(hash.Sum(nil)), nil
+	return hash.Sum(nil), nil
 }
 
 func (d *Diff) buildDir(path string) error {
@@ -351,6 +753,7 @@ func (d *Diff) copy(src, dst string) (int64, error) {
 	if !sourceFileStat.Mode().IsRegular() {
 		return 0, fmt.Errorf("%s is not a regular file", src)
 	}
+	d.throttle.writeFile()
 
 	source, err := os.Open(src)
 	if err != nil {
@@ -365,7 +768,19 @@ func (d *Diff) copy(src, dst string) (int64, error) {
 		return 0, err
 	}
 	defer destination.Close()
-	nBytes, err := io.Copy(destination, source)
+	sparse := filecopy.IsSparse(source, sourceFileStat)
+	strategy, nBytes, err := filecopy.Copy(destination, source, sourceFileStat.Size(), filecopy.Options{
+		Strategy: d.options.CopyStrategy,
+		Sparse:   sparse,
+		Pace:     d.throttle.pacer(),
+	})
+	if err == nil {
+		klog.V(4).Infof("[COPY] %s via %s\n", dst, strategy)
+		d.countStrategy(strategy)
+		if sparse {
+			d.countSparse(dst, sourceFileStat.Size())
+		}
+	}
 	if sourceFileStat.Size() != nBytes {
 		klog.Errorf("copy byte size mismatch. src: %d != dst: %d\n", sourceFileStat.Size(), nBytes)
 		return nBytes, fmt.Errorf("copy byte size mismatch. src: %d != dst: %d", sourceFileStat.Size(), nBytes)
@@ -0,0 +1,187 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+
+	klog "k8s.io/klog/v2"
+)
+
+/*
+findDuplicates groups the files of the same size by their hash, only sizes shared by
+more than one file are hashed. Groups are sorted by the bytes they waste.
+*/
+func (d *Diff) findDuplicates(bySize map[int64][]*DuplicateFile) ([]*DuplicateGroup, error) {
+	sizes := make([]int64, 0, len(bySize))
+	for size, files := range bySize {
+		if len(files) > 1 {
+			sizes = append(sizes, size)
+		}
+	}
+	sort.Slice(sizes, func(a, b int) bool { return sizes[a] > sizes[b] })
+
+	groups := make([]*DuplicateGroup, 0)
+	for _, size := range sizes {
+		byHash := make(map[string]*DuplicateGroup)
+		hashes := make([]string, 0)
+		for _, file := range bySize[size] {
+			hash, err := d.fileHash(file.File)
+			if err != nil {
+				klog.Errorf("fileHash(%s) failed. Err: %v\n", file.File.Path, err)
+				err = d.fileError("hash", file.File.RelPath, err)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if byHash[hash] == nil {
+				byHash[hash] = &DuplicateGroup{Size: size, Hash: hash}
+				hashes = append(hashes, hash)
+			}
+			byHash[hash].Files = append(byHash[hash].Files, file)
+		}
+		for _, hash := range hashes {
+			if group := byHash[hash]; len(group.Files) > 1 {
+				group.sort()
+				groups = append(groups, group)
+			}
+		}
+	}
+
+	sort.SliceStable(groups, func(a, b int) bool {
+		return groups[a].Wasted() > groups[b].Wasted()
+	})
+	return groups, nil
+}
+
+// sort puts src before dst and orders each tree by path, the first file is the one kept
+func (g *DuplicateGroup) sort() {
+	sort.Slice(g.Files, func(a, b int) bool {
+		if g.Files[a].Dst != g.Files[b].Dst {
+			return !g.Files[a].Dst
+		}
+		return g.Files[a].File.RelPath < g.Files[b].File.RelPath
+	})
+}
+
+// Wasted is the bytes taken by the copies, files already hardlinked to another one are free
+func (g *DuplicateGroup) Wasted() int64 {
+	distinct := make([]os.FileInfo, 0, len(g.Files))
+	for _, file := range g.Files {
+		info := *file.File.Attr
+		shared := false
+		for _, other := range distinct {
+			if os.SameFile(info, other) {
+				shared = true
+				break
+			}
+		}
+		if !shared {
+			distinct = append(distinct, info)
+		}
+	}
+	return int64(len(distinct)-1) * g.Size
+}
+
+func (f *DuplicateFile) String() string {
+	if f.Dst {
+		return "dst: " + f.File.RelPath
+	}
+	return "src: " + f.File.RelPath
+}
+
+/*
+hardlinkDuplicates replaces every copy in a group with a hardlink to the first file of
+its tree, or to the first file of the group with crossTree. Linking dst to src would tie
+the backup to the files it backs up. A file that changed since it was hashed is left
+alone, and files on another filesystem than the first can't be linked and fail.
+*/
+func (d *Diff) hardlinkDuplicates(report *StatsReport, crossTree bool) error {
+	for _, group := range report.Duplicates {
+		if crossTree {
+			err := d.hardlinkFiles(report, group.Size, group.Files)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// sorted src first, so each tree is a run of the group
+		src := 0
+		for src < len(group.Files) && !group.Files[src].Dst {
+			src++
+		}
+		for _, files := range [][]*DuplicateFile{group.Files[:src], group.Files[src:]} {
+			if len(files) < 2 {
+				continue
+			}
+			err := d.hardlinkFiles(report, group.Size, files)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hardlinkFiles links every file to the first one
+func (d *Diff) hardlinkFiles(report *StatsReport, size int64, files []*DuplicateFile) error {
+	keep := files[0].File
+	keepNow, err := os.Stat(keep.Path)
+	if err != nil || statChange(*keep.Attr, keepNow) != "" {
+		klog.Infof("[HARDLINK] %s changed since it was hashed, skipping its group\n", keep.Path)
+		return nil
+	}
+
+	for _, file := range files[1:] {
+		if os.SameFile(keepNow, *file.File.Attr) {
+			continue
+		}
+		if d.options.DryRun {
+			klog.Infof("DryRun: link(%s, %s)\n", keep.Path, file.File.Path)
+			continue
+		}
+
+		err := d.hardlink(keep.Path, file.File)
+		if err != nil {
+			klog.Errorf("hardlink(%s, %s) failed. Err: %v\n", keep.Path, file.File.Path, err)
+			err = d.fileError("hardlink", file.File.RelPath, err)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		klog.V(3).Infof("[HARDLINK] %s -> %s\n", file.File.Path, keep.Path)
+		report.Linked++
+		report.Reclaimed += size
+	}
+	return nil
+}
+
+// hardlink links a temporary name to keep and renames it over file so file is never missing
+func (d *Diff) hardlink(keep string, file *DiffFile) error {
+	now, err := os.Stat(file.Path)
+	if err != nil {
+		return err
+	}
+	if change := statChange(*file.Attr, now); change != "" {
+		return ErrFileChanged
+	}
+
+	tmp := filepath.Join(filepath.Dir(file.Path), ".diff-directory-link-"+filepath.Base(file.Path))
+	err = os.Link(keep, tmp)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, file.Path)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build linux
+
+package diff
+
+import (
+	"os"
+
+	unix "golang.org/x/sys/unix"
+	klog "k8s.io/klog/v2"
+)
+
+// dropCache flushes the file and asks the kernel to evict its pages so the next
+// read comes from the device instead of the page cache
+func dropCache(f *os.File) {
+	err := f.Sync()
+	if err != nil {
+		klog.V(4).Infof("Sync(%s) failed. Err: %v\n", f.Name(), err)
+	}
+	err = unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+	if err != nil {
+		klog.V(4).Infof("Fadvise(%s) failed. Err: %v\n", f.Name(), err)
+	}
+}
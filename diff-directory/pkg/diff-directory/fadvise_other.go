@@ -0,0 +1,21 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !linux
+
+package diff
+
+import (
+	"os"
+
+	klog "k8s.io/klog/v2"
+)
+
+// dropCache flushes the file, evicting the page cache is not supported here
+func dropCache(f *os.File) {
+	err := f.Sync()
+	if err != nil {
+		klog.V(4).Infof("Sync(%s) failed. Err: %v\n", f.Name(), err)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"fmt"
+
+	klog "k8s.io/klog/v2"
+)
+
+/*
+Error policy
+
+A failure on one file (permission denied, an I/O error, a file that vanished during the
+walk) either stops the run right away (fail-fast) or is recorded and the run goes on
+with the next file (continue). Either way the caller gets a *FileError naming the file,
+and a run that continued past failures returns all of them as FileErrors.
+*/
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Path, e.Err)
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+func (e FileErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	return fmt.Sprintf("%d files failed, first: %v", len(e), e[0])
+}
+
+// Unwrap makes errors.Is(err, ErrPartialFailure) true for a run that continued past failures
+func (e FileErrors) Unwrap() error {
+	return ErrPartialFailure
+}
+
+// checkErrorPolicy makes sure the error policy is one of the known ones
+func (d *Diff) checkErrorPolicy() error {
+	switch d.options.ErrorPolicy {
+	case "", ErrorPolicyFailFast, ErrorPolicyContinue:
+		return nil
+	}
+	klog.Errorf("Unknown error policy: %s\n", d.options.ErrorPolicy)
+	return ErrUnknownErrorPolicy
+}
+
+/*
+fileError records a failure on a single file, returning it when the run has to stop
+and nil when the error policy is to continue with the next file.
+*/
+func (d *Diff) fileError(op, relPath string, err error) error {
+	if relPath == "" {
+		relPath = "."
+	}
+	fileErr := &FileError{
+		Path: relPath,
+		Op:   op,
+		Err:  err,
+	}
+	if d.options.ErrorPolicy != ErrorPolicyContinue {
+		return fileErr
+	}
+
+	klog.Errorf("[ERROR] %v\n", fileErr)
+	d.fileErrors = append(d.fileErrors, fileErr)
+	return nil
+}
+
+// partialFailure returns the recorded failures, nil when there are none
+func (d *Diff) partialFailure() error {
+	if len(d.fileErrors) == 0 {
+		return nil
+	}
+	return d.fileErrors
+}
@@ -0,0 +1,172 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	klog "k8s.io/klog/v2"
+)
+
+/*
+Filters
+
+Filters narrow a comparison down to the files modified within a time window, sized
+within a range and not in an excluded extension class. They are checked on both trees
+during the walk: a path is compared when the file on either side passes, so a file that
+only just changed in one tree is still synced over the old one, and is left out entirely
+when no side passes.
+*/
+
+// extensionClasses are the extensions of each class that can be excluded
+var extensionClasses = map[string][]string{
+	FilterClassAudio: {".mp3", ".flac", ".m4a", ".aac", ".ogg", ".oga", ".opus", ".wav", ".wma", ".aif", ".aiff", ".ape", ".alac", ".mka"},
+	FilterClassVideo: {".mp4", ".m4v", ".mkv", ".avi", ".mov", ".wmv", ".webm", ".mpg", ".mpeg", ".flv", ".3gp", ".ts", ".vob"},
+	FilterClassImages: {".jpg", ".jpeg", ".png", ".gif", ".bmp", ".tif", ".tiff", ".webp", ".heic", ".heif", ".svg", ".raw",
+		".cr2", ".cr3", ".nef", ".arw", ".dng", ".orf", ".rw2"},
+}
+
+// ParseAge parses a duration that also accepts days (7d) and weeks (2w)
+func ParseAge(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+
+	unit := time.Duration(0)
+	switch {
+	case strings.HasSuffix(s, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(s, "w"):
+		unit = 7 * 24 * time.Hour
+	}
+	if unit != 0 {
+		n, err := strconv.ParseFloat(s[:len(s)-1], 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("%w: %s", ErrInvalidAge, s)
+		}
+		return time.Duration(n * float64(unit)), nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidAge, s)
+	}
+	return d, nil
+}
+
+func (o *FilterOpts) active() bool {
+	return o.NewerThan > 0 || o.OlderThan > 0 || o.MinSize > 0 || o.MaxSize > 0 || len(o.ExcludeClasses) > 0
+}
+
+// checkFilter validates the filters and fixes the time they are relative to
+func (d *Diff) checkFilter() error {
+	opts := &d.options.Filter
+	if opts.NewerThan < 0 || opts.OlderThan < 0 || opts.MinSize < 0 || opts.MaxSize < 0 {
+		return ErrInvalidFilter
+	}
+	if opts.MaxSize > 0 && opts.MinSize > opts.MaxSize {
+		klog.Errorf("min size %d is larger than max size %d\n", opts.MinSize, opts.MaxSize)
+		return ErrInvalidFilter
+	}
+	if opts.NewerThan > 0 && opts.OlderThan > 0 && opts.OlderThan >= opts.NewerThan {
+		klog.Errorf("newer than %v and older than %v leave no files\n", opts.NewerThan, opts.OlderThan)
+		return ErrInvalidFilter
+	}
+
+	d.excludeExts = make(map[string]bool)
+	for _, class := range opts.ExcludeClasses {
+		exts, ok := extensionClasses[class]
+		if !ok {
+			klog.Errorf("Unknown extension class: %s\n", class)
+			return ErrUnknownExtensionClass
+		}
+		for _, ext := range exts {
+			d.excludeExts[ext] = true
+		}
+	}
+
+	d.filterNow = time.Now()
+	return nil
+}
+
+// passes reports whether a file gets through the filters
+func (d *Diff) passes(file *DiffFile) bool {
+	opts := &d.options.Filter
+	info := *file.Attr
+
+	if opts.NewerThan > 0 && info.ModTime().Before(d.filterNow.Add(-opts.NewerThan)) {
+		return false
+	}
+	if opts.OlderThan > 0 && info.ModTime().After(d.filterNow.Add(-opts.OlderThan)) {
+		return false
+	}
+	if opts.MinSize > 0 && info.Size() < opts.MinSize {
+		return false
+	}
+	if opts.MaxSize > 0 && info.Size() > opts.MaxSize {
+		return false
+	}
+	return !d.excludeExts[strings.ToLower(filepath.Ext(file.RelPath))]
+}
+
+/*
+filterOut reports whether the files of one path, nil where a tree doesn't have it, are
+all filtered out, counting each against the label of its tree.
+*/
+func (d *Diff) filterOut(files []*DiffFile, labels []string) bool {
+	if !d.options.Filter.active() {
+		return false
+	}
+	present := 0
+	for _, file := range files {
+		if file == nil {
+			continue
+		}
+		if d.passes(file) {
+			return false
+		}
+		present++
+	}
+	if present == 0 {
+		return false
+	}
+
+	for i, file := range files {
+		if file != nil {
+			klog.V(4).Infof("[FILTER] [%s] %s\n", labels[i], file.RelPath)
+			d.filtered[labels[i]]++
+		}
+	}
+	return true
+}
+
+// filterSummary lists the files filtered out of each tree, empty when none were
+func (d *Diff) filterSummary() string {
+	labels := make([]string, 0, len(d.filtered))
+	for label := range d.filtered {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	parts := make([]string, 0, len(labels))
+	for _, label := range labels {
+		parts = append(parts, fmt.Sprintf("%s %d", label, d.filtered[label]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// reportFiltered prints the filtered out counts
+func (d *Diff) reportFiltered() {
+	if summary := d.filterSummary(); summary != "" {
+		klog.Infof("\n\n")
+		klog.Infof("Filtered out: %s\n", summary)
+	}
+}
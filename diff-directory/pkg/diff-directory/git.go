@@ -0,0 +1,653 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	klog "k8s.io/klog/v2"
+)
+
+/*
+Git source
+
+A src of git:<repo>@<rev> is read straight from the object database of the repository,
+nothing is checked out. dst files are compared by their git blob id so an unchanged file
+is only read on the dst side, and a changed one is written from its blob. The git side
+is never written: files only in dst are reported, not copied back or removed. Every
+file takes the commit time as its mod time. The whole tree is compared before anything is
+written so the safety limits and the free space are checked against the full plan.
+*/
+
+const (
+	gitChangeBlob = "blob"
+	gitChangeLink = "link"
+	gitChangeMode = "mode"
+)
+
+// gitWalk is the state of a run from a git source
+type gitWalk struct {
+	repo     *gitRepo
+	commitAt time.Time
+
+	attrs     []gitAttrRule // from the .gitattributes files above the current directory
+	infoAttrs []gitAttrRule // from info/attributes
+	macros    map[string][]string
+
+	changes  []*gitChange
+	copied   []string
+	extra    []string // only in dst
+	filtered []string // rewritten on checkout
+}
+
+// gitChange is one planned write to dst
+type gitChange struct {
+	kind    string
+	diff    *DiffCompare // nil for a mode change
+	entry   gitTreeEntry
+	dstPath string
+	relPath string
+	mode    fs.FileMode // the mode of a blob, the new mode of a mode change
+	target  string      // the target of a link
+	reason  string
+	replace bool // something is in the way of a link
+}
+
+func (i *treeFileInfo) Name() string       { return i.name }
+func (i *treeFileInfo) Size() int64        { return i.size }
+func (i *treeFileInfo) Mode() fs.FileMode  { return i.mode }
+func (i *treeFileInfo) ModTime() time.Time { return i.modTime }
+func (i *treeFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *treeFileInfo) Sys() interface{}   { return nil }
+
+// ParseGitSource splits git:<repo>@<rev>, the revision defaults to HEAD
+func ParseGitSource(src string) (string, string, bool) {
+	if !strings.HasPrefix(src, GitPrefix) {
+		return "", "", false
+	}
+	src = strings.TrimPrefix(src, GitPrefix)
+	at := strings.LastIndex(src, "@")
+	if at < 0 {
+		return src, "HEAD", true
+	}
+	rev := src[at+1:]
+	if rev == "" {
+		rev = "HEAD"
+	}
+	return src[:at], rev, true
+}
+
+func (d *Diff) processGit() error {
+	repoPath, rev, _ := ParseGitSource(d.options.RootSrcPath)
+
+	if d.options.EncryptDst || d.options.Interactive || d.options.SrcChecksumFile != "" || d.options.DstChecksumFile != "" {
+		klog.Errorf("A git source doesn't work with encryption, -interactive or checksum files\n")
+		return fmt.Errorf("%w: encryption, interactive review or checksum files", ErrGitUnsupported)
+	}
+
+	err := d.checkErrorPolicy()
+	if err != nil {
+		return err
+	}
+	err = d.startThrottle()
+	if err != nil {
+		return err
+	}
+	defer d.stopThrottle()
+
+	if !d.options.DryRun {
+		var locks []*runLock
+		locks, err = lockRoots([]string{d.options.RootDstPath}, d.options.LockWait)
+		if err != nil {
+			klog.Errorf("lockRoots failed. Err: %v\n", err)
+			return err
+		}
+		defer unlockRoots(locks)
+	}
+
+	err = d.resolveTargetFS()
+	if err != nil {
+		klog.Errorf("resolveTargetFS failed. Err: %v\n", err)
+		return err
+	}
+	err = d.checkNormalize()
+	if err != nil {
+		klog.Errorf("checkNormalize failed. Err: %v\n", err)
+		return err
+	}
+	err = d.loadRules()
+	if err != nil {
+		klog.Errorf("loadRules failed. Err: %v\n", err)
+		return err
+	}
+	err = d.checkFilter()
+	if err != nil {
+		klog.Errorf("checkFilter failed. Err: %v\n", err)
+		return err
+	}
+
+	repo, err := openGitRepo(repoPath)
+	if err != nil {
+		klog.Errorf("openGitRepo(%s) failed. Err: %v\n", repoPath, err)
+		return err
+	}
+	defer repo.close()
+
+	id, err := repo.resolve(rev)
+	if err != nil {
+		klog.Errorf("resolve(%s) failed. Err: %v\n", rev, err)
+		return err
+	}
+	tree, commitAt, err := repo.rootTree(id)
+	if err != nil {
+		klog.Errorf("rootTree(%s) failed. Err: %v\n", id, err)
+		return err
+	}
+	klog.V(3).Infof("[GIT] %s at %s is %s, tree %s\n", repoPath, rev, id, tree)
+
+	walk := &gitWalk{
+		repo:     repo,
+		commitAt: commitAt,
+		macros:   make(map[string][]string),
+	}
+	for name, attrs := range gitAttrMacros {
+		walk.macros[name] = attrs
+	}
+	walk.infoAttrs = parseGitAttributes(repo.attrs, "", walk.macros)
+	err = d.gitMergeDir(walk, tree, d.options.RootDstPath, "")
+	if err != nil {
+		klog.Errorf("gitMergeDir failed. Err: %v\n", err)
+		return err
+	}
+
+	diffs := make([]*DiffCompare, 0, len(walk.changes))
+	for _, change := range walk.changes {
+		if change.diff != nil {
+			diffs = append(diffs, change.diff)
+		}
+	}
+	err = d.checkSafety(diffs)
+	if err != nil {
+		return err
+	}
+	err = d.checkSpace(diffs)
+	if err != nil {
+		return err
+	}
+	for _, change := range walk.changes {
+		err = d.gitApply(walk, change)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !d.options.DryRun && len(walk.copied) > 0 {
+		klog.Infof("\n\n")
+		klog.Infof("Copied files:\n")
+		for _, copied := range walk.copied {
+			klog.Infof("%s\n", copied)
+		}
+	}
+	if len(walk.filtered) > 0 {
+		klog.Infof("\n\n")
+		klog.Infof("Rewritten on checkout by git attributes (skipped):\n")
+		for _, relPath := range walk.filtered {
+			klog.Infof("%s\n", relPath)
+		}
+	}
+	if len(walk.extra) > 0 {
+		klog.Infof("\n\n")
+		klog.Infof("Only in dst (a git source is read-only):\n")
+		for _, relPath := range walk.extra {
+			klog.Infof("%s\n", relPath)
+		}
+	}
+	d.reportFiltered()
+
+	return d.partialFailure()
+}
+
+// gitMergeDir compares a tree with the dst directory at the same relative path
+func (d *Diff) gitMergeDir(walk *gitWalk, treeID gitID, dstDir, relDir string) error {
+	entries, err := walk.repo.readTree(treeID)
+	if err != nil {
+		return d.fileError("read tree", relDir, err)
+	}
+	for _, entry := range entries {
+		if entry.name != ".gitattributes" || (entry.mode != "100644" && entry.mode != "100755") {
+			continue
+		}
+		obj, err := walk.repo.object(entry.id)
+		if err != nil {
+			return d.fileError("read object", filepath.Join(relDir, entry.name), err)
+		}
+		// the rules of this directory only hold below it
+		depth := len(walk.attrs)
+		walk.attrs = append(walk.attrs, parseGitAttributes(obj.data, filepath.ToSlash(relDir), walk.macros)...)
+		defer func() { walk.attrs = walk.attrs[:depth] }()
+	}
+
+	dstEntries := make(map[string]os.DirEntry)
+	list, err := os.ReadDir(dstDir)
+	if err != nil && !os.IsNotExist(err) {
+		return d.fileError("read dir", relDir, err)
+	}
+	for _, entry := range list {
+		if entry.Name() == ".git" || (!entry.IsDir() && isInternalFile(entry.Name())) {
+			continue
+		}
+		dstEntries[d.pathKey(entry.Name(), true)] = entry
+	}
+
+	// names that are the same entry on dst, like A and a on a case insensitive target,
+	// would have one written through the other: a symlink A makes a/passwd escape dst
+	keys := make(map[string]int, len(entries))
+	for _, entry := range entries {
+		keys[d.pathKey(entry.name, false)]++
+	}
+
+	for _, entry := range entries {
+		if !gitSafeName(entry.name) {
+			klog.Infof("[GIT] Skipping %q in %s because it isn't a safe file name\n", entry.name, filepath.Join(".", relDir))
+			continue
+		}
+		relPath := filepath.Join(relDir, entry.name)
+		key := d.pathKey(entry.name, false)
+		if keys[key] > 1 {
+			klog.Infof("[GIT] Skipping %s because another entry has the same name on dst\n", relPath)
+			continue
+		}
+		dstEntry := dstEntries[key]
+		delete(dstEntries, key)
+		// an existing dst entry keeps its spelling
+		dstPath := filepath.Join(dstDir, d.dstRelPath(entry.name))
+		if dstEntry != nil {
+			dstPath = filepath.Join(dstDir, dstEntry.Name())
+		}
+
+		if rule := d.matchRule(relPath); rule != nil && (rule.Direction == RuleIgnore || rule.Direction == RuleDstToSrc) {
+			klog.V(4).Infof("[GIT] skip %s (rule: %s)\n", relPath, rule)
+			continue
+		}
+
+		switch entry.mode {
+		case "40000":
+			if dstEntry != nil && !dstEntry.IsDir() {
+				klog.Infof("[GIT -> DST] Skipping %s because it is a file in dst\n", relPath)
+				continue
+			}
+			err = d.gitMergeDir(walk, entry.id, dstPath, relPath)
+		case "160000":
+			klog.V(3).Infof("[GIT] skip submodule %s\n", relPath)
+		case "120000":
+			err = d.gitSyncLink(walk, entry, dstPath, relPath, dstEntry)
+		default:
+			err = d.gitSyncFile(walk, entry, dstPath, relPath, dstEntry)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	extra := make([]string, 0, len(dstEntries))
+	for _, entry := range dstEntries {
+		relPath := filepath.Join(relDir, entry.Name())
+		if rule := d.matchRule(relPath); rule != nil && rule.Direction == RuleIgnore {
+			continue
+		}
+		if entry.IsDir() {
+			relPath += string(filepath.Separator)
+		}
+		extra = append(extra, relPath)
+	}
+	sort.Strings(extra)
+	walk.extra = append(walk.extra, extra...)
+
+	return nil
+}
+
+// gitSafeName refuses tree entry names a crafted repository could use to write outside dst
+func gitSafeName(name string) bool {
+	switch name {
+	case "", ".", "..":
+		return false
+	}
+	if strings.EqualFold(name, ".git") || strings.ContainsAny(name, "/\\\x00") {
+		return false
+	}
+	return !isInternalFile(name)
+}
+
+// gitSyncFile plans writing a blob to dst unless the dst file already has the same blob id
+func (d *Diff) gitSyncFile(walk *gitWalk, entry gitTreeEntry, dstPath, relPath string, dstEntry os.DirEntry) error {
+	if filter := gitCheckoutFilter(walk.macros, filepath.ToSlash(relPath), walk.attrs, walk.infoAttrs); filter != "" {
+		klog.V(3).Infof("[GIT] skip %s, %s rewrites it on checkout\n", relPath, filter)
+		walk.filtered = append(walk.filtered, relPath)
+		return nil
+	}
+	size, err := walk.repo.objectSize(entry.id)
+	if err != nil {
+		return d.fileError("read object", relPath, err)
+	}
+	mode := fs.FileMode(0644)
+	if entry.mode == "100755" {
+		mode = 0755
+	}
+
+	var srcInfo fs.FileInfo = &treeFileInfo{
+		name:    entry.name,
+		size:    size,
+		mode:    mode,
+		modTime: walk.commitAt,
+	}
+	srcFile := &DiffFile{
+		Path:    GitPrefix + entry.id.String(),
+		RelPath: relPath,
+		Attr:    &srcInfo,
+	}
+	d.srcCount++
+
+	var dstFile *DiffFile
+	if dstEntry != nil {
+		if dstEntry.IsDir() {
+			klog.Infof("[GIT -> DST] Skipping %s because it is a directory in dst\n", relPath)
+			return nil
+		}
+		dstInfo, err := os.Lstat(dstPath)
+		if err != nil {
+			return d.fileError("stat", relPath, err)
+		}
+		dstFile = &DiffFile{
+			Path:    dstPath,
+			RelPath: relPath,
+			Attr:    &dstInfo,
+		}
+		d.dstCount++
+	}
+	if d.filterOut([]*DiffFile{srcFile, dstFile}, []string{"src", "dst"}) {
+		return nil
+	}
+
+	reason := "Destination file does not exist"
+	if dstFile != nil {
+		dstInfo := *dstFile.Attr
+		switch {
+		case !dstInfo.Mode().IsRegular():
+			reason = "Destination is not a regular file"
+		case dstInfo.Size() != size:
+			reason = fmt.Sprintf("Size mismatch: %d -> %d", size, dstInfo.Size())
+		default:
+			blob, err := d.gitBlobHash(dstPath)
+			if err != nil {
+				return d.fileError("hash", relPath, err)
+			}
+			if blob == entry.id.String() {
+				return d.gitSyncMode(walk, mode, dstInfo, dstPath, relPath)
+			}
+			reason = fmt.Sprintf("Blob mismatch: %s -> %s", entry.id, blob)
+		}
+	}
+
+	walk.changes = append(walk.changes, &gitChange{
+		kind:    gitChangeBlob,
+		diff:    &DiffCompare{SrcFile: srcFile, DstFile: dstFile, Direction: DIRECTION_SRC_TO_DST},
+		entry:   entry,
+		dstPath: dstPath,
+		relPath: relPath,
+		mode:    mode,
+		reason:  reason,
+	})
+	return nil
+}
+
+// gitSyncMode plans setting the executable bit when only the mode differs
+func (d *Diff) gitSyncMode(walk *gitWalk, mode fs.FileMode, dstInfo fs.FileInfo, dstPath, relPath string) error {
+	// windows has no executable bit
+	if runtime.GOOS == "windows" || (mode&0100 != 0) == (dstInfo.Mode()&0100 != 0) {
+		return nil
+	}
+
+	walk.changes = append(walk.changes, &gitChange{
+		kind:    gitChangeMode,
+		dstPath: dstPath,
+		relPath: relPath,
+		mode:    dstInfo.Mode().Perm()&^0111 | mode&0111,
+	})
+	return nil
+}
+
+// gitSyncLink plans a symlink whose target is the content of the blob
+func (d *Diff) gitSyncLink(walk *gitWalk, entry gitTreeEntry, dstPath, relPath string, dstEntry os.DirEntry) error {
+	obj, err := walk.repo.object(entry.id)
+	if err != nil {
+		return d.fileError("read object", relPath, err)
+	}
+	target := string(obj.data)
+
+	var srcInfo fs.FileInfo = &treeFileInfo{
+		name:    entry.name,
+		size:    int64(len(target)),
+		mode:    fs.ModeSymlink | 0777,
+		modTime: walk.commitAt,
+	}
+	diff := &DiffCompare{
+		SrcFile:   &DiffFile{Path: GitPrefix + entry.id.String(), RelPath: relPath, Attr: &srcInfo},
+		Direction: DIRECTION_SRC_TO_DST,
+	}
+
+	reason := "Destination link does not exist"
+	if dstEntry != nil {
+		if dstEntry.IsDir() {
+			klog.Infof("[GIT -> DST] Skipping %s because it is a directory in dst\n", relPath)
+			return nil
+		}
+		current, err := os.Readlink(dstPath)
+		if err == nil && current == target {
+			return nil
+		}
+		reason = fmt.Sprintf("Link mismatch: %s -> %s", target, current)
+
+		dstInfo, err := dstEntry.Info()
+		if err != nil {
+			return d.fileError("stat", relPath, err)
+		}
+		diff.DstFile = &DiffFile{Path: dstPath, RelPath: relPath, Attr: &dstInfo}
+	}
+
+	walk.changes = append(walk.changes, &gitChange{
+		kind:    gitChangeLink,
+		diff:    diff,
+		entry:   entry,
+		dstPath: dstPath,
+		relPath: relPath,
+		target:  target,
+		reason:  reason,
+		replace: dstEntry != nil,
+	})
+	return nil
+}
+
+/*
+gitCheckPath makes sure no directory between the dst root and path is a symlink. A link
+written earlier in the run, or already on dst, would have the write land outside dst.
+*/
+func (d *Diff) gitCheckPath(path string) error {
+	root := filepath.Clean(d.options.RootDstPath)
+	rel, err := filepath.Rel(root, filepath.Dir(path))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%w: %s", ErrGitUnsafePath, path)
+	}
+	if rel == "." {
+		return nil
+	}
+
+	cur := root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		cur = filepath.Join(cur, part)
+		info, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("%w: %s", ErrGitUnsafePath, cur)
+		}
+	}
+	return nil
+}
+
+// gitApply writes one planned change to dst
+func (d *Diff) gitApply(walk *gitWalk, change *gitChange) error {
+	relPath := change.relPath
+	err := d.gitCheckPath(change.dstPath)
+	if err != nil {
+		klog.Errorf("[GIT -> DST] Refusing %s. Err: %v\n", relPath, err)
+		return d.fileError("write", relPath, err)
+	}
+	if change.kind == gitChangeMode {
+		klog.Infof("[GIT -> DST] Mode %s %s\n", change.mode, relPath)
+		if d.options.DryRun {
+			return nil
+		}
+		err := os.Chmod(change.dstPath, change.mode)
+		if err != nil {
+			return d.fileError("chmod", relPath, err)
+		}
+		walk.copied = append(walk.copied, fmt.Sprintf("[GIT -> DST] Mode %s", relPath))
+		return nil
+	}
+
+	switch {
+	case d.options.DryRun:
+		klog.Infof("[GIT -> DST] Diff: %s\n", relPath)
+	case change.kind == gitChangeLink:
+		klog.Infof("[GIT -> DST] Linking... %s\n", relPath)
+	default:
+		klog.Infof("[GIT -> DST] Copying... %s\n", relPath)
+	}
+	klog.Infof("\t%s\n", change.reason)
+	klog.Infof("\n")
+
+	if change.kind == gitChangeLink {
+		if d.options.DryRun {
+			return nil
+		}
+		err := d.buildDir(change.dstPath)
+		if err == nil && change.replace {
+			err = os.Remove(change.dstPath)
+		}
+		if err == nil {
+			err = os.Symlink(change.target, change.dstPath)
+		}
+		if err != nil {
+			klog.Errorf("Symlink(%s, %s) failed. Err: %v\n", change.target, change.dstPath, err)
+			return d.fileError("link", relPath, err)
+		}
+		walk.copied = append(walk.copied, fmt.Sprintf("[GIT -> DST] Linked %s", relPath))
+		return nil
+	}
+
+	err = d.gitWriteBlob(walk, change.entry, change.dstPath, change.mode)
+	if err != nil {
+		klog.Errorf("gitWriteBlob(%s, %s) failed. Err: %v\n", change.entry.id, change.dstPath, err)
+		return d.fileError("copy", relPath, err)
+	}
+	walk.copied = append(walk.copied, fmt.Sprintf("[GIT -> DST] Copied %s", relPath))
+	return nil
+}
+
+func (d *Diff) gitWriteBlob(walk *gitWalk, entry gitTreeEntry, dstPath string, mode fs.FileMode) error {
+	if d.options.DryRun {
+		klog.V(3).Infof("DryRun: write blob %s to %s\n", entry.id, dstPath)
+		return nil
+	}
+
+	obj, err := walk.repo.object(entry.id)
+	if err != nil {
+		return err
+	}
+	if obj.kind != "blob" {
+		return fmt.Errorf("%w: %s is a %s, not a blob", ErrGitCorrupt, entry.id, obj.kind)
+	}
+
+	err = d.buildDir(dstPath)
+	if err != nil {
+		return err
+	}
+	// a symlink or special file in the way is replaced, not written through
+	if info, err := os.Lstat(dstPath); err == nil && !info.Mode().IsRegular() {
+		if err = os.Remove(dstPath); err != nil {
+			return err
+		}
+	}
+
+	d.throttle.writeFile()
+	f, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	_, err = d.throttle.writer(f).Write(obj.data)
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return err
+	}
+
+	if runtime.GOOS != "windows" {
+		err = os.Chmod(dstPath, mode)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Chtimes(dstPath, walk.commitAt, walk.commitAt)
+	if err != nil {
+		return err
+	}
+
+	if d.options.Verify {
+		blob, err := d.gitBlobHash(dstPath)
+		if err != nil {
+			return err
+		}
+		if blob != entry.id.String() {
+			return fmt.Errorf("%w: %s", ErrVerifyMismatch, dstPath)
+		}
+	}
+	return nil
+}
+
+// gitBlobHash is the git blob id the file would have
+func (d *Diff) gitBlobHash(path string) (string, error) {
+	d.throttle.readFile()
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	hash := sha1.New()
+	fmt.Fprintf(hash, "blob %d\x00", info.Size())
+	sum, err := hashReaderWith(d.throttle.reader(f), hash)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum), nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// testGitRepo writes loose objects of a repository for a test
+type testGitRepo struct {
+	t   *testing.T
+	dir string
+}
+
+func newTestGitRepo(t *testing.T) *testGitRepo {
+	dir := t.TempDir()
+	gitDir := filepath.Join(dir, ".git")
+	if err := os.MkdirAll(filepath.Join(gitDir, "objects"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(gitDir, "HEAD"), []byte("ref: refs/heads/master\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &testGitRepo{t: t, dir: dir}
+}
+
+func (r *testGitRepo) object(kind string, data []byte) gitID {
+	raw := append([]byte(fmt.Sprintf("%s %d\x00", kind, len(data))), data...)
+	id := gitID(sha1.Sum(raw))
+
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write(raw)
+	zw.Close()
+
+	hexID := id.String()
+	path := filepath.Join(r.dir, ".git", "objects", hexID[:2], hexID[2:])
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		r.t.Fatal(err)
+	}
+	if err := os.WriteFile(path, compressed.Bytes(), 0644); err != nil {
+		r.t.Fatal(err)
+	}
+	return id
+}
+
+func (r *testGitRepo) blob(content string) gitID {
+	return r.object("blob", []byte(content))
+}
+
+func (r *testGitRepo) tree(entries ...gitTreeEntry) gitID {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	var data []byte
+	for _, entry := range entries {
+		data = append(data, fmt.Sprintf("%s %s\x00", entry.mode, entry.name)...)
+		data = append(data, entry.id[:]...)
+	}
+	return r.object("tree", data)
+}
+
+// source is the git source of a commit of tree
+func (r *testGitRepo) source(tree gitID) string {
+	commit := fmt.Sprintf("tree %s\nauthor A <a@example.com> 1700000000 +0000\ncommitter A <a@example.com> 1700000000 +0000\n\ntest\n", tree)
+	return GitPrefix + r.dir + "@" + r.object("commit", []byte(commit)).String()
+}
+
+func TestGitSafeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"README.md", true},
+		{".gitignore", true},
+		{"...", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{".git", false},
+		{".GIT", false},
+		{"../etc", false},
+		{"a/b", false},
+		{"a\\b", false},
+		{"a\x00b", false},
+		{".diff-directory-lock", false},
+	}
+
+	for _, tt := range tests {
+		if got := gitSafeName(tt.name); got != tt.want {
+			t.Errorf("gitSafeName(%q) = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGitCaseCollision(t *testing.T) {
+	repo := newTestGitRepo(t)
+	outside := t.TempDir()
+
+	// A is a link out of dst, a/passwd would be written through it where A and a are one name
+	tree := repo.tree(
+		gitTreeEntry{mode: "120000", name: "A", id: repo.blob(outside)},
+		gitTreeEntry{mode: "40000", name: "a", id: repo.tree(gitTreeEntry{mode: "100644", name: "passwd", id: repo.blob("root::0:0\n")})},
+		gitTreeEntry{mode: "100644", name: "README", id: repo.blob("readme\n")},
+	)
+
+	for _, targetFS := range []string{TargetFSFat, TargetFSPosix} {
+		t.Run(targetFS, func(t *testing.T) {
+			dst := t.TempDir()
+			err := New(DiffOpts{RootSrcPath: repo.source(tree), RootDstPath: dst, TargetFS: targetFS}).Process()
+			if err != nil {
+				t.Fatalf("Process() failed. Err: %v", err)
+			}
+
+			if _, err := os.Stat(filepath.Join(outside, "passwd")); err == nil {
+				t.Fatalf("passwd was written outside dst")
+			}
+			if _, err := os.Stat(filepath.Join(dst, "README")); err != nil {
+				t.Errorf("README wasn't written. Err: %v", err)
+			}
+			_, errLink := os.Lstat(filepath.Join(dst, "A"))
+			_, errDir := os.Stat(filepath.Join(dst, "a", "passwd"))
+			if targetFS == TargetFSFat && (errLink == nil || errDir == nil) {
+				t.Errorf("the colliding entries were written on a FAT target")
+			}
+			if targetFS == TargetFSPosix && (errLink != nil || errDir != nil) {
+				t.Errorf("distinct entries weren't written. Err: %v, %v", errLink, errDir)
+			}
+		})
+	}
+}
+
+func TestGitCheckPath(t *testing.T) {
+	dst := t.TempDir()
+	outside := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dst, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dst, "dir", "link")); err != nil {
+		t.Fatal(err)
+	}
+	d := New(DiffOpts{RootDstPath: dst})
+
+	tests := []struct {
+		path    string
+		wantErr bool
+	}{
+		{path: filepath.Join(dst, "file")},
+		{path: filepath.Join(dst, "dir", "file")},
+		{path: filepath.Join(dst, "dir", "link")},
+		{path: filepath.Join(dst, "new", "dir", "file")},
+		{path: filepath.Join(dst, "dir", "link", "file"), wantErr: true},
+		{path: filepath.Join(dst, "dir", "link", "deeper", "file"), wantErr: true},
+		{path: filepath.Join(outside, "file"), wantErr: true},
+	}
+	for _, tt := range tests {
+		err := d.gitCheckPath(tt.path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("gitCheckPath(%s) err = %v, want an error %t", tt.path, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"regexp"
+	"strings"
+)
+
+/*
+Git attributes
+
+A file checked out through a filter (LFS), ident or a CRLF line ending conversion isn't
+its blob, so comparing blob ids would copy it again on every run. The .gitattributes
+files of the tree being synced and info/attributes of the repository are read, and the
+files they rewrite on checkout are skipped and reported. The global attributes file
+isn't read, core.autocrlf and core.eol=crlf refuse the run.
+*/
+
+// gitAttrRule is one pattern line of an attributes file
+type gitAttrRule struct {
+	dir     string // the directory of the attributes file, slash separated
+	pattern *regexp.Regexp
+	attrs   []string
+}
+
+// gitAttrMacros are the built-in macros, files can define more with [attr]
+var gitAttrMacros = map[string][]string{
+	"binary": {"-diff", "-merge", "-text"},
+}
+
+// parseGitAttributes reads the rules of an attributes file in dir
+func parseGitAttributes(data []byte, dir string, macros map[string][]string) []gitAttrRule {
+	rules := make([]gitAttrRule, 0)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if strings.HasPrefix(fields[0], "[attr]") {
+			macros[strings.TrimPrefix(fields[0], "[attr]")] = fields[1:]
+			continue
+		}
+		// negative patterns are forbidden in attributes files
+		if strings.HasPrefix(fields[0], "!") {
+			continue
+		}
+		pattern, err := globRegexp(fields[0])
+		if err != nil {
+			continue
+		}
+		rules = append(rules, gitAttrRule{dir: dir, pattern: pattern, attrs: fields[1:]})
+	}
+	return rules
+}
+
+/*
+gitCheckoutFilter names the attribute that makes the checkout of a file differ from its
+blob, empty when there is none. Rule sets are given lowest priority first.
+*/
+func gitCheckoutFilter(macros map[string][]string, relPath string, ruleSets ...[]gitAttrRule) string {
+	state := make(map[string]string)
+	var apply func(attrs []string, depth int)
+	apply = func(attrs []string, depth int) {
+		for _, attr := range attrs {
+			switch {
+			case strings.HasPrefix(attr, "-"):
+				state[attr[1:]] = "unset"
+			case strings.HasPrefix(attr, "!"):
+				delete(state, attr[1:])
+			case strings.Contains(attr, "="):
+				at := strings.Index(attr, "=")
+				state[attr[:at]] = attr[at+1:]
+			default:
+				state[attr] = "set"
+				if macro, ok := macros[attr]; ok && depth < 8 {
+					apply(macro, depth+1)
+				}
+			}
+		}
+	}
+
+	for _, rules := range ruleSets {
+		for _, rule := range rules {
+			rel := relPath
+			if rule.dir != "" {
+				if !strings.HasPrefix(relPath, rule.dir+"/") {
+					continue
+				}
+				rel = strings.TrimPrefix(relPath, rule.dir+"/")
+			}
+			if rule.pattern.MatchString(rel) {
+				apply(rule.attrs, 0)
+			}
+		}
+	}
+
+	switch filter := state["filter"]; {
+	case filter != "" && filter != "set" && filter != "unset":
+		return "filter=" + filter
+	case state["ident"] == "set":
+		return "ident"
+	case state["eol"] == "crlf" && state["text"] != "unset":
+		return "eol=crlf"
+	case state["working-tree-encoding"] != "" && state["working-tree-encoding"] != "unset":
+		return "working-tree-encoding=" + state["working-tree-encoding"]
+	}
+	return ""
+}
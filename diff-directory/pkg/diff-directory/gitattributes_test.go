@@ -0,0 +1,54 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"testing"
+)
+
+func TestGitCheckoutFilter(t *testing.T) {
+	macros := map[string][]string{"binary": {"-diff", "-merge", "-text"}}
+	info := parseGitAttributes([]byte("*.bat eol=crlf\n"), "", macros)
+	root := parseGitAttributes([]byte(`# comment
+[attr]lfs filter=lfs diff=lfs merge=lfs -text
+*.psd lfs
+*.c ident
+*.txt text
+*.bat -eol
+*.win working-tree-encoding=UTF-16LE
+!*.neg filter=lfs
+*.unset filter
+bad[ filter=lfs
+`), "", macros)
+	sub := parseGitAttributes([]byte("*.c -ident\n*.bin binary eol=crlf\n"), "sub", macros)
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"image.psd", "filter=lfs"},
+		{"dir/image.psd", "filter=lfs"},
+		{"main.c", "ident"},
+		{"sub/main.c", ""},
+		{"notes.txt", ""},
+		{"run.bat", ""},
+		{"sub/data.bin", ""},
+		{"data.bin", ""},
+		{"file.win", "working-tree-encoding=UTF-16LE"},
+		{"file.neg", ""},
+		{"file.unset", ""},
+	}
+
+	for _, tt := range tests {
+		if got := gitCheckoutFilter(macros, tt.path, info, root, sub); got != tt.want {
+			t.Errorf("gitCheckoutFilter(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+
+	// info/attributes is applied last, over the files of the tree
+	if got := gitCheckoutFilter(macros, "run.bat", root, info); got != "eol=crlf" {
+		t.Errorf("gitCheckoutFilter(run.bat) = %q, want %q", got, "eol=crlf")
+	}
+}
@@ -0,0 +1,801 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Git object database
+
+A read-only reader for the objects of a git repository: refs (loose and packed), loose
+objects and pack files with their v2 indexes, including offset and ref deltas. Only the
+SHA-1 object format is supported.
+*/
+
+type gitID [sha1.Size]byte
+
+func (id gitID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func parseGitID(s string) (gitID, bool) {
+	var id gitID
+	if len(s) != 2*sha1.Size {
+		return id, false
+	}
+	_, err := hex.Decode(id[:], []byte(s))
+	return id, err == nil
+}
+
+type gitRepo struct {
+	gitDir    string // HEAD and the refs of this worktree
+	commonDir string // objects and shared refs
+	packs     []*gitPack
+	attrs     []byte // info/attributes
+
+	cache     map[gitID]*gitObject // delta bases
+	cacheSize int
+}
+
+type gitObject struct {
+	kind string // commit, tree, blob or tag
+	data []byte
+}
+
+type gitPack struct {
+	path    string
+	file    *os.File
+	fanout  [256]uint32
+	ids     []byte // sorted object ids
+	offsets []byte
+	large   []byte // 8 byte offsets of objects past 2GiB
+}
+
+type gitTreeEntry struct {
+	mode string // 100644, 100755, 120000 (symlink), 40000 (tree) or 160000 (submodule)
+	name string
+	id   gitID
+}
+
+// pack object types
+const (
+	gitObjCommit   = 1
+	gitObjTree     = 2
+	gitObjBlob     = 3
+	gitObjTag      = 4
+	gitObjOfsDelta = 6
+	gitObjRefDelta = 7
+
+	gitCacheLimit    = 64 * 1024 * 1024
+	gitPreallocLimit = 16 * 1024 * 1024
+)
+
+var gitObjKinds = map[int]string{gitObjCommit: "commit", gitObjTree: "tree", gitObjBlob: "blob", gitObjTag: "tag"}
+
+// openGitRepo opens a worktree, a .git directory or a bare repository
+func openGitRepo(path string) (*gitRepo, error) {
+	gitDir := path
+	dotGit := filepath.Join(path, ".git")
+	if stat, err := os.Stat(dotGit); err == nil {
+		if stat.IsDir() {
+			gitDir = dotGit
+		} else {
+			// a linked worktree or submodule points at its git directory
+			data, err := os.ReadFile(dotGit)
+			if err != nil {
+				return nil, err
+			}
+			target := strings.TrimSpace(strings.TrimPrefix(string(data), "gitdir:"))
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(path, target)
+			}
+			gitDir = target
+		}
+	}
+	if _, err := os.Stat(filepath.Join(gitDir, "HEAD")); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrGitNotRepo, path)
+	}
+
+	repo := &gitRepo{
+		gitDir:    gitDir,
+		commonDir: gitDir,
+		cache:     make(map[gitID]*gitObject),
+	}
+	if data, err := os.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		common := strings.TrimSpace(string(data))
+		if !filepath.IsAbs(common) {
+			common = filepath.Join(gitDir, common)
+		}
+		repo.commonDir = common
+	}
+
+	if config, err := os.ReadFile(filepath.Join(repo.commonDir, "config")); err == nil {
+		if regexp.MustCompile(`(?im)^\s*objectformat\s*=\s*sha256`).Match(config) {
+			return nil, fmt.Errorf("%w: sha256 object format", ErrGitUnsupported)
+		}
+		// these rewrite the line endings of every text file on checkout, blob ids wouldn't match
+		if regexp.MustCompile(`(?im)^\s*(autocrlf\s*=\s*true|eol\s*=\s*crlf)\s*$`).Match(config) {
+			return nil, fmt.Errorf("%w: core.autocrlf or core.eol=crlf", ErrGitUnsupported)
+		}
+	}
+	repo.attrs, _ = os.ReadFile(filepath.Join(repo.commonDir, "info", "attributes"))
+
+	idxs, err := filepath.Glob(filepath.Join(repo.commonDir, "objects", "pack", "pack-*.idx"))
+	if err != nil {
+		return nil, err
+	}
+	for _, idx := range idxs {
+		pack, err := openGitPack(idx)
+		if err != nil {
+			repo.close()
+			return nil, err
+		}
+		repo.packs = append(repo.packs, pack)
+	}
+	return repo, nil
+}
+
+func (r *gitRepo) close() {
+	for _, pack := range r.packs {
+		pack.file.Close()
+	}
+	r.packs = nil
+}
+
+// readRef resolves a ref name to an object id, following symbolic refs
+func (r *gitRepo) readRef(name string) (gitID, bool) {
+	for depth := 0; depth < 10; depth++ {
+		var data []byte
+		var err error
+		for _, dir := range []string{r.gitDir, r.commonDir} {
+			data, err = os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return r.packedRef(name)
+		}
+
+		content := strings.TrimSpace(string(data))
+		if strings.HasPrefix(content, "ref:") {
+			name = strings.TrimSpace(strings.TrimPrefix(content, "ref:"))
+			continue
+		}
+		return parseGitID(content)
+	}
+	return gitID{}, false
+}
+
+func (r *gitRepo) packedRef(name string) (gitID, bool) {
+	f, err := os.Open(filepath.Join(r.commonDir, "packed-refs"))
+	if err != nil {
+		return gitID{}, false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[1] == name {
+			return parseGitID(fields[0])
+		}
+	}
+	return gitID{}, false
+}
+
+var gitRevSuffix = regexp.MustCompile(`[~^][0-9]*$`)
+
+/*
+resolve turns a revision into the id of a commit or tree: a full or abbreviated id, a
+branch, tag or other ref, optionally followed by ~N and ^N to walk to ancestors.
+*/
+func (r *gitRepo) resolve(rev string) (gitID, error) {
+	suffixes := make([]string, 0)
+	base := rev
+	for {
+		suffix := gitRevSuffix.FindString(base)
+		if suffix == "" || suffix == base {
+			break
+		}
+		suffixes = append([]string{suffix}, suffixes...)
+		base = base[:len(base)-len(suffix)]
+	}
+
+	id, err := r.resolveBase(base)
+	if err != nil {
+		return id, err
+	}
+	id, err = r.peel(id)
+	if err != nil {
+		return id, err
+	}
+
+	for _, suffix := range suffixes {
+		n := 1
+		if len(suffix) > 1 {
+			n, _ = strconv.Atoi(suffix[1:])
+		}
+		if suffix[0] == '~' {
+			for i := 0; i < n; i++ {
+				id, err = r.parent(id, 1)
+				if err != nil {
+					return id, fmt.Errorf("%s: %w", rev, err)
+				}
+			}
+		} else if n > 0 {
+			id, err = r.parent(id, n)
+			if err != nil {
+				return id, fmt.Errorf("%s: %w", rev, err)
+			}
+		}
+	}
+	return id, nil
+}
+
+func (r *gitRepo) resolveBase(base string) (gitID, error) {
+	if base == "" || base == "@" {
+		base = "HEAD"
+	}
+	if id, ok := parseGitID(base); ok {
+		return id, nil
+	}
+	for _, name := range []string{base, "refs/" + base, "refs/tags/" + base, "refs/heads/" + base, "refs/remotes/" + base, "refs/remotes/" + base + "/HEAD"} {
+		if id, ok := r.readRef(name); ok {
+			return id, nil
+		}
+	}
+	if len(base) >= 4 && len(base) < 2*sha1.Size {
+		if _, err := hex.DecodeString(base + strings.Repeat("0", len(base)%2)); err == nil {
+			return r.expand(strings.ToLower(base))
+		}
+	}
+	return gitID{}, fmt.Errorf("%w: %s", ErrGitRevision, base)
+}
+
+// expand finds the object an abbreviated id stands for
+func (r *gitRepo) expand(prefix string) (gitID, error) {
+	matches := make(map[gitID]bool)
+
+	entries, _ := os.ReadDir(filepath.Join(r.commonDir, "objects", prefix[:2]))
+	for _, entry := range entries {
+		if id, ok := parseGitID(prefix[:2] + entry.Name()); ok && strings.HasPrefix(id.String(), prefix) {
+			matches[id] = true
+		}
+	}
+	for _, pack := range r.packs {
+		for _, id := range pack.withPrefix(prefix) {
+			matches[id] = true
+		}
+	}
+
+	if len(matches) > 1 {
+		return gitID{}, fmt.Errorf("%w: %s is ambiguous", ErrGitRevision, prefix)
+	}
+	for id := range matches {
+		return id, nil
+	}
+	return gitID{}, fmt.Errorf("%w: %s", ErrGitRevision, prefix)
+}
+
+// peel follows annotated tags to the object they point at
+func (r *gitRepo) peel(id gitID) (gitID, error) {
+	for depth := 0; depth < 10; depth++ {
+		obj, err := r.object(id)
+		if err != nil {
+			return id, err
+		}
+		if obj.kind != "tag" {
+			return id, nil
+		}
+		target, ok := gitHeader(obj.data, "object")
+		if !ok {
+			return id, fmt.Errorf("%w: tag %s", ErrGitCorrupt, id)
+		}
+		if id, ok = parseGitID(target); !ok {
+			return id, fmt.Errorf("%w: tag %s", ErrGitCorrupt, id)
+		}
+	}
+	return id, fmt.Errorf("%w: tag chain too long", ErrGitCorrupt)
+}
+
+// parent returns the n-th parent of a commit
+func (r *gitRepo) parent(id gitID, n int) (gitID, error) {
+	obj, err := r.object(id)
+	if err != nil {
+		return id, err
+	}
+	if obj.kind != "commit" {
+		return id, fmt.Errorf("%w: %s is a %s, not a commit", ErrGitRevision, id, obj.kind)
+	}
+	count := 0
+	for _, line := range strings.Split(string(obj.data), "\n") {
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "parent ") {
+			count++
+			if count == n {
+				if parent, ok := parseGitID(strings.TrimPrefix(line, "parent ")); ok {
+					return parent, nil
+				}
+			}
+		}
+	}
+	return id, fmt.Errorf("%w: %s has no parent %d", ErrGitRevision, id, n)
+}
+
+// gitHeader returns the value of a header line of a commit or tag
+func gitHeader(data []byte, key string) (string, bool) {
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, key+" ") {
+			return strings.TrimPrefix(line, key+" "), true
+		}
+	}
+	return "", false
+}
+
+// rootTree returns the tree of a commit, or the tree itself, and the commit time
+func (r *gitRepo) rootTree(id gitID) (gitID, time.Time, error) {
+	obj, err := r.object(id)
+	if err != nil {
+		return id, time.Time{}, err
+	}
+	switch obj.kind {
+	case "tree":
+		return id, time.Now(), nil
+	case "commit":
+	default:
+		return id, time.Time{}, fmt.Errorf("%w: %s is a %s", ErrGitRevision, id, obj.kind)
+	}
+
+	tree, ok := gitHeader(obj.data, "tree")
+	treeID, okID := parseGitID(tree)
+	if !ok || !okID {
+		return id, time.Time{}, fmt.Errorf("%w: commit %s", ErrGitCorrupt, id)
+	}
+
+	// committer Name <email> 1700000000 +0100
+	commitTime := time.Time{}
+	if committer, ok := gitHeader(obj.data, "committer"); ok {
+		fields := strings.Fields(committer)
+		if len(fields) >= 2 {
+			if secs, err := strconv.ParseInt(fields[len(fields)-2], 10, 64); err == nil {
+				commitTime = time.Unix(secs, 0)
+			}
+		}
+	}
+	return treeID, commitTime, nil
+}
+
+func (r *gitRepo) readTree(id gitID) ([]gitTreeEntry, error) {
+	obj, err := r.object(id)
+	if err != nil {
+		return nil, err
+	}
+	if obj.kind != "tree" {
+		return nil, fmt.Errorf("%w: %s is a %s, not a tree", ErrGitCorrupt, id, obj.kind)
+	}
+
+	entries := make([]gitTreeEntry, 0)
+	data := obj.data
+	for len(data) > 0 {
+		space := bytes.IndexByte(data, ' ')
+		nul := bytes.IndexByte(data, 0)
+		if space < 0 || nul < space || len(data) < nul+1+sha1.Size {
+			return nil, fmt.Errorf("%w: tree %s", ErrGitCorrupt, id)
+		}
+		entry := gitTreeEntry{
+			mode: string(data[:space]),
+			name: string(data[space+1 : nul]),
+		}
+		copy(entry.id[:], data[nul+1:nul+1+sha1.Size])
+		entries = append(entries, entry)
+		data = data[nul+1+sha1.Size:]
+	}
+	return entries, nil
+}
+
+// object reads an object from the loose objects or the packs
+func (r *gitRepo) object(id gitID) (*gitObject, error) {
+	if obj := r.cache[id]; obj != nil {
+		return obj, nil
+	}
+
+	hexID := id.String()
+	f, err := os.Open(filepath.Join(r.commonDir, "objects", hexID[:2], hexID[2:]))
+	if err == nil {
+		defer f.Close()
+		return readLooseObject(f, id)
+	}
+
+	for _, pack := range r.packs {
+		if offset, ok := pack.find(id); ok {
+			return r.packObject(pack, offset)
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrGitObjectMissing, id)
+}
+
+// objectSize returns the size of an object without reading all of it
+func (r *gitRepo) objectSize(id gitID) (int64, error) {
+	hexID := id.String()
+	f, err := os.Open(filepath.Join(r.commonDir, "objects", hexID[:2], hexID[2:]))
+	if err == nil {
+		defer f.Close()
+		zr, err := zlib.NewReader(f)
+		if err != nil {
+			return 0, err
+		}
+		defer zr.Close()
+		header, err := bufio.NewReader(zr).ReadString(0)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %s", ErrGitCorrupt, id)
+		}
+		fields := strings.Fields(strings.TrimSuffix(header, "\x00"))
+		if len(fields) != 2 {
+			return 0, fmt.Errorf("%w: %s", ErrGitCorrupt, id)
+		}
+		return strconv.ParseInt(fields[1], 10, 64)
+	}
+
+	for _, pack := range r.packs {
+		if offset, ok := pack.find(id); ok {
+			kind, size, dataOffset, _, err := pack.header(offset)
+			if err != nil {
+				return 0, err
+			}
+			if kind != gitObjOfsDelta && kind != gitObjRefDelta {
+				return size, nil
+			}
+			// the delta starts with the base and result sizes
+			zr, err := zlib.NewReader(io.NewSectionReader(pack.file, dataOffset, 1<<62))
+			if err != nil {
+				return 0, err
+			}
+			defer zr.Close()
+			br := bufio.NewReader(zr)
+			if _, err = binary.ReadUvarint(br); err != nil {
+				return 0, err
+			}
+			result, err := binary.ReadUvarint(br)
+			return int64(result), err
+		}
+	}
+	return 0, fmt.Errorf("%w: %s", ErrGitObjectMissing, id)
+}
+
+func readLooseObject(f io.Reader, id gitID) (*gitObject, error) {
+	zr, err := zlib.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrGitCorrupt, id, err)
+	}
+	defer zr.Close()
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrGitCorrupt, id, err)
+	}
+
+	nul := bytes.IndexByte(raw, 0)
+	if nul < 0 {
+		return nil, fmt.Errorf("%w: %s", ErrGitCorrupt, id)
+	}
+	fields := strings.Fields(string(raw[:nul]))
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("%w: %s", ErrGitCorrupt, id)
+	}
+	return &gitObject{kind: fields[0], data: raw[nul+1:]}, nil
+}
+
+func openGitPack(idxPath string) (*gitPack, error) {
+	idx, err := os.ReadFile(idxPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(idx) < 8+256*4 || !bytes.Equal(idx[:4], []byte{0xff, 't', 'O', 'c'}) || binary.BigEndian.Uint32(idx[4:8]) != 2 {
+		return nil, fmt.Errorf("%w: %s is not a v2 pack index", ErrGitUnsupported, idxPath)
+	}
+
+	pack := &gitPack{path: strings.TrimSuffix(idxPath, ".idx") + ".pack"}
+	for i := range pack.fanout {
+		pack.fanout[i] = binary.BigEndian.Uint32(idx[8+4*i:])
+		// the counts only grow, the last one is the number of objects
+		if i > 0 && pack.fanout[i] < pack.fanout[i-1] {
+			return nil, fmt.Errorf("%w: %s", ErrGitCorrupt, idxPath)
+		}
+	}
+	count := int(pack.fanout[255])
+	idsStart := 8 + 256*4
+	offsetsStart := idsStart + count*sha1.Size + count*4
+	if len(idx) < offsetsStart+count*4 {
+		return nil, fmt.Errorf("%w: %s", ErrGitCorrupt, idxPath)
+	}
+	pack.ids = idx[idsStart : idsStart+count*sha1.Size]
+	pack.offsets = idx[offsetsStart : offsetsStart+count*4]
+	pack.large = idx[offsetsStart+count*4:]
+
+	pack.file, err = os.Open(pack.path)
+	if err != nil {
+		return nil, err
+	}
+	return pack, nil
+}
+
+func (p *gitPack) idAt(i int) []byte {
+	return p.ids[i*sha1.Size : (i+1)*sha1.Size]
+}
+
+func (p *gitPack) find(id gitID) (int64, bool) {
+	lo := 0
+	if id[0] > 0 {
+		lo = int(p.fanout[id[0]-1])
+	}
+	hi := int(p.fanout[id[0]])
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(p.idAt(lo+i), id[:]) >= 0
+	})
+	if i >= hi || !bytes.Equal(p.idAt(i), id[:]) {
+		return 0, false
+	}
+
+	offset := binary.BigEndian.Uint32(p.offsets[i*4:])
+	if offset&0x80000000 == 0 {
+		return int64(offset), true
+	}
+	large := int(offset&0x7fffffff) * 8
+	if large+8 > len(p.large) {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(p.large[large:])), true
+}
+
+func (p *gitPack) withPrefix(prefix string) []gitID {
+	first, err := strconv.ParseUint(prefix[:2], 16, 8)
+	if err != nil {
+		return nil
+	}
+	lo := 0
+	if first > 0 {
+		lo = int(p.fanout[first-1])
+	}
+	hi := int(p.fanout[first])
+
+	ids := make([]gitID, 0)
+	for i := lo; i < hi; i++ {
+		var id gitID
+		copy(id[:], p.idAt(i))
+		if strings.HasPrefix(id.String(), prefix) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+/*
+header parses the header of the pack object at offset, returning its type, size, where
+its compressed data starts and, for deltas, the base: an offset or an id.
+*/
+func (p *gitPack) header(offset int64) (int, int64, int64, interface{}, error) {
+	buf := make([]byte, 64)
+	n, err := p.file.ReadAt(buf, offset)
+	if err != nil && !(err == io.EOF && n > 0) {
+		return 0, 0, 0, nil, err
+	}
+	buf = buf[:n]
+
+	pos := 0
+	next := func() (byte, error) {
+		if pos >= len(buf) {
+			return 0, fmt.Errorf("%w: %s at %d", ErrGitCorrupt, p.path, offset)
+		}
+		pos++
+		return buf[pos-1], nil
+	}
+
+	c, err := next()
+	if err != nil {
+		return 0, 0, 0, nil, err
+	}
+	kind := int(c>>4) & 7
+	size := int64(c & 0x0f)
+	for shift := 4; c&0x80 != 0; shift += 7 {
+		// a size that doesn't fit an int64
+		if shift > 56 {
+			return 0, 0, 0, nil, fmt.Errorf("%w: %s at %d", ErrGitCorrupt, p.path, offset)
+		}
+		if c, err = next(); err != nil {
+			return 0, 0, 0, nil, err
+		}
+		size |= int64(c&0x7f) << shift
+	}
+
+	var base interface{}
+	switch kind {
+	case gitObjOfsDelta:
+		if c, err = next(); err != nil {
+			return 0, 0, 0, nil, err
+		}
+		rel := int64(c & 0x7f)
+		for c&0x80 != 0 {
+			if c, err = next(); err != nil {
+				return 0, 0, 0, nil, err
+			}
+			if rel > offset {
+				break
+			}
+			rel = ((rel + 1) << 7) | int64(c&0x7f)
+		}
+		// the base comes before the delta, pointing at itself would never end
+		if rel <= 0 || rel > offset {
+			return 0, 0, 0, nil, fmt.Errorf("%w: %s at %d", ErrGitCorrupt, p.path, offset)
+		}
+		base = offset - rel
+	case gitObjRefDelta:
+		if pos+sha1.Size > len(buf) {
+			return 0, 0, 0, nil, fmt.Errorf("%w: %s at %d", ErrGitCorrupt, p.path, offset)
+		}
+		var id gitID
+		copy(id[:], buf[pos:pos+sha1.Size])
+		pos += sha1.Size
+		base = id
+	}
+	return kind, size, offset + int64(pos), base, nil
+}
+
+func (r *gitRepo) packObject(p *gitPack, offset int64) (*gitObject, error) {
+	kind, size, dataOffset, base, err := p.header(offset)
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := zlib.NewReader(io.NewSectionReader(p.file, dataOffset, 1<<62))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s at %d: %v", ErrGitCorrupt, p.path, offset, err)
+	}
+	defer zr.Close()
+	// the size comes from the pack, a corrupt one mustn't allocate it all up front
+	prealloc := size
+	if prealloc > gitPreallocLimit {
+		prealloc = gitPreallocLimit
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, prealloc))
+	_, err = io.Copy(buf, io.LimitReader(zr, size))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s at %d: %v", ErrGitCorrupt, p.path, offset, err)
+	}
+	if int64(buf.Len()) != size {
+		return nil, fmt.Errorf("%w: %s at %d: short object", ErrGitCorrupt, p.path, offset)
+	}
+	data := buf.Bytes()
+
+	if name, ok := gitObjKinds[kind]; ok {
+		return &gitObject{kind: name, data: data}, nil
+	}
+
+	var baseObj *gitObject
+	switch b := base.(type) {
+	case int64:
+		baseObj, err = r.packObject(p, b)
+	case gitID:
+		baseObj, err = r.object(b)
+	default:
+		return nil, fmt.Errorf("%w: unknown pack object type %d", ErrGitCorrupt, kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.remember(base, baseObj)
+
+	result, err := applyGitDelta(baseObj.data, data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s at %d: %v", ErrGitCorrupt, p.path, offset, err)
+	}
+	return &gitObject{kind: baseObj.kind, data: result}, nil
+}
+
+// remember caches delta bases by id, a base only known by its offset is cached by its hash
+func (r *gitRepo) remember(base interface{}, obj *gitObject) {
+	id, ok := base.(gitID)
+	if !ok {
+		h := sha1.New()
+		fmt.Fprintf(h, "%s %d\x00", obj.kind, len(obj.data))
+		h.Write(obj.data)
+		copy(id[:], h.Sum(nil))
+	}
+	if r.cache[id] != nil {
+		return
+	}
+	if r.cacheSize+len(obj.data) > gitCacheLimit {
+		r.cache = make(map[gitID]*gitObject)
+		r.cacheSize = 0
+	}
+	r.cache[id] = obj
+	r.cacheSize += len(obj.data)
+}
+
+func applyGitDelta(base, delta []byte) ([]byte, error) {
+	br := bytes.NewReader(delta)
+	baseSize, err := binary.ReadUvarint(br)
+	if err != nil || int(baseSize) != len(base) {
+		return nil, fmt.Errorf("delta base size mismatch")
+	}
+	resultSize, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+
+	// the size is only a hint, a corrupt delta can claim anything
+	capacity := resultSize
+	if limit := uint64(len(base) + len(delta)); capacity > limit {
+		capacity = limit
+	}
+	result := make([]byte, 0, capacity)
+	for {
+		op, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if op&0x80 != 0 {
+			// copy from the base, the low bits say which offset and size bytes follow
+			var offset, size uint32
+			for i := 0; i < 4; i++ {
+				if op&(1<<i) != 0 {
+					b, err := br.ReadByte()
+					if err != nil {
+						return nil, err
+					}
+					offset |= uint32(b) << (8 * i)
+				}
+			}
+			for i := 0; i < 3; i++ {
+				if op&(0x10<<i) != 0 {
+					b, err := br.ReadByte()
+					if err != nil {
+						return nil, err
+					}
+					size |= uint32(b) << (8 * i)
+				}
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			if int(offset)+int(size) > len(base) {
+				return nil, fmt.Errorf("delta copy out of range")
+			}
+			result = append(result, base[offset:offset+size]...)
+		} else if op != 0 {
+			chunk := make([]byte, op)
+			if _, err := io.ReadFull(br, chunk); err != nil {
+				return nil, err
+			}
+			result = append(result, chunk...)
+		} else {
+			return nil, fmt.Errorf("delta opcode 0")
+		}
+	}
+	if uint64(len(result)) != resultSize {
+		return nil, fmt.Errorf("delta result size mismatch")
+	}
+	return result, nil
+}
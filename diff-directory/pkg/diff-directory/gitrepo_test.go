@@ -0,0 +1,267 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// gitDelta builds a delta from the base and result sizes followed by the opcodes
+func gitDelta(baseSize, resultSize uint64, ops ...byte) []byte {
+	delta := binary.AppendUvarint(nil, baseSize)
+	delta = binary.AppendUvarint(delta, resultSize)
+	return append(delta, ops...)
+}
+
+func TestApplyGitDelta(t *testing.T) {
+	base := []byte("hello world")
+
+	tests := []struct {
+		name    string
+		delta   []byte
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "copy and insert",
+			// copy "world", insert " ", copy "hello"
+			delta: gitDelta(11, 11, 0x91, 6, 5, 0x01, ' ', 0x90, 5),
+			want:  "world hello",
+		},
+		{name: "only inserts", delta: gitDelta(11, 2, 0x02, 'h', 'i'), want: "hi"},
+		{name: "empty result", delta: gitDelta(11, 0), want: ""},
+		{name: "empty delta", delta: []byte{}, wantErr: true},
+		{name: "base size mismatch", delta: gitDelta(10, 5, 0x90, 5), wantErr: true},
+		{name: "base size truncated", delta: []byte{0x80}, wantErr: true},
+		{name: "result size missing", delta: binary.AppendUvarint(nil, 11), wantErr: true},
+		{name: "copy offset truncated", delta: gitDelta(11, 5, 0x91), wantErr: true},
+		{name: "copy size truncated", delta: gitDelta(11, 5, 0x91, 6), wantErr: true},
+		{name: "copy past the base", delta: gitDelta(11, 6, 0x91, 6, 6), wantErr: true},
+		{name: "copy offset past the base", delta: gitDelta(11, 1, 0x98, 0xff, 1), wantErr: true},
+		{name: "copy size 0 is 64KiB", delta: gitDelta(11, 0x10000, 0x80), wantErr: true},
+		{name: "insert truncated", delta: gitDelta(11, 4, 0x04, 'a', 'b'), wantErr: true},
+		{name: "opcode 0", delta: gitDelta(11, 0, 0x00), wantErr: true},
+		{name: "result shorter than its size", delta: gitDelta(11, 6, 0x90, 5), wantErr: true},
+		{name: "result longer than its size", delta: gitDelta(11, 4, 0x90, 5), wantErr: true},
+		{name: "huge result size", delta: gitDelta(11, 1<<62, 0x90, 5), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyGitDelta(base, tt.delta)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("applyGitDelta() = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("applyGitDelta() failed. Err: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("applyGitDelta() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGitPackHeader(t *testing.T) {
+	var id gitID
+	for i := range id {
+		id[i] = byte(i + 1)
+	}
+	refDelta := append([]byte{0x75}, id[:]...)
+	oversized := append([]byte{0xbf}, make([]byte, 10)...)
+	for i := 1; i < len(oversized); i++ {
+		oversized[i] = 0xff
+	}
+
+	// the objects are written at offset 200 so offset deltas have something before them
+	const offset = 200
+
+	tests := []struct {
+		name       string
+		data       []byte
+		wantKind   int
+		wantSize   int64
+		wantHeader int64 // bytes before the compressed data
+		wantBase   interface{}
+		wantErr    bool
+	}{
+		{name: "blob", data: []byte{0x35}, wantKind: gitObjBlob, wantSize: 5, wantHeader: 1},
+		{name: "multi byte size", data: []byte{0xbf, 0x01}, wantKind: gitObjBlob, wantSize: 31, wantHeader: 2},
+		{name: "tree", data: []byte{0x20}, wantKind: gitObjTree, wantSize: 0, wantHeader: 1},
+		{name: "offset delta", data: []byte{0x65, 0x05}, wantKind: gitObjOfsDelta, wantSize: 5, wantHeader: 2, wantBase: int64(offset - 5)},
+		{name: "multi byte offset delta", data: []byte{0x65, 0x80, 0x05}, wantKind: gitObjOfsDelta, wantSize: 5, wantHeader: 3, wantBase: int64(offset - 133)},
+		{name: "ref delta", data: refDelta, wantKind: gitObjRefDelta, wantSize: 5, wantHeader: 21, wantBase: id},
+		{name: "nothing at the offset", data: []byte{}, wantErr: true},
+		{name: "size truncated", data: []byte{0xbf}, wantErr: true},
+		{name: "size overflows", data: oversized, wantErr: true},
+		{name: "offset delta truncated", data: []byte{0x65}, wantErr: true},
+		{name: "offset delta continuation truncated", data: []byte{0x65, 0x80}, wantErr: true},
+		{name: "offset delta pointing at itself", data: []byte{0x65, 0x00}, wantErr: true},
+		{name: "offset delta before the pack", data: []byte{0x65, 0x81, 0x7f}, wantErr: true},
+		{name: "offset delta far before the pack", data: []byte{0x65, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}, wantErr: true},
+		{name: "ref delta truncated", data: refDelta[:10], wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.pack")
+			err := os.WriteFile(path, append(make([]byte, offset), tt.data...), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			pack := &gitPack{path: path, file: f}
+
+			kind, size, dataOffset, base, err := pack.header(offset)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("header() = %d, %d, %d, %v, want an error", kind, size, dataOffset, base)
+				}
+				if len(tt.data) > 0 && !errors.Is(err, ErrGitCorrupt) {
+					t.Errorf("header() err = %v, want %v", err, ErrGitCorrupt)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("header() failed. Err: %v", err)
+			}
+			if kind != tt.wantKind || size != tt.wantSize || dataOffset != offset+tt.wantHeader || base != tt.wantBase {
+				t.Errorf("header() = %d, %d, %d, %v, want %d, %d, %d, %v", kind, size, dataOffset, base,
+					tt.wantKind, tt.wantSize, offset+tt.wantHeader, tt.wantBase)
+			}
+		})
+	}
+}
+
+// gitPackIndex is a v2 pack index with the fanout and count zeroed object ids
+func gitPackIndex(fanout [256]uint32, count int) []byte {
+	idx := []byte{0xff, 't', 'O', 'c', 0, 0, 0, 2}
+	for _, n := range fanout {
+		idx = binary.BigEndian.AppendUint32(idx, n)
+	}
+	return append(idx, make([]byte, count*(20+4+4))...)
+}
+
+func TestOpenGitPack(t *testing.T) {
+	var empty, one, decreasing [256]uint32
+	for i := range one {
+		one[i] = 1
+	}
+	decreasing = one
+	decreasing[10] = 5
+
+	tests := []struct {
+		name    string
+		idx     []byte
+		wantErr error
+	}{
+		{name: "empty pack", idx: gitPackIndex(empty, 0)},
+		{name: "one object", idx: gitPackIndex(one, 1)},
+		{name: "not an index", idx: []byte("not an index"), wantErr: ErrGitUnsupported},
+		{name: "version 1", idx: append([]byte{0xff, 't', 'O', 'c', 0, 0, 0, 1}, make([]byte, 1024)...), wantErr: ErrGitUnsupported},
+		{name: "fanout decreasing", idx: gitPackIndex(decreasing, 5), wantErr: ErrGitCorrupt},
+		{name: "ids truncated", idx: gitPackIndex(one, 1)[:8+256*4+10], wantErr: ErrGitCorrupt},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			idxPath := filepath.Join(dir, "test.idx")
+			if err := os.WriteFile(idxPath, tt.idx, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "test.pack"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			pack, err := openGitPack(idxPath)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("openGitPack() err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("openGitPack() failed. Err: %v", err)
+			}
+			defer pack.file.Close()
+			// every id lookup stays inside the index
+			for first := 0; first < 256; first++ {
+				pack.find(gitID{byte(first)})
+			}
+		})
+	}
+}
+
+func TestGitPackObject(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write([]byte("hello"))
+	zw.Close()
+
+	// a blob header claiming size bytes, followed by the compressed "hello"
+	blob := func(size uint64) []byte {
+		header := []byte{byte(gitObjBlob<<4) | byte(size&0x0f)}
+		for size >>= 4; size > 0; size >>= 7 {
+			header[len(header)-1] |= 0x80
+			header = append(header, byte(size&0x7f))
+		}
+		return append(header, compressed.Bytes()...)
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{name: "blob", data: blob(5)},
+		{name: "size too large", data: blob(6), wantErr: true},
+		{name: "huge size", data: blob(1 << 50), wantErr: true},
+		{name: "largest size", data: blob(1<<60 - 1), wantErr: true},
+		{name: "not compressed", data: []byte{0x35, 'h', 'e', 'l', 'l', 'o'}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.pack")
+			if err := os.WriteFile(path, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			repo := &gitRepo{cache: make(map[gitID]*gitObject)}
+			obj, err := repo.packObject(&gitPack{path: path, file: f}, 0)
+			if tt.wantErr {
+				if !errors.Is(err, ErrGitCorrupt) {
+					t.Fatalf("packObject() err = %v, want %v", err, ErrGitCorrupt)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("packObject() failed. Err: %v", err)
+			}
+			if obj.kind != "blob" || string(obj.data) != "hello" {
+				t.Errorf("packObject() = %s %q, want blob %q", obj.kind, obj.data, "hello")
+			}
+		})
+	}
+}
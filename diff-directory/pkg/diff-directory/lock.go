@@ -0,0 +1,143 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	klog "k8s.io/klog/v2"
+)
+
+/*
+Run locking
+
+Two runs over the same trees, like cron and a manual run, race each other copying the
+same files. Every run that changes anything takes an advisory lock file in each root
+it can write, recording who holds it. The lock goes away with the process that holds
+it, so a lock file left behind by a crashed run is taken over. Roots are locked in
+sorted order so runs locking the same roots the other way around can't deadlock.
+*/
+
+// lockRoots locks every root, waiting up to wait for a run holding one to finish
+func lockRoots(roots []string, wait time.Duration) ([]*runLock, error) {
+	sorted := make([]string, 0, len(roots))
+	seen := make(map[string]bool, len(roots))
+	for _, root := range roots {
+		root = filepath.Clean(root)
+		if !seen[root] {
+			seen[root] = true
+			sorted = append(sorted, root)
+		}
+	}
+	sort.Strings(sorted)
+
+	locks := make([]*runLock, 0, len(sorted))
+	for _, root := range sorted {
+		lock, err := lockRoot(root, wait)
+		if err != nil {
+			unlockRoots(locks)
+			return nil, err
+		}
+		locks = append(locks, lock)
+	}
+	return locks, nil
+}
+
+func unlockRoots(locks []*runLock) {
+	for i := len(locks) - 1; i >= 0; i-- {
+		err := locks[i].release()
+		if err != nil {
+			klog.Errorf("Releasing %s failed. Err: %v\n", locks[i].path, err)
+		}
+	}
+}
+
+func lockRoot(root string, wait time.Duration) (*runLock, error) {
+	path := filepath.Join(root, lockFile)
+	deadline := time.Now().Add(wait)
+	waiting := false
+	for {
+		lock, err := tryLock(path)
+		if err == nil {
+			if stale := readLockInfo(lock.file); stale != nil {
+				klog.Infof("[LOCK] Taking over the stale lock of pid %d on %s from %s\n", stale.PID, stale.Host, stale.Started.Format("2006-01-02T15:04:05"))
+			}
+			err = lock.write()
+			if err != nil {
+				lock.release()
+				return nil, err
+			}
+			klog.V(3).Infof("[LOCK] Locked %s\n", root)
+			return lock, nil
+		}
+		if err != ErrLockHeld {
+			klog.Errorf("Locking %s failed. Err: %v\n", path, err)
+			return nil, err
+		}
+
+		holder := "another run"
+		if f, errOpen := os.Open(path); errOpen == nil {
+			if info := readLockInfo(f); info != nil {
+				holder = fmt.Sprintf("pid %d on %s since %s", info.PID, info.Host, info.Started.Format("2006-01-02T15:04:05"))
+			}
+			f.Close()
+		}
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("%w: %s is locked by %s", ErrLockHeld, root, holder)
+		}
+		if !waiting {
+			klog.Infof("[LOCK] %s is locked by %s, waiting up to %s\n", root, holder, wait)
+			waiting = true
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// write records this process as the holder of the lock
+func (l *runLock) write() error {
+	host, _ := os.Hostname()
+	data, err := json.Marshal(&lockInfo{
+		PID:     os.Getpid(),
+		Host:    host,
+		Started: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = l.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.WriteAt(data, 0)
+	if err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// readLockInfo returns who holds or held a lock, nil when the lock file is empty
+func readLockInfo(f *os.File) *lockInfo {
+	stat, err := f.Stat()
+	if err != nil || stat.Size() == 0 {
+		return nil
+	}
+	data := make([]byte, stat.Size())
+	_, err = f.ReadAt(data, 0)
+	if err != nil {
+		return nil
+	}
+
+	info := &lockInfo{}
+	if json.Unmarshal(data, info) != nil {
+		return nil
+	}
+	return info
+}
@@ -0,0 +1,59 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !unix
+
+package diff
+
+import (
+	"errors"
+	"os"
+
+	klog "k8s.io/klog/v2"
+)
+
+/*
+tryLock creates the lock file exclusively, ErrLockHeld when it exists. Without flock a
+lock file outlives a crashed run, so one left by this host for a process that is gone
+is removed first.
+*/
+func tryLock(path string) (*runLock, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			return &runLock{path: path, file: f}, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+
+		existing, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		info := readLockInfo(existing)
+		existing.Close()
+
+		host, _ := os.Hostname()
+		if info == nil || info.Host != host || processAlive(info.PID) {
+			return nil, ErrLockHeld
+		}
+		klog.Infof("[LOCK] Removing the stale lock of pid %d on %s\n", info.PID, info.Host)
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (l *runLock) release() error {
+	l.file.Close()
+	return os.Remove(l.path)
+}
+
+// processAlive can only tell a process is gone where FindProcess checks for it (windows)
+func processAlive(pid int) bool {
+	_, err := os.FindProcess(pid)
+	return err == nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build unix
+
+package diff
+
+import (
+	"errors"
+	"os"
+
+	unix "golang.org/x/sys/unix"
+)
+
+// tryLock takes the flock on path without blocking, ErrLockHeld when another process has it
+func tryLock(path string) (*runLock, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			f.Close()
+			return nil, ErrLockHeld
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		// the holder may have removed the file between our open and flock
+		var held, current unix.Stat_t
+		if unix.Fstat(int(f.Fd()), &held) == nil && unix.Stat(path, &current) == nil && held.Ino == current.Ino && held.Dev == current.Dev {
+			return &runLock{path: path, file: f}, nil
+		}
+		f.Close()
+	}
+}
+
+// release removes the lock file while still holding the lock so nobody locks a removed file
+func (l *runLock) release() error {
+	err := os.Remove(l.path)
+	errClose := l.file.Close()
+	if err != nil {
+		return err
+	}
+	return errClose
+}
@@ -0,0 +1,264 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	klog "k8s.io/klog/v2"
+)
+
+/*
+Sorted merge walk
+
+Both trees are read one directory at a time with os.ReadDir, the entries sorted by
+their path key and merge-joined like two sorted lists. Only the entries of the
+directories on the current path are held in memory, so memory is bounded by the
+depth of the trees rather than the number of files, and each difference is handed
+to emit as soon as it is found.
+*/
+
+type walkEntry struct {
+	key   string
+	name  string
+	isDir bool
+	entry os.DirEntry
+}
+
+// mergeItem is a src and dst entry with the same key, either can be missing
+type mergeItem struct {
+	src, dst         *walkEntry
+	srcFile, dstFile *DiffFile
+	skip             bool // a side failed so the pair can't be compared
+}
+
+// mergeTrees walks src and dst in sorted order calling emit for every difference
+func (d *Diff) mergeTrees(emit func(*DiffCompare) error) error {
+	return d.mergeDir(d.options.RootSrcPath, d.options.RootDstPath, "", "", emit)
+}
+
+/*
+mergeDir merge-joins one directory of src with the matching directory of dst. An empty
+srcDir or dstDir means that side does not have the directory at all.
+*/
+func (d *Diff) mergeDir(srcDir, dstDir, srcRel, dstRel string, emit func(*DiffCompare) error) error {
+	// a directory one side can't read is skipped on both sides rather than treated as empty
+	srcList, err := d.readDirSorted("SRC", srcDir, srcRel, false)
+	if err != nil {
+		return d.fileError("read dir", srcRel, err)
+	}
+	dstList, err := d.readDirSorted("DST", dstDir, dstRel, true)
+	if err != nil {
+		return d.fileError("read dir", dstRel, err)
+	}
+
+	// pair up the entries first so the files that need hashing can be hashed in parallel
+	items := make([]*mergeItem, 0, len(srcList)+len(dstList))
+	i, j := 0, 0
+	for i < len(srcList) || j < len(dstList) {
+		item := &mergeItem{}
+		switch {
+		case j >= len(dstList) || (i < len(srcList) && srcList[i].key < dstList[j].key):
+			item.src = srcList[i]
+			i++
+		case i >= len(srcList) || dstList[j].key < srcList[i].key:
+			item.dst = dstList[j]
+			j++
+		default:
+			item.src, item.dst = srcList[i], dstList[j]
+			i++
+			j++
+		}
+
+		// a directory on either side is descended into, a file on the other side is unmatched
+		if item.src != nil && !item.src.isDir {
+			item.srcFile, err = d.walkFile("SRC", srcDir, srcRel, item.src, false)
+			if err != nil {
+				err = d.fileError("stat", filepath.Join(srcRel, item.src.name), err)
+				if err != nil {
+					return err
+				}
+				item.skip = true
+			}
+		}
+		if item.dst != nil && !item.dst.isDir {
+			item.dstFile, err = d.walkFile("DST", dstDir, dstRel, item.dst, true)
+			if err != nil {
+				err = d.fileError("stat", filepath.Join(dstRel, item.dst.name), err)
+				if err != nil {
+					return err
+				}
+				item.skip = true
+			}
+		}
+		if !item.skip && d.filterOut([]*DiffFile{item.srcFile, item.dstFile}, []string{"src", "dst"}) {
+			item.srcFile, item.dstFile = nil, nil
+		}
+		items = append(items, item)
+	}
+	if d.visit == nil {
+		d.prehash(items)
+	}
+
+	for _, item := range items {
+		srcIsDir := item.src != nil && item.src.isDir
+		dstIsDir := item.dst != nil && item.dst.isDir
+		if srcIsDir || dstIsDir {
+			nextSrc, nextDst, nextSrcRel, nextDstRel := "", "", "", ""
+			if srcIsDir {
+				nextSrc = filepath.Join(srcDir, item.src.name)
+				nextSrcRel = filepath.Join(srcRel, item.src.name)
+			}
+			if dstIsDir {
+				nextDst = filepath.Join(dstDir, item.dst.name)
+				nextDstRel = filepath.Join(dstRel, item.dst.name)
+			}
+			err = d.mergeDir(nextSrc, nextDst, nextSrcRel, nextDstRel, emit)
+			if err != nil {
+				return err
+			}
+		}
+		if d.visit != nil {
+			if item.srcFile != nil {
+				d.visit(item.srcFile, false)
+			}
+			if item.dstFile != nil {
+				d.visit(item.dstFile, true)
+			}
+			continue
+		}
+		// a file that failed on one side must not look missing there
+		if item.skip || (item.srcFile == nil && item.dstFile == nil) {
+			continue
+		}
+
+		diff, err := d.compareFiles(item.srcFile, item.dstFile)
+		if err != nil {
+			return err
+		}
+		if diff == nil {
+			continue
+		}
+		err = emit(diff)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+prehash hashes the file pairs of a directory whose mod times differ with Workers
+goroutines, compareFiles then finds the hashes already cached on the files.
+*/
+func (d *Diff) prehash(items []*mergeItem) {
+	if d.options.Workers < 2 {
+		return
+	}
+
+	pairs := make(chan *mergeItem)
+	var wg sync.WaitGroup
+	for w := 0; w < d.options.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range pairs {
+				// errors are reported again by compareFiles
+				_, _, _ = d.contentHashes(item.srcFile, item.dstFile)
+			}
+		}()
+	}
+
+	for _, item := range items {
+		if item.skip || item.srcFile == nil || item.dstFile == nil {
+			continue
+		}
+		if d.compareModTime((*item.srcFile.Attr).ModTime(), (*item.dstFile.Attr).ModTime()) == 0 {
+			continue
+		}
+		if rule := d.matchRule(item.srcFile.RelPath); rule != nil && rule.Direction == RuleIgnore {
+			continue
+		}
+		pairs <- item
+	}
+	close(pairs)
+	wg.Wait()
+}
+
+// readDirSorted lists a directory sorted by path key, skipping internal files and collisions
+func (d *Diff) readDirSorted(label, dir, relDir string, dst bool) ([]*walkEntry, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	klog.V(6).Infof("[%s] ReadDir: %s\n", label, dir)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		klog.Errorf("ReadDir(%s) failed. Err: %v\n", dir, err)
+		return nil, err
+	}
+
+	list := make([]*walkEntry, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() && isInternalFile(entry.Name()) {
+			klog.V(4).Infof("[%s] skip internal file %s\n", label, filepath.Join(dir, entry.Name()))
+			continue
+		}
+		list = append(list, &walkEntry{
+			key:   d.pathKey(entry.Name(), dst),
+			name:  entry.Name(),
+			isDir: entry.IsDir(),
+			entry: entry,
+		})
+	}
+	sort.SliceStable(list, func(a, b int) bool {
+		return list[a].key < list[b].key
+	})
+
+	unique := list[:0]
+	for _, entry := range list {
+		if n := len(unique); n > 0 && unique[n-1].key == entry.key {
+			relPath := filepath.Join(relDir, entry.name)
+			klog.Infof("[%s] Skipping %s because it collides with %s\n", label, relPath, filepath.Join(relDir, unique[n-1].name))
+			d.collisions = append(d.collisions, relPath)
+			continue
+		}
+		unique = append(unique, entry)
+	}
+
+	return unique, nil
+}
+
+func (d *Diff) walkFile(label, dir, relDir string, entry *walkEntry, dst bool) (*DiffFile, error) {
+	info, err := entry.entry.Info()
+	if err != nil {
+		klog.Errorf("[%s] Info(%s) failed. Err: %v\n", label, filepath.Join(dir, entry.name), err)
+		return nil, err
+	}
+
+	file := &DiffFile{
+		Path:    filepath.Join(dir, entry.name),
+		RelPath: filepath.Join(relDir, entry.name),
+		Attr:    &info,
+	}
+	klog.V(6).Infof("[%s] path: %s\n", label, file.Path)
+
+	if dst {
+		d.dstCount++
+		err = d.dstSums.apply(file, d.pathKey(file.RelPath, true))
+	} else {
+		d.srcCount++
+		err = d.srcSums.apply(file, d.pathKey(file.RelPath, false))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
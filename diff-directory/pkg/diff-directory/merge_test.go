@@ -0,0 +1,294 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testFile struct {
+	rel     string
+	content string
+	modTime time.Time
+}
+
+// mergeResult runs the merge walk and describes every emitted difference as
+// "> path" for src to dst and "< path" for dst to src
+func mergeResult(t *testing.T, d *Diff) []string {
+	t.Helper()
+	got := make([]string, 0)
+	err := d.mergeTrees(func(dc *DiffCompare) error {
+		arrow := ">"
+		if dc.Direction == DIRECTION_DST_TO_SRC {
+			arrow = "<"
+		}
+		got = append(got, arrow+" "+filepath.ToSlash(diffRelPath(dc)))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("mergeTrees() failed. Err: %v", err)
+	}
+	return got
+}
+
+func TestMergeTrees(t *testing.T) {
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	now := old.Add(time.Minute)
+	nfc := "caf\u00e9.txt"
+	nfd := "cafe\u0301.txt"
+
+	tests := []struct {
+		name           string
+		normalize      string
+		fat            bool
+		src            []testFile
+		dst            []testFile
+		want           []string
+		wantCollisions []string
+	}{
+		{
+			name: "identical",
+			src:  []testFile{{"a.txt", "a", old}, {"d/b.txt", "b", old}},
+			dst:  []testFile{{"a.txt", "a", old}, {"d/b.txt", "b", old}},
+			want: []string{},
+		},
+		{
+			name: "src only",
+			src:  []testFile{{"a.txt", "a", old}, {"new/deep/b.txt", "b", old}},
+			dst:  []testFile{{"a.txt", "a", old}},
+			want: []string{"> new/deep/b.txt"},
+		},
+		{
+			name: "dst only",
+			src:  []testFile{{"a.txt", "a", old}},
+			dst:  []testFile{{"a.txt", "a", old}, {"b.txt", "b", old}, {"gone/c.txt", "c", old}},
+			want: []string{"< b.txt", "< gone/c.txt"},
+		},
+		{
+			name: "both sides",
+			src:  []testFile{{"newer.txt", "src", now}, {"older.txt", "src", old}, {"same.txt", "same", now}},
+			dst:  []testFile{{"newer.txt", "dst", old}, {"older.txt", "dst", now}, {"same.txt", "same", old}},
+			// same.txt only differs in mod time so its hashes match
+			want: []string{"> newer.txt", "< older.txt"},
+		},
+		{
+			name: "src file dst directory",
+			src:  []testFile{{"x", "file", old}},
+			dst:  []testFile{{"x/y.txt", "y", old}},
+			want: []string{"< x/y.txt", "> x"},
+		},
+		{
+			name: "src directory dst file",
+			src:  []testFile{{"x/y.txt", "y", old}},
+			dst:  []testFile{{"x", "file", old}},
+			want: []string{"> x/y.txt", "< x"},
+		},
+		{
+			name: "emit order",
+			src: []testFile{
+				{"c/a.txt", "c", old}, {"b.txt", "b", old}, {"a/z.txt", "z", old},
+				{"a/m/n.txt", "n", old}, {"a.txt", "a", old},
+			},
+			dst: []testFile{{"bb.txt", "bb", old}, {"a/b.txt", "b", old}},
+			// each directory in key order, a subdirectory before the entries after it
+			want: []string{"< a/b.txt", "> a/m/n.txt", "> a/z.txt", "> a.txt", "> b.txt", "< bb.txt", "> c/a.txt"},
+		},
+		{
+			name: "normalized names match",
+			// both spellings sort apart byte wise but share a key
+			normalize: NormalizeNFC,
+			src:       []testFile{{nfc, "same", old}, {"z.txt", "z", old}},
+			dst:       []testFile{{nfd, "same", old}, {"z.txt", "z", old}},
+			want:      []string{},
+		},
+		{
+			name:      "unnormalized names differ",
+			normalize: NormalizeNone,
+			src:       []testFile{{nfc, "same", old}},
+			dst:       []testFile{{nfd, "same", old}},
+			want:      []string{"< " + nfd, "> " + nfc},
+		},
+		{
+			name:           "normalization collision",
+			normalize:      NormalizeNFC,
+			src:            []testFile{{nfc, "nfc", old}, {nfd, "nfd", old}},
+			dst:            []testFile{},
+			want:           []string{"> " + nfd},
+			wantCollisions: []string{nfc},
+		},
+		{
+			name: "case collision on fat",
+			fat:  true,
+			src:  []testFile{{"A.txt", "upper", old}, {"a.txt", "lower", old}, {"Dir/b.txt", "b", old}},
+			dst:  []testFile{{"dir/b.txt", "b", old}},
+			// the directories match but dst needs the src spelling
+			want:           []string{"> A.txt", "> Dir/b.txt"},
+			wantCollisions: []string{"a.txt"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := t.TempDir(), t.TempDir()
+			for _, f := range tt.src {
+				writeTestFile(t, filepath.Join(src, filepath.FromSlash(f.rel)), f.content, f.modTime)
+			}
+			for _, f := range tt.dst {
+				writeTestFile(t, filepath.Join(dst, filepath.FromSlash(f.rel)), f.content, f.modTime)
+			}
+
+			d := New(DiffOpts{RootSrcPath: src, RootDstPath: dst, Normalize: tt.normalize})
+			d.fat = tt.fat
+			got := mergeResult(t, d)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeTrees() = %q, want %q", got, tt.want)
+			}
+
+			var collisions []string
+			for _, relPath := range d.collisions {
+				collisions = append(collisions, filepath.ToSlash(relPath))
+			}
+			if !reflect.DeepEqual(collisions, tt.wantCollisions) {
+				t.Errorf("collisions = %q, want %q", collisions, tt.wantCollisions)
+			}
+		})
+	}
+}
+
+func TestMergeTreesCounts(t *testing.T) {
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	src, dst := t.TempDir(), t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "a", old)
+	writeTestFile(t, filepath.Join(src, "d", "b.txt"), "b", old)
+	writeTestFile(t, filepath.Join(dst, "d", "b.txt"), "b", old)
+	// internal files are never compared
+	writeTestFile(t, filepath.Join(dst, lockFile), "lock", old)
+
+	d := New(DiffOpts{RootSrcPath: src, RootDstPath: dst})
+	got := mergeResult(t, d)
+	if want := []string{"> a.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("mergeTrees() = %q, want %q", got, want)
+	}
+	if d.srcCount != 2 || d.dstCount != 1 {
+		t.Errorf("srcCount, dstCount = %d, %d, want 2, 1", d.srcCount, d.dstCount)
+	}
+}
+
+// twoMapWalk is the comparison mergeTrees replaced, both trees are read into
+// maps and src is matched against dst before the dst only files are added
+func (d *Diff) twoMapWalk(emit func(*DiffCompare) error) error {
+	srcMap, err := d.walkTree("SRC", d.options.RootSrcPath)
+	if err != nil {
+		return err
+	}
+	dstMap, err := d.walkTree("DST", d.options.RootDstPath)
+	if err != nil {
+		return err
+	}
+
+	for key, src := range srcMap {
+		diff, err := d.compareFiles(src, dstMap[key])
+		if err != nil {
+			return err
+		}
+		if diff != nil {
+			err = emit(diff)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for key, dst := range dstMap {
+		if srcMap[key] != nil {
+			continue
+		}
+		diff, err := d.compareFiles(nil, dst)
+		if err != nil {
+			return err
+		}
+		if diff != nil {
+			err = emit(diff)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+benchTree creates src and dst trees with the same files, perDir files per
+directory, except that every 1000th file only exists in src. All mod times are
+the same so the benchmark measures the walk and not hashing or copying.
+*/
+func benchTree(b *testing.B, files, perDir int) (string, string) {
+	b.Helper()
+	root := b.TempDir()
+	src, dst := filepath.Join(root, "src"), filepath.Join(root, "dst")
+	stamp := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < files; i++ {
+		rel := filepath.Join(fmt.Sprintf("d%d", i/perDir), fmt.Sprintf("f%d", i%perDir))
+		sides := []string{src, dst}
+		if i%perDir == 0 {
+			for _, side := range sides {
+				if err := os.MkdirAll(filepath.Join(side, filepath.Dir(rel)), 0755); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		if i%1000 == 0 {
+			sides = sides[:1]
+		}
+		for _, side := range sides {
+			path := filepath.Join(side, rel)
+			if err := os.WriteFile(path, nil, 0644); err != nil {
+				b.Fatal(err)
+			}
+			if err := os.Chtimes(path, stamp, stamp); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	return src, dst
+}
+
+func BenchmarkCompareTrees(b *testing.B) {
+	walks := []struct {
+		name string
+		walk func(d *Diff, emit func(*DiffCompare) error) error
+	}{
+		{"merge", (*Diff).mergeTrees},
+		{"twomap", (*Diff).twoMapWalk},
+	}
+
+	for _, files := range []int{10000, 100000} {
+		src, dst := benchTree(b, files, 1000)
+		for _, w := range walks {
+			b.Run(fmt.Sprintf("%s/files=%d", w.name, files), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					d := New(DiffOpts{RootSrcPath: src, RootDstPath: dst})
+					found := 0
+					err := w.walk(d, func(*DiffCompare) error {
+						found++
+						return nil
+					})
+					if err != nil {
+						b.Fatalf("walk failed. Err: %v", err)
+					}
+					if want := (files + 999) / 1000; found != want {
+						b.Fatalf("found %d differences, want %d", found, want)
+					}
+				}
+			})
+		}
+	}
+}
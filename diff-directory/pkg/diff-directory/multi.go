@@ -0,0 +1,435 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	klog "k8s.io/klog/v2"
+)
+
+/*
+N-way sync
+
+Chaining pairwise runs over more than two copies of a tree gives results that depend on
+the order of the runs. A multi-root sync walks all roots at once with the same sorted
+merge as the pairwise walk, picks the newest version of every path across all roots and
+copies it to every root that has an older or no version, all in one pass.
+
+The copies are planned first so the safety limits and the free space of every root are
+checked before anything is written. A file missing from a root goes under the spelling
+that root already has for its directories. Every root is treated as POSIX, a FAT or
+exFAT root is refused.
+
+There is no record of earlier runs, so a missing file can't be told from a deleted one:
+like the pairwise sync, a file deleted from some roots is copied back from the others.
+Delete it from every root to remove it.
+*/
+
+func NewMulti(opts MultiOpts) *Multi {
+	multi := &Multi{
+		options: opts,
+		diff: New(DiffOpts{
+			DryRun:         opts.DryRun,
+			Verify:         opts.Verify,
+			TargetFS:       TargetFSPosix,
+			MTimeTolerance: opts.MTimeTolerance,
+			IgnoreTZShift:  opts.IgnoreTZShift,
+			Normalize:      opts.Normalize,
+			ErrorPolicy:    opts.ErrorPolicy,
+			CopyStrategy:   opts.CopyStrategy,
+			Throttle:       opts.Throttle,
+			Filter:         opts.Filter,
+
+			MaxFiles:        opts.MaxFiles,
+			MaxBytes:        opts.MaxBytes,
+			MaxOverwritePct: opts.MaxOverwritePct,
+			Force:           opts.Force,
+		}),
+	}
+	return multi
+}
+
+func (m *Multi) Process() error {
+	if len(m.options.Roots) < 2 {
+		klog.Errorf("Multi-root sync needs at least 2 roots, got %d\n", len(m.options.Roots))
+		return ErrMultiTooFewRoots
+	}
+
+	for i, root := range m.options.Roots {
+		if detectTargetFS(root) == TargetFSFat {
+			klog.Errorf("%s is on a FAT or exFAT filesystem: %s\n", m.label(i), root)
+			return ErrMultiTargetFS
+		}
+	}
+
+	err := m.diff.checkErrorPolicy()
+	if err != nil {
+		return err
+	}
+	err = m.diff.checkCopyStrategy()
+	if err != nil {
+		return err
+	}
+	err = m.diff.startThrottle()
+	if err != nil {
+		return err
+	}
+	defer m.diff.stopThrottle()
+
+	if !m.options.DryRun {
+		var locks []*runLock
+		locks, err = lockRoots(m.options.Roots, m.options.LockWait)
+		if err != nil {
+			klog.Errorf("lockRoots failed. Err: %v\n", err)
+			return err
+		}
+		defer unlockRoots(locks)
+	}
+
+	err = m.diff.checkNormalize()
+	if err != nil {
+		klog.Errorf("checkNormalize failed. Err: %v\n", err)
+		return err
+	}
+
+	err = m.diff.checkFilter()
+	if err != nil {
+		klog.Errorf("checkFilter failed. Err: %v\n", err)
+		return err
+	}
+
+	for i, root := range m.options.Roots {
+		klog.V(3).Infof("%s: %s\n", m.label(i), root)
+	}
+
+	m.counts = make([]int, len(m.options.Roots))
+	rels := make([]string, len(m.options.Roots))
+	err = m.mergeDir(m.options.Roots, m.options.Roots, rels)
+	if err != nil {
+		klog.Errorf("mergeDir failed. Err: %v\n", err)
+		return err
+	}
+
+	err = m.checkSafety()
+	if err != nil {
+		return err
+	}
+	err = m.checkSpace()
+	if err != nil {
+		return err
+	}
+	for _, c := range m.copies {
+		err = m.apply(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !m.options.DryRun && len(m.copied) > 0 {
+		klog.Infof("\n\n")
+		klog.Infof("Copied files:\n")
+		for _, copied := range m.copied {
+			klog.Infof("%s\n", copied)
+		}
+		if summary := m.diff.strategySummary(); summary != "" {
+			klog.Infof("Copied with: %s\n", summary)
+		}
+		if summary := m.diff.sparseSummary(); summary != "" {
+			klog.Infof("Sparse files: %s\n", summary)
+		}
+	}
+
+	if len(m.diff.collisions) > 0 {
+		klog.Infof("\n\n")
+		klog.Infof("Name collisions (skipped):\n")
+		for _, relPath := range m.diff.collisions {
+			klog.Infof("%s\n", relPath)
+		}
+	}
+
+	m.diff.reportFiltered()
+	m.diff.reportChanged()
+
+	return m.diff.partialFailure()
+}
+
+/*
+mergeDir merge-joins the same directory across all roots. An empty dir means that root
+does not have the directory, targets are where each root has or would get it.
+*/
+func (m *Multi) mergeDir(dirs, targets, rels []string) error {
+	n := len(dirs)
+	lists := make([][]*walkEntry, n)
+	for i := range dirs {
+		var err error
+		lists[i], err = m.diff.readDirSorted(m.label(i), dirs[i], rels[i], false)
+		if err != nil {
+			// skipped in every root so the others don't see it as empty
+			return m.diff.fileError("read dir", rels[i], err)
+		}
+	}
+
+	pos := make([]int, n)
+	for {
+		// the smallest key at the head of any root is next
+		key, found := "", false
+		for i := range lists {
+			if pos[i] < len(lists[i]) && (!found || lists[i][pos[i]].key < key) {
+				key = lists[i][pos[i]].key
+				found = true
+			}
+		}
+		if !found {
+			return nil
+		}
+
+		entries := make([]*walkEntry, n)
+		subDirs := make([]string, n)
+		subTargets := make([]string, n)
+		subRels := make([]string, n)
+		dirName := ""
+		hasFile := false
+		for i := range lists {
+			if pos[i] >= len(lists[i]) || lists[i][pos[i]].key != key {
+				continue
+			}
+			entries[i] = lists[i][pos[i]]
+			pos[i]++
+			if entries[i].isDir {
+				subDirs[i] = filepath.Join(dirs[i], entries[i].name)
+				subTargets[i] = subDirs[i]
+				subRels[i] = filepath.Join(rels[i], entries[i].name)
+				if dirName == "" {
+					dirName = entries[i].name
+				}
+			} else {
+				hasFile = true
+			}
+		}
+
+		if dirName != "" {
+			// a root without the directory gets it under its own parent
+			for i := range subTargets {
+				if subTargets[i] == "" {
+					subTargets[i] = filepath.Join(targets[i], dirName)
+				}
+			}
+			err := m.mergeDir(subDirs, subTargets, subRels)
+			if err != nil {
+				return err
+			}
+		}
+		if hasFile {
+			err := m.syncFile(dirs, targets, rels, entries)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// syncFile plans copying the newest version of a file to every root that is behind
+func (m *Multi) syncFile(dirs, targets, rels []string, entries []*walkEntry) error {
+	files := make([]*DiffFile, len(entries))
+	newest := -1
+	for i, entry := range entries {
+		if entry == nil || entry.isDir {
+			continue
+		}
+		var err error
+		files[i], err = m.diff.walkFile(m.label(i), dirs[i], rels[i], entry, false)
+		if err != nil {
+			return m.diff.fileError("stat", filepath.Join(rels[i], entry.name), err)
+		}
+		if newest < 0 || (*files[i].Attr).ModTime().After((*files[newest].Attr).ModTime()) {
+			newest = i
+		}
+	}
+	labels := make([]string, len(files))
+	for i := range labels {
+		labels[i] = m.label(i)
+	}
+	if m.diff.filterOut(files, labels) {
+		return nil
+	}
+	for i, file := range files {
+		if file != nil {
+			m.counts[i]++
+		}
+	}
+	winner := files[newest]
+
+	for i, file := range files {
+		if i == newest {
+			continue
+		}
+		if entries[i] != nil && entries[i].isDir {
+			klog.Infof("[%s] Skipping %s because it is a directory\n", m.label(i), winner.RelPath)
+			continue
+		}
+
+		// a missing file is named like the winner, in the directories this root has
+		target := filepath.Join(targets[i], entries[newest].name)
+		reason := "Destination file does not exist"
+		if file != nil {
+			if m.diff.compareModTime((*winner.Attr).ModTime(), (*file.Attr).ModTime()) == 0 {
+				continue
+			}
+			winnerHash, fileHash, err := m.diff.contentHashes(winner, file)
+			if err != nil {
+				klog.Errorf("Error calculating hash(%s, %s)\n", winner.Path, file.Path)
+				err = m.diff.fileError("hash", winner.RelPath, err)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if winnerHash == fileHash {
+				continue
+			}
+			target = file.Path
+			reason = fmt.Sprintf("Hash mismatch: %s -> %s", winnerHash, fileHash)
+		}
+
+		m.copies = append(m.copies, &multiCopy{
+			from:    winner,
+			planned: file,
+			to:      target,
+			src:     newest,
+			dst:     i,
+			reason:  reason,
+		})
+	}
+
+	return nil
+}
+
+// apply carries out one planned copy
+func (m *Multi) apply(c *multiCopy) error {
+	err := m.copyFile(c.from, c.planned, c.to)
+	if errors.Is(err, ErrFileChanged) {
+		// the other roots are still brought up to date, the file is only listed once
+		if n := len(m.diff.changed); n == 0 || m.diff.changed[n-1] != c.from.RelPath {
+			m.diff.changed = append(m.diff.changed, c.from.RelPath)
+		}
+		return nil
+	}
+	if err != nil {
+		return m.diff.fileError("sync", c.from.RelPath, err)
+	}
+
+	label := fmt.Sprintf("[%s -> %s]", m.label(c.src), m.label(c.dst))
+	klog.V(4).Infof("%s Paths: %s to %s\n", label, c.from.Path, c.to)
+	if m.options.DryRun {
+		klog.Infof("%s Diff: %s\n", label, c.from.RelPath)
+	} else {
+		klog.Infof("%s Copying... %s\n", label, c.from.RelPath)
+	}
+	klog.Infof("\t%s\n", c.reason)
+	klog.Infof("\n")
+	m.copied = append(m.copied, fmt.Sprintf("%s Copied %s", label, c.from.RelPath))
+	return nil
+}
+
+// checkSafety applies the safety limits to the planned copies, overwrites per root
+func (m *Multi) checkSafety() error {
+	if !m.diff.hasSafetyLimits() {
+		return nil
+	}
+
+	var bytes int64
+	overwrites := make([]int, len(m.options.Roots))
+	for _, c := range m.copies {
+		bytes += (*c.from.Attr).Size()
+		if c.planned != nil {
+			overwrites[c.dst]++
+		}
+	}
+
+	tripped := make([]string, 0)
+	if m.options.MaxFiles > 0 && len(m.copies) > m.options.MaxFiles {
+		tripped = append(tripped, fmt.Sprintf("%d files changed > max files %d", len(m.copies), m.options.MaxFiles))
+	}
+	if m.options.MaxBytes > 0 && bytes > m.options.MaxBytes {
+		tripped = append(tripped, fmt.Sprintf("%d bytes copied > max bytes %d", bytes, m.options.MaxBytes))
+	}
+	if m.options.MaxOverwritePct > 0 {
+		for i, n := range overwrites {
+			if pct := percentOf(n, m.counts[i]); pct > m.options.MaxOverwritePct {
+				tripped = append(tripped, fmt.Sprintf("%.1f%% of %s overwritten (%d of %d files) > max overwrite %.1f%%", pct, m.label(i), n, m.counts[i], m.options.MaxOverwritePct))
+			}
+		}
+	}
+	if len(tripped) == 0 {
+		klog.V(3).Infof("Safety limits OK: %d files, %d bytes\n", len(m.copies), bytes)
+		return nil
+	}
+	return m.diff.refuseSafety(tripped)
+}
+
+// checkSpace checks the free space of every filesystem the roots are on
+func (m *Multi) checkSpace() error {
+	plans := make([]*spacePlan, 0, len(m.options.Roots))
+	rootPlans := make([]*spacePlan, len(m.options.Roots))
+	for i, root := range m.options.Roots {
+		vol, err := statVolume(root)
+		if err != nil {
+			klog.V(3).Infof("statVolume(%s) failed, not checking free space. Err: %v\n", root, err)
+			continue
+		}
+		// roots on the same filesystem share its free space
+		for _, plan := range plans {
+			if plan.volume.id == vol.id {
+				plan.label += " and " + m.label(i)
+				rootPlans[i] = plan
+				break
+			}
+		}
+		if rootPlans[i] == nil {
+			rootPlans[i] = &spacePlan{label: m.label(i), volume: vol}
+			plans = append(plans, rootPlans[i])
+		}
+	}
+	if len(plans) == 0 {
+		return nil
+	}
+
+	for _, c := range m.copies {
+		plan := rootPlans[c.dst]
+		if plan == nil {
+			continue
+		}
+		var oldSize int64
+		if c.planned != nil {
+			oldSize = diskSize(c.planned)
+		}
+		plan.add(diskSize(c.from), oldSize, false)
+	}
+	return m.diff.refuseSpace(plans)
+}
+
+func (m *Multi) copyFile(from, planned *DiffFile, to string) error {
+	err := m.diff.buildDir(to)
+	if err != nil {
+		klog.Errorf("buildDir(%s) failed. Err: %v\n", to, err)
+		return err
+	}
+	err = m.diff.copyChecked(from, planned, to, true, false, func() error {
+		_, err := m.diff.copy(from.Path, to)
+		return err
+	})
+	if err != nil {
+		klog.Errorf("copy(%s, %s) failed. Err: %v\n", from.Path, to, err)
+		return err
+	}
+	return nil
+}
+
+func (m *Multi) label(i int) string {
+	return fmt.Sprintf("ROOT%d", i+1)
+}
@@ -0,0 +1,100 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestFile writes a file, creating its directories, with a mod time
+func writeTestFile(t *testing.T, path, content string, modTime time.Time) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMultiKeepsDirectorySpelling(t *testing.T) {
+	nfc := "caf\u00e9"
+	nfd := "cafe\u0301"
+	now := time.Now().Truncate(time.Second)
+
+	root1, root2 := t.TempDir(), t.TempDir()
+	writeTestFile(t, filepath.Join(root1, nfc, "new.txt"), "new", now)
+	writeTestFile(t, filepath.Join(root2, nfd, "old.txt"), "old", now)
+
+	err := NewMulti(MultiOpts{Roots: []string{root1, root2}, Normalize: NormalizeNFC}).Process()
+	if err != nil {
+		t.Fatalf("Process() failed. Err: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(root2, nfd, "new.txt")); err != nil {
+		t.Errorf("new.txt wasn't copied into the existing directory. Err: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root2, nfc)); err == nil {
+		t.Errorf("a second spelling of the directory was created")
+	}
+	if _, err := os.Stat(filepath.Join(root1, nfc, "old.txt")); err != nil {
+		t.Errorf("old.txt wasn't copied the other way. Err: %v", err)
+	}
+}
+
+func TestMultiSafetyLimits(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	tests := []struct {
+		name     string
+		opts     MultiOpts
+		wantErr  error
+		wantCopy bool
+	}{
+		{name: "no limits", wantCopy: true},
+		{name: "max files", opts: MultiOpts{MaxFiles: 2}, wantErr: ErrSafetyLimit},
+		{name: "max bytes", opts: MultiOpts{MaxBytes: 10}, wantErr: ErrSafetyLimit},
+		{name: "max overwrite", opts: MultiOpts{MaxOverwritePct: 40}, wantErr: ErrSafetyLimit},
+		{name: "forced", opts: MultiOpts{MaxFiles: 2, Force: true}, wantCopy: true},
+		{name: "dry run", opts: MultiOpts{MaxFiles: 2, DryRun: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root1, root2 := t.TempDir(), t.TempDir()
+			// three new files and one newer version for root2, one of its two files
+			for _, name := range []string{"a", "b", "c"} {
+				writeTestFile(t, filepath.Join(root1, name), "content "+name, now)
+			}
+			writeTestFile(t, filepath.Join(root1, "d"), "newer", now)
+			writeTestFile(t, filepath.Join(root2, "d"), "older", now.Add(-time.Hour))
+			writeTestFile(t, filepath.Join(root2, "e"), "same", now)
+			writeTestFile(t, filepath.Join(root1, "e"), "same", now)
+
+			opts := tt.opts
+			opts.Roots = []string{root1, root2}
+			err := NewMulti(opts).Process()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Process() err = %v, want %v", err, tt.wantErr)
+			}
+
+			_, errA := os.Stat(filepath.Join(root2, "a"))
+			if (errA == nil) != tt.wantCopy {
+				t.Errorf("root2/a copied %t, want %t", errA == nil, tt.wantCopy)
+			}
+			data, _ := os.ReadFile(filepath.Join(root2, "d"))
+			if (string(data) == "newer") != tt.wantCopy {
+				t.Errorf("root2/d = %q, want it copied %t", data, tt.wantCopy)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	norm "golang.org/x/text/unicode/norm"
+	klog "k8s.io/klog/v2"
+)
+
+/*
+Unicode normalization
+
+macOS writes names decomposed (NFD) while Linux keeps whatever it was given, usually
+composed (NFC). With a normalization form set, paths are matched by their normalized
+form while each side keeps its own spelling on disk.
+*/
+
+func (d *Diff) checkNormalize() error {
+	switch d.options.Normalize {
+	case "", NormalizeNone, NormalizeNFC, NormalizeNFD:
+		return nil
+	}
+	klog.Errorf("Unknown normalization: %s\n", d.options.Normalize)
+	return ErrUnknownNormalization
+}
+
+func (d *Diff) normalize(relPath string) string {
+	switch d.options.Normalize {
+	case NormalizeNFC:
+		return norm.NFC.String(relPath)
+	case NormalizeNFD:
+		return norm.NFD.String(relPath)
+	}
+	return relPath
+}
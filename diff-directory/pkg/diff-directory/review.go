@@ -0,0 +1,246 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	klog "k8s.io/klog/v2"
+)
+
+/*
+Interactive review
+
+Every planned action is shown with the reason for it and both sides' size, mod time
+and hash. Each one can be accepted, skipped or reversed, and all remaining actions
+under a directory can be accepted or skipped at once. Text files can be diffed before
+deciding.
+*/
+
+type reviewRule struct {
+	dir    string // relative directory, "." for everything
+	accept bool
+}
+
+// review asks about every action, returning the ones to carry out
+func (d *Diff) review(diffs []*DiffCompare) ([]*DiffCompare, error) {
+	in := d.options.ReviewIn
+	if in == nil {
+		in = os.Stdin
+	}
+	out := d.options.ReviewOut
+	if out == nil {
+		out = os.Stdout
+	}
+	reader := bufio.NewReader(in)
+	ask := func(prompt string) (string, error) {
+		fmt.Fprint(out, prompt)
+		answer, err := reader.ReadString('\n')
+		if err != nil && (err != io.EOF || answer == "") {
+			fmt.Fprintln(out)
+			return "", ErrReviewQuit
+		}
+		return strings.TrimSpace(answer), nil
+	}
+
+	accepted := make([]*DiffCompare, 0, len(diffs))
+	rules := make([]reviewRule, 0)
+	for i, diff := range diffs {
+		relPath := diffRelPath(diff)
+		if rule := matchReviewRule(rules, relPath); rule != nil {
+			klog.V(3).Infof("[REVIEW] %s accept: %t by the rule for %s\n", relPath, rule.accept, rule.dir)
+			if rule.accept {
+				accepted = append(accepted, diff)
+			}
+			continue
+		}
+
+		d.printAction(out, diff, i+1, len(diffs))
+		for decided := false; !decided; {
+			answer, err := ask("[a]ccept, [s]kip, [r]everse, [A]ccept dir, [S]kip dir, [d]iff, [q]uit? ")
+			if err != nil {
+				return nil, err
+			}
+
+			switch answer {
+			case "a":
+				accepted = append(accepted, diff)
+				decided = true
+			case "s":
+				decided = true
+			case "r":
+				err = d.reverse(diff)
+				if err != nil {
+					fmt.Fprintf(out, "Can't reverse: %v\n", err)
+					continue
+				}
+				accepted = append(accepted, diff)
+				decided = true
+			case "A", "S":
+				dir := filepath.Dir(relPath)
+				answerDir, err := ask(fmt.Sprintf("All remaining under directory [%s]: ", dir))
+				if err != nil {
+					return nil, err
+				}
+				if answerDir != "" {
+					dir = filepath.Clean(answerDir)
+				}
+				rule := reviewRule{dir: dir, accept: answer == "A"}
+				rules = append(rules, rule)
+				if rule.accept {
+					accepted = append(accepted, diff)
+				}
+				decided = true
+			case "d":
+				text, err := d.actionDiff(diff)
+				if err != nil {
+					fmt.Fprintf(out, "Can't diff: %v\n", err)
+					continue
+				}
+				if d.options.DiffColor {
+					text = colorizeDiff(text)
+				}
+				fmt.Fprint(out, text)
+			case "q":
+				return nil, ErrReviewQuit
+			}
+		}
+		fmt.Fprintln(out)
+	}
+
+	return accepted, nil
+}
+
+// printAction shows an action with everything needed to decide on it
+func (d *Diff) printAction(out io.Writer, diff *DiffCompare, n, total int) {
+	label := "[SRC -> DST]"
+	if diff.Direction == DIRECTION_DST_TO_SRC {
+		label = "[DST -> SRC]"
+	}
+	fmt.Fprintf(out, "(%d/%d) %s %s\n", n, total, label, diffRelPath(diff))
+	fmt.Fprintf(out, "\tReason: %s\n", d.actionReason(diff))
+	d.printSide(out, "Src", diff.SrcFile, false)
+	d.printSide(out, "Dst", diff.DstFile, d.crypt != nil)
+}
+
+func (d *Diff) printSide(out io.Writer, label string, file *DiffFile, encrypted bool) {
+	if file == nil {
+		fmt.Fprintf(out, "\t%s: does not exist\n", label)
+		return
+	}
+
+	hash := file.Hash
+	if hash == "" && !encrypted {
+		var err error
+		hash, err = d.fileHash(file)
+		if err != nil {
+			hash = "unreadable"
+		}
+	}
+	if hash == "" {
+		hash = "unknown"
+	}
+	attr := *file.Attr
+	fmt.Fprintf(out, "\t%s: %d bytes, modified %s, hash %s\n", label, attr.Size(), attr.ModTime().Format("2006-01-02T15:04:05"), hash)
+}
+
+func (d *Diff) actionReason(diff *DiffCompare) string {
+	switch {
+	case diff.DstFile == nil:
+		return "Destination file does not exist"
+	case diff.SrcFile == nil:
+		return "Source file does not exist"
+	case diff.RenameOnly:
+		return fmt.Sprintf("Destination file is spelled %s", diff.DstFile.RelPath)
+	case diff.Direction == DIRECTION_SRC_TO_DST:
+		return "Source file is newer and its content differs"
+	}
+	return "Destination file is newer and its content differs"
+}
+
+// reverse flips the direction of an action, which only works when both sides have the file
+func (d *Diff) reverse(diff *DiffCompare) error {
+	switch {
+	case diff.SrcFile == nil || diff.DstFile == nil:
+		return ErrReviewIrreversible
+	case diff.RenameOnly:
+		return ErrReviewIrreversible
+	case diff.Direction == DIRECTION_SRC_TO_DST && d.options.SkipSrcUpdate:
+		return ErrReviewIrreversible
+	}
+
+	if diff.Direction == DIRECTION_SRC_TO_DST {
+		diff.Direction = DIRECTION_DST_TO_SRC
+	} else {
+		diff.Direction = DIRECTION_SRC_TO_DST
+	}
+	return nil
+}
+
+// actionDiff returns the unified diff of what the action would change in the file it writes
+func (d *Diff) actionDiff(diff *DiffCompare) (string, error) {
+	from, to := diff.SrcFile, diff.DstFile
+	fromEncrypted, toEncrypted := false, d.crypt != nil
+	fromLabel, toLabel := "src", "dst"
+	if diff.Direction == DIRECTION_DST_TO_SRC {
+		from, to = to, from
+		fromEncrypted, toEncrypted = toEncrypted, fromEncrypted
+		fromLabel, toLabel = toLabel, fromLabel
+	}
+
+	// a file that doesn't exist yet diffs as empty
+	var oldData []byte
+	oldName := "/dev/null"
+	if to != nil {
+		if (*to.Attr).Size() > maxDiffSize {
+			return "", ErrDiffTooLarge
+		}
+		data, err := d.readContent(to, toEncrypted)
+		if err != nil {
+			return "", err
+		}
+		oldData = data
+		oldName = filepath.ToSlash(filepath.Join(toLabel, to.RelPath))
+	}
+	if (*from.Attr).Size() > maxDiffSize {
+		return "", ErrDiffTooLarge
+	}
+	newData, err := d.readContent(from, fromEncrypted)
+	if err != nil {
+		return "", err
+	}
+	if isBinary(oldData) || isBinary(newData) {
+		return "", ErrDiffBinary
+	}
+
+	text := unifiedDiff(oldName, filepath.ToSlash(filepath.Join(fromLabel, from.RelPath)), oldData, newData)
+	if text == "" {
+		return "Contents are the same\n", nil
+	}
+	return text, nil
+}
+
+func diffRelPath(diff *DiffCompare) string {
+	if diff.SrcFile != nil {
+		return diff.SrcFile.RelPath
+	}
+	return diff.DstFile.RelPath
+}
+
+func matchReviewRule(rules []reviewRule, relPath string) *reviewRule {
+	// the newest rule wins so a subdirectory can be excepted from an earlier rule
+	for i := len(rules) - 1; i >= 0; i-- {
+		dir := rules[i].dir
+		if dir == "." || strings.HasPrefix(relPath, dir+string(filepath.Separator)) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
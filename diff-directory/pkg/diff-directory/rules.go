@@ -0,0 +1,301 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	klog "k8s.io/klog/v2"
+)
+
+/*
+Sync rules
+
+A rules file assigns a direction and a conflict policy to subtrees, one rule per line:
+
+	# pattern     direction    [conflict]
+	Music/**      two-way
+	Podcasts/**   src-to-dst
+	Scratch/**    ignore
+	Docs/**       two-way      keep-both
+
+Patterns are matched against the relative path the way .gitignore does it: a pattern
+with a slash is anchored at the root, one without matches at any depth, * and ? don't
+cross a slash, ** matches any number of directories and a pattern matching a directory
+matches everything below it. Negated patterns are refused. The first matching rule
+wins, paths no rule matches get the default Direction and Conflict, two-way with the
+newer file winning unless set. Ignore patterns are checked before the rules file.
+
+A conflict is a file that exists on both sides with different content. The policy
+decides which side wins: the newer one, always src, always dst, neither (skip), or the
+newer one while the older version is kept next to it under a conflict name.
+*/
+
+// loadRules builds the rules from Ignore, RulesFile and the default Direction and Conflict
+func (d *Diff) loadRules() error {
+	if d.options.RulesFile == "" && len(d.options.Ignore) == 0 && d.options.Direction == "" && d.options.Conflict == "" {
+		return nil
+	}
+
+	rules := make([]*SyncRule, 0)
+	for _, pattern := range d.options.Ignore {
+		rule, err := newSyncRule(pattern, RuleIgnore, ConflictNewer)
+		if err != nil {
+			klog.Errorf("Invalid ignore pattern %s. Err: %v\n", pattern, err)
+			return err
+		}
+		rules = append(rules, rule)
+	}
+
+	if d.options.RulesFile != "" {
+		fileRules, err := d.readRulesFile(d.options.RulesFile)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, fileRules...)
+	}
+
+	direction := d.options.Direction
+	if direction == "" {
+		direction = RuleTwoWay
+	}
+	conflict := d.options.Conflict
+	if conflict == "" {
+		conflict = ConflictNewer
+	}
+	defaultRule, err := newSyncRule("default", direction, conflict)
+	if err != nil {
+		klog.Errorf("Invalid default rule. Err: %v\n", err)
+		return err
+	}
+
+	klog.V(3).Infof("Loaded %d sync rules\n", len(rules))
+	d.rules = rules
+	d.defaultRule = defaultRule
+	return nil
+}
+
+func (d *Diff) readRulesFile(path string) ([]*SyncRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		klog.Errorf("os.Open(%s) failed. Err: %v\n", path, err)
+		return nil, err
+	}
+	defer f.Close()
+
+	rules := make([]*SyncRule, 0)
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 3 {
+			klog.Errorf("%s:%d has too many fields\n", path, lineNum)
+			return nil, ErrRulesInvalid
+		}
+
+		direction, conflict := RuleTwoWay, ConflictNewer
+		if len(fields) > 1 {
+			direction = fields[1]
+		}
+		if len(fields) > 2 {
+			conflict = fields[2]
+		}
+		rule, err := newSyncRule(fields[0], direction, conflict)
+		if err != nil {
+			klog.Errorf("%s:%d is not a valid rule. Err: %v\n", path, lineNum, err)
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func newSyncRule(pattern, direction, conflict string) (*SyncRule, error) {
+	switch direction {
+	case RuleTwoWay, RuleSrcToDst, RuleDstToSrc, RuleIgnore:
+	default:
+		return nil, fmt.Errorf("%w: unknown direction %s", ErrRulesInvalid, direction)
+	}
+	switch conflict {
+	case ConflictNewer, ConflictKeepBoth, ConflictSrcWins, ConflictDstWins, ConflictSkip:
+	default:
+		return nil, fmt.Errorf("%w: unknown conflict policy %s", ErrRulesInvalid, conflict)
+	}
+
+	regex, err := globRegexp(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrRulesInvalid, err)
+	}
+	return &SyncRule{
+		Pattern:   pattern,
+		Direction: direction,
+		Conflict:  conflict,
+		regex:     regex,
+	}, nil
+}
+
+// matchRule returns the first rule matching the relative path, nil when no rules are set
+func (d *Diff) matchRule(relPath string) *SyncRule {
+	if d.defaultRule == nil {
+		return nil
+	}
+
+	relPath = filepath.ToSlash(relPath)
+	for _, rule := range d.rules {
+		if rule.regex.MatchString(relPath) {
+			return rule
+		}
+	}
+	return d.defaultRule
+}
+
+/*
+applyRule restricts a difference to what its rule allows, returning nil when the rule
+doesn't let it happen at all.
+*/
+func (d *Diff) applyRule(diff *DiffCompare) *DiffCompare {
+	rule := diff.Rule
+	relPath := diffRelPath(diff)
+
+	if diff.SrcFile != nil && diff.DstFile != nil && !diff.RenameOnly {
+		switch rule.Conflict {
+		case ConflictSrcWins:
+			diff.Direction = DIRECTION_SRC_TO_DST
+		case ConflictDstWins:
+			diff.Direction = DIRECTION_DST_TO_SRC
+		case ConflictSkip:
+			klog.Infof("[CONFLICT] Skipping %s (rule: %s)\n", relPath, rule)
+			return nil
+		}
+	}
+
+	switch {
+	case rule.Direction == RuleSrcToDst && diff.Direction != DIRECTION_SRC_TO_DST:
+		klog.V(3).Infof("[RULE] %s is only synced src to dst (rule: %s)\n", relPath, rule)
+		return nil
+	case rule.Direction == RuleDstToSrc && diff.Direction != DIRECTION_DST_TO_SRC:
+		klog.V(3).Infof("[RULE] %s is only synced dst to src (rule: %s)\n", relPath, rule)
+		return nil
+	}
+	return diff
+}
+
+// ruleSuffix is appended to report lines so the rule that applied is visible
+func (d *Diff) ruleSuffix(diff *DiffCompare) string {
+	if diff.Rule == nil {
+		return ""
+	}
+	return fmt.Sprintf(" (rule: %s)", diff.Rule)
+}
+
+/*
+keepConflictCopy moves the version about to be overwritten to a conflict name next to
+it, named after its mod time, so both versions survive. The conflict copy is synced to
+the other side like any new file on the next run. Returns the conflict relative path.
+*/
+func (d *Diff) keepConflictCopy(file *DiffFile, dst bool) (string, error) {
+	ext := filepath.Ext(file.RelPath)
+	stamp := (*file.Attr).ModTime().Format("20060102-150405")
+	conflictRel := fmt.Sprintf("%s.conflict-%s%s", strings.TrimSuffix(file.RelPath, ext), stamp, ext)
+	if d.options.DryRun {
+		return conflictRel, nil
+	}
+
+	path := d.renamedPath(file.Path)
+	conflictPath := filepath.Join(filepath.Dir(path), filepath.Base(conflictRel))
+	if dst && d.crypt != nil {
+		var err error
+		conflictPath, err = d.encryptedDstPath(conflictRel)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err := os.Rename(path, conflictPath)
+	if err != nil {
+		klog.Errorf("Rename(%s, %s) failed. Err: %v\n", path, conflictPath, err)
+		return "", err
+	}
+
+	if dst && d.crypt != nil {
+		if entry := d.crypt.manifest.Files[file.RelPath]; entry != nil {
+			moved := *entry
+			moved.Name = conflictPath[len(d.options.RootDstPath)+1:]
+			d.crypt.manifest.Files[conflictRel] = &moved
+			delete(d.crypt.manifest.Files, file.RelPath)
+			d.crypt.dirty = true
+		}
+	}
+	return conflictRel, nil
+}
+
+func (r *SyncRule) String() string {
+	return fmt.Sprintf("%s %s %s", r.Pattern, r.Direction, r.Conflict)
+}
+
+/*
+globRegexp turns a .gitignore style pattern into a regular expression. A leading ! would
+re-include paths in a .gitignore but the first matching rule wins here, so it is refused
+rather than matched literally; \! and \# start a pattern with a literal ! or #.
+*/
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	if strings.HasPrefix(pattern, "!") {
+		return nil, fmt.Errorf("negated pattern %s is not supported, write \\! for a literal !", pattern)
+	}
+	if strings.HasPrefix(pattern, `\!`) || strings.HasPrefix(pattern, `\#`) {
+		pattern = pattern[1:]
+	}
+
+	anchored := strings.Contains(strings.TrimSuffix(pattern, "/"), "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	if strings.HasSuffix(pattern, "/") {
+		pattern += "**"
+	}
+
+	var sb strings.Builder
+	sb.WriteString("^")
+	if !anchored {
+		sb.WriteString("(?:.*/)?")
+	}
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		switch runes[i] {
+		case '*':
+			if i+1 < len(runes) && runes[i+1] == '*' {
+				// "**/" is zero or more directories, any other "**" is everything
+				if i+2 < len(runes) && runes[i+2] == '/' {
+					sb.WriteString("(?:.*/)?")
+					i += 2
+				} else {
+					sb.WriteString(".*")
+					i++
+				}
+				continue
+			}
+			sb.WriteString("[^/]*")
+		case '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(runes[i])))
+		}
+	}
+	// a matching directory takes everything below it along
+	sb.WriteString("(?:/.*)?$")
+
+	return regexp.Compile(sb.String())
+}
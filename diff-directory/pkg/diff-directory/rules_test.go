@@ -0,0 +1,157 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGlobRegexp(t *testing.T) {
+	tests := []struct {
+		pattern string
+		match   []string
+		noMatch []string
+	}{
+		// no slash matches at any depth, a matching directory takes everything below it
+		{"*.log", []string{"a.log", "dir/a.log", "x/y/.log", "old.log/a.txt"}, []string{"a.log.txt", "alog"}},
+		{"?.txt", []string{"a.txt", "d/a.txt"}, []string{"ab.txt", ".txt", "a/.txt"}},
+		{"cache", []string{"cache", "a/cache", "a/cache/b.txt"}, []string{"mycache", "cache.txt"}},
+		{"*", []string{"a", "a/b/c"}, []string{}},
+
+		// a slash anywhere but the end anchors at the root
+		{"/top.txt", []string{"top.txt"}, []string{"dir/top.txt"}},
+		{"doc/*.md", []string{"doc/a.md", "doc/a.md/b"}, []string{"doc/x/a.md", "x/doc/a.md", "doc.md"}},
+
+		// ** is any number of directories or everything
+		{"Music/**", []string{"Music/a.mp3", "Music/x/y.mp3"}, []string{"Music", "sub/Music/a.mp3", "Musical/a.mp3"}},
+		{"**/cache", []string{"cache", "a/cache", "a/b/cache/x"}, []string{"mycache", "a/mycache"}},
+		{"a/**/b", []string{"a/b", "a/x/b", "a/x/y/b", "a/x/b/c"}, []string{"ab", "a/xb", "x/a/b"}},
+		{"**", []string{"a", "a/b"}, []string{}},
+
+		// a trailing slash only matches what is below the directory
+		{"build/", []string{"build/x", "src/build/x", "build/a/b"}, []string{"build", "builds/x", "mybuild/x"}},
+		{"src/build/", []string{"src/build/x"}, []string{"a/src/build/x", "src/build"}},
+
+		// regular expression characters are literal
+		{"a+b(1).txt", []string{"a+b(1).txt"}, []string{"aab(1).txt", "a+b1.txt"}},
+		{"[ab].txt", []string{"[ab].txt"}, []string{"a.txt"}},
+
+		// an escaped ! or # is literal
+		{`\!important`, []string{"!important", "d/!important"}, []string{"important"}},
+		{`\#notes`, []string{"#notes"}, []string{"notes"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			re, err := globRegexp(tt.pattern)
+			if err != nil {
+				t.Fatalf("globRegexp(%s) failed. Err: %v", tt.pattern, err)
+			}
+			for _, path := range tt.match {
+				if !re.MatchString(path) {
+					t.Errorf("%s doesn't match %s, want match (regexp: %s)", tt.pattern, path, re)
+				}
+			}
+			for _, path := range tt.noMatch {
+				if re.MatchString(path) {
+					t.Errorf("%s matches %s, want no match (regexp: %s)", tt.pattern, path, re)
+				}
+			}
+		})
+	}
+}
+
+func TestGlobRegexpNegation(t *testing.T) {
+	// a negated pattern would re-include in a .gitignore, here it is refused
+	for _, pattern := range []string{"!keep.log", "!/top", "!**"} {
+		if _, err := globRegexp(pattern); err == nil {
+			t.Errorf("globRegexp(%s) succeeded, want an error", pattern)
+		}
+	}
+
+	_, err := newSyncRule("!keep.log", RuleIgnore, ConflictNewer)
+	if !errors.Is(err, ErrRulesInvalid) {
+		t.Errorf("newSyncRule(!keep.log) = %v, want %v", err, ErrRulesInvalid)
+	}
+}
+
+func TestMatchRule(t *testing.T) {
+	rulesFile := filepath.Join(t.TempDir(), "rules")
+	rules := "# pattern direction conflict\n" +
+		"\n" +
+		"Music/Live/**   src-to-dst\n" +
+		"Music/**        two-way     src-wins\n" +
+		"*.tmp           ignore\n" +
+		"/Docs/          dst-to-src  keep-both\n"
+	if err := os.WriteFile(rulesFile, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := New(DiffOpts{RulesFile: rulesFile, Ignore: []string{"Music/Live/skip/"}, Direction: RuleSrcToDst})
+	if err := d.loadRules(); err != nil {
+		t.Fatalf("loadRules() failed. Err: %v", err)
+	}
+
+	tests := []struct {
+		relPath     string
+		wantPattern string
+		wantDir     string
+	}{
+		// ignore patterns come before the rules file
+		{"Music/Live/skip/a.mp3", "Music/Live/skip/", RuleIgnore},
+		// the first matching rule wins
+		{"Music/Live/b.mp3", "Music/Live/**", RuleSrcToDst},
+		{"Music/Studio/c.mp3", "Music/**", RuleTwoWay},
+		{"Music/d.tmp", "Music/**", RuleTwoWay},
+		{"e.tmp", "*.tmp", RuleIgnore},
+		{"Docs/f.txt", "/Docs/", RuleDstToSrc},
+		{"Other/Docs/g.txt", "default", RuleSrcToDst},
+		{"h.txt", "default", RuleSrcToDst},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.relPath, func(t *testing.T) {
+			rule := d.matchRule(filepath.FromSlash(tt.relPath))
+			if rule == nil {
+				t.Fatalf("matchRule(%s) = nil, want %s", tt.relPath, tt.wantPattern)
+			}
+			if rule.Pattern != tt.wantPattern || rule.Direction != tt.wantDir {
+				t.Errorf("matchRule(%s) = %s, want %s %s", tt.relPath, rule, tt.wantPattern, tt.wantDir)
+			}
+		})
+	}
+
+	if rule := New(DiffOpts{}).matchRule("a.txt"); rule != nil {
+		t.Errorf("matchRule() without rules = %s, want nil", rule)
+	}
+}
+
+func TestReadRulesFileErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+	}{
+		{"unknown direction", "a/** sideways\n"},
+		{"unknown conflict", "a/** two-way loudest\n"},
+		{"too many fields", "a/** two-way newer extra\n"},
+		{"negated pattern", "!a/** two-way\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rulesFile := filepath.Join(t.TempDir(), "rules")
+			if err := os.WriteFile(rulesFile, []byte(tt.rules), 0644); err != nil {
+				t.Fatal(err)
+			}
+			err := New(DiffOpts{RulesFile: rulesFile}).loadRules()
+			if !errors.Is(err, ErrRulesInvalid) {
+				t.Errorf("loadRules() = %v, want %v", err, ErrRulesInvalid)
+			}
+		})
+	}
+}
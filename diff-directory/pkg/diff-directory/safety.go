@@ -0,0 +1,104 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"fmt"
+	"strings"
+
+	klog "k8s.io/klog/v2"
+)
+
+/*
+Safety limits
+
+A typo in a path, like pointing src at an empty directory, turns into a run that copies
+a whole tree. Before anything is copied the planned changes are checked against the
+configured limits and the run is refused, unless forced, when any of them trips.
+*/
+
+func (d *Diff) hasSafetyLimits() bool {
+	return !d.options.Force && (d.options.MaxFiles > 0 || d.options.MaxBytes > 0 || d.options.MaxOverwritePct > 0)
+}
+
+// checkSafety returns ErrSafetyLimit naming every limit the planned changes exceed
+func (d *Diff) checkSafety(diffs []*DiffCompare) error {
+	if !d.hasSafetyLimits() {
+		return nil
+	}
+
+	files := 0
+	var bytes int64
+	srcOverwrites, dstOverwrites := 0, 0
+	for _, diff := range diffs {
+		switch diff.Direction {
+		case DIRECTION_SRC_TO_DST:
+			files++
+			if diff.RenameOnly {
+				continue
+			}
+			bytes += (*diff.SrcFile.Attr).Size()
+			if diff.DstFile != nil {
+				dstOverwrites++
+			}
+		case DIRECTION_DST_TO_SRC:
+			if d.options.SkipSrcUpdate {
+				continue
+			}
+			files++
+			bytes += (*diff.DstFile.Attr).Size()
+			if diff.SrcFile != nil {
+				srcOverwrites++
+			}
+		}
+	}
+
+	tripped := make([]string, 0)
+	if d.options.MaxFiles > 0 && files > d.options.MaxFiles {
+		tripped = append(tripped, fmt.Sprintf("%d files changed > max files %d", files, d.options.MaxFiles))
+	}
+	if d.options.MaxBytes > 0 && bytes > d.options.MaxBytes {
+		tripped = append(tripped, fmt.Sprintf("%d bytes copied > max bytes %d", bytes, d.options.MaxBytes))
+	}
+	if d.options.MaxOverwritePct > 0 {
+		if pct := percentOf(srcOverwrites, d.srcCount); pct > d.options.MaxOverwritePct {
+			tripped = append(tripped, fmt.Sprintf("%.1f%% of src overwritten (%d of %d files) > max overwrite %.1f%%", pct, srcOverwrites, d.srcCount, d.options.MaxOverwritePct))
+		}
+		if pct := percentOf(dstOverwrites, d.dstCount); pct > d.options.MaxOverwritePct {
+			tripped = append(tripped, fmt.Sprintf("%.1f%% of dst overwritten (%d of %d files) > max overwrite %.1f%%", pct, dstOverwrites, d.dstCount, d.options.MaxOverwritePct))
+		}
+	}
+	if len(tripped) == 0 {
+		klog.V(3).Infof("Safety limits OK: %d files, %d bytes\n", files, bytes)
+		return nil
+	}
+	return d.refuseSafety(tripped)
+}
+
+// refuseSafety reports the limits that tripped, refusing the run unless it is a dry run
+func (d *Diff) refuseSafety(tripped []string) error {
+	klog.Infof("\n\n")
+	if d.options.DryRun {
+		klog.Infof("Safety limits exceeded, this run would be refused (use -force to run anyway):\n")
+	} else {
+		klog.Infof("Safety limits exceeded, nothing was copied (use -force to run anyway):\n")
+	}
+	for _, reason := range tripped {
+		klog.Infof("\t%s\n", reason)
+	}
+	klog.Infof("\n")
+
+	if d.options.DryRun {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrSafetyLimit, strings.Join(tripped, ", "))
+}
+
+func percentOf(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(total)
+}
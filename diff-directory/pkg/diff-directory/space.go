@@ -0,0 +1,184 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"fmt"
+	"strings"
+
+	klog "k8s.io/klog/v2"
+)
+
+/*
+Free space preflight
+
+Running out of space halfway through leaves a partially updated tree. Before anything is
+copied the bytes each filesystem will gain or lose are summed in the order the copies
+happen: a replaced file gives its old blocks back, a kept conflict copy doesn't, and
+copies through a temporary file (encrypted dst) need the new and old version at the
+same time. The high-water mark is compared to the free space statfs reports. When src
+and dst are on the same filesystem their changes are counted together.
+*/
+
+// spacePlan is what a sync does to the free space of one filesystem
+type spacePlan struct {
+	label  string
+	volume *volume
+	delta  int64 // bytes used after the sync minus before
+	peak   int64 // the most bytes used at any point during the sync
+}
+
+// add accounts for one copy writing newSize bytes over a file using oldSize bytes
+func (p *spacePlan) add(newSize, oldSize int64, viaTemp bool) {
+	newSize = p.volume.allocated(newSize)
+	oldSize = p.volume.allocated(oldSize)
+	if viaTemp {
+		// the new version is complete before the old one is gone
+		p.bump(p.delta + newSize)
+	}
+	p.delta += newSize - oldSize
+	p.bump(p.delta)
+}
+
+func (p *spacePlan) bump(used int64) {
+	if used > p.peak {
+		p.peak = used
+	}
+}
+
+// checkSpace returns ErrInsufficientSpace when a filesystem can't take the planned changes
+func (d *Diff) checkSpace(diffs []*DiffCompare) error {
+	srcPlan, dstPlan := d.spacePlans()
+	if srcPlan == nil && dstPlan == nil {
+		return nil
+	}
+
+	for _, diff := range diffs {
+		keepBoth := diff.Rule != nil && diff.Rule.Conflict == ConflictKeepBoth
+		switch diff.Direction {
+		case DIRECTION_SRC_TO_DST:
+			if dstPlan == nil || diff.RenameOnly {
+				continue
+			}
+			newSize := diskSize(diff.SrcFile)
+			if d.fat {
+				// FAT has no holes, a sparse file takes all of its size there
+				newSize = (*diff.SrcFile.Attr).Size()
+			}
+			if d.crypt != nil {
+				newSize = cryptSize((*diff.SrcFile.Attr).Size())
+			}
+			var oldSize int64
+			if diff.DstFile != nil && !keepBoth {
+				oldSize = diskSize(diff.DstFile)
+				if d.crypt != nil {
+					oldSize = cryptSize((*diff.DstFile.Attr).Size())
+				}
+			}
+			dstPlan.add(newSize, oldSize, d.crypt != nil)
+		case DIRECTION_DST_TO_SRC:
+			if srcPlan == nil || d.options.SkipSrcUpdate {
+				continue
+			}
+			var oldSize int64
+			if diff.SrcFile != nil && !keepBoth {
+				oldSize = diskSize(diff.SrcFile)
+			}
+			srcPlan.add(diskSize(diff.DstFile), oldSize, d.crypt != nil)
+		}
+	}
+
+	plans := []*spacePlan{srcPlan, dstPlan}
+	if srcPlan == dstPlan {
+		plans = plans[:1]
+	}
+	return d.refuseSpace(plans)
+}
+
+// refuseSpace reports the filesystems that can't take their plan, refusing the run unless forced
+func (d *Diff) refuseSpace(plans []*spacePlan) error {
+	short := make([]string, 0)
+	for _, plan := range plans {
+		if plan == nil {
+			continue
+		}
+		if d.options.DryRun {
+			klog.Infof("[SPACE] %s: %s used by the sync, %s free, %s free after\n", plan.label,
+				formatBytes(plan.delta), formatBytes(plan.volume.free), formatBytes(plan.volume.free-plan.delta))
+		} else {
+			klog.V(3).Infof("[SPACE] %s: delta %d, peak %d, free %d\n", plan.label, plan.delta, plan.peak, plan.volume.free)
+		}
+		if plan.peak > plan.volume.free {
+			short = append(short, fmt.Sprintf("%s needs %s but only %s is free", plan.label, formatBytes(plan.peak), formatBytes(plan.volume.free)))
+		}
+	}
+	if len(short) == 0 {
+		return nil
+	}
+
+	klog.Infof("\n\n")
+	if d.options.DryRun {
+		klog.Infof("Not enough free space, this run would be refused (use -force to run anyway):\n")
+	} else {
+		klog.Infof("Not enough free space, nothing was copied (use -force to run anyway):\n")
+	}
+	for _, reason := range short {
+		klog.Infof("\t%s\n", reason)
+	}
+	klog.Infof("\n")
+
+	if d.options.DryRun || d.options.Force {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrInsufficientSpace, strings.Join(short, ", "))
+}
+
+// spacePlans returns the plan of each tree, the same plan when both share a filesystem
+func (d *Diff) spacePlans() (*spacePlan, *spacePlan) {
+	var srcPlan, dstPlan *spacePlan
+	if vol, err := statVolume(d.options.RootSrcPath); err == nil {
+		srcPlan = &spacePlan{label: "src", volume: vol}
+	} else {
+		klog.V(3).Infof("statVolume(%s) failed, not checking free space. Err: %v\n", d.options.RootSrcPath, err)
+	}
+	if vol, err := statVolume(d.options.RootDstPath); err == nil {
+		dstPlan = &spacePlan{label: "dst", volume: vol}
+	} else {
+		klog.V(3).Infof("statVolume(%s) failed, not checking free space. Err: %v\n", d.options.RootDstPath, err)
+	}
+
+	if srcPlan != nil && dstPlan != nil && srcPlan.volume.id == dstPlan.volume.id {
+		srcPlan.label = "src and dst"
+		dstPlan = srcPlan
+	}
+	return srcPlan, dstPlan
+}
+
+// allocated rounds a size up to the blocks it takes on the volume
+func (v *volume) allocated(size int64) int64 {
+	if v.blockSize <= 0 || size <= 0 {
+		return size
+	}
+	return (size + v.blockSize - 1) / v.blockSize * v.blockSize
+}
+
+// formatBytes prints a byte count the way df -h does
+func formatBytes(n int64) string {
+	sign := ""
+	if n < 0 {
+		sign = "-"
+		n = -n
+	}
+	if n < 1024 {
+		return fmt.Sprintf("%s%dB", sign, n)
+	}
+	value := float64(n)
+	unit := 0
+	for value >= 1024 && unit < 5 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%s%.1f%ciB", sign, value, "KMGTPE"[unit-1])
+}
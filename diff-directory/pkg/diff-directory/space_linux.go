@@ -0,0 +1,41 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build linux
+
+package diff
+
+import (
+	"fmt"
+
+	unix "golang.org/x/sys/unix"
+)
+
+// volume is the filesystem a tree lives on
+type volume struct {
+	id        string
+	free      int64 // bytes available to unprivileged users
+	blockSize int64
+}
+
+func statVolume(path string) (*volume, error) {
+	var stat unix.Statfs_t
+	err := unix.Statfs(path, &stat)
+	if err != nil {
+		return nil, err
+	}
+
+	// f_fsid is 0:0 on some FUSE, NFS and overlay mounts, the device of the root isn't
+	var st unix.Stat_t
+	err = unix.Stat(path, &st)
+	if err != nil {
+		return nil, err
+	}
+
+	return &volume{
+		id:        fmt.Sprintf("%x", st.Dev),
+		free:      int64(stat.Bavail) * int64(stat.Bsize),
+		blockSize: int64(stat.Bsize),
+	}, nil
+}
@@ -0,0 +1,42 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build linux
+
+package diff
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStatVolume(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := statVolume(dir)
+	if err != nil {
+		t.Fatalf("statVolume(%s) failed. Err: %v", dir, err)
+	}
+	b, err := statVolume(sub)
+	if err != nil {
+		t.Fatalf("statVolume(%s) failed. Err: %v", sub, err)
+	}
+	if a.id != b.id {
+		t.Errorf("statVolume() ids %s and %s differ on one filesystem", a.id, b.id)
+	}
+
+	// /proc is its own filesystem wherever the temp directory is
+	proc, err := statVolume("/proc")
+	if err != nil {
+		t.Skipf("statVolume(/proc) failed. Err: %v", err)
+	}
+	if proc.id == a.id {
+		t.Errorf("statVolume() id %s is the same for /proc and %s", a.id, dir)
+	}
+}
@@ -0,0 +1,19 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !linux
+
+package diff
+
+// volume is the filesystem a tree lives on
+type volume struct {
+	id        string
+	free      int64
+	blockSize int64
+}
+
+// statVolume can't tell the free space here so the preflight is skipped
+func statVolume(path string) (*volume, error) {
+	return nil, ErrSpaceUnknown
+}
@@ -0,0 +1,61 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"fmt"
+	"os"
+
+	filecopy "github.com/dvonthenen/go-utilities/filecopy"
+	klog "k8s.io/klog/v2"
+)
+
+/*
+Sparse files
+
+Disk images and VM files are mostly holes. A source with fewer blocks allocated than its
+size is copied extent by extent, finding the data with SEEK_DATA/SEEK_HOLE and leaving
+the holes unwritten, so the copy stays sparse. A hole reads back as zeros, so the hashes
+and the verify of a sparse copy match the source without anything special.
+*/
+
+// diskSize is what a file takes on disk, the allocated bytes of a sparse file
+func diskSize(file *DiffFile) int64 {
+	info := *file.Attr
+	if !info.Mode().IsRegular() || filecopy.AllocatedSize(info) >= info.Size() {
+		return info.Size()
+	}
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return info.Size()
+	}
+	defer f.Close()
+	if filecopy.IsSparse(f, info) {
+		return filecopy.AllocatedSize(info)
+	}
+	return info.Size()
+}
+
+// countSparse records the apparent and allocated size of a sparse copy for the summary
+func (d *Diff) countSparse(dst string, apparent int64) {
+	allocated := apparent
+	if info, err := os.Stat(dst); err == nil {
+		allocated = filecopy.AllocatedSize(info)
+	}
+	klog.V(3).Infof("[SPARSE] %s apparent %s, allocated %s\n", dst, formatBytes(apparent), formatBytes(allocated))
+
+	d.sparse.files++
+	d.sparse.apparent += apparent
+	d.sparse.allocated += allocated
+}
+
+// sparseSummary shows allocated versus apparent size of the sparse copies, empty without any
+func (d *Diff) sparseSummary() string {
+	if d.sparse.files == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d files, apparent %s, allocated %s", d.sparse.files,
+		formatBytes(d.sparse.apparent), formatBytes(d.sparse.allocated))
+}
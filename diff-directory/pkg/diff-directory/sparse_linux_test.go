@@ -0,0 +1,85 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build linux
+
+package diff
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	filecopy "github.com/dvonthenen/go-utilities/filecopy"
+)
+
+func TestSparseCopyStaysSparse(t *testing.T) {
+	const size = 8 * 1024 * 1024
+	src, dst := t.TempDir(), t.TempDir()
+	srcPath := filepath.Join(src, "disk.img")
+
+	f, err := os.Create(srcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, size)
+	for _, offset := range []int64{0, 5 * 1024 * 1024} {
+		data := testRandom(offset, 4096)
+		if _, err := f.WriteAt(data, offset); err != nil {
+			t.Fatal(err)
+		}
+		copy(want[offset:], data)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(srcPath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcFile := &DiffFile{Path: srcPath, RelPath: "disk.img", Attr: &info}
+	if diskSize(srcFile) >= size {
+		t.Skip("the filesystem doesn't keep holes")
+	}
+
+	d := New(DiffOpts{RootSrcPath: src, RootDstPath: dst, SkipSrcUpdate: true})
+	err = d.Process()
+	if err != nil {
+		t.Fatalf("Process() failed. Err: %v", err)
+	}
+
+	dstPath := filepath.Join(dst, "disk.img")
+	got, err := os.ReadFile(dstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("sparse copy differs from the source")
+	}
+	dstInfo, err := os.Stat(dstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dstInfo.Size() != size {
+		t.Errorf("Size() = %d, want %d", dstInfo.Size(), size)
+	}
+	if allocated := filecopy.AllocatedSize(dstInfo); allocated >= size {
+		t.Errorf("AllocatedSize() = %d, want < %d", allocated, size)
+	}
+
+	if d.strategies[filecopy.Sparse] != 1 {
+		t.Errorf("strategies = %v, want %s 1", d.strategies, filecopy.Sparse)
+	}
+	if d.sparse.files != 1 || d.sparse.apparent != size || d.sparse.allocated >= size {
+		t.Errorf("sparseSummary() = %q, want 1 file allocated below %d", d.sparseSummary(), size)
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	klog "k8s.io/klog/v2"
+)
+
+/*
+Tree statistics
+
+Stats walks src, and dst when set, with the same merge walk as the comparison but
+visits every file instead of comparing them. It reports the files and bytes by
+extension and by top level directory, the largest, oldest and newest files and, with
+Duplicates, the groups of identical files within and across the trees.
+*/
+
+// Stats walks the trees and returns their statistics
+func (d *Diff) Stats(opts StatsOpts) (*StatsReport, error) {
+	err := d.checkErrorPolicy()
+	if err != nil {
+		return nil, err
+	}
+	err = d.checkNormalize()
+	if err != nil {
+		return nil, err
+	}
+	err = d.loadRules()
+	if err != nil {
+		return nil, err
+	}
+	err = d.checkFilter()
+	if err != nil {
+		return nil, err
+	}
+	err = d.startThrottle()
+	if err != nil {
+		return nil, err
+	}
+	defer d.stopThrottle()
+
+	// hardlinking renames files, a sync running at the same time must not see that
+	if opts.Hardlink && !d.options.DryRun {
+		roots := []string{d.options.RootSrcPath}
+		if d.options.RootDstPath != "" {
+			roots = append(roots, d.options.RootDstPath)
+		}
+		locks, err := lockRoots(roots, d.options.LockWait)
+		if err != nil {
+			klog.Errorf("lockRoots failed. Err: %v\n", err)
+			return nil, err
+		}
+		defer unlockRoots(locks)
+	}
+
+	if opts.Top <= 0 {
+		opts.Top = statsTop
+	}
+	report := &StatsReport{
+		Src: newTreeStats(d.options.RootSrcPath),
+	}
+	if d.options.RootDstPath != "" {
+		report.Dst = newTreeStats(d.options.RootDstPath)
+	}
+
+	bySize := make(map[int64][]*DuplicateFile)
+	d.visit = func(file *DiffFile, dst bool) {
+		if rule := d.matchRule(file.RelPath); rule != nil && rule.Direction == RuleIgnore {
+			klog.V(4).Infof("Ignored %s\n", file.RelPath)
+			return
+		}
+		tree := report.Src
+		if dst {
+			tree = report.Dst
+		}
+		tree.add(file, opts.Top)
+
+		if opts.Duplicates && (*file.Attr).Mode().IsRegular() && (*file.Attr).Size() > 0 {
+			size := (*file.Attr).Size()
+			bySize[size] = append(bySize[size], &DuplicateFile{Dst: dst, File: file})
+		}
+	}
+	err = d.mergeTrees(func(*DiffCompare) error { return nil })
+	d.visit = nil
+	if err != nil {
+		return nil, err
+	}
+	report.Filtered = d.filtered
+
+	if opts.Duplicates {
+		report.Duplicates, err = d.findDuplicates(bySize)
+		if err != nil {
+			return nil, err
+		}
+		if opts.Hardlink {
+			err = d.hardlinkDuplicates(report, opts.CrossTree)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return report, d.partialFailure()
+}
+
+func newTreeStats(root string) *TreeStats {
+	return &TreeStats{
+		Root:  root,
+		ByExt: make(map[string]*StatCount),
+		ByDir: make(map[string]*StatCount),
+	}
+}
+
+func (t *TreeStats) add(file *DiffFile, top int) {
+	info := *file.Attr
+	t.Files++
+	t.Bytes += info.Size()
+
+	ext := strings.ToLower(filepath.Ext(file.RelPath))
+	if ext == "" {
+		ext = "(none)"
+	}
+	t.ByExt[ext] = t.ByExt[ext].add(info.Size())
+
+	dir := "."
+	if i := strings.IndexRune(file.RelPath, filepath.Separator); i >= 0 {
+		dir = file.RelPath[:i]
+	}
+	t.ByDir[dir] = t.ByDir[dir].add(info.Size())
+
+	t.Largest = insertTop(t.Largest, file, top, func(a, b *DiffFile) bool {
+		return (*a.Attr).Size() > (*b.Attr).Size()
+	})
+	t.Oldest = insertTop(t.Oldest, file, top, func(a, b *DiffFile) bool {
+		return (*a.Attr).ModTime().Before((*b.Attr).ModTime())
+	})
+	t.Newest = insertTop(t.Newest, file, top, func(a, b *DiffFile) bool {
+		return (*a.Attr).ModTime().After((*b.Attr).ModTime())
+	})
+}
+
+func (c *StatCount) add(size int64) *StatCount {
+	if c == nil {
+		c = &StatCount{}
+	}
+	c.Files++
+	c.Bytes += size
+	return c
+}
+
+// insertTop keeps the top n files ordered by before
+func insertTop(list []*DiffFile, file *DiffFile, n int, before func(a, b *DiffFile) bool) []*DiffFile {
+	i := sort.Search(len(list), func(i int) bool {
+		return before(file, list[i])
+	})
+	if i >= n {
+		return list
+	}
+	list = append(list, nil)
+	copy(list[i+1:], list[i:])
+	list[i] = file
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+// Print writes the report as text
+func (r *StatsReport) Print(w io.Writer) {
+	for _, tree := range []*TreeStats{r.Src, r.Dst} {
+		if tree != nil {
+			tree.print(w)
+		}
+	}
+	for _, label := range []string{"src", "dst"} {
+		if n := r.Filtered[label]; n > 0 {
+			fmt.Fprintf(w, "Filtered out of %s: %d files\n", label, n)
+		}
+	}
+
+	if r.Duplicates == nil {
+		return
+	}
+	var wasted int64
+	for _, group := range r.Duplicates {
+		wasted += group.Wasted()
+	}
+	fmt.Fprintf(w, "Duplicates: %d groups, %s reclaimable\n", len(r.Duplicates), formatBytes(wasted))
+	for _, group := range r.Duplicates {
+		fmt.Fprintf(w, "\t%d x %s (%s reclaimable)\n", len(group.Files), formatBytes(group.Size), formatBytes(group.Wasted()))
+		for _, file := range group.Files {
+			fmt.Fprintf(w, "\t\t%s\n", file)
+		}
+	}
+	if r.Linked > 0 {
+		fmt.Fprintf(w, "Hardlinked: %d files, %s reclaimed\n", r.Linked, formatBytes(r.Reclaimed))
+	}
+}
+
+func (t *TreeStats) print(w io.Writer) {
+	fmt.Fprintf(w, "%s: %d files, %s\n", t.Root, t.Files, formatBytes(t.Bytes))
+
+	printCounts := func(title string, counts map[string]*StatCount) {
+		names := make([]string, 0, len(counts))
+		for name := range counts {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(a, b int) bool {
+			if counts[names[a]].Bytes != counts[names[b]].Bytes {
+				return counts[names[a]].Bytes > counts[names[b]].Bytes
+			}
+			return names[a] < names[b]
+		})
+		fmt.Fprintf(w, "  %s:\n", title)
+		for _, name := range names {
+			fmt.Fprintf(w, "\t%-24s %8d files %12s\n", name, counts[name].Files, formatBytes(counts[name].Bytes))
+		}
+	}
+	printCounts("By extension", t.ByExt)
+	printCounts("By directory", t.ByDir)
+
+	printFiles := func(title string, files []*DiffFile) {
+		fmt.Fprintf(w, "  %s:\n", title)
+		for _, file := range files {
+			info := *file.Attr
+			fmt.Fprintf(w, "\t%12s  %s  %s\n", formatBytes(info.Size()), info.ModTime().Format(time.RFC3339), file.RelPath)
+		}
+	}
+	printFiles("Largest", t.Largest)
+	printFiles("Oldest", t.Oldest)
+	printFiles("Newest", t.Newest)
+	fmt.Fprintln(w)
+}
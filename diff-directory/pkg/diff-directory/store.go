@@ -0,0 +1,689 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"bytes"
+	"compress/gzip"
+	sha256 "crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	klog "k8s.io/klog/v2"
+)
+
+var storeNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+func NewStore(opts StoreOpts) *Store {
+	if opts.Compression == "" {
+		opts.Compression = StoreCompressionGzip
+	}
+	store := &Store{
+		options: opts,
+	}
+	return store
+}
+
+/*
+Init opens the store creating the layout when the path does not contain a store yet.
+*/
+func (s *Store) Init() error {
+	err := s.Open()
+	if err == nil {
+		return nil
+	}
+	if err != ErrStoreNotInitialized {
+		return err
+	}
+
+	switch s.options.Compression {
+	case StoreCompressionNone, StoreCompressionGzip:
+	default:
+		klog.Errorf("Unknown compression: %s\n", s.options.Compression)
+		return ErrStoreUnknownCompression
+	}
+
+	config := &StoreConfig{
+		Version:     storeVersion,
+		Compression: s.options.Compression,
+		ChunkMin:    storeChunkMin,
+		ChunkAvg:    storeChunkAvg,
+		ChunkMax:    storeChunkMax,
+	}
+
+	if s.options.DryRun {
+		klog.V(3).Infof("DryRun: Init store %s\n", s.options.RootPath)
+		s.config = config
+		return nil
+	}
+
+	for _, dir := range []string{storeChunksDir, storeSnapshotsDir} {
+		err := os.MkdirAll(filepath.Join(s.options.RootPath, dir), os.ModePerm)
+		if err != nil {
+			klog.Errorf("MkdirAll failed. Err: %v\n", err)
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		klog.Errorf("json.MarshalIndent failed. Err: %v\n", err)
+		return err
+	}
+	err = writeFileAtomic(filepath.Join(s.options.RootPath, storeConfigFile), data)
+	if err != nil {
+		klog.Errorf("writeFileAtomic failed. Err: %v\n", err)
+		return err
+	}
+
+	klog.V(3).Infof("Initialized store %s compression: %s\n", s.options.RootPath, config.Compression)
+	s.config = config
+	return nil
+}
+
+/*
+Open loads an existing store and fails with ErrStoreNotInitialized if there isnt one.
+*/
+func (s *Store) Open() error {
+	if s.config != nil {
+		return nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.options.RootPath, storeConfigFile))
+	if os.IsNotExist(err) {
+		return ErrStoreNotInitialized
+	}
+	if err != nil {
+		klog.Errorf("ReadFile failed. Err: %v\n", err)
+		return err
+	}
+
+	config := &StoreConfig{}
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		klog.Errorf("json.Unmarshal failed. Err: %v\n", err)
+		return err
+	}
+	if config.Version != storeVersion {
+		klog.Errorf("Unknown store version: %d\n", config.Version)
+		return ErrStoreUnknownVersion
+	}
+	switch config.Compression {
+	case StoreCompressionNone, StoreCompressionGzip:
+	default:
+		klog.Errorf("Unknown compression: %s\n", config.Compression)
+		return ErrStoreUnknownCompression
+	}
+
+	s.config = config
+	return nil
+}
+
+/*
+Backup walks srcPath and records it as a new snapshot. Files whose size and mod time
+match the latest snapshot reuse its chunks, everything else is chunked and only chunks
+not already in the store get written.
+*/
+func (s *Store) Backup(srcPath, name string) (*StoreStats, error) {
+	err := s.Open()
+	if err != nil {
+		return nil, err
+	}
+	if !storeNameRegex.MatchString(name) {
+		klog.Errorf("Invalid snapshot name: %s\n", name)
+		return nil, ErrStoreInvalidName
+	}
+	if _, err := os.Stat(s.snapshotPath(name)); err == nil {
+		klog.Errorf("Snapshot %s already exists\n", name)
+		return nil, ErrStoreSnapshotExists
+	}
+
+	snapshots, err := s.Snapshots()
+	if err != nil {
+		klog.Errorf("Snapshots failed. Err: %v\n", err)
+		return nil, err
+	}
+	parent := make(map[string]*StoreFile, 0)
+	if len(snapshots) > 0 {
+		latest := snapshots[len(snapshots)-1]
+		klog.V(3).Infof("Parent snapshot: %s\n", latest.Name)
+		for _, file := range latest.Files {
+			parent[file.RelPath] = file
+		}
+	}
+
+	snapshot := &StoreSnapshot{
+		Name:    name,
+		Source:  srcPath,
+		Created: time.Now(),
+		Files:   make([]*StoreFile, 0),
+	}
+	stats := &StoreStats{}
+	seen := make(map[string]bool, 0)
+	lenSrc := len(srcPath)
+
+	err = filepath.Walk(srcPath, func(path string, info os.FileInfo, err error) error {
+		klog.V(6).Infof("[SRC] path: %s\n", path)
+		if err != nil {
+			klog.Errorf("filepath.Walk Init. Err: %v\n", err)
+			return err
+		}
+		if path == srcPath || info.IsDir() {
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			klog.V(3).Infof("Skipping %s because it is not a regular file\n", path)
+			return nil
+		}
+
+		newRel := filepath.ToSlash(path[lenSrc+1:])
+		file := &StoreFile{
+			RelPath: newRel,
+			Size:    info.Size(),
+			Mode:    info.Mode().Perm(),
+			ModTime: info.ModTime(),
+		}
+		stats.Files++
+		stats.Bytes += info.Size()
+
+		prev := parent[newRel]
+		delete(parent, newRel)
+		if prev != nil && prev.Size == file.Size && prev.ModTime.Equal(file.ModTime) {
+			klog.V(4).Infof("[SRC -> STORE] Unchanged %s\n", newRel)
+			file.Hash = prev.Hash
+			file.Chunks = prev.Chunks
+			stats.ReusedFiles++
+			snapshot.Files = append(snapshot.Files, file)
+			return nil
+		}
+
+		if s.options.DryRun {
+			klog.Infof("[SRC -> STORE] Diff: %s\n", newRel)
+		} else {
+			klog.Infof("[SRC -> STORE] Adding... %s\n", newRel)
+		}
+		if prev == nil {
+			klog.Infof("\tFile does not exist in the previous snapshot\n")
+		}
+
+		err = s.putFile(path, file, seen, stats)
+		if err != nil {
+			klog.Errorf("putFile(%s) failed. Err: %v\n", path, err)
+			return err
+		}
+		snapshot.Files = append(snapshot.Files, file)
+		return nil
+	})
+	if err != nil {
+		klog.Errorf("filepath.Walk(%s) Err: %v\n", srcPath, err)
+		return nil, err
+	}
+
+	for relPath := range parent {
+		klog.Infof("[SRC -> STORE] Removed since previous snapshot: %s\n", relPath)
+	}
+
+	if s.options.DryRun {
+		return stats, nil
+	}
+
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		klog.Errorf("json.MarshalIndent failed. Err: %v\n", err)
+		return nil, err
+	}
+	err = writeFileAtomic(s.snapshotPath(name), data)
+	if err != nil {
+		klog.Errorf("writeFileAtomic failed. Err: %v\n", err)
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+/*
+Restore writes the files of a snapshot to dstPath. Files that already have the
+recorded size and mod time are left alone. Every restored file is checked against
+the whole file hash recorded at backup time.
+*/
+func (s *Store) Restore(name, dstPath string) error {
+	err := s.Open()
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := s.LoadSnapshot(name)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range snapshot.Files {
+		relPath := filepath.FromSlash(file.RelPath)
+		cleanRel := filepath.Clean(relPath)
+		if filepath.IsAbs(cleanRel) || cleanRel == ".." || strings.HasPrefix(cleanRel, ".."+string(filepath.Separator)) {
+			klog.Errorf("Snapshot %s has invalid path: %s\n", name, file.RelPath)
+			return ErrStoreCorrupt
+		}
+		target := filepath.Join(dstPath, cleanRel)
+
+		stat, err := os.Stat(target)
+		if err == nil && stat.Size() == file.Size && stat.ModTime().Equal(file.ModTime) {
+			klog.V(4).Infof("[STORE -> DST] Unchanged %s\n", file.RelPath)
+			continue
+		}
+
+		if s.options.DryRun {
+			klog.Infof("[STORE -> DST] Diff: %s\n", file.RelPath)
+			continue
+		}
+		klog.Infof("[STORE -> DST] Restoring... %s\n", file.RelPath)
+
+		err = s.restoreFile(file, target)
+		if err != nil {
+			klog.Errorf("restoreFile(%s) failed. Err: %v\n", target, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+Prune removes all but the newest keep snapshots (keep <= 0 keeps them all) and
+then deletes every chunk no remaining snapshot references.
+*/
+func (s *Store) Prune(keep int) (int, int64, error) {
+	err := s.Open()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	snapshots, err := s.Snapshots()
+	if err != nil {
+		klog.Errorf("Snapshots failed. Err: %v\n", err)
+		return 0, 0, err
+	}
+
+	if keep > 0 && len(snapshots) > keep {
+		for _, snapshot := range snapshots[:len(snapshots)-keep] {
+			if s.options.DryRun {
+				klog.Infof("[STORE] Diff: remove snapshot %s\n", snapshot.Name)
+				continue
+			}
+			klog.Infof("[STORE] Removing snapshot... %s\n", snapshot.Name)
+			err := os.Remove(s.snapshotPath(snapshot.Name))
+			if err != nil {
+				klog.Errorf("Remove failed. Err: %v\n", err)
+				return 0, 0, err
+			}
+		}
+		snapshots = snapshots[len(snapshots)-keep:]
+	}
+
+	referenced := make(map[string]bool, 0)
+	for _, snapshot := range snapshots {
+		for _, file := range snapshot.Files {
+			for _, id := range file.Chunks {
+				referenced[id] = true
+			}
+		}
+	}
+
+	removed := 0
+	var freed int64
+	err = filepath.Walk(filepath.Join(s.options.RootPath, storeChunksDir), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			klog.Errorf("filepath.Walk Init. Err: %v\n", err)
+			return err
+		}
+		if info.IsDir() || referenced[info.Name()] {
+			return nil
+		}
+
+		removed++
+		freed += info.Size()
+		if s.options.DryRun {
+			klog.V(3).Infof("DryRun: Remove(%s)\n", path)
+			return nil
+		}
+		klog.V(4).Infof("Removing chunk %s\n", path)
+		return os.Remove(path)
+	})
+	if err != nil {
+		klog.Errorf("filepath.Walk failed. Err: %v\n", err)
+		return removed, freed, err
+	}
+
+	return removed, freed, nil
+}
+
+/*
+Check verifies every chunk in the store against its address and makes sure every
+chunk referenced by a snapshot exists.
+*/
+func (s *Store) Check() error {
+	err := s.Open()
+	if err != nil {
+		return err
+	}
+
+	snapshots, err := s.Snapshots()
+	if err != nil {
+		klog.Errorf("Snapshots failed. Err: %v\n", err)
+		return err
+	}
+
+	bad := 0
+	present := make(map[string]bool, 0)
+	err = filepath.Walk(filepath.Join(s.options.RootPath, storeChunksDir), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			klog.Errorf("filepath.Walk Init. Err: %v\n", err)
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".diff-directory-") {
+			return nil
+		}
+
+		id := info.Name()
+		_, err = s.readChunk(id)
+		if err != nil {
+			klog.Infof("[STORE] Corrupt chunk %s. Err: %v\n", id, err)
+			bad++
+			return nil
+		}
+		present[id] = true
+		return nil
+	})
+	if err != nil {
+		klog.Errorf("filepath.Walk failed. Err: %v\n", err)
+		return err
+	}
+
+	missing := 0
+	for _, snapshot := range snapshots {
+		for _, file := range snapshot.Files {
+			for _, id := range file.Chunks {
+				if !present[id] {
+					klog.Infof("[STORE] Snapshot %s file %s references missing or corrupt chunk %s\n", snapshot.Name, file.RelPath, id)
+					missing++
+				}
+			}
+		}
+	}
+
+	klog.Infof("[STORE] Checked %d chunks and %d snapshots\n", len(present)+bad, len(snapshots))
+	if bad > 0 || missing > 0 {
+		return fmt.Errorf("%w: %d corrupt chunks, %d missing references", ErrStoreCorrupt, bad, missing)
+	}
+	return nil
+}
+
+/*
+Snapshots returns all snapshots in the store sorted oldest to newest.
+*/
+func (s *Store) Snapshots() ([]*StoreSnapshot, error) {
+	entries, err := os.ReadDir(filepath.Join(s.options.RootPath, storeSnapshotsDir))
+	if os.IsNotExist(err) {
+		return []*StoreSnapshot{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]*StoreSnapshot, 0)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		snapshot, err := s.LoadSnapshot(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].Created.Before(snapshots[j].Created)
+	})
+	return snapshots, nil
+}
+
+func (s *Store) LoadSnapshot(name string) (*StoreSnapshot, error) {
+	if !storeNameRegex.MatchString(name) {
+		return nil, ErrStoreInvalidName
+	}
+
+	data, err := os.ReadFile(s.snapshotPath(name))
+	if os.IsNotExist(err) {
+		return nil, ErrStoreSnapshotNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &StoreSnapshot{}
+	err = json.Unmarshal(data, snapshot)
+	if err != nil {
+		klog.Errorf("json.Unmarshal(%s) failed. Err: %v\n", name, err)
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+func (s *Store) snapshotPath(name string) string {
+	return filepath.Join(s.options.RootPath, storeSnapshotsDir, name+".json")
+}
+
+func (s *Store) chunkPath(id string) string {
+	return filepath.Join(s.options.RootPath, storeChunksDir, id[:2], id)
+}
+
+func (s *Store) putFile(path string, file *StoreFile, seen map[string]bool, stats *StoreStats) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	chunks := newChunker(f, s.config.ChunkMin, s.config.ChunkAvg, s.config.ChunkMax)
+	file.Chunks = make([]string, 0)
+	for {
+		data, err := chunks.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		hash.Write(data)
+
+		id, added, err := s.putChunk(data, seen)
+		if err != nil {
+			return err
+		}
+		if added {
+			stats.NewChunks++
+			stats.NewBytes += int64(len(data))
+		}
+		file.Chunks = append(file.Chunks, id)
+	}
+
+	file.Hash = base64.URLEncoding.EncodeToString(hash.Sum(nil))
+	return nil
+}
+
+// putChunk stores the chunk unless the store already has it and returns its id
+// along with whether it was new
+func (s *Store) putChunk(data []byte, seen map[string]bool) (string, bool, error) {
+	id := chunkID(data)
+	if seen[id] {
+		return id, false, nil
+	}
+	seen[id] = true
+
+	path := s.chunkPath(id)
+	if _, err := os.Stat(path); err == nil {
+		return id, false, nil
+	}
+
+	if s.options.DryRun {
+		klog.V(6).Infof("DryRun: putChunk(%s)\n", id)
+		return id, true, nil
+	}
+
+	var payload []byte
+	switch s.config.Compression {
+	case StoreCompressionGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, err := zw.Write(data)
+		if err != nil {
+			return "", false, err
+		}
+		err = zw.Close()
+		if err != nil {
+			return "", false, err
+		}
+		payload = buf.Bytes()
+	default:
+		payload = data
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		klog.Errorf("MkdirAll failed. Err: %v\n", err)
+		return "", false, err
+	}
+	err = writeFileAtomic(path, payload)
+	if err != nil {
+		klog.Errorf("writeFileAtomic(%s) failed. Err: %v\n", path, err)
+		return "", false, err
+	}
+
+	klog.V(6).Infof("Stored chunk %s size: %d stored: %d\n", id, len(data), len(payload))
+	return id, true, nil
+}
+
+func (s *Store) readChunk(id string) ([]byte, error) {
+	if len(id) != sha256.Size*2 {
+		return nil, fmt.Errorf("%w: invalid chunk id %s", ErrStoreCorrupt, id)
+	}
+
+	f, err := os.Open(s.chunkPath(id))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if s.config.Compression == StoreCompressionGzip {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrStoreCorrupt, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrStoreCorrupt, err)
+	}
+	if chunkID(data) != id {
+		return nil, fmt.Errorf("%w: chunk %s hash mismatch", ErrStoreCorrupt, id)
+	}
+	return data, nil
+}
+
+func (s *Store) restoreFile(file *StoreFile, target string) error {
+	dir := filepath.Dir(target)
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		klog.Errorf("MkdirAll failed. Err: %v\n", err)
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".diff-directory-*")
+	if err != nil {
+		klog.Errorf("CreateTemp failed. Err: %v\n", err)
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	w := io.MultiWriter(tmp, hash)
+	for _, id := range file.Chunks {
+		data, err := s.readChunk(id)
+		if err != nil {
+			klog.Errorf("readChunk(%s) failed. Err: %v\n", id, err)
+			return err
+		}
+		_, err = w.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	if base64.URLEncoding.EncodeToString(hash.Sum(nil)) != file.Hash {
+		klog.Errorf("Restored %s does not match the snapshot hash\n", file.RelPath)
+		return fmt.Errorf("%w: %s hash mismatch", ErrStoreCorrupt, file.RelPath)
+	}
+
+	err = tmp.Chmod(file.Mode)
+	if err != nil {
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), target)
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(target, file.ModTime, file.ModTime)
+}
+
+func chunkID(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".diff-directory-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,300 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestStore initializes a store with the test chunk sizes so small files
+// still split into several chunks
+func newTestStore(t *testing.T, compression string) *Store {
+	t.Helper()
+	s := NewStore(StoreOpts{RootPath: t.TempDir(), Compression: compression})
+	if err := s.Init(); err != nil {
+		t.Fatalf("Init() failed. Err: %v", err)
+	}
+	s.config.ChunkMin = testChunkMin
+	s.config.ChunkAvg = testChunkAvg
+	s.config.ChunkMax = testChunkMax
+	return s
+}
+
+// storeChunks returns the paths of every chunk in the store
+func storeChunks(t *testing.T, s *Store) []string {
+	t.Helper()
+	paths := make([]string, 0)
+	err := filepath.Walk(filepath.Join(s.options.RootPath, storeChunksDir), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+// writeTestTree writes files, keyed by slash separated relative path, under root
+func writeTestTree(t *testing.T, root string, files map[string][]byte) {
+	t.Helper()
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for rel, content := range files {
+		writeTestFile(t, filepath.Join(root, filepath.FromSlash(rel)), string(content), modTime)
+	}
+}
+
+// checkTestTree makes sure every file under root has the expected content
+func checkTestTree(t *testing.T, root string, files map[string][]byte) {
+	t.Helper()
+	for rel, want := range files {
+		got, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(rel)))
+		if err != nil {
+			t.Errorf("ReadFile(%s) failed. Err: %v", rel, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s has %d bytes that differ from the %d bytes backed up", rel, len(got), len(want))
+		}
+	}
+}
+
+func TestStoreBackupRestore(t *testing.T) {
+	files := map[string][]byte{
+		"empty.txt":        {},
+		"small.txt":        []byte("hello"),
+		"dir/random.bin":   testRandom(10, 20*1024),
+		"dir/sub/copy.bin": testRandom(10, 20*1024),
+		"dir/zeros.bin":    make([]byte, 5*testChunkMax),
+	}
+
+	tests := []struct {
+		name        string
+		compression string
+	}{
+		{"none", StoreCompressionNone},
+		{"gzip", StoreCompressionGzip},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore(t, tt.compression)
+			src, dst := t.TempDir(), t.TempDir()
+			writeTestTree(t, src, files)
+
+			stats, err := s.Backup(src, "first")
+			if err != nil {
+				t.Fatalf("Backup() failed. Err: %v", err)
+			}
+			if stats.Files != len(files) {
+				t.Errorf("stats.Files = %d, want %d", stats.Files, len(files))
+			}
+
+			// the duplicated file and the zero chunks are only stored once
+			if got := len(storeChunks(t, s)); got != stats.NewChunks {
+				t.Errorf("stored %d chunks, want %d", got, stats.NewChunks)
+			}
+			if stats.NewBytes >= stats.Bytes {
+				t.Errorf("stats.NewBytes = %d, want < %d", stats.NewBytes, stats.Bytes)
+			}
+
+			err = s.Restore("first", dst)
+			if err != nil {
+				t.Fatalf("Restore() failed. Err: %v", err)
+			}
+			checkTestTree(t, dst, files)
+
+			err = s.Check()
+			if err != nil {
+				t.Errorf("Check() failed. Err: %v", err)
+			}
+		})
+	}
+}
+
+func TestStoreBackupErrors(t *testing.T) {
+	s := newTestStore(t, StoreCompressionNone)
+	src := t.TempDir()
+	writeTestTree(t, src, map[string][]byte{"a.txt": []byte("a")})
+
+	if _, err := s.Backup(src, "first"); err != nil {
+		t.Fatalf("Backup() failed. Err: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		snap    string
+		wantErr error
+	}{
+		{"existing name", "first", ErrStoreSnapshotExists},
+		{"invalid name", "../escape", ErrStoreInvalidName},
+		{"leading dot", ".hidden", ErrStoreInvalidName},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.Backup(src, tt.snap)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Backup(%s) = %v, want %v", tt.snap, err, tt.wantErr)
+			}
+		})
+	}
+
+	err := s.Restore("missing", t.TempDir())
+	if !errors.Is(err, ErrStoreSnapshotNotFound) {
+		t.Errorf("Restore(missing) = %v, want %v", err, ErrStoreSnapshotNotFound)
+	}
+}
+
+func TestStorePruneKeepsReferencedChunks(t *testing.T) {
+	shared := testRandom(20, 8*1024)
+	first := map[string][]byte{
+		"shared.bin": shared,
+		"gone.bin":   testRandom(21, 8*1024),
+	}
+	second := map[string][]byte{
+		"shared.bin": shared,
+		"new.bin":    testRandom(22, 8*1024),
+	}
+
+	tests := []struct {
+		name        string
+		keep        int
+		wantRemoved bool
+		wantSnaps   int
+	}{
+		{"keep all", 0, false, 2},
+		{"keep more than exist", 5, false, 2},
+		{"keep newest", 1, true, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore(t, StoreCompressionGzip)
+			src := t.TempDir()
+			writeTestTree(t, src, first)
+			if _, err := s.Backup(src, "first"); err != nil {
+				t.Fatalf("Backup(first) failed. Err: %v", err)
+			}
+
+			if err := os.Remove(filepath.Join(src, "gone.bin")); err != nil {
+				t.Fatal(err)
+			}
+			writeTestTree(t, src, second)
+			if _, err := s.Backup(src, "second"); err != nil {
+				t.Fatalf("Backup(second) failed. Err: %v", err)
+			}
+			before := len(storeChunks(t, s))
+
+			removed, freed, err := s.Prune(tt.keep)
+			if err != nil {
+				t.Fatalf("Prune() failed. Err: %v", err)
+			}
+			if (removed > 0) != tt.wantRemoved {
+				t.Errorf("Prune() removed %d chunks, want removed %v", removed, tt.wantRemoved)
+			}
+			if tt.wantRemoved && freed <= 0 {
+				t.Errorf("Prune() freed %d bytes, want > 0", freed)
+			}
+			if got := len(storeChunks(t, s)); got != before-removed {
+				t.Errorf("%d chunks left, want %d", got, before-removed)
+			}
+
+			snapshots, err := s.Snapshots()
+			if err != nil {
+				t.Fatalf("Snapshots() failed. Err: %v", err)
+			}
+			if len(snapshots) != tt.wantSnaps || snapshots[len(snapshots)-1].Name != "second" {
+				t.Fatalf("len(Snapshots()) = %d, want %d ending with second", len(snapshots), tt.wantSnaps)
+			}
+
+			// every chunk a remaining snapshot needs is still there
+			err = s.Check()
+			if err != nil {
+				t.Errorf("Check() failed. Err: %v", err)
+			}
+			dst := t.TempDir()
+			err = s.Restore("second", dst)
+			if err != nil {
+				t.Fatalf("Restore() failed. Err: %v", err)
+			}
+			checkTestTree(t, dst, second)
+		})
+	}
+}
+
+func TestStoreCheckDetectsDamage(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression string
+		damage      func(path string) error
+	}{
+		{"none flipped byte", StoreCompressionNone, func(path string) error {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			data[len(data)/2] ^= 0xff
+			return os.WriteFile(path, data, 0644)
+		}},
+		{"gzip truncated", StoreCompressionGzip, func(path string) error {
+			return os.Truncate(path, 10)
+		}},
+		{"gzip replaced", StoreCompressionGzip, func(path string) error {
+			return os.WriteFile(path, []byte("not a chunk"), 0644)
+		}},
+		{"missing", StoreCompressionNone, os.Remove},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore(t, tt.compression)
+			src := t.TempDir()
+			files := map[string][]byte{"data.bin": testRandom(30, 16*1024)}
+			writeTestTree(t, src, files)
+			if _, err := s.Backup(src, "first"); err != nil {
+				t.Fatalf("Backup() failed. Err: %v", err)
+			}
+
+			err := s.Check()
+			if err != nil {
+				t.Fatalf("Check() before damage failed. Err: %v", err)
+			}
+
+			chunks := storeChunks(t, s)
+			if len(chunks) < 2 {
+				t.Fatalf("stored %d chunks, want several", len(chunks))
+			}
+			err = tt.damage(chunks[len(chunks)/2])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = s.Check()
+			if !errors.Is(err, ErrStoreCorrupt) {
+				t.Errorf("Check() = %v, want %v", err, ErrStoreCorrupt)
+			}
+
+			// a restore never writes the damaged file
+			dst := t.TempDir()
+			err = s.Restore("first", dst)
+			if err == nil {
+				t.Errorf("Restore() succeeded with a damaged chunk")
+			}
+			if _, err := os.Stat(filepath.Join(dst, "data.bin")); !os.IsNotExist(err) {
+				t.Errorf("Stat(data.bin) = %v, want not exist", err)
+			}
+		})
+	}
+}
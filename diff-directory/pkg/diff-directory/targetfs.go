@@ -0,0 +1,275 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	klog "k8s.io/klog/v2"
+)
+
+/*
+Target filesystem profiles
+
+FAT32 and exFAT are case insensitive, keep mod times with 2 second granularity in
+local time and reject a handful of characters. Under the FAT profile dst paths are
+matched case insensitively, mod times within the tolerance are treated as equal and
+the characters FAT rejects are mapped to their full width look-alikes on the way to
+dst and back again on the way to src.
+
+The mapping has to be reversible, so a name that already holds a look-alike, the
+escape character itself, a control character or the trailing dots and spaces FAT
+strips gets those written as %XX escapes of their UTF-8 bytes instead.
+*/
+
+// fatIllegalChars maps the characters FAT rejects to a printable look-alike
+var fatIllegalChars = map[rune]rune{
+	':':  '：',
+	'?':  '？',
+	'*':  '＊',
+	'"':  '＂',
+	'<':  '＜',
+	'>':  '＞',
+	'|':  '｜',
+	'\\': '＼',
+}
+
+// fatLookAlikes maps the look-alikes back to the characters FAT rejects
+var fatLookAlikes = func() map[rune]rune {
+	lookAlikes := make(map[rune]rune, len(fatIllegalChars))
+	for from, to := range fatIllegalChars {
+		lookAlikes[to] = from
+	}
+	return lookAlikes
+}()
+
+// fatEscape starts a %XX escape in a name on dst
+const fatEscape = '%'
+
+// resolveTargetFS picks the dst filesystem profile, detecting it when asked to
+func (d *Diff) resolveTargetFS() error {
+	profile := d.options.TargetFS
+	if profile == "" || profile == TargetFSAuto {
+		profile = detectTargetFS(d.options.RootDstPath)
+		klog.V(3).Infof("Detected dst filesystem profile: %s\n", profile)
+	}
+
+	switch profile {
+	case TargetFSPosix:
+		d.fat = false
+	case TargetFSFat:
+		d.fat = true
+		if d.options.MTimeTolerance == 0 {
+			d.options.MTimeTolerance = fatMTimeTolerance
+		}
+	default:
+		klog.Errorf("Unknown target filesystem profile: %s\n", profile)
+		return ErrUnknownTargetFS
+	}
+
+	return nil
+}
+
+// pathKey is the key used to match a relative path between src and dst
+func (d *Diff) pathKey(relPath string, dst bool) string {
+	if d.fat && d.crypt == nil {
+		if dst {
+			relPath = fatDecodePath(relPath)
+		}
+		relPath = strings.ToLower(relPath)
+	}
+	return d.normalize(relPath)
+}
+
+// dstRelPath maps a src relative path to its spelling on dst
+func (d *Diff) dstRelPath(relPath string) string {
+	if !d.fat {
+		return relPath
+	}
+	return fatEncodePath(relPath)
+}
+
+// srcRelPath maps a dst relative path to its spelling on src
+func (d *Diff) srcRelPath(relPath string) string {
+	if !d.fat {
+		return relPath
+	}
+	return fatDecodePath(relPath)
+}
+
+/*
+compareModTime returns 1 when src is newer, -1 when dst is newer and 0 when they are
+the same within MTimeTolerance. With IgnoreTZShift whole hour offsets, which is what
+FAT local time stamps turn into after a time zone or daylight saving change, are
+treated as the same time.
+*/
+func (d *Diff) compareModTime(src, dst time.Time) int {
+	delta := src.Sub(dst)
+	if delta < 0 {
+		delta = -delta
+	}
+
+	if delta <= d.options.MTimeTolerance {
+		return 0
+	}
+	if d.options.IgnoreTZShift && delta <= maxTZShift {
+		offset := delta % time.Hour
+		if offset <= d.options.MTimeTolerance || time.Hour-offset <= d.options.MTimeTolerance {
+			return 0
+		}
+	}
+
+	if src.After(dst) {
+		return 1
+	}
+	return -1
+}
+
+// needsCaseRename reports a dst file that matches src but is spelled differently
+func (d *Diff) needsCaseRename(src, dst *DiffFile) bool {
+	return d.fat && d.crypt == nil && d.normalize(d.dstRelPath(src.RelPath)) != d.normalize(dst.RelPath)
+}
+
+/*
+renameCase renames a dst file whose path only differs by case, directories included.
+Each step goes through a temporary name because a case insensitive filesystem sees
+both spellings as the same entry. Directory renames are remembered so later entries
+under the same directory still find their files.
+*/
+func (d *Diff) renameCase(oldPath, newPath string) error {
+	oldPath = d.renamedPath(oldPath)
+	if d.options.DryRun {
+		klog.V(3).Infof("DryRun: renameCase(%s, %s)\n", oldPath, newPath)
+		return nil
+	}
+
+	root := d.options.RootDstPath
+	oldParts := strings.Split(oldPath[len(root)+1:], string(filepath.Separator))
+	newParts := strings.Split(newPath[len(root)+1:], string(filepath.Separator))
+	if len(oldParts) == len(newParts) {
+		cur := root
+		for i := 0; i < len(oldParts)-1; i++ {
+			from := filepath.Join(cur, oldParts[i])
+			to := filepath.Join(cur, newParts[i])
+			cur = to
+			if from == to {
+				continue
+			}
+
+			// a case sensitive filesystem can have both, then the file just moves
+			if toStat, err := os.Stat(to); err == nil {
+				fromStat, err := os.Stat(from)
+				if err != nil || !os.SameFile(fromStat, toStat) {
+					continue
+				}
+			}
+
+			err := renameViaTemp(from, to)
+			if err != nil {
+				return err
+			}
+			d.dirRenames = append(d.dirRenames, [2]string{from, to})
+			oldPath = d.renamedPath(oldPath)
+		}
+	}
+
+	err := os.MkdirAll(filepath.Dir(newPath), os.ModePerm)
+	if err != nil {
+		klog.Errorf("MkdirAll failed. Err: %v\n", err)
+		return err
+	}
+	if oldPath == newPath {
+		return nil
+	}
+	return renameViaTemp(oldPath, newPath)
+}
+
+// renamedPath applies the directory case renames done so far to a dst path
+func (d *Diff) renamedPath(path string) string {
+	for _, rename := range d.dirRenames {
+		if strings.HasPrefix(path, rename[0]+string(filepath.Separator)) {
+			path = rename[1] + path[len(rename[0]):]
+		}
+	}
+	return path
+}
+
+func renameViaTemp(oldPath, newPath string) error {
+	tmp := filepath.Join(filepath.Dir(oldPath), ".diff-directory-rename-"+filepath.Base(oldPath))
+	err := os.Rename(oldPath, tmp)
+	if err != nil {
+		klog.Errorf("Rename(%s, %s) failed. Err: %v\n", oldPath, tmp, err)
+		return err
+	}
+	err = os.Rename(tmp, newPath)
+	if err != nil {
+		klog.Errorf("Rename(%s, %s) failed. Err: %v\n", tmp, newPath, err)
+		// put it back so nothing is left under the temporary name
+		os.Rename(tmp, oldPath)
+		return err
+	}
+	return nil
+}
+
+func fatEncodePath(relPath string) string {
+	parts := strings.Split(relPath, string(filepath.Separator))
+	for i, part := range parts {
+		parts[i] = fatEncodeName(part)
+	}
+	return strings.Join(parts, string(filepath.Separator))
+}
+
+// fatEncodeName spells one path component so FAT accepts it and it decodes back
+func fatEncodeName(name string) string {
+	// FAT strips trailing dots and spaces
+	keep := len(strings.TrimRight(name, ". "))
+	if name == "." || name == ".." {
+		keep = len(name)
+	}
+
+	var sb strings.Builder
+	for i, r := range name {
+		_, lookAlike := fatLookAlikes[r]
+		switch {
+		case i >= keep, r < 0x20, r == fatEscape, lookAlike:
+			for _, b := range []byte(string(r)) {
+				fmt.Fprintf(&sb, "%c%02X", fatEscape, b)
+			}
+		case fatIllegalChars[r] != 0:
+			sb.WriteRune(fatIllegalChars[r])
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// fatDecodePath reverses fatEncodePath, a % that doesn't start an escape is kept
+func fatDecodePath(relPath string) string {
+	var sb strings.Builder
+	for i := 0; i < len(relPath); {
+		if relPath[i] == fatEscape && i+2 < len(relPath) {
+			if b, err := strconv.ParseUint(relPath[i+1:i+3], 16, 8); err == nil {
+				sb.WriteByte(byte(b))
+				i += 3
+				continue
+			}
+		}
+		r, size := utf8.DecodeRuneInString(relPath[i:])
+		if from, ok := fatLookAlikes[r]; ok {
+			sb.WriteRune(from)
+		} else {
+			sb.WriteString(relPath[i : i+size])
+		}
+		i += size
+	}
+	return sb.String()
+}
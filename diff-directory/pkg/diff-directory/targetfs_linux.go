@@ -0,0 +1,32 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build linux
+
+package diff
+
+import (
+	unix "golang.org/x/sys/unix"
+	klog "k8s.io/klog/v2"
+)
+
+const (
+	exfatSuperMagic = 0x2011BAB0
+)
+
+// detectTargetFS looks at the filesystem type backing path
+func detectTargetFS(path string) string {
+	var stat unix.Statfs_t
+	err := unix.Statfs(path, &stat)
+	if err != nil {
+		klog.V(3).Infof("Statfs(%s) failed. Err: %v\n", path, err)
+		return TargetFSPosix
+	}
+
+	switch stat.Type {
+	case unix.MSDOS_SUPER_MAGIC, exfatSuperMagic:
+		return TargetFSFat
+	}
+	return TargetFSPosix
+}
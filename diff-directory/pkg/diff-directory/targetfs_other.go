@@ -0,0 +1,12 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !linux
+
+package diff
+
+// detectTargetFS can't tell the filesystem type here so the profile has to be declared
+func detectTargetFS(path string) string {
+	return TargetFSPosix
+}
@@ -0,0 +1,86 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFatEncodePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"plain.mp3", "plain.mp3"},
+		{"a:b?.txt", "a：b？.txt"},
+		{`<*>|"`, "＜＊＞｜＂"},
+		{"a：b", "a%EF%BC%9Ab"},
+		{"100%", "100%25"},
+		{"%41", "%2541"},
+		{"tab\there", "tab%09here"},
+		{"name.", "name%2E"},
+		{"name. .", "name%2E%20%2E"},
+		{"trailing ", "trailing%20"},
+		{".hidden", ".hidden"},
+		{filepath.Join("dir.", "a:b"), filepath.Join("dir%2E", "a：b")},
+		{"日本語：タイトル?", "日本語%EF%BC%9Aタイトル？"},
+	}
+
+	for _, tt := range tests {
+		if got := fatEncodePath(tt.path); got != tt.want {
+			t.Errorf("fatEncodePath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestFatDecodePath(t *testing.T) {
+	paths := []string{
+		"plain.mp3", "a:b?.txt", `<*>|"\`, "a：b", "＜mixed>", "100%", "%41", "%%", "%2", "%zz",
+		"tab\there", "name.", "...", "trailing  ", " lead", "日本語：タイトル?",
+		filepath.Join("dir.", "a:b", "c：d "),
+	}
+	for _, path := range paths {
+		if got := fatDecodePath(fatEncodePath(path)); got != path {
+			t.Errorf("fatDecodePath(fatEncodePath(%q)) = %q", path, got)
+		}
+	}
+
+	// names on dst that weren't written by an encode still decode sensibly
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"a：b", "a:b"},
+		{"100%", "100%"},
+		{"50%off", "50%off"},
+		{"%4", "%4"},
+	}
+	for _, tt := range tests {
+		if got := fatDecodePath(tt.path); got != tt.want {
+			t.Errorf("fatDecodePath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestFatPathKey(t *testing.T) {
+	d := New(DiffOpts{})
+	d.fat = true
+
+	// a src name and the name its copy gets on dst must match
+	for _, relPath := range []string{"Song: Live.mp3", "曲：ライブ.mp3", "Dir.", "A%B"} {
+		dstRel := d.dstRelPath(relPath)
+		if strings.ContainsAny(dstRel, `:?*"<>|`) || strings.HasSuffix(dstRel, ".") {
+			t.Errorf("dstRelPath(%q) = %q, FAT rejects it", relPath, dstRel)
+		}
+		if d.pathKey(relPath, false) != d.pathKey(dstRel, true) {
+			t.Errorf("pathKey(%q) != pathKey(%q)", relPath, dstRel)
+		}
+		if got := d.srcRelPath(dstRel); got != relPath {
+			t.Errorf("srcRelPath(%q) = %q, want %q", dstRel, got, relPath)
+		}
+	}
+}
@@ -0,0 +1,438 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	klog "k8s.io/klog/v2"
+)
+
+/*
+Throttling
+
+Reading (hashing) and writing (copying) can each be limited in bytes and files per second
+so a sync can run in the background without saturating the disk or the network. The
+limits only apply inside the schedule windows, e.g. 08:00-18:00 to run at full speed at
+night, and always without a schedule.
+
+The control file changes the limits of a running sync. It is re-read when it changes or
+on SIGHUP, its keys override the options and a key left out keeps the option value:
+
+	# throttle during office hours
+	read-bps = 20M
+	read-fps = 200
+	write-bps = 5M
+	write-fps = 50
+	schedule = 08:00-12:00, 13:00-18:00
+*/
+
+// ParseBytes parses a byte count with an optional K, M, G or T suffix (1024 based)
+func ParseBytes(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	upper := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+	if len(upper) > 1 {
+		if i := strings.IndexByte("KMGT", upper[len(upper)-1]); i >= 0 {
+			multiplier = int64(1) << (10 * (i + 1))
+			upper = upper[:len(upper)-1]
+		}
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(upper), 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidByteCount, s)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// parseSchedule parses comma separated HH:MM-HH:MM windows, a window may wrap past midnight
+func parseSchedule(s string) ([]throttleWindow, error) {
+	windows := make([]throttleWindow, 0)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		times := strings.Split(part, "-")
+		if len(times) != 2 {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidSchedule, part)
+		}
+		start, errStart := time.Parse("15:04", strings.TrimSpace(times[0]))
+		end, errEnd := time.Parse("15:04", strings.TrimSpace(times[1]))
+		if errStart != nil || errEnd != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidSchedule, part)
+		}
+		windows = append(windows, throttleWindow{
+			start: start.Hour()*60 + start.Minute(),
+			end:   end.Hour()*60 + end.Minute(),
+		})
+	}
+	return windows, nil
+}
+
+func (w throttleWindow) contains(minute int) bool {
+	if w.start <= w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+// active reports whether the limits apply at now
+func (l *throttleLimits) active(now time.Time) bool {
+	if len(l.schedule) == 0 {
+		return true
+	}
+	minute := now.Hour()*60 + now.Minute()
+	for _, window := range l.schedule {
+		if window.contains(minute) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *throttleLimits) unlimited() bool {
+	return l.readBytes <= 0 && l.readFiles <= 0 && l.writeBytes <= 0 && l.writeFiles <= 0
+}
+
+func (l *throttleLimits) String() string {
+	if l.unlimited() {
+		return "unlimited"
+	}
+	rate := func(bytes, files float64) string {
+		parts := make([]string, 0, 2)
+		if bytes > 0 {
+			parts = append(parts, formatBytes(int64(bytes))+"/s")
+		}
+		if files > 0 {
+			parts = append(parts, strconv.FormatFloat(files, 'g', -1, 64)+" files/s")
+		}
+		if len(parts) == 0 {
+			return "unlimited"
+		}
+		return strings.Join(parts, " ")
+	}
+	s := fmt.Sprintf("read %s, write %s", rate(l.readBytes, l.readFiles), rate(l.writeBytes, l.writeFiles))
+	if len(l.schedule) > 0 {
+		windows := make([]string, 0, len(l.schedule))
+		for _, w := range l.schedule {
+			windows = append(windows, fmt.Sprintf("%02d:%02d-%02d:%02d", w.start/60, w.start%60, w.end/60, w.end%60))
+		}
+		s += " during " + strings.Join(windows, ", ")
+	}
+	return s
+}
+
+// limits returns the limits of the options, without the control file
+func (o ThrottleOpts) limits() (throttleLimits, error) {
+	if o.ReadBytesPerSec < 0 || o.ReadFilesPerSec < 0 || o.WriteBytesPerSec < 0 || o.WriteFilesPerSec < 0 {
+		return throttleLimits{}, ErrInvalidThrottle
+	}
+	schedule, err := parseSchedule(o.Schedule)
+	if err != nil {
+		return throttleLimits{}, err
+	}
+	return throttleLimits{
+		readBytes:  float64(o.ReadBytesPerSec),
+		readFiles:  o.ReadFilesPerSec,
+		writeBytes: float64(o.WriteBytesPerSec),
+		writeFiles: o.WriteFilesPerSec,
+		schedule:   schedule,
+	}, nil
+}
+
+// String describes the limits of the options
+func (o ThrottleOpts) String() string {
+	limits, err := o.limits()
+	if err != nil {
+		return err.Error()
+	}
+	s := limits.String()
+	if o.ControlFile != "" {
+		s += ", control file " + o.ControlFile
+	}
+	return s
+}
+
+// readControlFile overrides limits with the keys of the control file, a missing file changes nothing
+func readControlFile(path string, limits *throttleLimits) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return fmt.Errorf("%w: %s:%d: expected key = value", ErrInvalidThrottle, path, lineNum)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		switch key {
+		case "read-bps", "write-bps":
+			n, err := ParseBytes(value)
+			if err != nil {
+				return fmt.Errorf("%w: %s:%d: %v", ErrInvalidThrottle, path, lineNum, err)
+			}
+			if key == "read-bps" {
+				limits.readBytes = float64(n)
+			} else {
+				limits.writeBytes = float64(n)
+			}
+		case "read-fps", "write-fps":
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil || n < 0 {
+				return fmt.Errorf("%w: %s:%d: invalid %s %s", ErrInvalidThrottle, path, lineNum, key, value)
+			}
+			if key == "read-fps" {
+				limits.readFiles = n
+			} else {
+				limits.writeFiles = n
+			}
+		case "schedule":
+			schedule, err := parseSchedule(value)
+			if err != nil {
+				return fmt.Errorf("%w: %s:%d: %v", ErrInvalidThrottle, path, lineNum, err)
+			}
+			limits.schedule = schedule
+		default:
+			return fmt.Errorf("%w: %s:%d: unknown key %s", ErrInvalidThrottle, path, lineNum, key)
+		}
+	}
+	return scanner.Err()
+}
+
+// newThrottle returns nil when nothing is limited and there is no control file
+func newThrottle(opts ThrottleOpts) (*throttle, error) {
+	limits, err := opts.limits()
+	if err != nil {
+		return nil, err
+	}
+	if limits.unlimited() && opts.ControlFile == "" {
+		return nil, nil
+	}
+
+	t := &throttle{
+		opts: opts,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if opts.ControlFile != "" {
+		if stat, err := os.Stat(opts.ControlFile); err == nil {
+			t.modTime = stat.ModTime()
+		}
+		err = readControlFile(opts.ControlFile, &limits)
+		if err != nil {
+			return nil, err
+		}
+	}
+	t.set(limits)
+	return t, nil
+}
+
+func (d *Diff) startThrottle() error {
+	t, err := newThrottle(d.options.Throttle)
+	if err != nil {
+		klog.Errorf("Invalid throttle. Err: %v\n", err)
+		return err
+	}
+	d.throttle = t
+	if t == nil {
+		return nil
+	}
+
+	klog.V(3).Infof("[THROTTLE] %s\n", t.limits.String())
+	if t.opts.ControlFile == "" {
+		close(t.done)
+		return nil
+	}
+	go t.watch()
+	return nil
+}
+
+func (d *Diff) stopThrottle() {
+	if d.throttle == nil {
+		return
+	}
+	close(d.throttle.stop)
+	<-d.throttle.done
+	d.throttle = nil
+}
+
+// watch re-reads the control file on SIGHUP or when it changes
+func (t *throttle) watch() {
+	defer close(t.done)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(throttleReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-hup:
+			klog.V(3).Infof("[THROTTLE] SIGHUP, reloading %s\n", t.opts.ControlFile)
+			t.reload()
+		case <-ticker.C:
+			var modTime time.Time
+			if stat, err := os.Stat(t.opts.ControlFile); err == nil {
+				modTime = stat.ModTime()
+			}
+			if !modTime.Equal(t.modTime) {
+				t.modTime = modTime
+				t.reload()
+			}
+		}
+	}
+}
+
+// reload applies the control file over the options, keeping the current limits when it is invalid
+func (t *throttle) reload() {
+	limits, err := t.opts.limits()
+	if err == nil {
+		err = readControlFile(t.opts.ControlFile, &limits)
+	}
+	if err != nil {
+		klog.Errorf("Reloading throttle failed, keeping the current limits. Err: %v\n", err)
+		return
+	}
+	t.set(limits)
+	klog.Infof("Throttle: %s\n", limits.String())
+}
+
+// set replaces the limits, starting every bucket over
+func (t *throttle) set(limits throttleLimits) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.limits = limits
+	t.readBytes = rateLimit{rate: limits.readBytes}
+	t.readFiles = rateLimit{rate: limits.readFiles}
+	t.writeBytes = rateLimit{rate: limits.writeBytes}
+	t.writeFiles = rateLimit{rate: limits.writeFiles}
+}
+
+// reserve takes n tokens, going into debt, and returns how long to wait for them
+func (l *rateLimit) reserve(n float64, now time.Time) time.Duration {
+	if l.rate <= 0 {
+		return 0
+	}
+	if l.last.IsZero() {
+		// allow a burst of one second
+		l.tokens = l.rate
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+	}
+	l.last = now
+	l.tokens -= n
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+func (t *throttle) wait(limit func(t *throttle) *rateLimit, n int64) {
+	if t == nil || n <= 0 {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	if !t.limits.active(now) {
+		t.mu.Unlock()
+		return
+	}
+	delay := limit(t).reserve(float64(n), now)
+	t.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// read waits for n bytes to be read
+func (t *throttle) read(n int64) {
+	t.wait(func(t *throttle) *rateLimit { return &t.readBytes }, n)
+}
+
+// write waits for n bytes to be written
+func (t *throttle) write(n int64) {
+	t.wait(func(t *throttle) *rateLimit { return &t.writeBytes }, n)
+}
+
+// readFile waits to start reading another file
+func (t *throttle) readFile() {
+	t.wait(func(t *throttle) *rateLimit { return &t.readFiles }, 1)
+}
+
+// writeFile waits to start writing another file
+func (t *throttle) writeFile() {
+	t.wait(func(t *throttle) *rateLimit { return &t.writeFiles }, 1)
+}
+
+// pacer returns what copies call after writing each chunk, nil without a throttle
+func (t *throttle) pacer() func(int64) {
+	if t == nil {
+		return nil
+	}
+	return t.write
+}
+
+// reader throttles reads from r
+func (t *throttle) reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &pacedReader{r: r, pace: t.read}
+}
+
+// writer throttles writes to w
+func (t *throttle) writer(w io.Writer) io.Writer {
+	if t == nil {
+		return w
+	}
+	return &pacedWriter{w: w, pace: t.write}
+}
+
+func (r *pacedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.pace(int64(n))
+	return n, err
+}
+
+func (w *pacedWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.pace(int64(n))
+	return n, err
+}
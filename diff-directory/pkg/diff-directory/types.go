@@ -4,7 +4,14 @@
 
 package diff
 
-import "io/fs"
+import (
+	"io"
+	"io/fs"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
 
 type DIRECTION int
 
@@ -19,10 +26,130 @@ type DiffOpts struct {
 	RootDstPath   string
 	SkipSrcUpdate bool
 	DryRun        bool
+	Verify        bool // read back every copied file and compare hashes
+	Stream        bool // resolve each difference as soon as it is found
+
+	// per subtree direction and conflict policy, Direction and Conflict apply to
+	// paths no rule matches and Ignore patterns are skipped entirely
+	RulesFile string
+	Direction string
+	Conflict  string
+	Ignore    []string
+
+	// where the copy strategy chain starts, auto tries reflink first
+	CopyStrategy string
+
+	// content hash used to compare files (sha256, md5 or sfv) and how many files
+	// are hashed in parallel
+	Hash    string
+	Workers int
+
+	// with DryRun show a unified diff for every changed text file
+	ShowDiff  bool
+	DiffColor bool
+
+	// ask about every action before carrying it out, defaults to stdin and stdout
+	Interactive bool
+	ReviewIn    io.Reader
+	ReviewOut   io.Writer
+
+	// trusted checksum files (SHA256SUMS, .md5, .sfv) used instead of hashing
+	SrcChecksumFile string
+	DstChecksumFile string
+
+	// dst filesystem profile (auto, posix or fat) and how close mod times must be
+	TargetFS       string
+	MTimeTolerance time.Duration
+	IgnoreTZShift  bool
+
+	// match paths by their unicode normalized form (none, nfc or nfd)
+	Normalize string
+
+	// refuse runs that change more than this, 0 means no limit, Force runs anyway
+	MaxFiles        int
+	MaxBytes        int64
+	MaxOverwritePct float64 // percentage of either tree overwritten
+	Force           bool
+
+	// fail-fast (default) stops at the first file that fails, continue goes on with the rest
+	ErrorPolicy string
+
+	// how long to wait for another run holding the lock on src or dst, 0 fails right away
+	LockWait time.Duration
+
+	// rate limits for hashing and copying, adjustable while running with a control file
+	Throttle ThrottleOpts
+
+	// only compare files passing these filters
+	Filter FilterOpts
+
+	// with an archive on one side, write its new and changed members to the directory
+	Extract bool
+
+	// compare music by its audio payload, SyncTags syncs tags-only changes by their tags
+	Audio    bool
+	SyncTags bool
+
+	// keep dst encrypted with a key derived from Passphrase or KeyFile
+	EncryptDst bool
+	Passphrase string
+	KeyFile    string
 }
 
 type Diff struct {
 	options DiffOpts
+	crypt   *cryptor
+	fat     bool
+
+	dirRenames [][2]string // dst directories renamed to fix their case
+	collisions []string    // paths skipped because another path has the same key
+
+	srcSums *trustedSums // trusted checksums by path key
+	dstSums *trustedSums
+
+	srcCount int // files seen in each tree
+	dstCount int
+
+	rules       []*SyncRule
+	defaultRule *SyncRule
+
+	fileErrors FileErrors            // failures the run continued past
+	failed     map[*DiffCompare]bool // differences that couldn't be resolved
+	changed    []string              // files deferred because they kept changing
+	strategies map[string]int        // files copied by each copy strategy
+	sparse     sparseStats           // sparse files copied
+	throttle   *throttle             // nil when nothing is throttled
+
+	visit func(file *DiffFile, dst bool) // set by Stats, the walk visits files instead of comparing
+
+	filterNow   time.Time       // the filter ages are relative to
+	excludeExts map[string]bool // extensions of the excluded classes
+	filtered    map[string]int  // files filtered out of each tree
+
+	audioChanges map[string]int // music differences by kind
+}
+
+// FilterOpts narrows a comparison down, zero values don't filter
+type FilterOpts struct {
+	NewerThan      time.Duration // modified within this long
+	OlderThan      time.Duration // modified more than this long ago
+	MinSize        int64
+	MaxSize        int64
+	ExcludeClasses []string // audio, video or images
+}
+
+// ThrottleOpts limits the I/O of a run, a zero rate is unlimited
+type ThrottleOpts struct {
+	ReadBytesPerSec  int64 // hashing
+	ReadFilesPerSec  float64
+	WriteBytesPerSec int64 // copying
+	WriteFilesPerSec float64
+
+	// HH:MM-HH:MM windows the limits apply in, comma separated, empty is always
+	Schedule string
+
+	// file overriding the limits while running, re-read when it changes or on SIGHUP
+	ControlFile string
 }
 
 type DiffFile struct {
@@ -30,10 +157,331 @@ type DiffFile struct {
 	RelPath string
 	Attr    *fs.FileInfo
 	Hash    string // crypto/sha256 calculated only if attr mod is different
+
+	// sum from a trusted checksum file when it isnt crypto/sha256
+	SumFormat string
+	Sum       string
+
+	AudioHash string // crypto/sha256 of the audio payload of a music file, tags left out
+}
+
+// treeFileInfo describes a file of a tree that isn't on disk, a git blob or an archive member
+type treeFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
 }
 
 type DiffCompare struct {
-	SrcFile   *DiffFile
-	DstFile   *DiffFile
-	Direction DIRECTION
+	SrcFile    *DiffFile
+	DstFile    *DiffFile
+	Direction  DIRECTION
+	RenameOnly bool      // same content, dst only needs the src spelling
+	Rule       *SyncRule // the rule that applied, nil without a rules file
+	Audio      string    // tags-only or audio-changed when music is compared by its audio
+}
+
+// SyncRule assigns a direction and conflict policy to the paths matching Pattern
+type SyncRule struct {
+	Pattern   string
+	Direction string
+	Conflict  string
+
+	regex *regexp.Regexp
+}
+
+type MultiOpts struct {
+	Roots          []string
+	DryRun         bool
+	Verify         bool
+	MTimeTolerance time.Duration
+	IgnoreTZShift  bool
+	Normalize      string
+	LockWait       time.Duration
+	ErrorPolicy    string
+	CopyStrategy   string
+	Throttle       ThrottleOpts
+	Filter         FilterOpts
+
+	// safety limits, MaxOverwritePct applies to each root
+	MaxFiles        int
+	MaxBytes        int64
+	MaxOverwritePct float64
+	Force           bool
+}
+
+type Multi struct {
+	options MultiOpts
+	diff    *Diff // comparison and copy helpers shared with the pairwise sync
+
+	counts []int // files in each root
+	copies []*multiCopy
+	copied []string
+}
+
+// multiCopy is one planned copy of the newest version of a file to a root behind
+type multiCopy struct {
+	from    *DiffFile
+	planned *DiffFile // what the root had when it was compared, nil when missing
+	to      string
+	src     int // root index
+	dst     int
+	reason  string
+}
+
+// Config is a config file of named sync profiles
+type Config struct {
+	Profiles map[string]*Profile `yaml:"profiles"`
+}
+
+/*
+Profile is one named sync run. Most keys are named after a command line flag, spelled
+with a dash between words where the flag isn't: skip-src is -skipsrc, dry-run is -dryrun
+and lock-wait is -wait. direction, conflict and ignore have no flag of the sync command.
+*/
+type Profile struct {
+	Name string `yaml:"-"`
+
+	Src      string `yaml:"src"`
+	Dst      string `yaml:"dst"` // store:<path> backs up into a store
+	SkipSrc  bool   `yaml:"skip-src"`
+	DryRun   bool   `yaml:"dry-run"`
+	Verify   bool   `yaml:"verify"`
+	Stream   bool   `yaml:"stream"`
+	Extract  bool   `yaml:"extract"` // with an archive src or dst
+	Audio    bool   `yaml:"audio"`
+	SyncTags bool   `yaml:"sync-tags"`
+
+	Direction string   `yaml:"direction"`
+	Conflict  string   `yaml:"conflict"`
+	Rules     string   `yaml:"rules"`
+	Ignore    []string `yaml:"ignore"`
+
+	Hash         string `yaml:"hash"`
+	Workers      int    `yaml:"workers"`
+	CopyStrategy string `yaml:"copy-strategy"`
+
+	TargetFS       string        `yaml:"target-fs"`
+	MTimeTolerance time.Duration `yaml:"mtime-tolerance"`
+	IgnoreTZShift  bool          `yaml:"ignore-tz-shift"`
+	Normalize      string        `yaml:"normalize"`
+
+	SrcHashes string `yaml:"src-hashes"`
+	DstHashes string `yaml:"dst-hashes"`
+
+	Encrypt bool   `yaml:"encrypt"`
+	KeyFile string `yaml:"keyfile"`
+
+	MaxFiles        int     `yaml:"max-files"`
+	MaxBytes        int64   `yaml:"max-bytes"`
+	MaxOverwritePct float64 `yaml:"max-overwrite-pct"`
+
+	ReadBPS          string  `yaml:"read-bps"` // bytes per second, K, M, G suffixes
+	ReadFPS          float64 `yaml:"read-fps"`
+	WriteBPS         string  `yaml:"write-bps"`
+	WriteFPS         float64 `yaml:"write-fps"`
+	ThrottleSchedule string  `yaml:"throttle-schedule"`
+	ThrottleFile     string  `yaml:"throttle-file"`
+
+	NewerThan      string   `yaml:"newer-than"` // 7d, 2w or a duration
+	OlderThan      string   `yaml:"older-than"`
+	MinSize        string   `yaml:"min-size"` // K, M, G suffixes
+	MaxSize        string   `yaml:"max-size"`
+	ExcludeClasses []string `yaml:"exclude-classes"`
+
+	OnError  string        `yaml:"on-error"`
+	LockWait time.Duration `yaml:"lock-wait"`
+	Logging  int           `yaml:"logging"`
+}
+
+// FileError is a failure on a single file
+type FileError struct {
+	Path string // relative to the tree root
+	Op   string
+	Err  error
+}
+
+// FileErrors are all the failures of a run that continued past them
+type FileErrors []*FileError
+
+// sparseStats totals the sparse files copied
+type sparseStats struct {
+	files     int
+	apparent  int64
+	allocated int64
+}
+
+// audioRange is a byte range of the audio payload of a music file
+type audioRange struct {
+	start int64
+	end   int64
+}
+
+// throttle holds the rate limits of a run
+type throttle struct {
+	mu         sync.Mutex
+	limits     throttleLimits
+	readBytes  rateLimit
+	readFiles  rateLimit
+	writeBytes rateLimit
+	writeFiles rateLimit
+
+	opts    ThrottleOpts
+	modTime time.Time // of the control file when last read
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// throttleLimits are rates per second, 0 is unlimited
+type throttleLimits struct {
+	readBytes  float64
+	readFiles  float64
+	writeBytes float64
+	writeFiles float64
+	schedule   []throttleWindow
+}
+
+// throttleWindow is a time of day range in minutes after midnight
+type throttleWindow struct {
+	start int
+	end   int
+}
+
+// rateLimit is a token bucket holding up to a second of tokens
+type rateLimit struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+type pacedReader struct {
+	r    io.Reader
+	pace func(int64)
+}
+
+type pacedWriter struct {
+	w    io.Writer
+	pace func(int64)
+}
+
+// runLock is a held lock file in the root of a tree
+type runLock struct {
+	path string
+	file *os.File
+}
+
+// lockInfo is written to a lock file so others can tell who holds it
+type lockInfo struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+}
+
+type StoreOpts struct {
+	RootPath    string
+	Compression string // used by Init only, existing stores keep their own
+	DryRun      bool
+}
+
+type Store struct {
+	options StoreOpts
+	config  *StoreConfig
+}
+
+type StoreConfig struct {
+	Version     int    `json:"version"`
+	Compression string `json:"compression"`
+	ChunkMin    int    `json:"chunkMin"`
+	ChunkAvg    int    `json:"chunkAvg"`
+	ChunkMax    int    `json:"chunkMax"`
+}
+
+type StoreSnapshot struct {
+	Name    string       `json:"name"`
+	Source  string       `json:"source"`
+	Created time.Time    `json:"created"`
+	Files   []*StoreFile `json:"files"`
+}
+
+type StoreFile struct {
+	RelPath string      `json:"path"`
+	Size    int64       `json:"size"`
+	Mode    fs.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+	Hash    string      `json:"hash"`   // crypto/sha256 of the whole file, same encoding as DiffFile.Hash
+	Chunks  []string    `json:"chunks"` // hex crypto/sha256 of each uncompressed chunk
+}
+
+type StoreStats struct {
+	Files       int
+	Bytes       int64
+	NewChunks   int
+	NewBytes    int64
+	ReusedFiles int
+}
+
+type StatsOpts struct {
+	Top        int  // how many of the largest, oldest and newest files, defaults to 10
+	Duplicates bool // group identical files within and across the trees
+	Hardlink   bool // replace duplicates with hardlinks to the first file of their group
+	CrossTree  bool // with Hardlink also link dst files to src, by default each tree keeps its own first file
+}
+
+type StatsReport struct {
+	Src        *TreeStats
+	Dst        *TreeStats // nil without a dst
+	Duplicates []*DuplicateGroup
+	Filtered   map[string]int // files filtered out of src and dst
+
+	Linked    int // duplicates replaced with hardlinks
+	Reclaimed int64
+}
+
+type TreeStats struct {
+	Root  string
+	Files int
+	Bytes int64
+	ByExt map[string]*StatCount // lower case extension with the dot
+	ByDir map[string]*StatCount // top level directory, . for files in the root
+
+	Largest []*DiffFile
+	Oldest  []*DiffFile
+	Newest  []*DiffFile
+}
+
+type StatCount struct {
+	Files int
+	Bytes int64
+}
+
+// DuplicateGroup is files with identical content, the first is kept when hardlinking
+type DuplicateGroup struct {
+	Size  int64
+	Hash  string
+	Files []*DuplicateFile
+}
+
+type DuplicateFile struct {
+	Dst  bool
+	File *DiffFile
+}
+
+type VerifyReport struct {
+	Checked  int
+	Missing  []string
+	Modified []string
+	Corrupt  []string
+}
+
+type VerifyManifest struct {
+	Version int                             `json:"version"`
+	Created time.Time                       `json:"created"`
+	Files   map[string]*VerifyManifestEntry `json:"files"`
+}
+
+type VerifyManifestEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Hash    string    `json:"hash"`
 }
@@ -0,0 +1,316 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	klog "k8s.io/klog/v2"
+)
+
+/*
+Unified diffs
+
+Line diffs use the Myers O(ND) algorithm. The edit script is found by remembering the
+furthest reaching path of every diagonal for each edit distance and walking it back
+from the end. Files that need more than maxDiffEdits edits are shown as one hunk that
+replaces everything.
+*/
+
+type diffOp struct {
+	kind byte // ' ' same, '-' only in a, '+' only in b
+	a, b int  // line index in a and b
+}
+
+// unifiedDiff returns the unified diff turning a into b, empty when they are the same
+func unifiedDiff(nameA, nameB string, a, b []byte) string {
+	linesA := splitLines(a)
+	linesB := splitLines(b)
+	ops := diffLines(linesA, linesB)
+
+	var sb strings.Builder
+	for start := 0; start < len(ops); {
+		// find the next change and everything within the context of it
+		for start < len(ops) && ops[start].kind == ' ' {
+			start++
+		}
+		if start == len(ops) {
+			break
+		}
+		end := start
+		for i := start; i < len(ops); i++ {
+			if ops[i].kind != ' ' {
+				end = i + 1
+			} else if i-end >= 2*diffContext {
+				break
+			}
+		}
+		from := start - diffContext
+		if from < 0 {
+			from = 0
+		}
+		to := end + diffContext
+		if to > len(ops) {
+			to = len(ops)
+		}
+
+		if sb.Len() == 0 {
+			sb.WriteString(fmt.Sprintf("--- %s\n+++ %s\n", nameA, nameB))
+		}
+		writeHunk(&sb, ops[from:to], linesA, linesB)
+		start = to
+	}
+
+	return sb.String()
+}
+
+func writeHunk(sb *strings.Builder, ops []diffOp, a, b []string) {
+	startA, startB := ops[0].a, ops[0].b
+	countA, countB := 0, 0
+	for _, op := range ops {
+		if op.kind != '+' {
+			countA++
+		}
+		if op.kind != '-' {
+			countB++
+		}
+	}
+	// an empty range starts at the line before it
+	if countA > 0 {
+		startA++
+	}
+	if countB > 0 {
+		startB++
+	}
+	sb.WriteString(fmt.Sprintf("@@ -%s +%s @@\n", hunkRange(startA, countA), hunkRange(startB, countB)))
+
+	for _, op := range ops {
+		line := ""
+		switch op.kind {
+		case '+':
+			line = b[op.b]
+		default:
+			line = a[op.a]
+		}
+		sb.WriteByte(op.kind)
+		sb.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			sb.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+func hunkRange(start, count int) string {
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// diffLines returns the edit script turning a into b
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+
+	// the common prefix and suffix never need the search
+	prefix := 0
+	for prefix < n && prefix < m && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < n-prefix && suffix < m-prefix && a[n-1-suffix] == b[m-1-suffix] {
+		suffix++
+	}
+
+	ops := make([]diffOp, 0, n+m)
+	for i := 0; i < prefix; i++ {
+		ops = append(ops, diffOp{kind: ' ', a: i, b: i})
+	}
+	ops = append(ops, myers(a[prefix:n-suffix], b[prefix:m-suffix], prefix, prefix)...)
+	for i := 0; i < suffix; i++ {
+		ops = append(ops, diffOp{kind: ' ', a: n - suffix + i, b: m - suffix + i})
+	}
+	return ops
+}
+
+func myers(a, b []string, offA, offB int) []diffOp {
+	n, m := len(a), len(b)
+	max := n + m
+	if max > maxDiffEdits {
+		max = maxDiffEdits
+	}
+
+	// trace[d][k+d] is the furthest x on diagonal k after d edits
+	trace := make([][]int, 0)
+	v := []int{0, 0}
+	found := false
+	for d := 0; d <= max && !found; d++ {
+		next := make([]int, 2*d+1)
+		for k := -d; k <= d; k += 2 {
+			var x int
+			switch {
+			case d == 0:
+				x = 0
+			case k == -d || (k != d && v[k-1+d-1] < v[k+1+d-1]):
+				x = v[k+1+d-1]
+			default:
+				x = v[k-1+d-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			next[k+d] = x
+			if x >= n && y >= m {
+				found = true
+			}
+		}
+		trace = append(trace, next)
+		v = next
+	}
+
+	if !found {
+		ops := make([]diffOp, 0, n+m)
+		for i := 0; i < n; i++ {
+			ops = append(ops, diffOp{kind: '-', a: offA + i, b: offB})
+		}
+		for i := 0; i < m; i++ {
+			ops = append(ops, diffOp{kind: '+', a: offA + n, b: offB + i})
+		}
+		return ops
+	}
+
+	// walk back from the end through the diagonals
+	ops := make([]diffOp, 0, n+m)
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		prev := trace[d-1]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && prev[k-1+d-1] < prev[k+1+d-1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := prev[prevK+d-1]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, diffOp{kind: ' ', a: offA + x, b: offB + y})
+		}
+		if x == prevX {
+			y--
+			ops = append(ops, diffOp{kind: '+', a: offA + x, b: offB + y})
+		} else {
+			x--
+			ops = append(ops, diffOp{kind: '-', a: offA + x, b: offB + y})
+		}
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		ops = append(ops, diffOp{kind: ' ', a: offA + x, b: offB + y})
+	}
+
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// splitLines splits after every newline, the last line has none when the file doesn't end in one
+func splitLines(data []byte) []string {
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// colorizeDiff adds terminal colors to a unified diff
+func colorizeDiff(text string) string {
+	lines := strings.SplitAfter(text, "\n")
+	for i, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "--- ") || strings.HasPrefix(line, "+++ "):
+			lines[i] = colorLine(line, colorBold)
+		case strings.HasPrefix(line, "@@"):
+			lines[i] = colorLine(line, colorCyan)
+		case strings.HasPrefix(line, "-"):
+			lines[i] = colorLine(line, colorRed)
+		case strings.HasPrefix(line, "+"):
+			lines[i] = colorLine(line, colorGreen)
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+func colorLine(line, color string) string {
+	if strings.HasSuffix(line, "\n") {
+		return color + line[:len(line)-1] + colorReset + "\n"
+	}
+	return color + line + colorReset
+}
+
+// printContentDiff shows in a dry run report what a copy would change in a text file
+func (d *Diff) printContentDiff(diff *DiffCompare) {
+	if !d.options.ShowDiff || !d.options.DryRun || diff.SrcFile == nil || diff.DstFile == nil || diff.RenameOnly {
+		return
+	}
+
+	text, err := d.actionDiff(diff)
+	switch {
+	case errors.Is(err, ErrDiffBinary):
+		klog.Infof("\tBinary files differ\n")
+		return
+	case errors.Is(err, ErrDiffTooLarge):
+		klog.Infof("\tToo large to diff (over %d bytes)\n", maxDiffSize)
+		return
+	case err != nil:
+		klog.Infof("\tCan't diff: %v\n", err)
+		return
+	}
+
+	if d.options.DiffColor {
+		text = colorizeDiff(text)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		klog.Infof("\t%s\n", line)
+	}
+}
+
+// isBinary guesses binary content the way git does, by looking for a NUL byte
+func isBinary(data []byte) bool {
+	if len(data) > binarySniffSize {
+		data = data[:binarySniffSize]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+// readContent reads a file for diffing, decrypting it when it lives in an encrypted dst
+func (d *Diff) readContent(file *DiffFile, encrypted bool) ([]byte, error) {
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if !encrypted {
+		return io.ReadAll(f)
+	}
+	var buf bytes.Buffer
+	_, err = d.crypt.decryptStream(&buf, f)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,194 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// numberedLines returns the lines from to to, one number per line, with the
+// changed ones prefixed by X
+func numberedLines(from, to int, changed ...int) string {
+	var sb strings.Builder
+	for i := from; i <= to; i++ {
+		prefix := ""
+		for _, c := range changed {
+			if c == i {
+				prefix = "X"
+			}
+		}
+		fmt.Fprintf(&sb, "%s%d\n", prefix, i)
+	}
+	return sb.String()
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	// the expected output is what diff -u --label a --label b prints
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{"both empty", "", "", ""},
+		{"same", "x\ny\n", "x\ny\n", ""},
+		{"same without newline", "x", "x", ""},
+		{"empty to line", "", "x\n", "--- a\n+++ b\n@@ -0,0 +1 @@\n+x\n"},
+		{"line to empty", "x\n", "", "--- a\n+++ b\n@@ -1 +0,0 @@\n-x\n"},
+		{"no newline", "x", "y", "--- a\n+++ b\n@@ -1 +1 @@\n-x\n\\ No newline at end of file\n+y\n\\ No newline at end of file\n"},
+		{"newline added", "x", "x\n", "--- a\n+++ b\n@@ -1 +1 @@\n-x\n\\ No newline at end of file\n+x\n"},
+		{"no newline context", "a\nb\nc", "a\nB\nc", "--- a\n+++ b\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n\\ No newline at end of file\n"},
+		{
+			"context around a change",
+			numberedLines(1, 10), numberedLines(1, 10, 5),
+			"--- a\n+++ b\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+X5\n 6\n 7\n 8\n",
+		},
+		{
+			"changes far apart",
+			numberedLines(1, 20), numberedLines(1, 20, 2, 15),
+			"--- a\n+++ b\n@@ -1,5 +1,5 @@\n 1\n-2\n+X2\n 3\n 4\n 5\n" +
+				"@@ -12,7 +12,7 @@\n 12\n 13\n 14\n-15\n+X15\n 16\n 17\n 18\n",
+		},
+		{
+			"gap of twice the context joins hunks",
+			numberedLines(1, 20), numberedLines(1, 20, 5, 12),
+			"--- a\n+++ b\n@@ -2,14 +2,14 @@\n 2\n 3\n 4\n-5\n+X5\n 6\n 7\n 8\n 9\n 10\n 11\n-12\n+X12\n 13\n 14\n 15\n",
+		},
+		{
+			"gap over twice the context splits hunks",
+			numberedLines(1, 20), numberedLines(1, 20, 5, 13),
+			"--- a\n+++ b\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+X5\n 6\n 7\n 8\n" +
+				"@@ -10,7 +10,7 @@\n 10\n 11\n 12\n-13\n+X13\n 14\n 15\n 16\n",
+		},
+		{"prepend", "b\nc\n", "a\nb\nc\n", "--- a\n+++ b\n@@ -1,2 +1,3 @@\n+a\n b\n c\n"},
+		{
+			"insert",
+			numberedLines(1, 10), numberedLines(1, 5) + "new\n" + numberedLines(6, 10),
+			"--- a\n+++ b\n@@ -3,6 +3,7 @@\n 3\n 4\n 5\n+new\n 6\n 7\n 8\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := unifiedDiff("a", "b", []byte(tt.a), []byte(tt.b))
+			if got != tt.want {
+				t.Errorf("unifiedDiff() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnifiedDiffTooManyEdits(t *testing.T) {
+	// past maxDiffEdits everything is replaced in one hunk
+	n := maxDiffEdits/2 + 1
+	var a, b strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&a, "a%d\n", i)
+		fmt.Fprintf(&b, "b%d\n", i)
+	}
+
+	got := unifiedDiff("a", "b", []byte(a.String()), []byte(b.String()))
+	lines := strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+	if want := fmt.Sprintf("@@ -1,%d +1,%d @@", n, n); lines[2] != want {
+		t.Errorf("hunk header = %s, want %s", lines[2], want)
+	}
+	if len(lines) != 3+2*n {
+		t.Fatalf("len(lines) = %d, want %d", len(lines), 3+2*n)
+	}
+	if lines[3] != "-a0" || lines[3+n] != "+b0" {
+		t.Errorf("lines = %s ... %s, want -a0 ... +b0", lines[3], lines[3+n])
+	}
+}
+
+func TestDiffLinesEditScript(t *testing.T) {
+	tests := []struct {
+		name      string
+		a, b      []string
+		wantEdits int
+	}{
+		{"empty", nil, nil, 0},
+		{"all added", nil, []string{"a", "b"}, 2},
+		{"all removed", []string{"a", "b"}, nil, 2},
+		{"replace middle", []string{"a", "b", "c"}, []string{"a", "x", "c"}, 2},
+		// the classic example from the Myers paper, the shortest script has 5 edits
+		{"abcabba cbabac", strings.Split("abcabba", ""), strings.Split("cbabac", ""), 5},
+		{"swap", []string{"a", "b"}, []string{"b", "a"}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops := diffLines(tt.a, tt.b)
+			checkEditScript(t, ops, tt.a, tt.b)
+			if edits := countEdits(ops); edits != tt.wantEdits {
+				t.Errorf("diffLines() has %d edits, want %d", edits, tt.wantEdits)
+			}
+		})
+	}
+
+	// random edits of a random file always give a script that turns a into b
+	// with no more edits than were made
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		a := make([]string, rng.Intn(40))
+		for j := range a {
+			a[j] = string(rune('a' + rng.Intn(4)))
+		}
+		b := append([]string(nil), a...)
+		made := rng.Intn(6)
+		for e := 0; e < made; e++ {
+			if len(b) > 0 && rng.Intn(2) == 0 {
+				j := rng.Intn(len(b))
+				b = append(b[:j], b[j+1:]...)
+			} else {
+				j := rng.Intn(len(b) + 1)
+				b = append(b[:j], append([]string{"new"}, b[j:]...)...)
+			}
+		}
+
+		ops := diffLines(a, b)
+		checkEditScript(t, ops, a, b)
+		if edits := countEdits(ops); edits > made {
+			t.Errorf("diffLines(%q, %q) has %d edits, want <= %d", a, b, edits, made)
+		}
+	}
+}
+
+// checkEditScript replays ops and makes sure they walk both sides in order
+func checkEditScript(t *testing.T, ops []diffOp, a, b []string) {
+	t.Helper()
+	x, y := 0, 0
+	for _, op := range ops {
+		if op.a != x || op.b != y {
+			t.Fatalf("op %c at (%d, %d), want (%d, %d)", op.kind, op.a, op.b, x, y)
+		}
+		switch op.kind {
+		case ' ':
+			if a[x] != b[y] {
+				t.Fatalf("kept line %q differs from %q", a[x], b[y])
+			}
+			x++
+			y++
+		case '-':
+			x++
+		case '+':
+			y++
+		}
+	}
+	if x != len(a) || y != len(b) {
+		t.Fatalf("script ends at (%d, %d), want (%d, %d)", x, y, len(a), len(b))
+	}
+}
+
+func countEdits(ops []diffOp) int {
+	edits := 0
+	for _, op := range ops {
+		if op.kind != ' ' {
+			edits++
+		}
+	}
+	return edits
+}
@@ -0,0 +1,277 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	klog "k8s.io/klog/v2"
+)
+
+/*
+VerifyTrees re-hashes every file in src and dst straight from the device and reports
+files that differ. A file whose size and mod time match on both sides but whose
+content does not is reported as corrupt (bit rot).
+*/
+func (d *Diff) VerifyTrees() (*VerifyReport, error) {
+	err := d.openDst()
+	if err != nil {
+		return nil, err
+	}
+	err = d.resolveTargetFS()
+	if err != nil {
+		return nil, err
+	}
+	err = d.checkNormalize()
+	if err != nil {
+		return nil, err
+	}
+
+	srcMap, err := d.walkTree("SRC", d.options.RootSrcPath)
+	if err != nil {
+		klog.Errorf("walkTree(%s) Err: %v\n", d.options.RootSrcPath, err)
+		return nil, err
+	}
+
+	var dstMap map[string]*DiffFile
+	if d.crypt != nil {
+		dstMap, err = d.walkEncryptedTree()
+	} else {
+		dstMap, err = d.walkTree("DST", d.options.RootDstPath)
+	}
+	if err != nil {
+		klog.Errorf("walkTree(%s) Err: %v\n", d.options.RootDstPath, err)
+		return nil, err
+	}
+
+	report := &VerifyReport{}
+	for _, key := range sortedKeys(srcMap) {
+		src := srcMap[key]
+		dst := dstMap[key]
+		if dst == nil {
+			klog.Infof("[VERIFY] Missing in dst: %s\n", key)
+			report.Missing = append(report.Missing, key)
+			continue
+		}
+
+		report.Checked++
+		srcHash, err := d.rehash(src.Path, false)
+		if err != nil {
+			klog.Infof("[VERIFY] Unreadable in src: %s. Err: %v\n", key, err)
+			report.Corrupt = append(report.Corrupt, key)
+			continue
+		}
+		dstHash, err := d.rehash(dst.Path, d.crypt != nil)
+		if err != nil {
+			klog.Infof("[VERIFY] Unreadable in dst: %s. Err: %v\n", key, err)
+			report.Corrupt = append(report.Corrupt, key)
+			continue
+		}
+		if srcHash == dstHash {
+			klog.V(4).Infof("[VERIFY] OK %s\n", key)
+			continue
+		}
+
+		srcAttr := *src.Attr
+		dstAttr := *dst.Attr
+		if srcAttr.Size() == dstAttr.Size() && d.compareModTime(srcAttr.ModTime(), dstAttr.ModTime()) == 0 {
+			klog.Infof("[VERIFY] Corrupt: %s\n", key)
+			klog.Infof("\tSame size and mod time but hash mismatch: %s -> %s\n", srcHash, dstHash)
+			report.Corrupt = append(report.Corrupt, key)
+		} else {
+			klog.Infof("[VERIFY] Modified: %s\n", key)
+			klog.Infof("\tHash mismatch: %s -> %s\n", srcHash, dstHash)
+			report.Modified = append(report.Modified, key)
+		}
+	}
+
+	for _, key := range sortedKeys(dstMap) {
+		if srcMap[key] == nil {
+			klog.Infof("[VERIFY] Missing in src: %s\n", key)
+			report.Missing = append(report.Missing, key)
+		}
+	}
+
+	return report, report.err()
+}
+
+/*
+VerifyManifest re-hashes src straight from the device and compares it against a
+manifest previously written by WriteManifest.
+*/
+func (d *Diff) VerifyManifest(manifestPath string) (*VerifyReport, error) {
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		klog.Errorf("ReadFile(%s) failed. Err: %v\n", manifestPath, err)
+		return nil, err
+	}
+	manifest := &VerifyManifest{}
+	err = json.Unmarshal(data, manifest)
+	if err != nil {
+		klog.Errorf("json.Unmarshal(%s) failed. Err: %v\n", manifestPath, err)
+		return nil, err
+	}
+
+	srcMap, err := d.walkTree("SRC", d.options.RootSrcPath)
+	if err != nil {
+		klog.Errorf("walkTree(%s) Err: %v\n", d.options.RootSrcPath, err)
+		return nil, err
+	}
+
+	report := &VerifyReport{}
+	for _, key := range sortedKeys(srcMap) {
+		src := srcMap[key]
+		entry := manifest.Files[key]
+		if entry == nil {
+			klog.Infof("[VERIFY] Not in manifest: %s\n", key)
+			report.Missing = append(report.Missing, key)
+			continue
+		}
+
+		report.Checked++
+		hash, err := d.rehash(src.Path, false)
+		if err != nil {
+			klog.Infof("[VERIFY] Unreadable: %s. Err: %v\n", key, err)
+			report.Corrupt = append(report.Corrupt, key)
+			continue
+		}
+		if hash == entry.Hash {
+			klog.V(4).Infof("[VERIFY] OK %s\n", key)
+			continue
+		}
+
+		attr := *src.Attr
+		if attr.Size() == entry.Size && attr.ModTime().Equal(entry.ModTime) {
+			klog.Infof("[VERIFY] Corrupt: %s\n", key)
+			klog.Infof("\tSame size and mod time but hash mismatch: %s -> %s\n", entry.Hash, hash)
+			report.Corrupt = append(report.Corrupt, key)
+		} else {
+			klog.Infof("[VERIFY] Modified: %s\n", key)
+			klog.Infof("\tHash mismatch: %s -> %s\n", entry.Hash, hash)
+			report.Modified = append(report.Modified, key)
+		}
+	}
+
+	keys := make([]string, 0, len(manifest.Files))
+	for key := range manifest.Files {
+		if srcMap[key] == nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		klog.Infof("[VERIFY] Missing on disk: %s\n", key)
+		report.Missing = append(report.Missing, key)
+	}
+
+	return report, report.err()
+}
+
+/*
+WriteManifest hashes every file in src and records it in a manifest that can later be
+checked with VerifyManifest.
+*/
+func (d *Diff) WriteManifest(manifestPath string) error {
+	srcMap, err := d.walkTree("SRC", d.options.RootSrcPath)
+	if err != nil {
+		klog.Errorf("walkTree(%s) Err: %v\n", d.options.RootSrcPath, err)
+		return err
+	}
+
+	manifest := &VerifyManifest{
+		Version: verifyManifestVersion,
+		Created: time.Now(),
+		Files:   make(map[string]*VerifyManifestEntry, len(srcMap)),
+	}
+	for key, src := range srcMap {
+		hash, err := d.getHash(src.Path)
+		if err != nil {
+			klog.Errorf("getHash(%s) failed. Err: %v\n", src.Path, err)
+			return err
+		}
+		manifest.Files[key] = &VerifyManifestEntry{
+			Size:    (*src.Attr).Size(),
+			ModTime: (*src.Attr).ModTime(),
+			Hash:    hash,
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(manifestPath, data)
+}
+
+/*
+verifyCopy reads back a file that was just copied, bypassing the page cache where
+possible, and makes sure it matches the file it was copied from.
+*/
+func (d *Diff) verifyCopy(from *DiffFile, to string, encrypted bool) error {
+	if d.options.DryRun {
+		return nil
+	}
+
+	expected, err := d.fileHash(from)
+	if err != nil {
+		klog.Errorf("fileHash(%s) failed. Err: %v\n", from.Path, err)
+		return err
+	}
+	actual, err := d.rehash(to, encrypted)
+	if err != nil {
+		klog.Errorf("rehash(%s) failed. Err: %v\n", to, err)
+		return err
+	}
+
+	if expected != actual {
+		klog.Errorf("Verify failed %s: %s != %s\n", to, expected, actual)
+		return fmt.Errorf("%w: %s", ErrVerifyMismatch, to)
+	}
+	klog.V(3).Infof("Verified %s hash: %s\n", to, actual)
+	return nil
+}
+
+// rehash hashes the file after dropping it from the page cache
+func (d *Diff) rehash(path string, encrypted bool) (string, error) {
+	d.throttle.readFile()
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	dropCache(f)
+
+	if encrypted {
+		_, hash, err := d.crypt.hashEncryptedReader(d.throttle.reader(f))
+		return hash, err
+	}
+
+	sum, err := hashReader(d.throttle.reader(f))
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(sum), nil
+}
+
+func (r *VerifyReport) err() error {
+	if len(r.Missing) > 0 || len(r.Modified) > 0 || len(r.Corrupt) > 0 {
+		return fmt.Errorf("%w: %d missing, %d modified, %d corrupt", ErrVerifyFailed, len(r.Missing), len(r.Modified), len(r.Corrupt))
+	}
+	return nil
+}
+
+func sortedKeys(files map[string]*DiffFile) []string {
+	keys := make([]string, 0, len(files))
+	for key := range files {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
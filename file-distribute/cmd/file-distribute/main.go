@@ -32,6 +32,9 @@ func main() {
 	var dstDir string
 	flag.StringVar(&dstDir, "dst", "", "The destination directory for all music files")
 
+	var copyStrategy string
+	flag.StringVar(&copyStrategy, "copyStrategy", distribute.CopyAuto, "First copy strategy to try: auto, reflink, copy_file_range, sendfile or buffered")
+
 	flag.Parse()
 	// flags
 
@@ -47,17 +50,17 @@ func main() {
 	// src
 	absSrcPath, err := filepath.Abs(srcDir)
 	if err != nil {
-		fmt.Println("Source filepath.Abs failed. Err: %v\n", err)
+		fmt.Printf("Source filepath.Abs failed. Err: %v\n", err)
 		os.Exit(1)
 	}
 
 	stat, err := os.Stat(absSrcPath)
 	if err != nil {
-		fmt.Println("Invalid src=%s directory. Must provide a valid directory.", absSrcPath)
+		fmt.Printf("Invalid src=%s directory. Must provide a valid directory.\n", absSrcPath)
 		os.Exit(1)
 	}
 	if !stat.IsDir() {
-		fmt.Println("Invalid src=%s directory. Must provide a valid directory.", absSrcPath)
+		fmt.Printf("Invalid src=%s directory. Must provide a valid directory.\n", absSrcPath)
 		os.Exit(1)
 	}
 	fmt.Printf("Src Path: %s\n", absSrcPath)
@@ -69,26 +72,28 @@ func main() {
 	} else {
 		absDstPath, err := filepath.Abs(srcDir)
 		if err != nil {
-			fmt.Println("Destination filepath.Abs failed. Err: %v\n", err)
+			fmt.Printf("Destination filepath.Abs failed. Err: %v\n", err)
 			os.Exit(1)
 		}
 
 		err = os.MkdirAll(absDstPath, 0755)
 		if err != nil {
-			fmt.Println("MkdirAll(%s) failed. Err: %v\n", absDstPath, err)
+			fmt.Printf("MkdirAll(%s) failed. Err: %v\n", absDstPath, err)
 			os.Exit(1)
 		}
 	}
 	fmt.Printf("Dst Path: %s\n", absDstPath)
+	fmt.Printf("Copy Strategy: %s\n", copyStrategy)
 
 	if maxFolders == 0 {
 		maxFolders = MaxNumOfFolders
 	}
 
 	dist := distribute.New(distribute.DistributeOpts{
-		RootSrcPath: absSrcPath,
-		RootDstPath: absDstPath,
-		MaxFolders:  maxFolders,
+		RootSrcPath:  absSrcPath,
+		RootDstPath:  absDstPath,
+		MaxFolders:   maxFolders,
+		CopyStrategy: copyStrategy,
 	})
 
 	err = dist.Process()
@@ -2,7 +2,14 @@ module github.com/dvonthenen/go-utilities/file-distribute
 
 go 1.20
 
+require (
+	github.com/dvonthenen/go-utilities/filecopy v0.0.0
+	k8s.io/klog/v2 v2.100.1
+)
+
 require (
 	github.com/go-logr/logr v1.2.0 // indirect
-	k8s.io/klog/v2 v2.100.1 // indirect
+	golang.org/x/sys v0.21.0 // indirect
 )
+
+replace github.com/dvonthenen/go-utilities/filecopy => ../filecopy
@@ -0,0 +1,78 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package distribute
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	filecopy "github.com/dvonthenen/go-utilities/filecopy"
+	klog "k8s.io/klog/v2"
+)
+
+const (
+	// CopyAuto use the fastest copy strategy the filesystems support
+	CopyAuto string = filecopy.Auto
+
+	// CopyReflink share the blocks of the source on copy-on-write filesystems (FICLONE)
+	CopyReflink string = filecopy.Reflink
+
+	// CopyFileRange copy inside the kernel with copy_file_range
+	CopyFileRange string = filecopy.FileRange
+
+	// CopySendfile copy inside the kernel with sendfile
+	CopySendfile string = filecopy.Sendfile
+
+	// CopyBuffered copy through a buffer in user space
+	CopyBuffered string = filecopy.Buffered
+)
+
+var (
+	// ErrUnknownCopyStrategy unknown copy strategy (auto, reflink, copy_file_range, sendfile OR buffered)
+	ErrUnknownCopyStrategy = filecopy.ErrUnknownStrategy
+)
+
+/*
+Copies go through the filecopy package, shared with diff-directory: a reflink first,
+then copy_file_range and sendfile inside the kernel and a buffered copy last.
+CopyStrategy picks where to start.
+*/
+
+func (d *Distribute) checkCopyStrategy() error {
+	err := filecopy.CheckStrategy(d.options.CopyStrategy)
+	if err != nil {
+		klog.Errorf("Unknown copy strategy: %s\n", d.options.CopyStrategy)
+		return err
+	}
+	return nil
+}
+
+// copyData copies size bytes from source to destination with the first strategy that works
+func (d *Distribute) copyData(destination, source *os.File, size int64) (string, int64, error) {
+	strategy, nBytes, err := filecopy.Copy(destination, source, size, filecopy.Options{
+		Strategy: d.options.CopyStrategy,
+	})
+	if err == nil {
+		d.strategies[strategy]++
+	}
+	return strategy, nBytes, err
+}
+
+// StrategySummary lists how many files each copy strategy copied
+func (d *Distribute) StrategySummary() string {
+	names := make([]string, 0, len(d.strategies))
+	for name := range d.strategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s %d", name, d.strategies[name]))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -6,7 +6,6 @@ package distribute
 
 import (
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -17,14 +16,20 @@ import (
 
 func New(opts DistributeOpts) *Distribute {
 	dist := &Distribute{
-		options: opts,
+		options:    opts,
+		strategies: make(map[string]int),
 	}
 	return dist
 }
 
 func (d *Distribute) Process() error {
+	err := d.checkCopyStrategy()
+	if err != nil {
+		return err
+	}
+
 	cnt := int64(0)
-	err := filepath.Walk(d.options.RootSrcPath, func(path string, info os.FileInfo, err error) error {
+	err = filepath.Walk(d.options.RootSrcPath, func(path string, info os.FileInfo, err error) error {
 		klog.V(5).Infof("Path: %s\n", path)
 
 		if err != nil {
@@ -92,6 +97,7 @@ func (d *Distribute) Process() error {
 		klog.Errorf("Process failed. Err: %v\n", err)
 	} else {
 		klog.V(2).Infof("Distribute.Process succeeded")
+		klog.V(2).Infof("Copied with: %s\n", d.StrategySummary())
 	}
 	return err
 }
@@ -120,7 +126,8 @@ func (d *Distribute) copy(src, dst string) (int64, error) {
 		return 0, err
 	}
 	defer destination.Close()
-	nBytes, err := io.Copy(destination, source)
+	strategy, nBytes, err := d.copyData(destination, source, sourceFileStat.Size())
+	klog.V(4).Infof("Copied %s via %s\n", dst, strategy)
 	if sourceFileStat.Size() != nBytes {
 		klog.Errorf("copy byte size mismatch. src: %d != dst: %d\n", sourceFileStat.Size(), nBytes)
 		return nBytes, fmt.Errorf("copy byte size mismatch. src: %d != dst: %d\n", sourceFileStat.Size(), nBytes)
@@ -8,8 +8,12 @@ type DistributeOpts struct {
 	RootSrcPath string
 	RootDstPath string
 	MaxFolders  int64
+
+	// where the copy strategy chain starts, auto tries reflink first
+	CopyStrategy string
 }
 
 type Distribute struct {
-	options DistributeOpts
+	options    DistributeOpts
+	strategies map[string]int
 }
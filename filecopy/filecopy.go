@@ -0,0 +1,152 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+Package filecopy copies file contents the cheapest way the filesystems support.
+
+A reflink shares the blocks of the source on a copy-on-write filesystem (Btrfs, XFS)
+without copying anything, copy_file_range and sendfile copy inside the kernel without
+passing the data through user space, and a buffered copy works everywhere. A strategy
+that isn't supported falls through to the next one, Options.Strategy picks where to
+start. A sparse source that can't be reflinked is copied by its data extents instead so
+the holes are kept.
+*/
+package filecopy
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+
+	klog "k8s.io/klog/v2"
+)
+
+const (
+	// Auto use the fastest copy strategy the filesystems support
+	Auto string = "auto"
+
+	// Reflink share the blocks of the source on copy-on-write filesystems (FICLONE)
+	Reflink string = "reflink"
+
+	// FileRange copy inside the kernel with copy_file_range
+	FileRange string = "copy_file_range"
+
+	// Sendfile copy inside the kernel with sendfile
+	Sendfile string = "sendfile"
+
+	// Buffered copy through a buffer in user space
+	Buffered string = "buffered"
+
+	// Sparse copy only the data extents of a sparse file, reported but not a choice
+	Sparse string = "sparse"
+
+	bufferSize int   = 1024 * 1024
+	chunkSize  int64 = 1 << 30
+)
+
+var (
+	// ErrUnknownStrategy unknown copy strategy (auto, reflink, copy_file_range, sendfile OR buffered)
+	ErrUnknownStrategy = errors.New("unknown copy strategy (auto, reflink, copy_file_range, sendfile OR buffered)")
+
+	// errUnsupported a strategy can't copy between these files, the next one is tried
+	errUnsupported = errors.New("copy strategy not supported")
+)
+
+// Strategies are the copy strategies in the order they are tried
+var Strategies = []string{Reflink, FileRange, Sendfile, Buffered}
+
+// Options of a copy
+type Options struct {
+	Strategy string      // where the chain starts, empty or Auto starts with a reflink
+	Sparse   bool        // copy only the data extents, see IsSparse
+	Pace     func(int64) // called with the bytes of every chunk written, the chunks are small when set
+}
+
+// CheckStrategy makes sure a copy strategy is auto or one of the strategies
+func CheckStrategy(strategy string) error {
+	if strategy == "" || strategy == Auto {
+		return nil
+	}
+	for _, s := range Strategies {
+		if s == strategy {
+			return nil
+		}
+	}
+	return ErrUnknownStrategy
+}
+
+/*
+Copy copies size bytes from source to destination, both at offset 0, with the first
+strategy that works. Returns the strategy used.
+*/
+func Copy(destination, source *os.File, size int64, opts Options) (string, int64, error) {
+	start := 0
+	for i, strategy := range Strategies {
+		if strategy == opts.Strategy {
+			start = i
+		}
+	}
+
+	sparse := opts.Sparse
+	for _, strategy := range Strategies[start:] {
+		var nBytes int64
+		var err error
+		if sparse && strategy != Reflink {
+			nBytes, err = copySparse(destination, source, size, opts.Pace)
+			if err != errUnsupported {
+				return Sparse, nBytes, err
+			}
+			klog.V(6).Infof("%s not supported for %s\n", Sparse, destination.Name())
+			sparse = false
+		}
+
+		switch strategy {
+		case Reflink:
+			nBytes, err = copyReflink(destination, source, size)
+		case FileRange:
+			nBytes, err = copyFileRange(destination, source, size, opts.Pace)
+		case Sendfile:
+			nBytes, err = copySendfile(destination, source, size, opts.Pace)
+		default:
+			nBytes, err = copyBuffered(destination, source, opts.Pace)
+		}
+		if err == errUnsupported {
+			klog.V(6).Infof("%s not supported for %s\n", strategy, destination.Name())
+			continue
+		}
+		return strategy, nBytes, err
+	}
+	return Buffered, 0, errUnsupported
+}
+
+/*
+IsSparse reports an open file with a hole. Fewer bytes allocated than its size is only a
+hint: compressed files and files stored inline in their inode have that too, and there
+SEEK_HOLE finds nothing before the end.
+*/
+func IsSparse(f *os.File, info fs.FileInfo) bool {
+	return info.Mode().IsRegular() && AllocatedSize(info) < info.Size() && hasHole(f, info.Size())
+}
+
+// copyBuffered copies through user space, hiding ReadFrom so io.Copy can't use the kernel
+func copyBuffered(destination, source *os.File, pace func(int64)) (int64, error) {
+	var writer io.Writer = struct{ io.Writer }{destination}
+	if pace != nil {
+		writer = &pacedWriter{w: destination, pace: pace}
+	}
+	buf := make([]byte, bufferSize)
+	return io.CopyBuffer(writer, struct{ io.Reader }{source}, buf)
+}
+
+type pacedWriter struct {
+	w    io.Writer
+	pace func(int64)
+}
+
+func (w *pacedWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.pace(int64(n))
+	return n, err
+}
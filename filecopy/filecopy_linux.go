@@ -0,0 +1,207 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build linux
+
+package filecopy
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+
+	unix "golang.org/x/sys/unix"
+)
+
+// copyUnsupported reports errors meaning the filesystems or kernel can't do a strategy
+func unsupported(err error) bool {
+	return errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EXDEV) ||
+		errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.ENOTTY)
+}
+
+// copyReflink shares the blocks of source with destination (FICLONE)
+func copyReflink(destination, source *os.File, size int64) (int64, error) {
+	err := unix.IoctlFileClone(int(destination.Fd()), int(source.Fd()))
+	if err != nil {
+		if unsupported(err) {
+			return 0, errUnsupported
+		}
+		return 0, err
+	}
+	return size, nil
+}
+
+// copyFileRange copies inside the kernel, possibly offloaded to the filesystem or device
+func copyFileRange(destination, source *os.File, size int64, pace func(int64)) (int64, error) {
+	return copyKernel(size, pace, func(remaining int) (int, error) {
+		return unix.CopyFileRange(int(source.Fd()), nil, int(destination.Fd()), nil, remaining, 0)
+	})
+}
+
+// copySendfile copies inside the kernel through the page cache
+func copySendfile(destination, source *os.File, size int64, pace func(int64)) (int64, error) {
+	return copyKernel(size, pace, func(remaining int) (int, error) {
+		return unix.Sendfile(int(destination.Fd()), int(source.Fd()), nil, remaining)
+	})
+}
+
+/*
+copyKernel calls a kernel copy until size bytes are copied or the source runs out. With
+pace the chunks are small enough for a throttle to keep a steady rate.
+*/
+func copyKernel(size int64, pace func(int64), copyFn func(remaining int) (int, error)) (int64, error) {
+	chunk := chunkSize
+	if pace != nil {
+		chunk = int64(bufferSize)
+	}
+
+	var written int64
+	for written < size {
+		remaining := size - written
+		if remaining > chunk {
+			remaining = chunk
+		}
+		n, err := copyFn(int(remaining))
+		if err == unix.EINTR || err == unix.EAGAIN {
+			continue
+		}
+		if err != nil {
+			// nothing was copied yet so another strategy can start over
+			if written == 0 && unsupported(err) {
+				return 0, errUnsupported
+			}
+			return written, err
+		}
+		if n == 0 {
+			// some filesystems report files they can't copy from as empty
+			if written == 0 {
+				return 0, errUnsupported
+			}
+			break
+		}
+		written += int64(n)
+		if pace != nil {
+			pace(int64(n))
+		}
+	}
+	return written, nil
+}
+
+// AllocatedSize is the bytes the blocks of a file take, st_blocks is in 512 byte units
+func AllocatedSize(info fs.FileInfo) int64 {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return info.Size()
+	}
+	return stat.Blocks * 512
+}
+
+// hasHole looks for a hole before the end of the file, leaving the offset at the start
+func hasHole(f *os.File, size int64) bool {
+	fd := int(f.Fd())
+	hole, err := unix.Seek(fd, 0, unix.SEEK_HOLE)
+	unix.Seek(fd, 0, io.SeekStart)
+	return err == nil && hole < size
+}
+
+/*
+copySparse copies only the data extents of source, each at its own offset, and sets the
+size of destination so the holes between them, and a hole at the end, stay holes.
+*/
+func copySparse(destination, source *os.File, size int64, pace func(int64)) (int64, error) {
+	srcFd := int(source.Fd())
+
+	var offset int64
+	for offset < size {
+		data, err := unix.Seek(srcFd, offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// only a hole is left
+			break
+		}
+		if err != nil {
+			if offset == 0 && unsupported(err) {
+				source.Seek(0, io.SeekStart)
+				return 0, errUnsupported
+			}
+			return offset, err
+		}
+		hole, err := unix.Seek(srcFd, data, unix.SEEK_HOLE)
+		if err != nil {
+			return offset, err
+		}
+		if hole > size {
+			hole = size
+		}
+
+		err = copyExtent(destination, source, data, hole-data, pace)
+		if err != nil {
+			return offset, err
+		}
+		offset = hole
+	}
+
+	err := destination.Truncate(size)
+	if err != nil {
+		return offset, err
+	}
+	return size, nil
+}
+
+// copyExtent copies length bytes at offset, inside the kernel when it can
+func copyExtent(destination, source *os.File, offset, length int64, pace func(int64)) error {
+	maxChunk := chunkSize
+	if pace != nil {
+		maxChunk = int64(bufferSize)
+	}
+
+	roff, woff := offset, offset
+	for length > 0 {
+		chunk := length
+		if chunk > maxChunk {
+			chunk = maxChunk
+		}
+		n, err := unix.CopyFileRange(int(source.Fd()), &roff, int(destination.Fd()), &woff, int(chunk), 0)
+		if err == unix.EINTR || err == unix.EAGAIN {
+			continue
+		}
+		if (err != nil && unsupported(err)) || (err == nil && n == 0) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		length -= int64(n)
+		if pace != nil {
+			pace(int64(n))
+		}
+	}
+	if length == 0 {
+		return nil
+	}
+
+	// copy_file_range can't copy between these files, copy the rest through a buffer
+	reader := io.NewSectionReader(source, roff, length)
+	buf := make([]byte, bufferSize)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			_, werr := destination.WriteAt(buf[:n], woff)
+			if werr != nil {
+				return werr
+			}
+			woff += int64(n)
+			if pace != nil {
+				pace(int64(n))
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build linux
+
+package filecopy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	unix "golang.org/x/sys/unix"
+)
+
+func TestUnsupported(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{unix.EOPNOTSUPP, true},
+		{unix.EXDEV, true},
+		{unix.EINVAL, true},
+		{unix.ENOSYS, true},
+		{unix.ENOTTY, true},
+		{&os.SyscallError{Syscall: "copy_file_range", Err: unix.EXDEV}, true},
+		// the files are wrong, not the strategy
+		{unix.EBADF, false},
+		{unix.EPERM, false},
+		{unix.EACCES, false},
+		{unix.EIO, false},
+		{unix.ENOSPC, false},
+		{&os.SyscallError{Syscall: "copy_file_range", Err: unix.EPERM}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			if got := unsupported(tt.err); got != tt.want {
+				t.Errorf("unsupported(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopyKernelErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		results     []error // one per call, nil copies 10 bytes
+		wantWritten int64
+		wantErr     error
+	}{
+		{"unsupported first", []error{unix.EXDEV}, 0, errUnsupported},
+		{"unsupported after data", []error{nil, unix.EXDEV}, 10, unix.EXDEV},
+		{"ebadf first", []error{unix.EBADF}, 0, unix.EBADF},
+		{"eperm first", []error{unix.EPERM}, 0, unix.EPERM},
+		{"eperm after data", []error{nil, unix.EPERM}, 10, unix.EPERM},
+		{"interrupted", []error{unix.EINTR, nil, unix.EAGAIN, nil}, 20, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			written, err := copyKernel(20, nil, func(remaining int) (int, error) {
+				if calls >= len(tt.results) {
+					t.Fatalf("copyFn called %d times, want %d", calls+1, len(tt.results))
+				}
+				result := tt.results[calls]
+				calls++
+				if result != nil {
+					return -1, result
+				}
+				return 10, nil
+			})
+			if err != tt.wantErr {
+				t.Errorf("copyKernel() = %v, want %v", err, tt.wantErr)
+			}
+			if written != tt.wantWritten {
+				t.Errorf("copyKernel() wrote %d bytes, want %d", written, tt.wantWritten)
+			}
+		})
+	}
+}
+
+func TestCopyReadOnlyDestinationEBADF(t *testing.T) {
+	data := testData(1024)
+
+	for _, strategy := range Strategies {
+		t.Run(strategy, func(t *testing.T) {
+			src, dst := testFiles(t, data)
+			readOnly, err := os.Open(dst.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer readOnly.Close()
+
+			used, _, err := Copy(readOnly, src, int64(len(data)), Options{Strategy: strategy})
+			if !errors.Is(err, unix.EBADF) {
+				t.Errorf("Copy() = %v, want %v", err, unix.EBADF)
+			}
+			// a reflink isn't supported on every filesystem, the kernel copies all check the file first
+			if strategy != Reflink && used != strategy {
+				t.Errorf("Copy() used %s, want %s", used, strategy)
+			}
+		})
+	}
+}
+
+// sparseLayout describes a file as extents of data at offsets in a file of size bytes
+type sparseLayout struct {
+	name    string
+	size    int64
+	extents map[int64][]byte
+}
+
+// writeSparse writes the extents of a layout and returns the expected content
+func writeSparse(t *testing.T, f *os.File, layout sparseLayout) []byte {
+	t.Helper()
+	want := make([]byte, layout.size)
+	for offset, data := range layout.extents {
+		if _, err := f.WriteAt(data, offset); err != nil {
+			t.Fatal(err)
+		}
+		copy(want[offset:], data)
+	}
+	if err := f.Truncate(layout.size); err != nil {
+		t.Fatal(err)
+	}
+	return want
+}
+
+func TestCopySparse(t *testing.T) {
+	const mb = 1024 * 1024
+
+	tests := []sparseLayout{
+		{"only a hole", 4 * mb, nil},
+		{"hole at the end", 4 * mb, map[int64][]byte{0: testData(mb)}},
+		{"hole at the start", 4 * mb, map[int64][]byte{3 * mb: testData(mb)}},
+		{"holes between", 8 * mb, map[int64][]byte{0: []byte("head"), 3 * mb: testData(mb + 5), 7 * mb: []byte("tail")}},
+		{"no hole", 2 * mb, map[int64][]byte{0: testData(2 * mb)}},
+	}
+
+	for _, tt := range tests {
+		for _, paced := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/paced=%v", tt.name, paced), func(t *testing.T) {
+				_, dst := testFiles(t, nil)
+				src, err := os.CreateTemp(t.TempDir(), "sparse")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer src.Close()
+				want := writeSparse(t, src, tt)
+				if err := src.Sync(); err != nil {
+					t.Fatal(err)
+				}
+
+				var pace func(int64)
+				if paced {
+					pace = func(int64) {}
+				}
+				n, err := copySparse(dst, src, tt.size, pace)
+				if err == errUnsupported {
+					t.Skip("SEEK_DATA isn't supported here")
+				}
+				if err != nil {
+					t.Fatalf("copySparse() failed. Err: %v", err)
+				}
+				if n != tt.size {
+					t.Errorf("copySparse() = %d, want %d", n, tt.size)
+				}
+
+				// the apparent size and the content are kept
+				info, err := dst.Stat()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Size() != tt.size {
+					t.Errorf("Size() = %d, want %d", info.Size(), tt.size)
+				}
+				got, err := os.ReadFile(dst.Name())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("sparse copy differs from the source")
+				}
+
+				// the holes stay holes when the source has them
+				srcInfo, err := src.Stat()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if IsSparse(src, srcInfo) && AllocatedSize(info) >= tt.size {
+					t.Errorf("AllocatedSize() = %d, want < %d", AllocatedSize(info), tt.size)
+				}
+			})
+		}
+	}
+}
+
+func TestCopySparseOption(t *testing.T) {
+	src, err := os.CreateTemp(t.TempDir(), "sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	want := writeSparse(t, src, sparseLayout{size: 4 << 20, extents: map[int64][]byte{1 << 20: []byte("data")}})
+	info, err := src.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSparse(src, info) {
+		t.Skip("the filesystem doesn't keep holes")
+	}
+
+	// a reflink keeps the holes itself, every other strategy copies the extents
+	for _, strategy := range []string{FileRange, Sendfile, Buffered} {
+		t.Run(strategy, func(t *testing.T) {
+			_, dst := testFiles(t, nil)
+			used, n, err := Copy(dst, src, info.Size(), Options{Strategy: strategy, Sparse: true})
+			if err != nil {
+				t.Fatalf("Copy() failed. Err: %v", err)
+			}
+			if used != Sparse || n != info.Size() {
+				t.Errorf("Copy() = %s, %d, want %s, %d", used, n, Sparse, info.Size())
+			}
+			got, err := os.ReadFile(dst.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("sparse copy differs from the source")
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !linux
+
+package filecopy
+
+import (
+	"io/fs"
+	"os"
+)
+
+// only the buffered copy is available here, allocation isn't known so files are never sparse
+
+func copyReflink(destination, source *os.File, size int64) (int64, error) {
+	return 0, errUnsupported
+}
+
+func copyFileRange(destination, source *os.File, size int64, pace func(int64)) (int64, error) {
+	return 0, errUnsupported
+}
+
+func copySendfile(destination, source *os.File, size int64, pace func(int64)) (int64, error) {
+	return 0, errUnsupported
+}
+
+// AllocatedSize is the size of a file, allocation isn't known here
+func AllocatedSize(info fs.FileInfo) int64 {
+	return info.Size()
+}
+
+func hasHole(f *os.File, size int64) bool {
+	return false
+}
+
+func copySparse(destination, source *os.File, size int64, pace func(int64)) (int64, error) {
+	return 0, errUnsupported
+}
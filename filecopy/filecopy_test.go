@@ -0,0 +1,228 @@
+// Copyright 2023 dvonthenen/go-utilities contributors. All Rights Reserved.
+// Use of this source code is governed by an Apache-2.0 license that can be found in the LICENSE file.
+// SPDX-License-Identifier: Apache-2.0
+
+package filecopy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testData returns size bytes of deterministic pseudo random data
+func testData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+// testFiles writes data to a source file and creates an empty destination, both open
+func testFiles(t testing.TB, data []byte) (*os.File, *os.File) {
+	t.Helper()
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src")
+	if err := os.WriteFile(srcPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	src, err := os.Open(srcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { src.Close() })
+	dst, err := os.Create(filepath.Join(dir, "dst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dst.Close() })
+	return src, dst
+}
+
+// strategyIndex is the position of a strategy in the chain, -1 when it isn't in it
+func strategyIndex(strategy string) int {
+	for i, s := range Strategies {
+		if s == strategy {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestCheckStrategy(t *testing.T) {
+	tests := []struct {
+		strategy string
+		wantErr  error
+	}{
+		{"", nil},
+		{Auto, nil},
+		{Reflink, nil},
+		{FileRange, nil},
+		{Sendfile, nil},
+		{Buffered, nil},
+		// sparse is chosen per file, never asked for
+		{Sparse, ErrUnknownStrategy},
+		{"mmap", ErrUnknownStrategy},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			err := CheckStrategy(tt.strategy)
+			if err != tt.wantErr {
+				t.Errorf("CheckStrategy(%s) = %v, want %v", tt.strategy, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCopyEachStrategy(t *testing.T) {
+	sizes := []int{0, 1, bufferSize + 17, 3 * bufferSize}
+
+	for _, strategy := range append([]string{"", Auto}, Strategies...) {
+		for _, size := range sizes {
+			for _, paced := range []bool{false, true} {
+				t.Run(fmt.Sprintf("%s/size=%d/paced=%v", strategy, size, paced), func(t *testing.T) {
+					data := testData(size)
+					src, dst := testFiles(t, data)
+
+					var paceBytes int64
+					opts := Options{Strategy: strategy}
+					if paced {
+						opts.Pace = func(n int64) { paceBytes += n }
+					}
+
+					used, n, err := Copy(dst, src, int64(size), opts)
+					if err != nil {
+						t.Fatalf("Copy() failed. Err: %v", err)
+					}
+					if n != int64(size) {
+						t.Errorf("Copy() copied %d bytes, want %d", n, size)
+					}
+
+					// a strategy either works or falls through to a later one
+					want := strategyIndex(strategy)
+					if want < 0 {
+						want = 0
+					}
+					if got := strategyIndex(used); got < want {
+						t.Errorf("Copy() used %s, want %s or a later strategy", used, Strategies[want])
+					}
+
+					got, err := os.ReadFile(dst.Name())
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(got, data) {
+						t.Errorf("copy with %s differs from the source", used)
+					}
+					// a reflink copies nothing so it never paces
+					if paced && used != Reflink && paceBytes != int64(size) {
+						t.Errorf("paced %d bytes, want %d", paceBytes, size)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestCopyFallsBackFromPipe(t *testing.T) {
+	// nothing but a buffered copy reads from a pipe
+	data := testData(2*bufferSize + 3)
+
+	for _, strategy := range Strategies {
+		t.Run(strategy, func(t *testing.T) {
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			go func() {
+				w.Write(data)
+				w.Close()
+			}()
+			_, dst := testFiles(t, nil)
+
+			used, n, err := Copy(dst, r, int64(len(data)), Options{Strategy: strategy})
+			if err != nil {
+				t.Fatalf("Copy() failed. Err: %v", err)
+			}
+			if used != Buffered {
+				t.Errorf("Copy() used %s, want %s", used, Buffered)
+			}
+			if n != int64(len(data)) {
+				t.Errorf("Copy() copied %d bytes, want %d", n, len(data))
+			}
+			got, err := os.ReadFile(dst.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("copy differs from the source")
+			}
+		})
+	}
+}
+
+func TestCopyReadOnlyDestination(t *testing.T) {
+	// a destination that can't be written is an error, not a reason to try the next strategy
+	data := testData(1024)
+
+	for _, strategy := range Strategies {
+		t.Run(strategy, func(t *testing.T) {
+			src, dst := testFiles(t, data)
+			readOnly, err := os.Open(dst.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer readOnly.Close()
+
+			used, _, err := Copy(readOnly, src, int64(len(data)), Options{Strategy: strategy})
+			if err == nil {
+				t.Fatalf("Copy() to a read-only file succeeded with %s", used)
+			}
+			if errors.Is(err, errUnsupported) {
+				t.Errorf("Copy() = %v, want the write error", err)
+			}
+		})
+	}
+}
+
+/*
+BenchmarkCopy copies a file with every strategy forced in turn. The strategy that
+actually ran is in the name of the result, so a filesystem without reflinks shows
+the fallback. Set TMPDIR to compare filesystems, e.g. tmpfs against ext4, Btrfs or XFS.
+*/
+func BenchmarkCopy(b *testing.B) {
+	for _, size := range []int{1024 * 1024, 64 * 1024 * 1024} {
+		data := testData(size)
+		for _, strategy := range Strategies {
+			src, dst := testFiles(b, data)
+			used, _, err := Copy(dst, src, int64(size), Options{Strategy: strategy})
+			if err != nil {
+				b.Fatalf("Copy() failed. Err: %v", err)
+			}
+
+			b.Run(fmt.Sprintf("%s/used=%s/size=%dMB", strategy, used, size>>20), func(b *testing.B) {
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					if err := dst.Truncate(0); err != nil {
+						b.Fatal(err)
+					}
+					if _, err := dst.Seek(0, 0); err != nil {
+						b.Fatal(err)
+					}
+					if _, err := src.Seek(0, 0); err != nil {
+						b.Fatal(err)
+					}
+					_, _, err := Copy(dst, src, int64(size), Options{Strategy: strategy})
+					if err != nil {
+						b.Fatalf("Copy() failed. Err: %v", err)
+					}
+				}
+			})
+		}
+	}
+}
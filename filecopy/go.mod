@@ -0,0 +1,10 @@
+module github.com/dvonthenen/go-utilities/filecopy
+
+go 1.18
+
+require (
+	golang.org/x/sys v0.21.0
+	k8s.io/klog/v2 v2.100.1
+)
+
+require github.com/go-logr/logr v1.2.0 // indirect